@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+)
+
+// Strategies for choosing which addresses of a resource are published.
+const (
+	ipSelectionFirst  = "first"  // the first addresses reported in status
+	ipSelectionRandom = "random" // a random subset, stable for each resource
+	ipSelectionAll    = "all"    // every address, ignoring --max-ips-per-name
+)
+
+// validateIPSelection checks the IP selection flags.
+func validateIPSelection() error {
+	switch s := conf.IPSelection; s {
+	case ipSelectionFirst, ipSelectionRandom, ipSelectionAll:
+	default:
+		return fmt.Errorf("unknown IP selection strategy %q", s)
+	}
+	if conf.MaxIPsPerName < 0 {
+		return fmt.Errorf("--%s must not be negative", config.MaxIPsPerName)
+	}
+	return nil
+}
+
+// selectIPs returns the addresses of r to publish: those of an exposed
+// address family, preferring those on this node in node-local mode, limited
+// to --max-ips-per-name using --ip-selection.
+//
+// The random strategy is seeded from the resource identity so that the same
+// subset is chosen when the resource is later withdrawn.
+func selectIPs(r resource.Resource) []string {
+	var ips []string
+	for _, resourceIP := range r.IPs {
+		if ip := net.ParseIP(resourceIP); ip != nil && recordTypeFor(ip) != "" {
+			ips = append(ips, resourceIP)
+		}
+	}
+	ips = nodeLocalIPs(ips)
+
+	limit := conf.MaxIPsPerName
+	strategy := conf.IPSelection
+	if limit <= 0 || len(ips) <= limit || strategy == ipSelectionAll {
+		return ips
+	}
+
+	if strategy == ipSelectionRandom {
+		h := fnv.New64a()
+		h.Write([]byte(ownerKey(r)))
+		rng := rand.New(rand.NewSource(int64(h.Sum64())))
+		rng.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	}
+	return ips[:limit]
+}
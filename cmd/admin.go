@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// adminMux serves metrics, health checks and the admin API on
+// --admin-listen.
+var adminMux = http.NewServeMux()
+
+func init() {
+	// OpenMetrics is offered for the exemplars of PublishLatency.
+	adminMux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	adminMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ok, reason := source.Ready(); !ok {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// adminAuthToken is the token the admin API endpoints that change the zone
+// require, or empty when they are disabled. It is set before the admin
+// server starts.
+var adminAuthToken string
+
+// adminToken returns the token read from --admin-token-file or the
+// EXTERNAL_MDNS_ADMIN_TOKEN environment variable, or "" if neither is set.
+func adminToken() (string, error) {
+	token := conf.AdminToken
+	if path := conf.AdminTokenFile; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read admin token: %w", err)
+		}
+		token = string(b)
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// authorized only lets requests presenting the admin token through to
+// handler, which changes the zone. The admin port also serves /metrics,
+// which is usually reachable by anything that can scrape, so without a
+// token those endpoints are refused altogether.
+func authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminAuthToken == "" {
+			http.Error(w, fmt.Sprintf("this endpoint is disabled, set --%s to enable it", config.AdminTokenFile), http.StatusForbidden)
+			return
+		}
+		presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(adminAuthToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// startAdminServer serves adminMux on --admin-listen, if set.
+func startAdminServer() {
+	addr := conf.AdminListen
+	if addr == "" {
+		return
+	}
+	token, err := adminToken()
+	if err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	adminAuthToken = token
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           adminMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		lg.Fatal("Admin server stopped:", zap.Error(server.ListenAndServe()))
+	}()
+	lg.Info("Serving metrics and admin API", zap.String("address", addr))
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Answer mDNS queries for a zone streamed from an in-cluster controller",
+	Long: `agent runs only the mDNS responder, publishing the records computed by an
+external-mdns controller started with --agent-listen. This lets the multicast
+speaker live on the LAN while the controller stays in the cluster.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		// Flags shared with svc are rebound so this command's values win.
+		bindSettings(cmd.Flags())
+	},
+	Run: runAgent,
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+
+	agentCmd.Flags().Bool(config.Debug, false, "Enable debug logging")
+	agentCmd.Flags().String(config.Controller, "", "URL of the controller's agent stream, e.g. https://controller:8443")
+	agentCmd.Flags().String(config.AgentTokenFile, "", "File holding the bearer token presented to the controller")
+	agentCmd.Flags().String(config.ControllerCA, "", "CA certificate used to verify the controller")
+	agentCmd.Flags().Bool(config.InsecureSkipVerify, false, "Do not verify the controller's TLS certificate")
+	addResponderFlags(agentCmd.Flags())
+}
+
+// runAgent follows the controller, reconnecting with backoff, while the
+// local responder answers from the last zone received.
+func runAgent(cmd *cobra.Command, args []string) {
+	var err error
+	if lg, err = NewLogger(); err != nil {
+		log.Fatalf("Failed to create logger: %v", err)
+	}
+
+	controller := strings.TrimSuffix(conf.Controller, "/")
+	if controller == "" {
+		lg.Fatal("--controller is required")
+	}
+	token, err := agentToken()
+	if err != nil {
+		lg.Fatal("Invalid agent configuration:", zap.Error(err))
+	}
+	client, err := agentHTTPClient()
+	if err != nil {
+		lg.Fatal("Invalid agent configuration:", zap.Error(err))
+	}
+
+	startResponder()
+	sdReady()
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := followController(client, controller+"/v1/zone", token)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		lg.Warn("Lost controller stream, keeping last known zone", zap.Error(err), zap.Duration("retry", backoff))
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// agentHTTPClient returns a client trusting --controller-ca when given.
+func agentHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if path := conf.ControllerCA; path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read controller CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// followController applies the controller's zone stream to the local zone
+// until the stream fails or goes quiet.
+func followController(client *http.Client, url, token string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller answered %s", resp.Status)
+	}
+	lg.Info("Connected to controller", zap.String("controller", url))
+
+	// Abandon the stream if nothing, not even a ping, arrives in time.
+	watchdog := time.AfterFunc(3*feedPingInterval, cancel)
+	defer watchdog.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		watchdog.Reset(3 * feedPingInterval)
+
+		var ev feedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("malformed stream: %w", err)
+		}
+		switch ev.Op {
+		case feedReset:
+			mdns.Clear()
+		case feedAdd:
+			lg.Debug("Publishing record from controller", zap.String("record", ev.Record))
+			if err := mdns.Publish(ev.Record); err != nil {
+				lg.Warn("Ignoring invalid record from controller", zap.String("record", ev.Record), zap.Error(err))
+			}
+		case feedDel:
+			lg.Debug("Removing record from controller", zap.String("record", ev.Record))
+			if err := mdns.UnPublish(ev.Record); err != nil {
+				lg.Warn("Ignoring invalid record from controller", zap.String("record", ev.Record), zap.Error(err))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("controller closed the stream")
+}
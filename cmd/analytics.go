@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"go.uber.org/zap"
+)
+
+// queryReportTop is how many entries the periodic query summary logs.
+const queryReportTop = 5
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/queries/stats", func(w http.ResponseWriter, r *http.Request) {
+		top := 20
+		if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+			top = n
+		}
+		writeJSON(w, mdns.QueryStats(top))
+	})
+}
+
+// reportQueries logs the most queried names, the busiest clients and the
+// names asked for but not answered every interval.
+func reportQueries(interval time.Duration) {
+	for range time.Tick(interval) {
+		report := mdns.TakeQueryWindow(queryReportTop)
+		if report.Queries == 0 {
+			continue
+		}
+		lg.Info("Query summary",
+			zap.Duration("interval", interval),
+			zap.Int("queries", report.Queries),
+			zap.Any("topNames", report.TopNames),
+			zap.Any("topClients", report.TopClients),
+			zap.Any("unanswered", report.Unanswered))
+	}
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// benchDrain is how long answers are waited for once the last query is sent.
+const benchDrain = time.Second
+
+// benchPort is the port bench answers on unless --mdns-port is given, so
+// the synthetic records never reach the caches of mDNS clients on the LAN.
+const benchPort = 15353
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure how fast the responder answers queries",
+	Long: `bench starts the mDNS responder with the given responder flags, publishes
+synthetic A records and sends legacy unicast queries for random ones at a
+steady rate from a second socket. It then reports the answer latency, the
+queries left unanswered and the memory allocated per query, which includes
+the little the load generator itself allocates.`,
+	Example: `  external-mdns bench --records 100000 --rate 5000 --duration 30s`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindSettings(cmd.Flags())
+	},
+	Run: runBench,
+}
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().Bool(config.Debug, false, "Enable debug logging")
+	benchCmd.Flags().Int(config.BenchRecords, 10000, "Number of synthetic records to publish")
+	benchCmd.Flags().Int(config.BenchRate, 1000, "Queries to send per second")
+	benchCmd.Flags().Duration(config.BenchDuration, 10*time.Second, "How long to send queries for")
+	addResponderFlags(benchCmd.Flags())
+	port := benchCmd.Flags().Lookup(config.MDNSPort)
+	port.DefValue = strconv.Itoa(benchPort)
+	port.Value.Set(port.DefValue)
+}
+
+// benchRecord returns synthetic record i, with an address from the
+// benchmarking range (RFC 2544).
+func benchRecord(i int) (string, string) {
+	n := i % (1 << 17)
+	name := fmt.Sprintf("bench-%d.local.", i)
+	return name, fmt.Sprintf("%s 120 IN A %s", name, net.IPv4(198, 18+byte(n>>16), byte(n>>8), byte(n)))
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	var err error
+	if lg, err = NewLogger(); err != nil {
+		log.Fatalf("Failed to create logger: %v", err)
+	}
+
+	records := conf.BenchRecords
+	rate := conf.BenchRate
+	duration := conf.BenchDuration
+	if records < 1 || rate < 1 || duration <= 0 {
+		lg.Fatal("Invalid configuration:", zap.Error(fmt.Errorf("--%s, --%s and --%s must be positive",
+			config.BenchRecords, config.BenchRate, config.BenchDuration)))
+	}
+
+	responderConfig, err := newResponderConfig()
+	if err != nil {
+		lg.Fatal("Invalid responder configuration:", zap.Error(err))
+	}
+	if len(responderConfig.Transports) > 0 {
+		lg.Fatal("Invalid configuration:", zap.Error(fmt.Errorf("bench queries over the network and cannot use --%s", config.MemoryTransport)))
+	}
+	// Only queries are answered: the synthetic records are never
+	// announced, whatever the port.
+	responderConfig.RespondOnly = true
+	if err := mdns.Start(responderConfig); err != nil {
+		lg.Fatal("Failed to start mDNS responder:", zap.Error(err))
+	}
+
+	// Queries are packed once, only their ID changes from one send to
+	// the next, so the load generator barely allocates while measuring.
+	queries := make([][]byte, records)
+	for i := range queries {
+		name, record := benchRecord(i)
+		if err := mdns.Publish(record); err != nil {
+			lg.Fatal("Failed to publish record:", zap.Error(err))
+		}
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		query.RecursionDesired = false
+		if queries[i], err = query.Pack(); err != nil {
+			lg.Fatal("Failed to pack query:", zap.Error(err))
+		}
+	}
+
+	group := &net.UDPAddr{IP: responderConfig.IPv4Group, Port: responderConfig.Port}
+	conn, err := mdns.OpenQuerySocket(group)
+	if err != nil {
+		lg.Fatal("Failed to open query socket:", zap.Error(err))
+	}
+	defer conn.Close()
+
+	var (
+		sentAt    [1 << 16]atomic.Int64 // by query ID, in Unix nanoseconds
+		latencies = make([]time.Duration, 0, int(float64(rate)*duration.Seconds())+1)
+		done      = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		reply := make([]byte, 9000)
+		for {
+			n, _, err := conn.ReadFromUDP(reply)
+			if err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					lg.Warn("Failed to read answer", zap.Error(err))
+				}
+				return
+			}
+			if n < 12 || binary.BigEndian.Uint16(reply[6:8]) == 0 {
+				continue
+			}
+			if sent := sentAt[binary.BigEndian.Uint16(reply[0:2])].Swap(0); sent != 0 {
+				latencies = append(latencies, time.Duration(time.Now().UnixNano()-sent))
+			}
+		}
+	}()
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	sent := 0
+	for elapsed := time.Duration(0); elapsed < duration; elapsed = time.Since(start) {
+		for due := int(elapsed.Seconds()*float64(rate)) + 1; sent < due; sent++ {
+			query := queries[rand.IntN(records)]
+			id := uint16(sent)
+			binary.BigEndian.PutUint16(query[0:2], id)
+			sentAt[id].Store(time.Now().UnixNano())
+			if _, err := conn.WriteToUDP(query, group); err != nil {
+				lg.Fatal("Failed to send query:", zap.Error(err))
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(benchDrain))
+	<-done
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	answered := len(latencies)
+	lost := sent - answered
+	fmt.Printf("records   %d\n", records)
+	fmt.Printf("queries   %d sent in %s (%.0f/s), %d answered, %d lost (%.2f%%)\n",
+		sent, duration, float64(sent)/duration.Seconds(), answered, lost, 100*float64(lost)/float64(sent))
+	if answered > 0 {
+		fmt.Printf("latency   p50 %s  p99 %s  max %s\n", percentile(latencies, 0.5).Round(time.Microsecond),
+			percentile(latencies, 0.99).Round(time.Microsecond), latencies[answered-1].Round(time.Microsecond))
+	}
+	fmt.Printf("allocs    %.1f per query, %d bytes per query\n",
+		float64(after.Mallocs-before.Mallocs)/float64(sent), (after.TotalAlloc-before.TotalAlloc)/uint64(sent))
+	fmt.Printf("heap      %d bytes in use\n", after.HeapAlloc)
+
+	if answered == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// recordOverhead approximates the memory held for a published record
+// besides its text: the parsed record in the zone, its entry in the feed
+// and the map and slice overhead of both.
+const recordOverhead = 256
+
+// budgetWarnRatio is the share of the budget in use at which a warning is
+// logged, ahead of any eviction.
+const budgetWarnRatio = 0.9
+
+// zoneBudget bounds the estimated memory held by the published records.
+// When the zone outgrows it, whole resources are withdrawn, lowest priority
+// class and priority first and, within those, the ones whose names were
+// least recently multicast. They are published again once there is room.
+// It is only used on the main loop.
+type zoneBudget struct {
+	limit   int64 // bytes, 0 for no limit
+	used    int64 // estimated bytes held by the published records
+	warned  bool
+	evicted map[string]resource.Resource // by liveKey
+	since   map[string]time.Time         // when live resources were published
+	cached  map[string]budgetEntry       // by liveKey, see entry
+}
+
+// budgetEntry is what the budget needs to know of the records of a
+// resource, kept so enforcing the budget does not build them again for
+// every resource on each eviction.
+type budgetEntry struct {
+	names []string // owner names of the records
+	size  int64    // estimated bytes, see recordSize
+}
+
+var budget = &zoneBudget{
+	evicted: make(map[string]resource.Resource),
+	since:   make(map[string]time.Time),
+	cached:  make(map[string]budgetEntry),
+}
+
+// recordSize estimates the memory held for a published record.
+func recordSize(record string) int64 {
+	return int64(len(record)) + recordOverhead
+}
+
+// configureBudget sets the budget from --zone-memory-budget.
+func configureBudget() error {
+	value := conf.ZoneMemoryBudget
+	if value == "" {
+		return nil
+	}
+	q, err := apiresource.ParseQuantity(value)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", config.ZoneMemoryBudget, err)
+	}
+	if q.Sign() < 0 {
+		return fmt.Errorf("--%s must not be negative", config.ZoneMemoryBudget)
+	}
+	budget.limit = q.Value()
+	metrics.ZoneMemoryBudget.Set(float64(budget.limit))
+	return nil
+}
+
+// forget drops r from the evicted resources, as a newer version of it, or
+// its deletion, has arrived.
+func (b *zoneBudget) forget(r resource.Resource) {
+	key := liveKey(r)
+	delete(b.evicted, key)
+	delete(b.cached, key)
+	if r.Action == resource.Added {
+		b.since[key] = time.Now()
+	} else {
+		delete(b.since, key)
+	}
+	metrics.EvictedResources.Set(float64(len(b.evicted)))
+}
+
+// invalidate drops what is known of the records of every resource, as the
+// configuration they are built with changed.
+func (b *zoneBudget) invalidate() {
+	clear(b.cached)
+}
+
+// enforce evicts resources while the zone is over budget, or publishes
+// evicted resources again while there is room for them.
+func (b *zoneBudget) enforce(live map[string]resource.Resource) {
+	metrics.ZoneMemory.Set(float64(b.used))
+	if b.limit <= 0 {
+		return
+	}
+
+	limit := apiresource.NewQuantity(b.limit, apiresource.BinarySI).String()
+	if !b.warned && float64(b.used) > budgetWarnRatio*float64(b.limit) {
+		lg.Warn("Zone is close to its memory budget", zap.Int64("bytes", b.used), zap.String("budget", limit))
+		b.warned = true
+	} else if b.warned && float64(b.used) < budgetWarnRatio*0.9*float64(b.limit) {
+		b.warned = false
+	}
+
+	evicted := false
+	if b.used > b.limit {
+		for _, key := range b.evictionOrder(live) {
+			if b.used <= b.limit {
+				break
+			}
+			b.evict(live, key, limit)
+			evicted = true
+		}
+	}
+
+	// Resources just evicted would not fit again, and others were
+	// evicted in their favour.
+	if !evicted {
+		for _, key := range b.readmissionOrder() {
+			r := b.evicted[key]
+			if b.used+b.entry(key, r).size > b.limit {
+				continue
+			}
+			lg.Info("Zone memory budget has room again, publishing evicted resource", zap.String("resource", ownerKey(r)))
+			delete(b.evicted, key)
+			b.since[key] = time.Now()
+			if kind := skipKind(r); kind != "" {
+				source.ClearSkip(kind, r.Namespace, r.SourceName)
+			}
+			applyResource(live, r)
+		}
+	}
+	metrics.EvictedResources.Set(float64(len(b.evicted)))
+	metrics.ZoneMemory.Set(float64(b.used))
+}
+
+// evict withdraws the live resource with key, keeping it aside until there
+// is room for it again under the budget, given as limit for the logs.
+func (b *zoneBudget) evict(live map[string]resource.Resource, key, limit string) {
+	r := live[key]
+	lg.Warn("Zone exceeds its memory budget, evicting resource",
+		zap.String("resource", ownerKey(r)), zap.String("class", r.PriorityClass), zap.Int("priority", r.Priority),
+		zap.Int64("bytes", b.used), zap.String("budget", limit))
+
+	withdrawn := r
+	withdrawn.Action = resource.Deleted
+	applyResource(live, withdrawn)
+	delete(b.since, key)
+	b.evicted[key] = r
+	if kind := skipKind(r); kind != "" {
+		source.RecordSkip(source.Skip{Kind: kind, Namespace: r.Namespace, Name: r.SourceName,
+			Reason: source.SkipEvicted, Message: "evicted as the zone exceeds its memory budget of " + limit})
+	}
+	metrics.Evictions.Inc()
+}
+
+// evictionOrder returns the keys of the live resources in the order they
+// are evicted: the lowest priority class and priority first, then the ones
+// whose names were least recently multicast or, if never, that were
+// published longest ago.
+func (b *zoneBudget) evictionOrder(live map[string]resource.Resource) []string {
+	keys := make([]string, 0, len(live))
+	used := make(map[string]time.Time, len(live))
+	for key, r := range live {
+		keys = append(keys, key)
+		used[key] = b.lastUsed(key, r)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := comparePriority(live[keys[i]], live[keys[j]]); c != 0 {
+			return c < 0
+		}
+		if !used[keys[i]].Equal(used[keys[j]]) {
+			return used[keys[i]].Before(used[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// lastUsed is when the names of r were last multicast, or when it was
+// published if later.
+func (b *zoneBudget) lastUsed(key string, r resource.Resource) time.Time {
+	last := b.since[key]
+	for _, name := range b.entry(key, r).names {
+		if t := mdns.LastMulticast(name); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// entry returns the names and size of the records of r, the resource with
+// key, building them only the first time since r last changed.
+func (b *zoneBudget) entry(key string, r resource.Resource) budgetEntry {
+	if e, ok := b.cached[key]; ok {
+		return e
+	}
+	var e budgetEntry
+	seen := make(map[string]bool)
+	for _, record := range constructRecords(r) {
+		if record == "" {
+			continue
+		}
+		e.size += recordSize(record)
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil || seen[rr.Header().Name] {
+			continue
+		}
+		seen[rr.Header().Name] = true
+		e.names = append(e.names, rr.Header().Name)
+	}
+	b.cached[key] = e
+	return e
+}
+
+// readmissionOrder returns the evicted resources, highest priority first.
+func (b *zoneBudget) readmissionOrder() []string {
+	keys := make([]string, 0, len(b.evicted))
+	for key := range b.evicted {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := comparePriority(b.evicted[keys[i]], b.evicted[keys[j]]); c != 0 {
+			return c > 0
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"go.uber.org/zap"
+)
+
+// canaryMarker is the TXT record published at every name of a canary, so
+// anyone looking can tell its records are still on probation.
+const canaryMarker = `"external-mdns=canary"`
+
+// canaryCheckInterval is how often canaries are checked for the end of
+// their window, and probed again after a failure.
+const canaryCheckInterval = 10 * time.Second
+
+// canaryTracker publishes the records of objects created while running as
+// canaries: with the --canary-ttl and a TXT marker, so a broken deployment
+// does not linger in caches across the link, until --canary-window has
+// passed and their addresses accept connections. Only the main loop uses
+// it, apart from the probes it starts.
+type canaryTracker struct {
+	window  time.Duration
+	ttl     int
+	started time.Time          // objects created before are not canaries
+	ticks   <-chan time.Time   // nil when disabled
+	results chan canaryResult  // probe outcomes
+	entries map[string]*canary // by object UID
+}
+
+// canary is the probation state of an object.
+type canary struct {
+	admitted time.Time
+	promoted bool // passed its probe, published with the full TTL
+	probing  bool
+	missing  bool // had no live resource at the last check
+}
+
+// canaryResult is the outcome of probing the addresses of an object.
+type canaryResult struct {
+	uid string
+	err error
+}
+
+// probeTarget is an address of a canary and the TCP ports it serves.
+type probeTarget struct {
+	address string
+	ports   []int
+}
+
+// canaries is disabled until configureCanaries runs.
+var canaries = &canaryTracker{}
+
+// configureCanaries sets up canary publishing from --canary-window and
+// --canary-ttl.
+func configureCanaries() error {
+	window := conf.CanaryWindow
+	if window < 0 {
+		return fmt.Errorf("--%s must not be negative", config.CanaryWindow)
+	}
+	if window == 0 {
+		return nil
+	}
+	ttl := conf.CanaryTTL
+	if ttl <= 0 {
+		return fmt.Errorf("--%s must be positive", config.CanaryTTL)
+	}
+	canaries = &canaryTracker{
+		window:  window,
+		ttl:     ttl,
+		started: time.Now(),
+		ticks:   time.NewTicker(min(window, canaryCheckInterval)).C,
+		results: make(chan canaryResult),
+		entries: make(map[string]*canary),
+	}
+	return nil
+}
+
+// admit puts the object of r on probation when it was created after
+// external-mdns started and is seen for the first time. Updates keep the
+// state of the object, as they do its UID.
+func (c *canaryTracker) admit(r resource.Resource) {
+	if c.window == 0 || r.Action != resource.Added || r.Object.UID == "" || !r.Created.After(c.started) {
+		return
+	}
+	if _, ok := c.entries[r.Object.UID]; ok {
+		return
+	}
+	c.entries[r.Object.UID] = &canary{admitted: time.Now()}
+	lg.Info("Publishing new object as a canary", zap.String("resource", ownerKey(r)),
+		zap.Duration("window", c.window), zap.Int("ttl", c.ttl))
+	c.updateMetrics()
+}
+
+// active reports whether the records of r are published as a canary.
+func (c *canaryTracker) active(r resource.Resource) bool {
+	e := c.entries[r.Object.UID]
+	return e != nil && !e.promoted
+}
+
+// capTTL caps ttl, the TTL of a record of r, at the canary TTL while r is
+// a canary.
+func (c *canaryTracker) capTTL(r resource.Resource, ttl int) int {
+	if c.active(r) {
+		return min(ttl, c.ttl)
+	}
+	return ttl
+}
+
+// markers returns the canary TXT record of every name of forward.
+func (c *canaryTracker) markers(r resource.Resource, forward []forwardName) []string {
+	if !c.active(r) {
+		return nil
+	}
+	var records []string
+	seen := make(map[string]bool)
+	for _, f := range forward {
+		if !seen[f.name] {
+			seen[f.name] = true
+			records = append(records, fmt.Sprintf("%s %d IN TXT %s", f.name, recordTTL(r, f.name), canaryMarker))
+		}
+	}
+	return records
+}
+
+// check probes the canaries whose window has passed and forgets objects
+// that have had no live resource for two checks in a row. An update
+// withdraws and publishes an object again, so a single miss is not enough.
+func (c *canaryTracker) check(live map[string]resource.Resource) {
+	byUID := make(map[string][]resource.Resource)
+	for _, r := range live {
+		if c.entries[r.Object.UID] != nil {
+			byUID[r.Object.UID] = append(byUID[r.Object.UID], r)
+		}
+	}
+	for uid, e := range c.entries {
+		resources := byUID[uid]
+		if len(resources) == 0 {
+			if e.missing {
+				delete(c.entries, uid)
+			}
+			e.missing = true
+			continue
+		}
+		e.missing = false
+		if e.promoted || e.probing || time.Since(e.admitted) < c.window {
+			continue
+		}
+		e.probing = true
+		go c.probe(uid, probeTargets(resources))
+	}
+	c.updateMetrics()
+}
+
+// probeTargets returns the published addresses of resources with the ports
+// they serve.
+func probeTargets(resources []resource.Resource) []probeTarget {
+	var targets []probeTarget
+	for _, r := range resources {
+		for _, address := range selectIPs(r) {
+			targets = append(targets, probeTarget{address, r.Ports})
+		}
+	}
+	return targets
+}
+
+// probe reports to the main loop whether every target accepts a TCP
+// connection on at least one of its ports. Targets without ports have
+// nothing to probe and pass.
+func (c *canaryTracker) probe(uid string, targets []probeTarget) {
+	c.results <- canaryResult{uid, probeReachable(targets)}
+}
+
+func probeReachable(targets []probeTarget) error {
+	for _, t := range targets {
+		if err := dialAny(t.address, t.ports, probeTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settle promotes the object of result once its probe passed, publishing
+// its records with the full TTL and without the marker. A canary that
+// failed is probed again at the next check.
+func (c *canaryTracker) settle(live map[string]resource.Resource, result canaryResult) {
+	e := c.entries[result.uid]
+	if e == nil {
+		return
+	}
+	e.probing = false
+	name := result.uid
+	for _, r := range live {
+		if r.Object.UID == result.uid {
+			name = ownerKey(r)
+			break
+		}
+	}
+	if result.err != nil {
+		lg.Warn("Canary failed its reachability probe, keeping it on probation",
+			zap.String("resource", name), zap.Error(result.err))
+		return
+	}
+	e.promoted = true
+	withdrawn, published := republish(live)
+	lg.Info("Canary passed its reachability probe, publishing it with the full TTL",
+		zap.String("resource", name), zap.Int("withdrawn", withdrawn), zap.Int("published", published))
+	c.updateMetrics()
+}
+
+// updateMetrics counts the objects still on probation.
+func (c *canaryTracker) updateMetrics() {
+	n := 0
+	for _, e := range c.entries {
+		if !e.promoted {
+			n++
+		}
+	}
+	metrics.CanaryObjects.Set(float64(n))
+}
@@ -1,16 +1,133 @@
 package config
 
 const (
-	Debug                   = "debug"
-	KubeConfig              = "kubeconfig"
-	Master                  = "master"
-	Namespace               = "namespace"
-	PublishInternalServices = "publish-internal-services"
-	RecordTTL               = "record-ttl"
-	Source                  = "source"
-	WithoutNamespace        = "without-namespace"
-	Test                    = "test"
-	ExposeIPv4              = "expose-ipv4"
-	ExposeIPv6              = "expose-ipv6"
-	DefaultNamespace        = "default-namespace"
+	Debug                     = "debug"
+	KubeConfig                = "kubeconfig"
+	Master                    = "master"
+	Namespace                 = "namespace"
+	CheckPermissions          = "check-permissions"
+	PublishInternalServices   = "publish-internal-services"
+	RecordTTL                 = "record-ttl"
+	Source                    = "source"
+	WithoutNamespace          = "without-namespace"
+	Test                      = "test"
+	ExposeIPv4                = "expose-ipv4"
+	ExposeIPv6                = "expose-ipv6"
+	DefaultNamespace          = "default-namespace"
+	AllowSubnets              = "allow-subnets"
+	DenySubnets               = "deny-subnets"
+	ReusePort                 = "reuse-port"
+	PortConflict              = "port-conflict"
+	MissingPrivileges         = "missing-privileges"
+	MulticastTTL              = "multicast-ttl"
+	MulticastHopLimit         = "multicast-hop-limit"
+	MDNSPort                  = "mdns-port"
+	MDNSIPv4Group             = "mdns-ipv4-group"
+	MDNSIPv6Group             = "mdns-ipv6-group"
+	MemoryTransport           = "memory-transport"
+	NetNS                     = "netns"
+	WatchInterfaces           = "watch-interfaces"
+	HyphenatedNames           = "hyphenated-names"
+	RecordStrategy            = "record-strategy"
+	DNSSDPorts                = "dns-sd-ports"
+	DNSSDAppProtocol          = "dns-sd-app-protocol"
+	ShortNameConflict         = "short-name-conflict"
+	PTRConflict               = "ptr-conflict"
+	MaxIPsPerName             = "max-ips-per-name"
+	IPSelection               = "ip-selection"
+	RequireReadyEndpoints     = "require-ready-endpoints"
+	GoodbyeFinalizer          = "goodbye-finalizer"
+	RestoreSnapshot           = "restore-snapshot"
+	ResolveExternalNames      = "resolve-external-names"
+	CRDSources                = "crd"
+	ServeMDNS                 = "serve-mdns"
+	AgentListen               = "agent-listen"
+	AgentToken                = "agent-token"
+	AgentTokenFile            = "agent-token-file"
+	AgentTLSCert              = "agent-tls-cert"
+	AgentTLSKey               = "agent-tls-key"
+	Controller                = "controller"
+	ControllerCA              = "controller-ca"
+	InsecureSkipVerify        = "insecure-skip-verify"
+	NodeLocal                 = "node-local"
+	NodeLocalFallback         = "node-local-fallback"
+	NodeName                  = "node-name"
+	AdminListen               = "admin-listen"
+	AdminToken                = "admin-token"
+	AdminTokenFile            = "admin-token-file"
+	TracingEndpoint           = "tracing-endpoint"
+	ResyncPeriod              = "resync-period"
+	CollectOrphansAfter       = "collect-orphans-after"
+	StaleZoneAfter            = "stale-zone-after"
+	ServiceFieldSelector      = "service-field-selector"
+	IngressFieldSelector      = "ingress-field-selector"
+	IngressControllerSelector = "ingress-controller-selector"
+	IngressControllerService  = "ingress-controller-service"
+	KubeAPIQPS                = "kube-api-qps"
+	KubeAPIBurst              = "kube-api-burst"
+	KubeContext               = "context"
+	ImpersonateUser           = "as"
+	ImpersonateGroups         = "as-group"
+	TestFixture               = "test-fixture"
+	SelftestTimeout           = "timeout"
+	SelftestIPv6Interface     = "ipv6-interface"
+	SoakResources             = "soak-resources"
+	SoakChurn                 = "soak-churn"
+	SoakReportInterval        = "soak-report-interval"
+	BenchRecords              = "records"
+	BenchRate                 = "rate"
+	BenchDuration             = "duration"
+	TTLJitter                 = "ttl-jitter"
+	RespondOnly               = "respond-only"
+	AcceptOffLink             = "accept-off-link"
+	MaxPacketSize             = "max-packet-size"
+	MaxAnswers                = "max-answers"
+	AnnounceRate              = "announce-rate"
+	AnnounceBurst             = "announce-burst"
+	Filter                    = "filter"
+	Rewrite                   = "rewrite"
+	EventsNATSURL             = "events-nats-url"
+	EventsNATSSubject         = "events-nats-subject"
+	EventsMQTTURL             = "events-mqtt-url"
+	EventsMQTTTopic           = "events-mqtt-topic"
+	HookPrePublish            = "hook-pre-publish"
+	HookPostUnpublish         = "hook-post-unpublish"
+	HookTimeout               = "hook-timeout"
+	IPAMURL                   = "ipam-url"
+	IPAMType                  = "ipam-type"
+	IPAMToken                 = "ipam-token"
+	IPAMPolicy                = "ipam-policy"
+	IPAMCacheTTL              = "ipam-cache-ttl"
+	ZoneConfigMap             = "zone-configmap"
+	ZoneConfigMapInterval     = "zone-configmap-interval"
+	HostsFileWatch            = "hostsfile-watch"
+	ZoneFileWatch             = "zonefile-watch"
+	Include                   = "include"
+	KubeConfigSecret          = "kubeconfig-secret"
+	KubeConfigSecretKey       = "kubeconfig-secret-key"
+	AdvertiseSelf             = "advertise-self"
+	SelfAlias                 = "self-alias"
+	SelfAddresses             = "self-address"
+	AdvertiseAPIServer        = "advertise-api-server"
+	APIServerAddresses        = "api-server-address"
+	SSDP                      = "ssdp"
+	WSD                       = "wsd"
+	QueryReportInterval       = "query-report-interval"
+	StalePolicy               = "stale-policy"
+	StaleTTL                  = "stale-ttl"
+	CanaryWindow              = "canary-window"
+	CanaryTTL                 = "canary-ttl"
+	Probe                     = "probe"
+	ProbeInterval             = "probe-interval"
+	ProbeFailures             = "probe-failures"
+	ProbeAction               = "probe-action"
+	DuplicateCheckInterval    = "duplicate-check-interval"
+	VerifyInterval            = "verify-interval"
+	VerifySample              = "verify-sample"
+	WithdrawnGrace            = "withdrawn-grace"
+	AnswerOrder               = "answer-order"
+	Wildcards                 = "answer-wildcards"
+	BothFamilies              = "answer-both-families"
+	ZoneMemoryBudget          = "zone-memory-budget"
+	PriorityClass             = "priority-class"
 )
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/miekg/dns"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// zoneRequests asks the main loop which resource each record comes from.
+var zoneRequests = make(chan chan map[string]resource.Resource)
+
+// zoneRecord is a published record as shown by the dashboard and admin API.
+type zoneRecord struct {
+	Name          string     `json:"name"`
+	Record        string     `json:"record"`
+	Source        string     `json:"source,omitempty"`
+	Object        *zoneOwner `json:"object,omitempty"`
+	LastMulticast *time.Time `json:"lastMulticast,omitempty"`
+	LastVerified  *time.Time `json:"lastVerified,omitempty"`
+}
+
+// zoneOwner is the Kubernetes object a record comes from.
+type zoneOwner struct {
+	APIVersion      string `json:"apiVersion"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+func init() {
+	adminMux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	adminMux.HandleFunc("GET /api/v1/zone", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, describeZone())
+	})
+	adminMux.HandleFunc("GET /api/v1/queries", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mdns.RecentQueries())
+	})
+}
+
+// recordSources maps the records of the live resources to the resource
+// they come from. It runs on the main loop.
+func recordSources(live map[string]resource.Resource) map[string]resource.Resource {
+	sources := make(map[string]resource.Resource)
+	for _, r := range live {
+		for _, record := range constructRecords(r) {
+			rr, err := dns.NewRR(record)
+			if err != nil || rr == nil {
+				continue
+			}
+			sources[rr.String()] = r
+		}
+	}
+	return sources
+}
+
+// describeZone lists the published records with their source resource and
+// object, when they were last multicast and when they last resolved in a
+// verification query.
+func describeZone() []zoneRecord {
+	var sources map[string]resource.Resource
+	res := make(chan map[string]resource.Resource, 1)
+	select {
+	case zoneRequests <- res:
+		sources = <-res
+	case <-time.After(2 * time.Second):
+		// The main loop is not running, as in agent or test mode.
+	}
+
+	var records []zoneRecord
+	for _, record := range mdns.Records() {
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			continue
+		}
+		zr := zoneRecord{Name: rr.Header().Name, Record: record}
+		if r, ok := sources[record]; ok {
+			zr.Source = ownerKey(r)
+			if r.Object.Kind != "" {
+				zr.Object = &zoneOwner{
+					APIVersion:      r.Object.APIVersion,
+					Kind:            r.Object.Kind,
+					Namespace:       r.Namespace,
+					Name:            r.SourceName,
+					UID:             r.Object.UID,
+					ResourceVersion: r.Object.ResourceVersion,
+				}
+			}
+		}
+		if t := mdns.LastMulticast(zr.Name); !t.IsZero() {
+			zr.LastMulticast = &t
+		}
+		if t := lastVerified(zr.Name); !t.IsZero() {
+			zr.LastVerified = &t
+		}
+		records = append(records, zr)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Record < records[j].Record
+	})
+	return records
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
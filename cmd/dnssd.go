@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+)
+
+// dnssdRecords returns the DNS-SD records of the instances of r, one for
+// each of the fully qualified targets: the service type enumeration, the
+// instance PTR, and its SRV and TXT records pointing at the target (RFC
+// 6763). Instances are named after their target, foo.bar.local. giving
+// foo-bar.
+func dnssdRecords(r resource.Resource, targets []string) []string {
+	if len(r.DNSSD) == 0 || len(targets) == 0 || len(selectIPs(r)) == 0 {
+		return nil
+	}
+
+	var records []string
+	for _, s := range r.DNSSD {
+		serviceType := s.Type + ".local."
+		for i, target := range targets {
+			instance := strings.ReplaceAll(strings.TrimSuffix(target, ".local."), ".", "-")
+			name := instance + "." + serviceType
+			ttl := recordTTL(r, name)
+			if i == 0 {
+				records = append(records, fmt.Sprintf("_services._dns-sd._udp.local. %d IN PTR %s", ttl, serviceType))
+			}
+			records = append(records,
+				fmt.Sprintf("%s %d IN PTR %s", serviceType, ttl, name),
+				fmt.Sprintf("%s %d IN SRV 0 0 %d %s", name, ttl, s.Port, target),
+				fmt.Sprintf("%s %d IN TXT %s", name, ttl, txtData(s.TXT)),
+			)
+		}
+	}
+	return records
+}
+
+// txtData formats pairs as TXT record data. Instances without any have a
+// single empty string, as RFC 6763 section 6.1 requires.
+func txtData(pairs []string) string {
+	if len(pairs) == 0 {
+		return `""`
+	}
+	quoted := make([]string, len(pairs))
+	for i, pair := range pairs {
+		quoted[i] = `"` + strings.ReplaceAll(pair, `"`, `\"`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+)
+
+// Defaults of POST /api/v1/zone/drain.
+const (
+	defaultDrainTTL   = 10
+	defaultDrainDelay = 30 * time.Second
+)
+
+// zoneDrain steps the zone down ahead of planned maintenance: every record
+// is announced again with a short TTL, then goodbyes are sent once the
+// delay has passed, so clients switch over within seconds of the node
+// going away instead of holding records for their full TTL. It is only
+// used from the main loop.
+type zoneDrain struct {
+	due      <-chan time.Time // nil unless goodbyes are due
+	goodbyes time.Time
+	done     bool // goodbyes were sent and the zone is held
+}
+
+// drainRequest asks the main loop to drain the zone, or to stop draining
+// it when cancel is set.
+type drainRequest struct {
+	ttl    int
+	delay  time.Duration
+	cancel bool
+	result chan drainResult
+}
+
+// drainResult reports the state of the drain.
+type drainResult struct {
+	TTL      int       `json:"ttl,omitempty"`
+	Goodbyes time.Time `json:"goodbyes,omitzero"`
+	conflict string    // why the drain cannot start or stop
+}
+
+// drainRequests carries drain requests to the main loop.
+var drainRequests = make(chan drainRequest)
+
+// drain is the drain in progress, if any.
+var drain zoneDrain
+
+func init() {
+	adminMux.HandleFunc("POST /api/v1/zone/drain", authorized(func(w http.ResponseWriter, r *http.Request) {
+		req := drainRequest{ttl: defaultDrainTTL, delay: defaultDrainDelay}
+		if value := r.URL.Query().Get("ttl"); value != "" {
+			ttl, err := strconv.Atoi(value)
+			if err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl %q, must be a positive number of seconds", value), http.StatusBadRequest)
+				return
+			}
+			req.ttl = ttl
+		}
+		if value := r.URL.Query().Get("delay"); value != "" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				http.Error(w, fmt.Sprintf("invalid delay %q, must be a duration such as 30s", value), http.StatusBadRequest)
+				return
+			}
+			req.delay = delay
+		}
+		requestDrain(w, req)
+	}))
+	adminMux.HandleFunc("DELETE /api/v1/zone/drain", authorized(func(w http.ResponseWriter, r *http.Request) {
+		requestDrain(w, drainRequest{cancel: true})
+	}))
+}
+
+// requestDrain hands req to the main loop and writes the result.
+func requestDrain(w http.ResponseWriter, req drainRequest) {
+	req.result = make(chan drainResult, 1)
+	select {
+	case drainRequests <- req:
+		result := <-req.result
+		if result.conflict != "" {
+			http.Error(w, result.conflict, http.StatusConflict)
+			return
+		}
+		writeJSON(w, result)
+	case <-time.After(2 * time.Second):
+		// The main loop is not running, as in agent or test mode.
+		http.Error(w, "the zone cannot be drained in this mode", http.StatusServiceUnavailable)
+	}
+}
+
+// applyDrain starts or cancels a drain. It runs on the main loop.
+func applyDrain(live map[string]resource.Resource, req drainRequest) drainResult {
+	if req.cancel {
+		return cancelDrain(live)
+	}
+	return startDrain(live, req.ttl, req.delay)
+}
+
+// startDrain announces the records of every live resource again with TTLs
+// capped at ttl and schedules goodbyes for the whole zone after delay.
+func startDrain(live map[string]resource.Resource, ttl int, delay time.Duration) drainResult {
+	if drain.due != nil || drain.done {
+		return drainResult{conflict: "the zone is already being drained"}
+	}
+	next := ttls
+	next.drain = ttl
+	republishWithTTLs(live, next)
+	drain = zoneDrain{due: time.After(delay), goodbyes: time.Now().Add(delay).UTC()}
+	lg.Info("Draining the zone, lowering record TTLs", zap.Int("ttl", ttl), zap.Time("goodbyes", drain.goodbyes))
+	return drainResult{TTL: ttl, Goodbyes: drain.goodbyes}
+}
+
+// finishDrain sends goodbyes for the whole zone and stops answering
+// queries. It runs on the main loop.
+func finishDrain() {
+	drain.due = nil
+	drain.done = true
+	lg.Info("Sending goodbyes for the drained zone", zap.Int("records", len(recordOwners)))
+	mdns.SayGoodbye()
+}
+
+// cancelDrain restores the full TTLs and, once goodbyes were sent, answers
+// and announces the zone again.
+func cancelDrain(live map[string]resource.Resource) drainResult {
+	if drain.due == nil && !drain.done {
+		return drainResult{conflict: "the zone is not being drained"}
+	}
+	held := drain.done
+	drain = zoneDrain{}
+	next := ttls
+	next.drain = 0
+	republishWithTTLs(live, next)
+	if held {
+		// A stale zone stays silent under --stale-policy=withdraw.
+		if ready, _ := source.Ready(); ready {
+			mdns.Release()
+			go mdns.AnnounceZone()
+		}
+	}
+	lg.Info("Drain cancelled, restoring record TTLs")
+	return drainResult{}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// duplicateReports passes the duplicates found in each interval to the main
+// loop, which knows the resources they concern.
+var duplicateReports = make(chan []mdns.Duplicate, 1)
+
+// reportDuplicates collects the answers other responders sent for our names
+// every interval, and warns about each responder seen.
+func reportDuplicates(interval time.Duration) {
+	mdns.WatchDuplicates()
+	for range time.Tick(interval) {
+		dups := mdns.TakeDuplicates()
+
+		byResponder := make(map[string][]mdns.Duplicate)
+		for _, d := range dups {
+			byResponder[d.Responder] = append(byResponder[d.Responder], d)
+			metrics.DuplicateAnswers.Add(float64(d.Count))
+		}
+		metrics.DuplicateResponders.Set(float64(len(byResponder)))
+
+		for responder, ds := range byResponder {
+			names := make(map[string]bool)
+			conflicting := 0
+			for _, d := range ds {
+				names[d.Name] = true
+				if d.Conflicting {
+					conflicting++
+				}
+			}
+			lg.Warn("Another responder is answering for names we publish",
+				zap.String("responder", responder),
+				zap.Strings("names", sortedKeys(names)),
+				zap.Int("conflictingRecords", conflicting),
+				zap.Duration("interval", interval))
+		}
+
+		if len(dups) > 0 {
+			select {
+			case duplicateReports <- dups:
+			default:
+				// The main loop is not running, as in agent mode.
+			}
+		}
+	}
+}
+
+// recordDuplicateEvents emits an Event on each resource whose names another
+// responder answered for. It runs on the main loop.
+func recordDuplicateEvents(live map[string]resource.Resource, dups []mdns.Duplicate) {
+	owners := make(map[string]resource.Resource)
+	for _, r := range live {
+		for _, record := range constructRecords(r) {
+			rr, err := dns.NewRR(record)
+			if err != nil || rr == nil {
+				continue
+			}
+			owners[strings.TrimSuffix(strings.ToLower(rr.Header().Name), ".")] = r
+		}
+	}
+
+	for _, d := range dups {
+		r, ok := owners[d.Name]
+		if !ok {
+			continue
+		}
+		if d.Conflicting {
+			recordEvent(r, corev1.EventTypeWarning, "DuplicateResponder",
+				"Responder %s answers for %s with a different record: %s", d.Responder, d.Name, d.Record)
+		} else {
+			recordEvent(r, corev1.EventTypeWarning, "DuplicateResponder",
+				"Responder %s also answers for %s", d.Responder, d.Name)
+		}
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
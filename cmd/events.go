@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// recorder emits Kubernetes Events against source objects. It is nil when
+// running without a cluster.
+var recorder record.EventRecorder
+
+// newEventRecorder returns a recorder that writes Events through client.
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "external-mdns"})
+}
+
+// objectReference returns a reference to the Kubernetes object r was built
+// from.
+func objectReference(r resource.Resource) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{
+		Namespace: r.Namespace,
+		Name:      r.SourceName,
+	}
+	if r.Object.Kind != "" {
+		ref.APIVersion, ref.Kind = r.Object.APIVersion, r.Object.Kind
+		ref.UID, ref.ResourceVersion = types.UID(r.Object.UID), r.Object.ResourceVersion
+		return ref
+	}
+	switch r.SourceType {
+	case "service":
+		ref.Kind, ref.APIVersion = "Service", "v1"
+	case "ingress":
+		ref.Kind, ref.APIVersion = "Ingress", "networking.k8s.io/v1"
+	case "httproute":
+		ref.Kind, ref.APIVersion = "HTTPRoute", "gateway.networking.k8s.io/v1"
+	case "grpcroute":
+		ref.Kind, ref.APIVersion = "GRPCRoute", "gateway.networking.k8s.io/v1"
+	case "tlsroute":
+		ref.Kind, ref.APIVersion = "TLSRoute", "gateway.networking.k8s.io/v1alpha2"
+	}
+	return ref
+}
+
+// recordEvent emits an Event for the object r was built from, if events
+// are enabled and the object is a Kubernetes object.
+func recordEvent(r resource.Resource, eventType, reason, messageFmt string, args ...interface{}) {
+	if recorder == nil || r.SourceName == "" {
+		return
+	}
+	ref := objectReference(r)
+	if ref.Kind == "" {
+		return
+	}
+	recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"go.uber.org/zap"
+)
+
+// Operations streamed to agents, one JSON object per line.
+const (
+	feedReset = "reset" // discard all records, a snapshot follows
+	feedAdd   = "add"
+	feedDel   = "del"
+	feedPing  = "ping" // keepalive, sent when the zone is quiet
+)
+
+const (
+	// feedPingInterval is how often idle streams are pinged. Agents treat
+	// a stream silent for several intervals as dead.
+	feedPingInterval = 15 * time.Second
+	// feedBacklog is how many changes a slow agent may fall behind before
+	// it is disconnected and left to resynchronise.
+	feedBacklog = 1024
+)
+
+// feedEvent is a change to the published zone.
+type feedEvent struct {
+	Op     string `json:"op"`
+	Record string `json:"record,omitempty"`
+}
+
+// feed tracks the zone published by this process for streaming to agents.
+var feed = newZoneFeed()
+
+// zoneFeed holds the set of published records and fans changes out to
+// subscribed agents.
+type zoneFeed struct {
+	mu      sync.Mutex
+	records map[string]struct{}
+	subs    map[chan feedEvent]struct{}
+}
+
+func newZoneFeed() *zoneFeed {
+	return &zoneFeed{
+		records: make(map[string]struct{}),
+		subs:    make(map[chan feedEvent]struct{}),
+	}
+}
+
+// add records a published record and reports whether it is new.
+func (f *zoneFeed) add(record string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.records[record]
+	f.records[record] = struct{}{}
+	f.broadcast(feedEvent{Op: feedAdd, Record: record})
+	return !exists
+}
+
+// del records a withdrawn record and reports whether it was published.
+func (f *zoneFeed) del(record string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.records[record]
+	delete(f.records, record)
+	f.broadcast(feedEvent{Op: feedDel, Record: record})
+	return exists
+}
+
+// broadcast sends ev to every subscriber, dropping those that have fallen
+// too far behind. The caller must hold f.mu.
+func (f *zoneFeed) broadcast(ev feedEvent) {
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the current records and a channel of subsequent
+// changes. The channel is closed if the subscriber falls behind.
+func (f *zoneFeed) subscribe() ([]string, chan feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	snapshot := make([]string, 0, len(f.records))
+	for record := range f.records {
+		snapshot = append(snapshot, record)
+	}
+	ch := make(chan feedEvent, feedBacklog)
+	f.subs[ch] = struct{}{}
+	return snapshot, ch
+}
+
+func (f *zoneFeed) unsubscribe(ch chan feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// feedHandler streams the zone to an authenticated agent: a reset, the
+// current records, then changes as they happen.
+func feedHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		snapshot, changes := feed.subscribe()
+		defer feed.unsubscribe(changes)
+
+		lg.Info("Agent connected", zap.String("remote", r.RemoteAddr))
+		defer lg.Info("Agent disconnected", zap.String("remote", r.RemoteAddr))
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(feedEvent{Op: feedReset}); err != nil {
+			return
+		}
+		for _, record := range snapshot {
+			if err := enc.Encode(feedEvent{Op: feedAdd, Record: record}); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ping := time.NewTicker(feedPingInterval)
+		defer ping.Stop()
+		for {
+			var ev feedEvent
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ping.C:
+				ev = feedEvent{Op: feedPing}
+			case change, ok := <-changes:
+				if !ok {
+					lg.Warn("Agent fell behind, disconnecting", zap.String("remote", r.RemoteAddr))
+					return
+				}
+				ev = change
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// agentToken returns the token agents must present, read from
+// --agent-token-file or the EXTERNAL_MDNS_AGENT_TOKEN environment variable.
+func agentToken() (string, error) {
+	token := conf.AgentToken
+	if path := conf.AgentTokenFile; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read agent token: %w", err)
+		}
+		token = string(b)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("agents require a token, set --agent-token-file or EXTERNAL_MDNS_AGENT_TOKEN")
+	}
+	return token, nil
+}
+
+// serveAgents starts streaming the zone to agents on --agent-listen.
+func serveAgents() error {
+	token, err := agentToken()
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/zone", feedHandler(token))
+	server := &http.Server{
+		Addr:              conf.AgentListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	cert, key := conf.AgentTLSCert, conf.AgentTLSKey
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("--%s and --%s must be given together", config.AgentTLSCert, config.AgentTLSKey)
+	}
+	if cert == "" {
+		lg.Warn("Streaming the zone to agents without TLS")
+	}
+
+	go func() {
+		var err error
+		if cert != "" {
+			err = server.ListenAndServeTLS(cert, key)
+		} else {
+			err = server.ListenAndServe()
+		}
+		lg.Fatal("Agent stream stopped:", zap.Error(err))
+	}()
+	lg.Info("Streaming zone to agents", zap.String("address", server.Addr))
+	return nil
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// finalizerTimeout bounds each request adding or removing the finalizer.
+const finalizerTimeout = 10 * time.Second
+
+// goodbyeFinalizers holds published Services and Ingresses back from being
+// deleted until the goodbyes for their records have been sent, even when
+// the responder is down as they are deleted. Only the main loop uses it.
+type goodbyeFinalizers struct {
+	client   kubernetes.Interface
+	held     map[string]bool     // UIDs of the objects given the finalizer
+	released []resource.Resource // terminating objects, released after the next flush
+}
+
+// finalizers is nil unless --goodbye-finalizer is set.
+var finalizers *goodbyeFinalizers
+
+// goodbyesSent is closed once the goodbyes for the records of the previous
+// instance have been sent, see warmCaches. Until then, objects deleted
+// while we were down are not released.
+var goodbyesSent = make(chan struct{})
+
+// configureFinalizers enables the finalizer when --goodbye-finalizer is set.
+func configureFinalizers(client kubernetes.Interface, enabled bool) {
+	if !enabled {
+		return
+	}
+	if client == nil {
+		lg.Fatal("The goodbye finalizer needs a Kubernetes cluster")
+	}
+	if conf.RespondOnly {
+		lg.Fatal("The goodbye finalizer needs goodbyes to be sent, it cannot be used with --" + config.RespondOnly)
+	}
+	finalizers = &goodbyeFinalizers{client: client, held: make(map[string]bool)}
+}
+
+// track adds the finalizer to the object of a published resource, and
+// queues objects being deleted for release. It is nil-safe.
+func (f *goodbyeFinalizers) track(r resource.Resource) {
+	if f == nil || r.Object.UID == "" || (r.Object.Kind != "Service" && r.Object.Kind != "Ingress") {
+		return
+	}
+	if r.Object.Terminating {
+		f.released = append(f.released, r)
+		return
+	}
+	if r.Action != resource.Added || len(r.IPs) == 0 || f.held[r.Object.UID] {
+		return
+	}
+	f.held[r.Object.UID] = true
+	go func() {
+		if err := f.add(r); err != nil {
+			lg.Warn("Failed to add the goodbye finalizer", zap.String("resource", ownerKey(r)), zap.Error(err))
+		}
+	}()
+}
+
+// release removes the finalizer from the objects being deleted, once the
+// goodbyes for the records withdrawn with them have been written. It is
+// nil-safe.
+func (f *goodbyeFinalizers) release() {
+	if f == nil || len(f.released) == 0 {
+		return
+	}
+	released := f.released
+	for _, r := range released {
+		delete(f.held, r.Object.UID)
+	}
+	mdns.AfterGoodbyes(func() {
+		for _, r := range released {
+			go func() {
+				<-goodbyesSent
+				if err := f.remove(r); err != nil {
+					lg.Warn("Failed to remove the goodbye finalizer", zap.String("resource", ownerKey(r)), zap.Error(err))
+				}
+			}()
+		}
+	})
+	f.released = nil
+}
+
+// add puts the finalizer on the object of r. The strategic merge patch adds
+// it to the existing finalizers.
+func (f *goodbyeFinalizers) add(r resource.Resource) error {
+	ctx, cancel := context.WithTimeout(context.Background(), finalizerTimeout)
+	defer cancel()
+
+	patch := []byte(fmt.Sprintf(`{"metadata":{"finalizers":[%q]}}`, source.GoodbyeFinalizer))
+	var err error
+	switch r.Object.Kind {
+	case "Service":
+		_, err = f.client.CoreV1().Services(r.Namespace).Patch(ctx, r.SourceName, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "Ingress":
+		_, err = f.client.NetworkingV1().Ingresses(r.Namespace).Patch(ctx, r.SourceName, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// remove takes the finalizer off the object of r, if it is still there.
+func (f *goodbyeFinalizers) remove(r resource.Resource) error {
+	ctx, cancel := context.WithTimeout(context.Background(), finalizerTimeout)
+	defer cancel()
+
+	without := func(finalizers []string) ([]string, bool) {
+		i := slices.Index(finalizers, source.GoodbyeFinalizer)
+		if i < 0 {
+			return finalizers, false
+		}
+		return slices.Delete(slices.Clone(finalizers), i, i+1), true
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		switch r.Object.Kind {
+		case "Service":
+			services := f.client.CoreV1().Services(r.Namespace)
+			service, err := services.Get(ctx, r.SourceName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			var found bool
+			if service.Finalizers, found = without(service.Finalizers); !found {
+				return nil
+			}
+			_, err = services.Update(ctx, service, metav1.UpdateOptions{})
+			return err
+		case "Ingress":
+			ingresses := f.client.NetworkingV1().Ingresses(r.Namespace)
+			ingress, err := ingresses.Get(ctx, r.SourceName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			var found bool
+			if ingress.Finalizers, found = without(ingress.Finalizers); !found {
+				return nil
+			}
+			_, err = ingresses.Update(ctx, ingress, metav1.UpdateOptions{})
+			return err
+		}
+		return nil
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		lg.Info("Goodbyes sent, released object for deletion", zap.String("resource", ownerKey(r)))
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// fixture describes a fake cluster for --test-fixture: the objects it
+// starts with and a script of changes applied to them.
+type fixture struct {
+	Objects []json.RawMessage `json:"objects"`
+	Events  []fixtureEvent    `json:"events"`
+}
+
+// fixtureEvent creates, updates or deletes Object once After has elapsed
+// since the previous event.
+type fixtureEvent struct {
+	After  string          `json:"after"`
+	Action string          `json:"action"`
+	Object json.RawMessage `json:"object"`
+
+	delay  time.Duration
+	object runtime.Object
+}
+
+// loadFixture reads and validates the fixture file at path.
+func loadFixture(path string) ([]runtime.Object, []fixtureEvent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var f fixture
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, nil, fmt.Errorf("invalid fixture %s: %w", path, err)
+	}
+
+	objects := make([]runtime.Object, 0, len(f.Objects))
+	for i, raw := range f.Objects {
+		obj, err := decodeFixtureObject(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fixture object %d: %w", i, err)
+		}
+		objects = append(objects, obj)
+	}
+
+	for i := range f.Events {
+		event := &f.Events[i]
+		switch event.Action {
+		case "create", "update", "delete":
+		default:
+			return nil, nil, fmt.Errorf("fixture event %d: unknown action %q (create, update, delete)", i, event.Action)
+		}
+		if event.After != "" {
+			if event.delay, err = time.ParseDuration(event.After); err != nil {
+				return nil, nil, fmt.Errorf("fixture event %d: %w", i, err)
+			}
+		}
+		if event.object, err = decodeFixtureObject(event.Object); err != nil {
+			return nil, nil, fmt.Errorf("fixture event %d: %w", i, err)
+		}
+	}
+	return objects, f.Events, nil
+}
+
+func decodeFixtureObject(raw json.RawMessage) (runtime.Object, error) {
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(raw, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch obj.(type) {
+	case *corev1.Service, *networkingv1.Ingress, *discoveryv1.EndpointSlice, *corev1.ConfigMap, *corev1.Pod:
+		return obj, nil
+	}
+	return nil, fmt.Errorf("unsupported kind %s", obj.GetObjectKind().GroupVersionKind().Kind)
+}
+
+// newFixtureClient returns a fake clientset holding the fixture objects.
+func newFixtureClient(objects []runtime.Object) kubernetes.Interface {
+	return fake.NewClientset(objects...)
+}
+
+// playFixture applies the scripted events to client in order.
+func playFixture(client kubernetes.Interface, events []fixtureEvent) {
+	ctx := context.Background()
+	for _, event := range events {
+		time.Sleep(event.delay)
+
+		meta := event.object.(metav1.Object)
+		lg.Info("Fixture event", zap.String("action", event.Action),
+			zap.String("kind", fmt.Sprintf("%T", event.object)),
+			zap.String("object", meta.GetNamespace()+"/"+meta.GetName()))
+		if err := applyFixtureEvent(ctx, client, event.Action, event.object); err != nil {
+			lg.Error("Failed to apply fixture event", zap.Error(err))
+		}
+	}
+	lg.Info("Fixture script finished")
+}
+
+func applyFixtureEvent(ctx context.Context, client kubernetes.Interface, action string, obj runtime.Object) error {
+	var err error
+	switch o := obj.(type) {
+	case *corev1.Service:
+		services := client.CoreV1().Services(o.Namespace)
+		switch action {
+		case "create":
+			_, err = services.Create(ctx, o, metav1.CreateOptions{})
+		case "update":
+			_, err = services.Update(ctx, o, metav1.UpdateOptions{})
+		case "delete":
+			err = services.Delete(ctx, o.Name, metav1.DeleteOptions{})
+		}
+	case *networkingv1.Ingress:
+		ingresses := client.NetworkingV1().Ingresses(o.Namespace)
+		switch action {
+		case "create":
+			_, err = ingresses.Create(ctx, o, metav1.CreateOptions{})
+		case "update":
+			_, err = ingresses.Update(ctx, o, metav1.UpdateOptions{})
+		case "delete":
+			err = ingresses.Delete(ctx, o.Name, metav1.DeleteOptions{})
+		}
+	case *discoveryv1.EndpointSlice:
+		slices := client.DiscoveryV1().EndpointSlices(o.Namespace)
+		switch action {
+		case "create":
+			_, err = slices.Create(ctx, o, metav1.CreateOptions{})
+		case "update":
+			_, err = slices.Update(ctx, o, metav1.UpdateOptions{})
+		case "delete":
+			err = slices.Delete(ctx, o.Name, metav1.DeleteOptions{})
+		}
+	case *corev1.ConfigMap:
+		configMaps := client.CoreV1().ConfigMaps(o.Namespace)
+		switch action {
+		case "create":
+			_, err = configMaps.Create(ctx, o, metav1.CreateOptions{})
+		case "update":
+			_, err = configMaps.Update(ctx, o, metav1.UpdateOptions{})
+		case "delete":
+			err = configMaps.Delete(ctx, o.Name, metav1.DeleteOptions{})
+		}
+	case *corev1.Pod:
+		pods := client.CoreV1().Pods(o.Namespace)
+		switch action {
+		case "create":
+			_, err = pods.Create(ctx, o, metav1.CreateOptions{})
+		case "update":
+			_, err = pods.Update(ctx, o, metav1.UpdateOptions{})
+		case "delete":
+			err = pods.Delete(ctx, o.Name, metav1.DeleteOptions{})
+		}
+	}
+	return err
+}
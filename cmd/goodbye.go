@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// instanceZoneKey suffixes the ConfigMap key holding the zone of each
+// instance writing to the zone ConfigMap, see instanceName.
+const instanceZoneKey = ".zone"
+
+// instanceName names this instance among the replicas or agents sharing the
+// zone ConfigMap or a broker: its node in node-local mode, where each agent
+// publishes a zone of its own, and its pod otherwise.
+func instanceName() string {
+	if conf.NodeLocal {
+		return nodeName()
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// previousZone returns the records this instance published before it
+// restarted, as last written to the zone ConfigMap, along with the keys of
+// instances whose pod or node is gone. Their records are taken over, as a
+// replaced pod has another name, and the keys are dropped on the next
+// write. Records another instance still publishes are left out, so they
+// are not said goodbye to. It must be read before this instance writes its
+// own zone there.
+func previousZone(client kubernetes.Interface) (records, orphaned []string) {
+	ref := conf.ZoneConfigMap
+	if ref == "" || client == nil {
+		return nil, nil
+	}
+	cm, err := readZoneConfigMap(client, ref)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			lg.Warn("Failed to read the previous zone, not sending goodbyes for its records", zap.Error(err))
+		}
+		return nil, nil
+	}
+
+	own := instanceName() + instanceZoneKey
+	published := make(map[string]bool)
+	var instances bool
+	for key, zone := range cm.Data {
+		instance, ok := strings.CutSuffix(key, instanceZoneKey)
+		if !ok {
+			continue
+		}
+		instances = true
+		switch {
+		case key == own:
+			records = append(records, zoneRecords(zone)...)
+		case instanceGone(client, cm.Namespace, instance):
+			records = append(records, zoneRecords(zone)...)
+			orphaned = append(orphaned, key)
+		default:
+			for _, record := range zoneRecords(zone) {
+				published[recordIdentity(record)] = true
+			}
+		}
+	}
+	// The zone of an earlier release, which did not key it by instance.
+	if !instances {
+		records = zoneRecords(cm.Data["zone"])
+	}
+	return slices.DeleteFunc(records, func(record string) bool {
+		return published[recordIdentity(record)]
+	}), orphaned
+}
+
+// zoneRecords splits a zone written to the zone ConfigMap into records.
+func zoneRecords(zone string) []string {
+	var records []string
+	for _, record := range strings.Split(zone, "\n") {
+		if record = strings.TrimSpace(record); record != "" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// instanceGone reports whether the node, in node-local mode, or the pod in
+// namespace that instance names no longer exists. An instance that cannot
+// be looked up is assumed to still run.
+func instanceGone(client kubernetes.Interface, namespace, instance string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var err error
+	if conf.NodeLocal {
+		_, err = client.CoreV1().Nodes().Get(ctx, instance, metav1.GetOptions{})
+	} else {
+		_, err = client.CoreV1().Pods(namespace).Get(ctx, instance, metav1.GetOptions{})
+	}
+	return apierrors.IsNotFound(err)
+}
+
+// sayGoodbye sends goodbyes for the records of previous that are no longer
+// published, such as those renamed by a changed name template or rewrite
+// rule across a restart, so caches on the link drop the old names instead
+// of keeping them until their TTL runs out.
+func sayGoodbye(previous []string) {
+	current := make(map[string]bool)
+	for _, record := range mdns.Records() {
+		current[recordIdentity(record)] = true
+	}
+
+	var stale []string
+	for _, record := range previous {
+		if id := recordIdentity(record); id != "" && !current[id] {
+			stale = append(stale, record)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	lg.Info("Sending goodbyes for records the previous instance published", zap.Int("records", len(stale)))
+	if err := mdns.Apply(nil, stale); err != nil {
+		lg.Warn("Failed to send goodbyes", zap.Error(err))
+	}
+}
+
+// recordIdentity returns record without its TTL and cache-flush bit, so
+// the same record published with another TTL compares equal. It is empty
+// if the record does not parse.
+func recordIdentity(record string) string {
+	rr, err := dns.NewRR(record)
+	if err != nil || rr == nil {
+		return ""
+	}
+	rr.Header().Ttl = 0
+	rr.Header().Class &^= 0x8000
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	return rr.String()
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"go.uber.org/zap"
+)
+
+// Record hooks, run for each record with its lifecycle event as JSON.
+const (
+	hookPrePublish    = "pre-publish"
+	hookPostUnpublish = "post-unpublish"
+)
+
+// hookConcurrency bounds the hooks run at once.
+const hookConcurrency = 8
+
+// recordHooks holds the commands and webhook URLs run for each kind of
+// hook.
+var recordHooks = make(map[string][]string)
+
+// configureHooks reads --hook-pre-publish and --hook-post-unpublish.
+func configureHooks() error {
+	for _, h := range []struct {
+		kind, flag string
+		hooks      []string
+	}{
+		{hookPrePublish, config.HookPrePublish, conf.HookPrePublish},
+		{hookPostUnpublish, config.HookPostUnpublish, conf.HookPostUnpublish},
+	} {
+		var hooks []string
+		for _, hook := range h.hooks {
+			if hook = strings.TrimSpace(hook); hook == "" {
+				return fmt.Errorf("--%s must not be empty", h.flag)
+			}
+			hooks = append(hooks, hook)
+		}
+		recordHooks[h.kind] = hooks
+	}
+	if conf.HookTimeout <= 0 {
+		return fmt.Errorf("--%s must be positive", config.HookTimeout)
+	}
+	return nil
+}
+
+// runHooks runs the hooks of kind for each of records and waits for them,
+// for at most --hook-timeout in all, so pre-publish hooks hold the main loop
+// up no longer than that however many records are published at once. Hooks
+// still running then are stopped and those not started are skipped.
+// Failures are logged and counted, they do not hold the record back.
+func runHooks(kind string, records []string) {
+	hooks := recordHooks[kind]
+	if len(hooks) == 0 || len(records) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.HookTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	running := make(chan struct{}, hookConcurrency)
+	skipped := 0
+	for _, record := range records {
+		event, ok := newLifecycleEvent(kind, record)
+		if !ok {
+			continue
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		for _, hook := range hooks {
+			select {
+			case running <- struct{}{}:
+			case <-ctx.Done():
+				skipped++
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-running }()
+				if err := runHook(ctx, hook, payload); err != nil {
+					lg.Warn("Record hook failed", zap.String("hook", kind), zap.String("command", hook),
+						zap.String("record", record), zap.Error(err))
+					metrics.HookFailures.WithLabelValues(kind).Inc()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if skipped > 0 {
+		lg.Warn("Record hooks skipped, --hook-timeout passed before they could run",
+			zap.String("hook", kind), zap.Int("skipped", skipped), zap.Int("records", len(records)))
+		metrics.HookFailures.WithLabelValues(kind).Add(float64(skipped))
+	}
+}
+
+// runHook POSTs payload to hook if it is an http or https URL, and
+// otherwise runs it as a command, split on spaces, with payload on stdin.
+// It is stopped when ctx is done.
+func runHook(ctx context.Context, hook string, payload []byte) error {
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		return nil
+	}
+
+	args := strings.Fields(hook)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if output = bytes.TrimSpace(output); len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
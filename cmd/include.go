@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/spf13/viper"
+)
+
+// mergeIncludes merges the files listed under the include key of the config
+// file read into v, in order, so later files override earlier ones. Each
+// entry is a file, a glob or a directory, whose configuration files are
+// merged in lexical order as in a conf.d directory. Relative paths are taken
+// from the directory of the config file. Included files cannot include
+// further files.
+func mergeIncludes(v *viper.Viper) error {
+	files, err := includedConfigFiles(v)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fragment := viper.New()
+		fragment.SetConfigFile(file)
+		if err := fragment.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read included config %s: %w", file, err)
+		}
+		if err := v.MergeConfigMap(fragment.AllSettings()); err != nil {
+			return fmt.Errorf("failed to merge included config %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// includedConfigFiles returns the files listed under the include key of v,
+// in the order they are merged.
+func includedConfigFiles(v *viper.Viper) ([]string, error) {
+	base := filepath.Dir(v.ConfigFileUsed())
+	var all []string
+	for _, include := range v.GetStringSlice(config.Include) {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(base, include)
+		}
+		files, err := includedFiles(include)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, files...)
+	}
+	return all, nil
+}
+
+// includedFiles expands an include entry into the files it names.
+func includedFiles(include string) ([]string, error) {
+	if info, err := os.Stat(include); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(include)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && len(ext) > 1 && slices.Contains(viper.SupportedExts, ext[1:]) {
+				files = append(files, filepath.Join(include, entry.Name()))
+			}
+		}
+		return files, nil
+	}
+
+	files, err := filepath.Glob(include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %s: %w", include, err)
+	}
+	// A missing file is an error, a glob matching nothing is not.
+	if len(files) == 0 && !strings.ContainsAny(include, "*?[") {
+		return nil, fmt.Errorf("included config %s does not exist", include)
+	}
+	sort.Strings(files)
+	return files, nil
+}
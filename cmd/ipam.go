@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// IPAM systems addresses can be checked against, see --ipam-type.
+const (
+	ipamNetBox  = "netbox"
+	ipamPHPIPAM = "phpipam"
+)
+
+// Policies for addresses the IPAM system does not know.
+const (
+	ipamPolicyWarn   = "warn"   // publish them, with a warning
+	ipamPolicyRefuse = "refuse" // leave them out
+)
+
+// ipamTimeout bounds a single lookup.
+const ipamTimeout = 5 * time.Second
+
+// ipamConcurrency bounds the lookups running at once.
+const ipamConcurrency = 4
+
+// ipamLookup reports whether address is registered in an IPAM system.
+type ipamLookup func(ctx context.Context, address string) (bool, error)
+
+// ipamVerdict is the cached answer for an address.
+type ipamVerdict struct {
+	registered bool
+	checked    time.Time
+}
+
+// ipamResult is the outcome of looking up an address.
+type ipamResult struct {
+	address    string
+	registered bool
+	err        error
+}
+
+// ipamWaiter is a resource waiting for lookups, and whether one of them
+// changed what is published of it.
+type ipamWaiter struct {
+	r       resource.Resource
+	changed bool
+}
+
+// ipamGuard checks the addresses of resources about to be published
+// against an IPAM system, so that squatted addresses are not advertised.
+// Lookups run in the background and their verdicts, including failures,
+// are cached for --ipam-cache-ttl; an expired verdict is used until the
+// lookup refreshing it completes. When the IPAM system cannot be reached,
+// addresses are let through. It is only used on the main loop.
+type ipamGuard struct {
+	lookup   ipamLookup
+	policy   string
+	cacheTTL time.Duration
+	verdicts map[string]ipamVerdict
+	// pending holds the addresses being looked up.
+	pending map[string]bool
+	// waiting holds the resources checked while some of their addresses
+	// were being looked up, by liveKey, to check again once they are.
+	waiting map[string]*ipamWaiter
+	slots   chan struct{}
+	results chan ipamResult
+}
+
+// ipam is disabled unless --ipam-url is set.
+var ipam = &ipamGuard{}
+
+// configureIPAM sets up the IPAM check from the ipam flags.
+func configureIPAM() error {
+	base := strings.TrimSuffix(conf.IPAMURL, "/")
+	if base == "" {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(base); err != nil {
+		return fmt.Errorf("--%s: %w", config.IPAMURL, err)
+	}
+	token := conf.IPAMToken
+
+	g := &ipamGuard{
+		policy:   conf.IPAMPolicy,
+		cacheTTL: conf.IPAMCacheTTL,
+		verdicts: make(map[string]ipamVerdict),
+		pending:  make(map[string]bool),
+		waiting:  make(map[string]*ipamWaiter),
+		slots:    make(chan struct{}, ipamConcurrency),
+		results:  make(chan ipamResult),
+	}
+	switch g.policy {
+	case ipamPolicyWarn, ipamPolicyRefuse:
+	default:
+		return fmt.Errorf("--%s: unknown policy %q (warn, refuse)", config.IPAMPolicy, g.policy)
+	}
+	switch kind := conf.IPAMType; kind {
+	case ipamNetBox:
+		g.lookup = netBoxLookup(base, token)
+	case ipamPHPIPAM:
+		g.lookup = phpIPAMLookup(base, token)
+	default:
+		return fmt.Errorf("--%s: unknown IPAM system %q (netbox, phpipam)", config.IPAMType, kind)
+	}
+	ipam = g
+	lg.Info("Checking published addresses against IPAM", zap.String("url", base), zap.String("policy", g.policy))
+	return nil
+}
+
+// check returns the addresses of r to publish. Addresses without a verdict
+// yet are looked up, and published meanwhile only with --ipam-policy=warn;
+// r is checked again by settle once they are. Addresses being withdrawn are
+// filtered by the verdicts already known, without lookups, so records that
+// were refused are not withdrawn.
+func (g *ipamGuard) check(r resource.Resource) []string {
+	if g.lookup == nil {
+		return r.IPs
+	}
+
+	delete(g.waiting, liveKey(r))
+	var allowed, unregistered []string
+	for _, address := range r.IPs {
+		registered, known := g.registered(address, r.Action == resource.Added)
+		switch {
+		case registered:
+			allowed = append(allowed, address)
+		case known:
+			unregistered = append(unregistered, address)
+		}
+		if g.pending[address] && r.Action == resource.Added {
+			g.waiting[liveKey(r)] = &ipamWaiter{r: r}
+		}
+	}
+	if len(unregistered) == 0 || r.Action != resource.Added {
+		if r.Action == resource.Added {
+			g.clearSkip(r)
+		}
+		if g.policy == ipamPolicyWarn {
+			return r.IPs
+		}
+		return allowed
+	}
+
+	metrics.UnregisteredAddresses.Add(float64(len(unregistered)))
+	list := strings.Join(unregistered, ", ")
+	if g.policy == ipamPolicyWarn {
+		lg.Warn("Publishing addresses not registered in IPAM", zap.String("resource", ownerKey(r)), zap.Strings("addresses", unregistered))
+		recordEvent(r, corev1.EventTypeWarning, "UnregisteredAddress", "Addresses %s are not registered in IPAM", list)
+		return r.IPs
+	}
+
+	lg.Warn("Not publishing addresses not registered in IPAM", zap.String("resource", ownerKey(r)), zap.Strings("addresses", unregistered))
+	if len(allowed) == 0 {
+		if kind := skipKind(r); kind != "" {
+			source.RecordSkip(source.Skip{Kind: kind, Namespace: r.Namespace, Name: r.SourceName,
+				Reason: source.SkipUnregistered, Message: "addresses " + list + " are not registered in IPAM"})
+		}
+	} else {
+		g.clearSkip(r)
+		recordEvent(r, corev1.EventTypeWarning, "UnregisteredAddress", "Not publishing addresses %s, not registered in IPAM", list)
+	}
+	return allowed
+}
+
+// clearSkip forgets that r was skipped for its addresses, if it was.
+func (g *ipamGuard) clearSkip(r resource.Resource) {
+	kind := skipKind(r)
+	if kind == "" {
+		return
+	}
+	if skip, ok := source.SkipFor(kind, r.Namespace, r.SourceName); ok && skip.Reason == source.SkipUnregistered {
+		source.ClearSkip(kind, r.Namespace, r.SourceName)
+	}
+}
+
+// registered reports whether address is registered by its cached verdict,
+// and whether there is one. With lookup, the address is looked up in the
+// background unless its verdict is fresh. Without, addresses without a
+// verdict count as registered.
+func (g *ipamGuard) registered(address string, lookup bool) (registered, known bool) {
+	verdict, ok := g.verdicts[address]
+	if !lookup {
+		return !ok || verdict.registered, true
+	}
+	if (!ok || time.Since(verdict.checked) >= g.cacheTTL) && !g.pending[address] {
+		g.pending[address] = true
+		go g.run(address)
+	}
+	return ok && verdict.registered, ok
+}
+
+// run looks address up and reports to the main loop.
+func (g *ipamGuard) run(address string) {
+	g.slots <- struct{}{}
+	defer func() { <-g.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), ipamTimeout)
+	defer cancel()
+	registered, err := g.lookup(ctx, address)
+	g.results <- ipamResult{address, registered, err}
+}
+
+// settle caches the verdict of a lookup, and admits again the resources
+// waiting for it once all their addresses are looked up, if a verdict
+// changed what is published of them. A failed lookup counts as registered.
+func (g *ipamGuard) settle(live map[string]resource.Resource, result ipamResult) {
+	delete(g.pending, result.address)
+	if result.err != nil {
+		lg.Warn("Failed to look up address in IPAM, publishing it", zap.String("address", result.address), zap.Error(result.err))
+		result.registered = true
+	}
+	previous, known := g.verdicts[result.address]
+	g.verdicts[result.address] = ipamVerdict{registered: result.registered, checked: time.Now()}
+	changed := previous.registered != result.registered
+	if !known {
+		// Unknown addresses were only published with the warn policy.
+		changed = g.policy == ipamPolicyRefuse || !result.registered
+	}
+
+	for key, w := range g.waiting {
+		if !slices.Contains(w.r.IPs, result.address) {
+			continue
+		}
+		w.changed = w.changed || changed
+		if slices.ContainsFunc(w.r.IPs, func(address string) bool { return g.pending[address] }) {
+			continue
+		}
+		delete(g.waiting, key)
+		if w.changed {
+			admitResource(live, w.r)
+		}
+	}
+}
+
+// netBoxLookup looks addresses up in NetBox with its REST API.
+func netBoxLookup(base, token string) ipamLookup {
+	return func(ctx context.Context, address string) (bool, error) {
+		var page struct {
+			Count int `json:"count"`
+		}
+		header := http.Header{"Accept": {"application/json"}}
+		if token != "" {
+			header.Set("Authorization", "Token "+token)
+		}
+		err := ipamGet(ctx, base+"/api/ipam/ip-addresses/?address="+url.QueryEscape(address), header, &page)
+		return page.Count > 0, err
+	}
+}
+
+// phpIPAMLookup looks addresses up in phpIPAM with its REST API. base
+// includes the API application, as in https://ipam.example.com/api/myapp.
+func phpIPAMLookup(base, token string) ipamLookup {
+	return func(ctx context.Context, address string) (bool, error) {
+		var result struct {
+			Success bool              `json:"success"`
+			Data    []json.RawMessage `json:"data"`
+		}
+		header := http.Header{"Accept": {"application/json"}}
+		if token != "" {
+			header.Set("token", token)
+		}
+		err := ipamGet(ctx, base+"/addresses/search/"+url.PathEscape(address)+"/", header, &result)
+		if errors.Is(err, errIPAMNotFound) {
+			return false, nil
+		}
+		return result.Success && len(result.Data) > 0, err
+	}
+}
+
+// errIPAMNotFound is returned by ipamGet for a 404 answer, which phpIPAM
+// gives for unknown addresses.
+var errIPAMNotFound = errors.New("not found")
+
+// ipamGet fetches target and decodes its JSON body into v.
+func ipamGet(ctx context.Context, target string, header http.Header, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errIPAMNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("IPAM answered %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,15 @@
+// Command kubectl-mdns is a kubectl plugin for inspecting External-mDNS.
+// Install it anywhere on $PATH and run it as "kubectl mdns".
+package main
+
+import (
+	"os"
+
+	"github.com/grumpylabs/external-mdns/cmd"
+)
+
+func main() {
+	if err := cmd.ExecuteKubectlPlugin(); err != nil {
+		os.Exit(1)
+	}
+}
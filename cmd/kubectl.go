@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kubectlCmd is the root of the kubectl-mdns plugin, built as a separate
+// binary from cmd/kubectl-mdns.
+var kubectlCmd = &cobra.Command{
+	Use:   "kubectl-mdns",
+	Short: "Inspect what External-mDNS publishes",
+	Long: `kubectl-mdns shows which Services and Ingresses External-mDNS publishes, and
+why the others are skipped, and resolves names over mDNS to check what the LAN
+sees. Listing needs the controller to run with --zone-configmap.`,
+	Annotations: map[string]string{
+		cobra.CommandDisplayNameAnnotation: "kubectl mdns",
+	},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	},
+	SilenceUsage: true,
+}
+
+var kubectlListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List Services and Ingresses with their published names or skip reason",
+	Example: `  kubectl mdns list -n shop
+  kubectl mdns list -o zone --origin local | named-checkzone local /dev/stdin`,
+	Args: cobra.NoArgs,
+	RunE: runKubectlList,
+}
+
+var kubectlExplainCmd = &cobra.Command{
+	Use:   "explain TYPE/NAME",
+	Short: "Explain why a Service or Ingress is or is not published",
+	Example: `  kubectl mdns explain svc/web -n shop
+  kubectl mdns explain ingress/dashboard`,
+	Args: cobra.ExactArgs(1),
+	RunE: runKubectlExplain,
+}
+
+var kubectlResolveCmd = &cobra.Command{
+	Use:   "resolve NAME...",
+	Short: "Resolve names over mDNS on the local network",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runKubectlResolve,
+}
+
+// ExecuteKubectlPlugin runs the kubectl-mdns plugin.
+func ExecuteKubectlPlugin() error {
+	return kubectlCmd.Execute()
+}
+
+func init() {
+	flags := kubectlCmd.PersistentFlags()
+	flags.String(config.KubeConfig, "", "Path to the kubeconfig file")
+	flags.String(config.KubeContext, "", "Kubeconfig context to use (default the current context)")
+	flags.StringP(config.Namespace, "n", "", "Only list objects in this namespace (default all namespaces)")
+	flags.String(config.ZoneConfigMap, "default/external-mdns-zone", "ConfigMap the controller writes the zone to, as namespace/name")
+
+	kubectlListCmd.Flags().StringP("output", "o", "table", "Output format: table, or zone for the published records as a master file")
+	kubectlListCmd.Flags().String("origin", "", "With -o zone, only print the records of this zone, with an SOA and NS")
+	kubectlResolveCmd.Flags().Duration(config.SelftestTimeout, 3*time.Second, "How long to wait for an answer")
+	kubectlResolveCmd.Flags().String("type", "A", "Record type to query")
+
+	kubectlCmd.AddCommand(kubectlListCmd, kubectlExplainCmd, kubectlResolveCmd)
+}
+
+// publishedObject is a Service or Ingress as listed by the plugin.
+type publishedObject struct {
+	kind, namespace, name string
+	names                 []string
+	reason                string
+}
+
+func runKubectlList(cmd *cobra.Command, args []string) error {
+	client, err := newK8sClient()
+	if err != nil {
+		return err
+	}
+	switch output := viper.GetString("output"); output {
+	case "table":
+	case "zone":
+		return printZoneFile(client, viper.GetString(config.ZoneConfigMap), viper.GetString("origin"))
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+	published, skipped, err := readZoneStatus(client, viper.GetString(config.ZoneConfigMap))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	namespace := viper.GetString(config.Namespace)
+	var objects []publishedObject
+
+	services, err := client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		obj := publishedObject{kind: "Service", namespace: svc.Namespace, name: svc.Name}
+		if obj.names = published["service/"+svc.Namespace+"/"+svc.Name]; len(obj.names) == 0 {
+			obj.reason = serviceSkipReason(svc)
+			if skip, ok := skipped["Service/"+svc.Namespace+"/"+svc.Name]; ok {
+				obj.reason = skip.Message
+			}
+		}
+		objects = append(objects, obj)
+	}
+
+	ingresses, err := client.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	for i := range ingresses.Items {
+		ing := &ingresses.Items[i]
+		obj := publishedObject{kind: "Ingress", namespace: ing.Namespace, name: ing.Name}
+		if obj.names = published["ingress/"+ing.Namespace+"/"+ing.Name]; len(obj.names) == 0 {
+			obj.reason = ingressSkipReason(ing)
+			if skip, ok := skipped["Ingress/"+ing.Namespace+"/"+ing.Name]; ok {
+				obj.reason = skip.Message
+			}
+		}
+		objects = append(objects, obj)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME\tSTATUS\tDETAIL")
+	for _, obj := range objects {
+		if len(obj.names) > 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\tpublished\t%s\n", obj.kind, obj.namespace, obj.name, strings.Join(obj.names, ", "))
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\tskipped\t%s\n", obj.kind, obj.namespace, obj.name, obj.reason)
+		}
+	}
+	return w.Flush()
+}
+
+// readZoneStatus reads the zone ConfigMap and returns the names published
+// for each source resource, keyed like ownerKey, and the reported skips,
+// keyed by kind, namespace and name.
+func readZoneStatus(client kubernetes.Interface, ref string) (map[string][]string, map[string]source.Skip, error) {
+	cm, err := readZoneConfigMap(client, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []zoneStatusEntry
+	if err := json.Unmarshal([]byte(cm.Data["zone.json"]), &entries); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ConfigMap %s: %w", ref, err)
+	}
+	var skips []source.Skip
+	if data, ok := cm.Data["skipped.json"]; ok {
+		if err := json.Unmarshal([]byte(data), &skips); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse ConfigMap %s: %w", ref, err)
+		}
+	}
+	skipped := make(map[string]source.Skip, len(skips))
+	for _, s := range skips {
+		skipped[s.Kind+"/"+s.Namespace+"/"+s.Name] = s
+	}
+	seen := make(map[string]bool)
+	sources := make(map[string][]string)
+	for _, entry := range entries {
+		rr, err := dns.NewRR(entry.Record)
+		if err != nil || rr == nil || rr.Header().Rrtype == dns.TypePTR || entry.Source == "" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name, ".")
+		if seen[entry.Source+" "+name] {
+			continue
+		}
+		seen[entry.Source+" "+name] = true
+		sources[entry.Source] = append(sources[entry.Source], name)
+	}
+	for _, names := range sources {
+		sort.Strings(names)
+	}
+	return sources, skipped, nil
+}
+
+// readZoneConfigMap reads the zone ConfigMap written by the controller.
+func readZoneConfigMap(client kubernetes.Interface, ref string) (*corev1.ConfigMap, error) {
+	namespace, name, err := parseNamespacedName(ref)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the zone from ConfigMap %s (is the controller running with --%s=%s?): %w",
+			ref, config.ZoneConfigMap, ref, err)
+	}
+	return cm, nil
+}
+
+// printZoneFile prints the records in the zone ConfigMap as a master file.
+func printZoneFile(client kubernetes.Interface, ref, origin string) error {
+	cm, err := readZoneConfigMap(client, ref)
+	if err != nil {
+		return err
+	}
+	zone, err := masterFile(strings.Split(cm.Data["zone"], "\n"), origin)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString(zone)
+	return err
+}
+
+// serviceSkipReason guesses why svc is not published from its spec and
+// status. It cannot see the controller's flags, filter or readiness checks.
+func serviceSkipReason(svc *corev1.Service) string {
+	switch svc.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, lb := range svc.Status.LoadBalancer.Ingress {
+			if lb.IP != "" {
+				return "not in the published zone (filtered out or without ready endpoints)"
+			}
+		}
+		return "waiting for a LoadBalancer address"
+	case corev1.ServiceTypeClusterIP, "":
+		if internal, _ := strconv.ParseBool(svc.Annotations[source.PublishInternalAnnotation]); !internal {
+			return "ClusterIP services need --publish-internal-services or the publish-internal annotation"
+		}
+	case corev1.ServiceTypeNodePort:
+		return "NodePort services are only published in node-local mode"
+	case corev1.ServiceTypeExternalName:
+		return "ExternalName services need --resolve-external-names"
+	}
+	return "not in the published zone (filtered out, without ready endpoints or namespace not watched)"
+}
+
+// ingressSkipReason guesses why ing is not published.
+func ingressSkipReason(ing *networkingv1.Ingress) string {
+	hasIP := false
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			hasIP = true
+		}
+	}
+	if !hasIP {
+		return "waiting for a load balancer address"
+	}
+	for _, rule := range ing.Spec.Rules {
+		if strings.HasSuffix(rule.Host, ".local") {
+			return "not in the published zone (filtered out or namespace not watched)"
+		}
+	}
+	return "no rule host ends in .local"
+}
+
+func runKubectlExplain(cmd *cobra.Command, args []string) error {
+	typ, name, ok := strings.Cut(args[0], "/")
+	kind := objectKind(typ)
+	if !ok || kind == "" || name == "" {
+		return fmt.Errorf("%q must be given as svc/NAME or ingress/NAME", args[0])
+	}
+	namespace := viper.GetString(config.Namespace)
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	client, err := newK8sClient()
+	if err != nil {
+		return err
+	}
+	published, skipped, err := readZoneStatus(client, viper.GetString(config.ZoneConfigMap))
+	if err != nil {
+		return err
+	}
+
+	// Guesses from the object itself are only used when the controller
+	// has not reported a reason.
+	ctx := context.Background()
+	var guess string
+	switch kind {
+	case "Service":
+		svc, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		guess = serviceSkipReason(svc)
+	case "Ingress":
+		ing, err := client.NetworkingV1().Ingresses(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		guess = ingressSkipReason(ing)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s %s/%s\n", kind, namespace, name)
+	if names := published[strings.ToLower(kind)+"/"+namespace+"/"+name]; len(names) > 0 {
+		fmt.Fprintf(w, "Status:\tpublished\n")
+		fmt.Fprintf(w, "Names:\t%s\n", strings.Join(names, ", "))
+	} else if skip, ok := skipped[kind+"/"+namespace+"/"+name]; ok {
+		fmt.Fprintf(w, "Status:\tskipped\n")
+		fmt.Fprintf(w, "Reason:\t%s\n", skip.Reason)
+		fmt.Fprintf(w, "Message:\t%s\n", skip.Message)
+		fmt.Fprintf(w, "Since:\t%s (%s ago)\n", skip.Since.Format(time.RFC3339), time.Since(skip.Since).Round(time.Second))
+	} else {
+		fmt.Fprintf(w, "Status:\tskipped\n")
+		fmt.Fprintf(w, "Message:\t%s\n", guess)
+		fmt.Fprintf(w, "\t(guessed from the object, the controller has not reported a reason)\n")
+	}
+	return w.Flush()
+}
+
+func runKubectlResolve(cmd *cobra.Command, args []string) error {
+	qtype, ok := dns.StringToType[strings.ToUpper(viper.GetString("type"))]
+	if !ok {
+		return fmt.Errorf("unknown record type %q", viper.GetString("type"))
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+	timeout := viper.GetDuration(config.SelftestTimeout)
+
+	failed := false
+	for _, name := range args {
+		if !strings.HasSuffix(strings.TrimSuffix(name, "."), ".local") {
+			name += ".local"
+		}
+		answers, rtt, err := mdns.Lookup(group, name, qtype, timeout)
+		if err != nil {
+			failed = true
+			fmt.Printf("%s: %v\n", name, err)
+			continue
+		}
+		for _, rr := range answers {
+			fmt.Printf("%s (%s)\n", rr, rtt.Round(time.Microsecond))
+		}
+	}
+	if failed {
+		return fmt.Errorf("some names did not resolve")
+	}
+	return nil
+}
@@ -6,39 +6,63 @@ package cmd
 
 import (
 	"fmt"
-	"path/filepath"
 
-	homedir "github.com/mitchellh/go-homedir"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 // getKubeConfig returns a Kubernetes REST config. It uses in-cluster
-// configuration if available, otherwise falls back to the user's
-// local kubeconfig file.
+// configuration if available and no kubeconfig or context was given,
+// otherwise it loads the kubeconfig file from --kubeconfig, $KUBECONFIG or
+// ~/.kube/config. With --kubeconfig-secret, that cluster is only used to
+// read the kubeconfig of the cluster to watch from a Secret. --master and
+// the impersonation flags apply to the cluster being watched.
 func getKubeConfig() (*rest.Config, error) {
-	// Attempt in-cluster configuration
-	config, err := rest.InClusterConfig()
-	if err == nil {
-		return config, nil
+	kubeconfig := conf.KubeConfig
+	context := conf.KubeContext
+
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" && context == "" {
+		// Attempt in-cluster configuration
+		config, err = rest.InClusterConfig()
+		if err != nil && err != rest.ErrNotInCluster {
+			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		}
 	}
 
-	if err != rest.ErrNotInCluster {
-		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	if config == nil {
+		// Fall back to local kubeconfig
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Fall back to local kubeconfig
-	kubeconfig := kubeconfigPath()
-	return clientcmd.BuildConfigFromFlags("", kubeconfig)
-}
+	if conf.KubeConfigSecret != "" {
+		if config, err = kubeConfigFromSecret(config); err != nil {
+			return nil, err
+		}
+	}
 
-// kubeconfigPath returns the default kubeconfig path or an empty string if the home directory is not found.
-func kubeconfigPath() string {
-	if home, err := homedir.Dir(); err == nil {
-		return filepath.Join(home, ".kube", "config")
+	if master := conf.Master; master != "" {
+		config.Host = master
 	}
-	return ""
+	config.Impersonate = rest.ImpersonationConfig{
+		UserName: conf.ImpersonateUser,
+		Groups:   conf.ImpersonateGroups,
+	}
+	config.QPS = float32(conf.KubeAPIQPS)
+	config.Burst = conf.KubeAPIBurst
+	return config, nil
 }
 
 // newK8sClient creates a new Kubernetes clientset based on the current configuration.
@@ -48,6 +72,11 @@ func newK8sClient() (*kubernetes.Clientset, error) {
 		return nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
 	}
 
+	// Core types are requested as protobuf, which is considerably cheaper
+	// to decode than JSON on large clusters.
+	config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+	config.ContentType = "application/vnd.kubernetes.protobuf"
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
@@ -55,3 +84,53 @@ func newK8sClient() (*kubernetes.Clientset, error) {
 
 	return clientset, nil
 }
+
+// servedResource returns the resource name in group at the preferred
+// version serving it, and whether any version of group serves it.
+func servedResource(group, name string) (schema.GroupVersionResource, bool, error) {
+	config, err := getKubeConfig()
+	if err != nil {
+		return schema.GroupVersionResource{}, false, fmt.Errorf("failed to load Kubernetes config: %w", err)
+	}
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return schema.GroupVersionResource{}, false, fmt.Errorf("failed to create discovery client: %w", err)
+	}
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return schema.GroupVersionResource{}, false, fmt.Errorf("failed to list API groups: %w", err)
+	}
+	for _, g := range groups.Groups {
+		if g.Name != group {
+			continue
+		}
+		versions := append([]metav1.GroupVersionForDiscovery{g.PreferredVersion}, g.Versions...)
+		for _, version := range versions {
+			resources, err := client.ServerResourcesForGroupVersion(version.GroupVersion)
+			if err != nil {
+				continue
+			}
+			for _, r := range resources.APIResources {
+				if r.Name == name {
+					return schema.GroupVersionResource{Group: group, Version: version.Version, Resource: name}, true, nil
+				}
+			}
+		}
+	}
+	return schema.GroupVersionResource{}, false, nil
+}
+
+// newDynamicClient creates a dynamic Kubernetes client for arbitrary resources.
+func newDynamicClient() (dynamic.Interface, error) {
+	config, err := getKubeConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic Kubernetes client: %w", err)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	cfg "github.com/grumpylabs/external-mdns/cmd/config"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// secretKubeConfig is a kubeconfig loaded from a Secret. Its transport is
+// swapped when the Secret is rotated, so clients built from it pick up new
+// credentials without being recreated.
+type secretKubeConfig struct {
+	config    *rest.Config
+	transport atomic.Pointer[http.RoundTripper]
+	data      []byte
+}
+
+var (
+	kubeSecretOnce sync.Once
+	kubeSecret     *secretKubeConfig
+	kubeSecretErr  error
+)
+
+// kubeConfigFromSecret returns the REST config of the kubeconfig in the
+// Secret given by --kubeconfig-secret, read through home, the cluster the
+// controller runs in. The Secret is loaded and watched once per process.
+func kubeConfigFromSecret(home *rest.Config) (*rest.Config, error) {
+	kubeSecretOnce.Do(func() {
+		kubeSecret, kubeSecretErr = loadSecretKubeConfig(home, conf.KubeConfigSecret, conf.KubeConfigSecretKey)
+	})
+	if kubeSecretErr != nil {
+		return nil, kubeSecretErr
+	}
+	return rest.CopyConfig(kubeSecret.config), nil
+}
+
+func loadSecretKubeConfig(home *rest.Config, ref, key string) (*secretKubeConfig, error) {
+	namespace, name, err := parseNamespacedName(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %w", cfg.KubeConfigSecret, err)
+	}
+	client, err := kubernetes.NewForConfig(home)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig Secret %s: %w", ref, err)
+	}
+
+	s := &secretKubeConfig{}
+	config, transport, err := secretTransport(secret, key)
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig Secret %s: %w", ref, err)
+	}
+	s.data = secret.Data[key]
+	s.transport.Store(&transport)
+	// Credentials and TLS settings live in the swapped transport only. Were
+	// they left in the config, client-go would add the original
+	// credentials to every request around it.
+	s.config = &rest.Config{
+		Host:    config.Host,
+		APIPath: config.APIPath,
+		WrapTransport: func(http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return (*s.transport.Load()).RoundTrip(req)
+			})
+		},
+	}
+
+	go s.watch(client, namespace, name, key, config.Host)
+	lg.Info("Using kubeconfig from Secret", zap.String("secret", ref), zap.String("server", config.Host))
+	return s, nil
+}
+
+// secretTransport builds the REST config and transport of the kubeconfig
+// held under key in secret.
+func secretTransport(secret *corev1.Secret, key string) (*rest.Config, http.RoundTripper, error) {
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, nil, fmt.Errorf("no %q key", key)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, transport, nil
+}
+
+// watch swaps in the credentials of the Secret whenever it is updated.
+// Requests already in flight, including open watches, finish on the old
+// credentials.
+func (s *secretKubeConfig) watch(client kubernetes.Interface, namespace, name, key, host string) {
+	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "secrets", namespace,
+		fields.OneTermEqualSelector("metadata.name", name))
+	_, informer := cache.NewInformerWithOptions(cache.InformerOptions{
+		ListerWatcher: lw,
+		ObjectType:    &corev1.Secret{},
+		Handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				secret := newObj.(*corev1.Secret)
+				if bytes.Equal(secret.Data[key], s.data) {
+					return
+				}
+				config, transport, err := secretTransport(secret, key)
+				if err != nil {
+					lg.Warn("Ignoring invalid kubeconfig Secret update", zap.Error(err))
+					return
+				}
+				if config.Host != host {
+					lg.Warn("The server in the kubeconfig Secret changed, restart to connect to it",
+						zap.String("server", config.Host))
+				}
+				s.data = secret.Data[key]
+				s.transport.Store(&transport)
+				lg.Info("Reloaded credentials from kubeconfig Secret", zap.String("secret", namespace+"/"+name))
+			},
+		},
+	})
+	informer.Run(make(chan struct{}))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
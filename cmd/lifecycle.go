@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/miekg/dns"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// Record lifecycle actions sent to message brokers.
+const (
+	recordPublished = "published"
+	recordWithdrawn = "withdrawn"
+)
+
+// lifecycleBacklog is how many events may wait for a slow broker before
+// new ones are dropped.
+const lifecycleBacklog = 1024
+
+// lifecycleEvent tells home-automation systems and record hooks that a
+// record appeared or disappeared.
+type lifecycleEvent struct {
+	Action string    `json:"action"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Value  string    `json:"value"`
+	TTL    uint32    `json:"ttl"`
+	Record string    `json:"record"`
+	Time   time.Time `json:"time"`
+}
+
+// eventSink delivers encoded events to a broker.
+type eventSink interface {
+	send(payload []byte) error
+}
+
+// lifecycle queues record events for the configured brokers. It is nil
+// when none is configured.
+var lifecycle chan lifecycleEvent
+
+// startLifecycleEvents connects to the brokers given by the events flags
+// and starts forwarding record events to them.
+func startLifecycleEvents() error {
+	var sinks []eventSink
+	if url := conf.EventsNATSURL; url != "" {
+		conn, err := nats.Connect(url, nats.Name("external-mdns"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+		if err != nil {
+			return fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		sinks = append(sinks, &natsSink{conn: conn, subject: conf.EventsNATSSubject})
+		lg.Info("Publishing record events to NATS", zap.String("url", url), zap.String("subject", conf.EventsNATSSubject))
+	}
+	if url := conf.EventsMQTTURL; url != "" {
+		// Brokers disconnect a client when another connects with its ID,
+		// so every replica and agent needs its own.
+		clientID := "external-mdns-" + instanceName()
+		opts := mqtt.NewClientOptions().AddBroker(url).SetClientID(clientID).SetAutoReconnect(true).SetConnectRetry(true)
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			return fmt.Errorf("failed to connect to MQTT: %w", token.Error())
+		}
+		sinks = append(sinks, &mqttSink{client: client, topic: conf.EventsMQTTTopic})
+		lg.Info("Publishing record events to MQTT", zap.String("url", url), zap.String("topic", conf.EventsMQTTTopic),
+			zap.String("client_id", clientID))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	lifecycle = make(chan lifecycleEvent, lifecycleBacklog)
+	go func() {
+		for event := range lifecycle {
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			for _, sink := range sinks {
+				if err := sink.send(payload); err != nil {
+					lg.Warn("Failed to send record event", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// sendRecordEvent queues an event for record, dropping it if the brokers
+// have fallen too far behind.
+func sendRecordEvent(action, record string) {
+	if lifecycle == nil {
+		return
+	}
+	event, ok := newLifecycleEvent(action, record)
+	if !ok {
+		return
+	}
+	select {
+	case lifecycle <- event:
+	default:
+		lg.Warn("Record event backlog full, dropping event", zap.String("record", record))
+	}
+}
+
+// newLifecycleEvent describes action on record, reporting false if the
+// record does not parse.
+func newLifecycleEvent(action, record string) (lifecycleEvent, bool) {
+	rr, err := dns.NewRR(record)
+	if err != nil || rr == nil {
+		return lifecycleEvent{}, false
+	}
+	return lifecycleEvent{
+		Action: action,
+		Name:   strings.TrimSuffix(rr.Header().Name, "."),
+		Type:   dns.TypeToString[rr.Header().Rrtype],
+		Value:  strings.TrimPrefix(rr.String(), rr.Header().String()),
+		TTL:    rr.Header().Ttl,
+		Record: rr.String(),
+		Time:   time.Now(),
+	}, true
+}
+
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (s *natsSink) send(payload []byte) error {
+	return s.conn.Publish(s.subject, payload)
+}
+
+type mqttSink struct {
+	client mqtt.Client
+	topic  string
+}
+
+func (s *mqttSink) send(payload []byte) error {
+	token := s.client.Publish(s.topic, 1, false, payload)
+	token.WaitTimeout(10 * time.Second)
+	return token.Error()
+}
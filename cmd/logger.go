@@ -3,16 +3,18 @@ package cmd
 import (
 	"os"
 
-	"github.com/grumpylabs/external-mdns/cmd/config"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// logDestination is where logs are written, standard error for commands
+// whose output goes to standard output.
+var logDestination = os.Stdout
+
 func NewLogger() (*zap.Logger, error) {
 	var logLevel zapcore.Level = zapcore.InfoLevel
 
-	if viper.GetBool(config.Debug) {
+	if conf.Debug {
 		logLevel = zapcore.DebugLevel
 	}
 
@@ -22,7 +24,7 @@ func NewLogger() (*zap.Logger, error) {
 
 	encoder := zapcore.NewJSONEncoder(encoderConfig)
 
-	logOutput := zapcore.Lock(os.Stdout)
+	logOutput := zapcore.Lock(logDestination)
 	core := zapcore.NewCore(encoder, logOutput, logLevel)
 
 	logger := zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
@@ -24,7 +24,11 @@ import (
 	"log"
 
 	"net"
+	"slices"
+	"sort"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/grumpylabs/external-mdns/cmd/config"
 	"github.com/grumpylabs/external-mdns/cmd/mdns"
@@ -35,8 +39,14 @@ import (
 
 	"github.com/spf13/viper"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
@@ -55,15 +65,98 @@ func init() {
 	svcCmd.Flags().Bool(config.Debug, false, "Enable debug logging")
 	svcCmd.Flags().String(config.KubeConfig, "", "(optional) Absolute path to the kubeconfig file")
 	svcCmd.Flags().String(config.Master, "", "URL to Kubernetes master")
-	svcCmd.Flags().String(config.Namespace, "", "Limit sources of endpoints to a specific namespace")
+	svcCmd.Flags().String(config.KubeConfigSecret, "", "Load the kubeconfig of the cluster to watch from this Secret, given as namespace/name")
+	svcCmd.Flags().String(config.KubeConfigSecretKey, "kubeconfig", "Key of the kubeconfig in --kubeconfig-secret")
+	svcCmd.Flags().String(config.KubeContext, "", "Kubeconfig context to use (default the current context)")
+	svcCmd.Flags().String(config.ImpersonateUser, "", "User to impersonate for Kubernetes API requests")
+	svcCmd.Flags().StringSlice(config.ImpersonateGroups, nil, "Group to impersonate for Kubernetes API requests, may be repeated")
+	svcCmd.Flags().Float64(config.KubeAPIQPS, 5, "Maximum queries per second to the Kubernetes API server")
+	svcCmd.Flags().Int(config.KubeAPIBurst, 10, "Maximum burst of queries to the Kubernetes API server")
+	svcCmd.Flags().Bool(config.CheckPermissions, true, "Check at startup that the service account may list and watch what each source needs, and disable the sources it may not")
+	svcCmd.Flags().StringSlice(config.Namespace, nil, "Only watch these namespaces, each with its own namespaced informers so a Role in each is enough (default all namespaces)")
+	svcCmd.Flags().String(config.RestoreSnapshot, "", "Zone snapshot, as saved from /api/v1/zone/snapshot, to answer from until the sources have synced")
+	svcCmd.Flags().Bool(config.GoodbyeFinalizer, false, "Hold published services and ingresses back from deletion until goodbyes for their records are sent")
 	svcCmd.Flags().Bool(config.PublishInternalServices, false, "Publish ClusterIP services")
+	svcCmd.Flags().Bool(config.RequireReadyEndpoints, false, "Only publish services, and ingresses routing to them, while they have at least one ready endpoint")
+	svcCmd.Flags().Bool(config.ResolveExternalNames, false, "Publish ExternalName services with the addresses their target resolves to")
+	svcCmd.Flags().String(config.Filter, "", "CEL expression deciding which Services and Ingresses are published")
+	svcCmd.Flags().String(config.ServiceFieldSelector, "", "Only watch services matching this field selector, e.g. spec.type=LoadBalancer")
+	svcCmd.Flags().String(config.IngressFieldSelector, "", "Only watch ingresses matching this field selector")
+	svcCmd.Flags().String(config.IngressControllerService, "", "Service of the ingress controller as namespace/name; ingresses still showing its previous load balancer IPs are published with the current ones")
+	svcCmd.Flags().String(config.IngressControllerSelector, "", "Label selector of the ingress controller pods whose node IPs are published for ingresses without a status address")
+	svcCmd.Flags().Duration(config.ResyncPeriod, 5*time.Minute, "Interval at which informers resync their cache")
+	svcCmd.Flags().Int(config.CollectOrphansAfter, 3, "Withdraw records whose object has been missing from the source cache for this many resync periods without a delete event (0 to disable)")
+	svcCmd.Flags().Duration(config.StaleZoneAfter, 5*time.Minute, "Report the zone as stale after the API server has been unreachable this long (0 to disable)")
+	svcCmd.Flags().String(config.StalePolicy, stalePolicyKeep, "While the zone is stale: keep answering from the last known zone, lower-ttl to cap TTLs at --stale-ttl, or withdraw to stop answering")
+	svcCmd.Flags().Int(config.StaleTTL, 10, "Record TTL in seconds while the zone is stale under --stale-policy=lower-ttl")
+	svcCmd.Flags().Duration(config.CanaryWindow, 0, "Publish the records of objects created while running with --canary-ttl and a canary TXT record for this long, and until their addresses accept connections (0 to disable)")
+	svcCmd.Flags().Int(config.CanaryTTL, 10, "Record TTL in seconds of resources in their --canary-window")
+	svcCmd.Flags().String(config.Probe, "", "Probe the published addresses of resources: tcp to connect to one of their ports, icmp to ping them (empty to disable)")
+	svcCmd.Flags().Duration(config.ProbeInterval, 30*time.Second, "Interval between reachability probes of published addresses")
+	svcCmd.Flags().Int(config.ProbeFailures, 3, "Consecutive failed probes after which an address is unreachable")
+	svcCmd.Flags().String(config.ProbeAction, probeActionWithdraw, "What to do with unreachable addresses: withdraw their records, or degrade to keep them and publish a TXT record naming them")
+	svcCmd.Flags().String(config.ZoneMemoryBudget, "", "Estimated memory the published records may take, such as 64Mi; lowest priority resources are evicted beyond it (empty for no limit)")
+	svcCmd.Flags().StringSlice(config.PriorityClass, defaultPriorityClasses, "Priority classes as name=value; resources pick one with the priority-class annotation and a higher class outranks any priority")
 	svcCmd.Flags().Bool(config.Test, false, "Run in testing mode (no connection to Kubernetes)")
+	svcCmd.Flags().String(config.TestFixture, "", "Run against fake Services and Ingresses from this YAML file instead of a cluster")
 	svcCmd.Flags().Int(config.RecordTTL, 120, "DNS record TTL")
+	svcCmd.Flags().Int(config.TTLJitter, 0, "Spread record TTLs by up to this percentage either side of --record-ttl (0-50)")
 	svcCmd.Flags().Bool(config.WithoutNamespace, false, "Publish shorter mDNS names without namespace")
-	svcCmd.Flags().StringSlice(config.Source, []string{"service"}, "Resource types to query (options: service, ingress)")
+	svcCmd.Flags().StringSlice(config.Source, []string{"service"}, "Resource types to query (options: service, ingress, crd, gateway, plugin:<path-or-url>, hostsfile:<path>, zonefile:<path>)")
+	svcCmd.Flags().Bool(config.HostsFileWatch, true, "Re-read hostsfile sources when they change")
+	svcCmd.Flags().Bool(config.ZoneFileWatch, true, "Re-read zonefile sources when they change")
 	svcCmd.Flags().Bool(config.ExposeIPv4, true, "Publish IPv4 addresses")
 	svcCmd.Flags().Bool(config.ExposeIPv6, false, "Publish IPv6 addresses")
-	svcCmd.Flags().String(config.DefaultNamespace, "default", "Default namespace to use if not specified in the resource")
+	svcCmd.Flags().Int(config.MaxIPsPerName, 0, "Maximum addresses published per name (0 for no limit)")
+	svcCmd.Flags().String(config.IPSelection, ipSelectionFirst, "Which addresses to publish when over the limit (first, random, all)")
+	svcCmd.Flags().StringSlice(config.DefaultNamespace, []string{"default"}, "Namespaces whose resources are also published with short <name>.local names")
+	svcCmd.Flags().String(config.ShortNameConflict, shortNameFirstWins, "How to resolve resources claiming the same <name>.local (first-wins, priority, refuse, all)")
+	svcCmd.Flags().String(config.PTRConflict, ptrConflictAll, "Which resources publish PTR records for an address they share (all, first-wins, annotation, suppress)")
+	svcCmd.Flags().Bool(config.DNSSDPorts, false, "Advertise DNS-SD instances for well-known Service ports, such as _https._tcp for 443")
+	svcCmd.Flags().StringSlice(config.DNSSDAppProtocol, nil, "Map a port appProtocol to a DNS-SD service type for --dns-sd-ports, as appProtocol=_service._tcp")
+	svcCmd.Flags().String(config.RecordStrategy, strategyDefault, "Naming scheme for records: default, windows-compat (no subdomains), dns-sd-full (DNS-SD instances for every name) or flat-names (<name>.local only)")
+	svcCmd.Flags().Bool(config.HyphenatedNames, true, "Also publish <name>-<namespace>.local for clients without subdomain support")
+	svcCmd.Flags().Bool(config.NodeLocal, false, "Only publish addresses of this node, for running as a hostNetwork DaemonSet")
+	svcCmd.Flags().Bool(config.NodeLocalFallback, false, "In node-local mode, publish resources without an address on this node with all of their addresses instead of skipping them")
+	svcCmd.Flags().String(config.NodeName, "", "Name of this node in node-local mode (default $NODE_NAME)")
+	svcCmd.Flags().String(config.ZoneConfigMap, "", "Write the published zone into this ConfigMap, given as namespace/name")
+	svcCmd.Flags().Duration(config.ZoneConfigMapInterval, 10*time.Second, "How often to check the zone ConfigMap for changes")
+	svcCmd.Flags().String(config.EventsNATSURL, "", "NATS server to publish record events to, e.g. nats://nats:4222")
+	svcCmd.Flags().String(config.EventsNATSSubject, "external-mdns.records", "NATS subject for record events")
+	svcCmd.Flags().String(config.EventsMQTTURL, "", "MQTT broker to publish record events to, e.g. tcp://mosquitto:1883")
+	svcCmd.Flags().String(config.EventsMQTTTopic, "external-mdns/records", "MQTT topic for record events")
+	svcCmd.Flags().StringArray(config.HookPrePublish, nil, "Command or webhook URL run for each record before it is published, with the record as JSON")
+	svcCmd.Flags().StringArray(config.HookPostUnpublish, nil, "Command or webhook URL run for each record after it is withdrawn, with the record as JSON")
+	svcCmd.Flags().Duration(config.HookTimeout, 5*time.Second, "How long the record hooks run for a batch of records may take in all")
+	svcCmd.Flags().String(config.IPAMURL, "", "NetBox or phpIPAM URL to check addresses against before publishing them")
+	svcCmd.Flags().String(config.IPAMType, ipamNetBox, "IPAM system at --ipam-url (netbox, phpipam)")
+	svcCmd.Flags().String(config.IPAMToken, "", "API token for the IPAM system (or $EXTERNAL_MDNS_IPAM_TOKEN)")
+	svcCmd.Flags().String(config.IPAMPolicy, ipamPolicyWarn, "What to do with addresses not registered in IPAM (warn, refuse)")
+	svcCmd.Flags().Duration(config.IPAMCacheTTL, 5*time.Minute, "How long IPAM lookups are cached")
+	svcCmd.Flags().Bool(config.AdvertiseSelf, false, "Publish this host's name, --self-alias and a DNS-SD instance for the admin API")
+	svcCmd.Flags().String(config.SelfAlias, "", "Extra name to publish for this host with --advertise-self, e.g. mdns-gw")
+	svcCmd.Flags().StringSlice(config.SelfAddresses, nil, "Addresses to publish for this host (default the addresses of its interfaces)")
+	svcCmd.Flags().String(config.AdvertiseAPIServer, "", "Publish this name, e.g. kubernetes or prod.k8s, for the Kubernetes API server")
+	svcCmd.Flags().StringSlice(config.APIServerAddresses, nil, "Addresses to publish for the API server (default those of the default/kubernetes Service endpoints)")
+	svcCmd.Flags().Bool(config.SSDP, false, "Also send SSDP announcements for services with the ssdp-location annotation")
+	svcCmd.Flags().Bool(config.WSD, false, "Answer WS-Discovery for services with the wsd-xaddrs annotation")
+	svcCmd.Flags().String(config.AdminListen, "", "Address to serve metrics, health checks and the admin API on, e.g. :9090")
+	svcCmd.Flags().String(config.AdminTokenFile, "", "File holding the bearer token required by the admin API endpoints that change the zone, which are disabled without one")
+	svcCmd.Flags().String(config.TracingEndpoint, "", "OTLP/HTTP endpoint to export traces of Kubernetes events to their publication to, e.g. http://otel-collector:4318 (empty to disable)")
+	svcCmd.Flags().Bool(config.ServeMDNS, true, "Answer mDNS queries locally (disable when only agents face the LAN)")
+	svcCmd.Flags().String(config.AgentListen, "", "Address to stream the zone to agents on, e.g. :8443 (disabled when empty)")
+	svcCmd.Flags().String(config.AgentTokenFile, "", "File holding the bearer token agents must present")
+	svcCmd.Flags().String(config.AgentTLSCert, "", "TLS certificate for the agent stream")
+	svcCmd.Flags().String(config.AgentTLSKey, "", "TLS private key for the agent stream")
+	addResponderFlags(svcCmd.Flags())
+
+	// Soak testing, for validating the daemon before large deployments.
+	svcCmd.Flags().Int(config.SoakResources, 0, "Run against this many synthetic services instead of a cluster")
+	svcCmd.Flags().Float64(config.SoakChurn, 10, "Synthetic service creations, updates and deletions per second")
+	svcCmd.Flags().Duration(config.SoakReportInterval, 10*time.Second, "Interval between soak latency and memory reports")
+	for _, flag := range []string{config.SoakResources, config.SoakChurn, config.SoakReportInterval} {
+		svcCmd.Flags().MarkHidden(flag)
+	}
 
 	// Bind Cobra flags to Viper
 	viper.BindPFlags(svcCmd.Flags())
@@ -77,7 +170,7 @@ func (s *k8sSource) String() string {
 
 func (s *k8sSource) Set(value string) error {
 	switch value {
-	case "ingress", "service":
+	case "ingress", "service", "crd", "gateway":
 		*s = append(*s, value)
 	}
 	return nil
@@ -115,80 +208,318 @@ func reverseAddress(addr string) (arpa string, err error) {
 	return string(buf), nil
 }
 
+// constructRecords returns the records of r: address records for every
+// name it is published under, the PTRs derived from them, its DNS-SD
+// services and any records it carries as they are.
 func constructRecords(r resource.Resource) []string {
-	var records []string
+	forward := forwardNames(r)
+	records := append(addressRecords(r, forward), derivedPTRs(r, forward)...)
+	records = append(records, canaries.markers(r, forward)...)
+	records = append(records, prober.markers(r, forward)...)
+
+	targets := slices.DeleteFunc(strategyFor(r).serviceTargets(r), isWildcardName)
+	records = append(records, dnssdRecords(r, targets)...)
+	return append(records, r.Records...)
+}
 
-	for _, resourceIP := range r.IPs {
-		ip := net.ParseIP(resourceIP)
-		if ip == nil {
-			continue
+// wantsShortNames reports whether r is published as <name>.local under its
+// strategy.
+func wantsShortNames(r resource.Resource) bool {
+	return strategyFor(r).shortNames(r)
+}
+
+// shortNameRecords returns the <name>.local records, and their PTRs unless
+// r has a ptr-name, for every address of r, with the canary and degraded
+// markers that apply.
+func shortNameRecords(r resource.Resource, name string) []string {
+	forward := shortForwardNames(r, name)
+	records := append(addressRecords(r, forward), canaries.markers(r, forward)...)
+	records = append(records, prober.markers(r, forward)...)
+	if r.PTRName == "" {
+		records = append(records, derivedPTRs(r, forward)...)
+	}
+	return records
+}
+
+// wantsRecordType reports whether r publishes address records of type t,
+// which its record-types annotation can narrow down within the exposed
+// address families.
+func wantsRecordType(r resource.Resource, t string) bool {
+	return r.RecordTypes == nil || slices.Contains(r.RecordTypes, t)
+}
+
+// wantsPTR reports whether r publishes PTR records for its addresses with
+// records of type addressType. Listing only PTR in the record-types
+// annotation publishes them for every address, otherwise only for the
+// address types listed alongside. Wildcard names get no PTR records unless
+// r has a ptr-name.
+func wantsPTR(r resource.Resource, addressType string) bool {
+	if !wantsRecordType(r, "PTR") || r.PTRName == "" && slices.ContainsFunc(r.Names, isWildcardName) {
+		return false
+	}
+	return r.RecordTypes == nil || wantsRecordType(r, addressType) || len(r.RecordTypes) == 1
+}
+
+// isWildcardName reports whether name, such as *.preview, stands for every
+// name below it, see --answer-wildcards.
+func isWildcardName(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// recordTypeFor returns the address record type for ip, or an empty string
+// if that address family is not exposed.
+func recordTypeFor(ip net.IP) string {
+	if ip.To4() != nil {
+		if !conf.ExposeIPv4 {
+			return ""
 		}
+		return "A"
+	}
+	if !conf.ExposeIPv6 {
+		return ""
+	}
+	return "AAAA"
+}
 
-		reverseIP, _ := reverseAddress(resourceIP)
+// startCRDSources starts a watcher for each resource configured under the
+// crd key of the configuration file.
+func startCRDSources(notifyMdns chan<- resource.Resource, stopper chan struct{}) {
+	var crds []source.CRDConfig
+	if err := decodeSection(config.CRDSources, &crds); err != nil {
+		lg.Fatal("Invalid crd source configuration:", zap.Error(err))
+	}
+	if len(crds) == 0 {
+		lg.Fatal("The crd source is enabled but no resources are configured under the crd key")
+	}
 
-		var recordType string
-		if ip.To4() != nil {
-			if !viper.GetBool(config.ExposeIPv4) {
-				continue
+	dynamicClient, err := newDynamicClient()
+	if err != nil {
+		lg.Fatal("Failed to create dynamic Kubernetes client:", zap.Error(err))
+	}
+	for _, namespace := range watchedNamespaces() {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, conf.ResyncPeriod, namespace, nil)
+		for _, crd := range crds {
+			crdController, err := source.NewCRDWatcher(lg, factory, namespace, crd, notifyMdns)
+			if err != nil {
+				lg.Fatal("Failed to create crd source:", zap.Error(err), zap.String("resource", crd.GroupVersionResource().String()))
 			}
-			recordType = "A"
-		} else {
-			if !viper.GetBool(config.ExposeIPv6) {
+			go crdController.Run(stopper)
+		}
+	}
+}
+
+// controllerPodInformer returns an informer watching the ingress controller
+// pods selected with --ingress-controller-selector in every namespace, or nil
+// if no selector was given.
+func controllerPodInformer(client kubernetes.Interface) cache.SharedIndexInformer {
+	selector := conf.IngressControllerSelector
+	if selector == "" {
+		return nil
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, conf.ResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector
+		}),
+		informers.WithTransform(source.StripObject))
+	return factory.Core().V1().Pods().Informer()
+}
+
+// controllerServiceInformer returns an informer watching the Service given
+// with --ingress-controller-service, or nil if none was given.
+func controllerServiceInformer(client kubernetes.Interface) cache.SharedIndexInformer {
+	key := conf.IngressControllerService
+	if key == "" {
+		return nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || namespace == "" || name == "" {
+		lg.Fatal("Invalid configuration:", zap.Error(fmt.Errorf("--%s must be namespace/name, got %q", config.IngressControllerService, key)))
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, conf.ResyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+		informers.WithTransform(source.StripObject))
+	return factory.Core().V1().Services().Informer()
+}
+
+// startGatewaySource starts a watcher for the Gateway API routes served by
+// the cluster. Route kinds whose resources are not installed, or with
+// --check-permissions that client may not list and watch, are skipped.
+func startGatewaySource(client kubernetes.Interface, notifyMdns chan<- resource.Resource, stopper chan struct{}) {
+	dynamicClient, err := newDynamicClient()
+	if err != nil {
+		lg.Fatal("Failed to create dynamic Kubernetes client:", zap.Error(err))
+	}
+	gateways, ok, err := servedResource(source.GatewayGroup, "gateways")
+	if err != nil {
+		lg.Fatal("Failed to discover the Gateway API:", zap.Error(err))
+	}
+	if !ok {
+		lg.Fatal("The gateway source is enabled but the Gateway API is not installed")
+	}
+	routes := make(map[string]schema.GroupVersionResource)
+	for sourceType, name := range source.GatewayRouteKinds {
+		gvr, ok, err := servedResource(source.GatewayGroup, name)
+		if err != nil {
+			lg.Fatal("Failed to discover the Gateway API:", zap.Error(err))
+		}
+		if !ok {
+			lg.Info("Gateway API route kind not installed, skipping", zap.String("resource", name))
+			continue
+		}
+		if conf.CheckPermissions {
+			var resources []watchedResource
+			for _, namespace := range watchedNamespaces() {
+				resources = append(resources, watchedResource{group: source.GatewayGroup, resource: name, namespace: namespace})
+			}
+			if denied, ok := forbiddenResource(client, resources); ok {
+				lg.Warn("Skipping Gateway API route kind, the service account may not list and watch it", zap.Stringer("resource", denied))
 				continue
 			}
-			recordType = "AAAA"
 		}
+		routes[sourceType] = gvr
+	}
 
-		// Publish records resources as <name>.<namespace>.local and as <name>-<namespace>.local
-		// Because Windows does not support subdomains resolution via mDNS and uses regular DNS query instead.
-		// Ensure corresponding PTR records map to this hostname
-		// To maintain backwards compatibility, without-namespace annontation still generates these records
-		for _, name := range r.Names {
-			records = append(records, fmt.Sprintf("%s.%s.local. %d IN %s %s", name, r.Namespace, viper.GetInt(config.RecordTTL), recordType, ip))
-			records = append(records, fmt.Sprintf("%s-%s.local. %d IN %s %s", name, r.Namespace, viper.GetInt(config.RecordTTL), recordType, ip))
-			if reverseIP != "" {
-				records = append(records, fmt.Sprintf("%s %d IN PTR %s.%s.local.", reverseIP, viper.GetInt(config.RecordTTL), name, r.Namespace))
-				records = append(records, fmt.Sprintf("%s %d IN PTR %s-%s.local.", reverseIP, viper.GetInt(config.RecordTTL), name, r.Namespace))
-			}
+	for _, namespace := range watchedNamespaces() {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, conf.ResyncPeriod, namespace, nil)
+		gatewayController, err := source.NewGatewayWatcher(lg, factory, namespace, gateways, routes, notifyMdns)
+		if err != nil {
+			lg.Fatal("Failed to create gateway source:", zap.Error(err))
 		}
+		go gatewayController.Run(stopper)
+	}
+}
 
-		// Publish services without the name in the namespace if any of the following
-		// criteria is satisfied:
-		// 1. The Service exists in the default namespace
-		// 2. Service names exposed with annotation and with additional without-namespace annotation set to true
-		// 3. The -without-namespace flag is equal to true
-		// 4. The record to be published is from an Ingress with a defined hostname
-		if r.Namespace == viper.GetString(config.DefaultNamespace) || r.WithoutNamespace || viper.GetBool(config.WithoutNamespace) || r.SourceType == "ingress" {
-			for _, name := range r.Names {
-				records = append(records, fmt.Sprintf("%s.local. %d IN %s %s", name, viper.GetInt(config.RecordTTL), recordType, ip))
-				if reverseIP != "" {
-					records = append(records, fmt.Sprintf("%s %d IN PTR %s.local.", reverseIP, viper.GetInt(config.RecordTTL), name))
-				}
+// isDefaultNamespace reports whether namespace is one of the namespaces
+// given with --default-namespace.
+func isDefaultNamespace(namespace string) bool {
+	return slices.Contains(namespaceList(conf.DefaultNamespace), namespace)
+}
+
+// watchedNamespaces returns the namespaces given with --namespace, or a
+// single empty namespace standing for all of them.
+func watchedNamespaces() []string {
+	if namespaces := namespaceList(conf.Namespace); len(namespaces) > 0 {
+		return namespaces
+	}
+	return []string{metav1.NamespaceAll}
+}
+
+// namespaceList returns the namespaces of the entries of a list flag.
+// Entries may be comma or space separated so the list can also be supplied
+// through the environment.
+func namespaceList(entries []string) []string {
+	var namespaces []string
+	for _, entry := range entries {
+		for _, ns := range strings.FieldsFunc(entry, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			if !slices.Contains(namespaces, ns) {
+				namespaces = append(namespaces, ns)
 			}
 		}
 	}
+	return namespaces
+}
 
-	return records
+// recordOwners holds the live resources publishing each record, by
+// liveKey. Resources can publish identical records, such as Services sharing
+// a LoadBalancer IP under the same short name, so a record is only
+// withdrawn along with its last owner. It is only used on the main loop.
+var recordOwners = make(map[string]map[string]struct{})
+
+// pendingRecords holds the records published, when true, or withdrawn since
+// the last flushRecords. It is only used on the main loop.
+var pendingRecords = make(map[string]bool)
+
+// queueRecord notes rr for the next flushRecords. A record published and
+// withdrawn again in the meantime, or the other way round, never reaches
+// the zone.
+func queueRecord(rr string, publish bool) {
+	if queued, ok := pendingRecords[rr]; ok && queued != publish {
+		delete(pendingRecords, rr)
+		return
+	}
+	pendingRecords[rr] = publish
 }
 
-func publishRecord(rr string) {
-	if err := mdns.Publish(rr); err != nil {
-		lg.Fatal("Failed to publish record ", zap.String("record", rr), zap.Error(err))
+// notifyBatchDelay is how long records changed by source notifications are
+// held back for the notifications following them. Sources send an update as
+// a withdrawal of the old object and a publication of the new one, and
+// flushing them together cancels out the records both have instead of
+// saying goodbye to them only to announce them again.
+const notifyBatchDelay = 50 * time.Millisecond
+
+// flushRecords applies the queued records to the zone in one step, so the
+// records changed by a pass of the main loop are swapped and announced
+// together rather than one by one.
+func flushRecords() {
+	defer observePublished()
+	if len(pendingRecords) == 0 {
+		return
+	}
+	var added, removed []string
+	for rr, publish := range pendingRecords {
+		if publish {
+			added = append(added, rr)
+		} else {
+			removed = append(removed, rr)
+		}
+	}
+	clear(pendingRecords)
+	sort.Strings(added)
+	sort.Strings(removed)
+	runHooks(hookPrePublish, added)
+	if err := mdns.Apply(added, removed); err != nil {
+		lg.Fatal("Failed to apply records ", zap.Int("added", len(added)), zap.Int("removed", len(removed)), zap.Error(err))
+	}
+	go runHooks(hookPostUnpublish, removed)
+	finalizers.release()
+}
+
+// publishRecord publishes rr on behalf of owner, unless another owner has
+// already published it.
+func publishRecord(owner, rr string) {
+	owners := recordOwners[rr]
+	if owners == nil {
+		owners = make(map[string]struct{})
+		recordOwners[rr] = owners
+	}
+	shared := len(owners) > 0
+	owners[owner] = struct{}{}
+	if shared {
+		return
+	}
+
+	queueRecord(rr, true)
+	if feed.add(rr) {
+		budget.used += recordSize(rr)
+		sendRecordEvent(recordPublished, rr)
 	}
 }
 
-func unpublishRecord(rr string) {
-	if err := mdns.UnPublish(rr); err != nil {
-		lg.Fatal("Failed to unpublish record ", zap.String("record", rr), zap.Error(err))
+// unpublishRecord withdraws rr on behalf of owner, unless other owners still
+// publish it.
+func unpublishRecord(owner, rr string) {
+	if owners := recordOwners[rr]; owners != nil {
+		delete(owners, owner)
+		if len(owners) > 0 {
+			lg.Info("Keeping DNS record still published for other resources:", zap.String("record", rr), zap.Int("owners", len(owners)))
+			return
+		}
+		delete(recordOwners, rr)
+	}
+
+	queueRecord(rr, false)
+	if feed.del(rr) {
+		budget.used -= recordSize(rr)
+		sendRecordEvent(recordWithdrawn, rr)
 	}
 }
 
 // Run the service
 func run(cmd *cobra.Command, args []string) {
-	var (
-		lg  *zap.Logger
-		err error
-	)
+	var err error
 
 	if lg, err = NewLogger(); err != nil {
 		log.Fatalf("Failed to create logger: %v", err)
@@ -198,20 +529,154 @@ func run(cmd *cobra.Command, args []string) {
 	lg.Debug("Starting external-mDNS with configuration:",
 		zap.Any("settings", viper.AllSettings()))
 
-	if viper.GetBool("test") {
-		publishRecord("router.local. 60 IN A 192.168.1.254")
-		publishRecord("254.1.168.192.in-addr.arpa. 60 IN PTR router.local.")
+	if shortNames, err = newShortNameRegistry(conf.ShortNameConflict); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if reversePTRs, err = newPTRRegistry(conf.PTRConflict); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := validateIPSelection(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := validateTTLJitter(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := validateRecordStrategy(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := validateStalePolicy(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := configureBudget(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := configureCanaries(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := configureProber(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	shutdownTracing, err := configureTracing()
+	if err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	defer shutdownTracing()
+	if err := configurePriorityClasses(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	ttls = configuredTTLs()
+	if rewriteRules, err = loadRewriteRules(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+
+	startAdminServer()
+	if err := configureIPAM(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := configureHooks(); err != nil {
+		lg.Fatal("Invalid configuration:", zap.Error(err))
+	}
+	if err := startLifecycleEvents(); err != nil {
+		lg.Fatal("Failed to start record events:", zap.Error(err))
+	}
+	if conf.SSDP {
+		if ssdpAnnouncer, err = startSSDP(); err != nil {
+			lg.Fatal("Failed to start SSDP announcements:", zap.Error(err))
+		}
+	}
+	if conf.WSD {
+		if wsdResponder, err = startWSD(); err != nil {
+			lg.Fatal("Failed to start WS-Discovery responder:", zap.Error(err))
+		}
+	}
+	// Outside test mode, queries are only answered once the sources have
+	// synced, see warmCaches, unless a snapshot of the whole zone is
+	// restored to answer from meanwhile.
+	var snapshot []string
+	if path := conf.RestoreSnapshot; path != "" {
+		if snapshot, err = readSnapshot(path); err != nil {
+			lg.Fatal("Failed to restore the zone snapshot:", zap.Error(err))
+		}
+	}
+	if (!conf.Test || conf.TestFixture != "") && snapshot == nil {
+		mdns.Hold()
+	}
+	if conf.ServeMDNS {
+		startResponder()
+	}
+	if snapshot != nil {
+		lg.Info("Answering from the restored zone snapshot until the sources have synced", zap.Int("records", len(snapshot)))
+		restoreSnapshot(snapshot, false)
+		flushRecords()
+	}
+	if conf.AgentListen != "" {
+		if err := serveAgents(); err != nil {
+			lg.Fatal("Failed to serve agents:", zap.Error(err))
+		}
+	}
+
+	fixturePath := conf.TestFixture
+	if conf.Test && fixturePath == "" {
+		publishRecord("test", "router.local. 60 IN A 192.168.1.254")
+		publishRecord("test", "254.1.168.192.in-addr.arpa. 60 IN PTR router.local.")
+		flushRecords()
+		sdReady()
 		select {}
 	}
 
-	sources := viper.GetStringSlice("source")
+	sources := conf.Source
 	if len(sources) == 0 {
-		lg.Fatal("Error: No sources specified. Use --source=service or --source=ingress.")
+		lg.Fatal("Error: No sources specified. Use --source=service, --source=ingress, --source=crd, --source=plugin:<path-or-url>, --source=hostsfile:<path> or --source=zonefile:<path>.")
+	}
+	// Plugins, hosts files and zone files are the only sources that work
+	// without a cluster.
+	needsCluster := conf.NodeLocal || conf.ZoneConfigMap != "" ||
+		(conf.AdvertiseAPIServer != "" && len(conf.APIServerAddresses) == 0)
+	for _, src := range sources {
+		if !strings.HasPrefix(src, source.PluginPrefix) && !strings.HasPrefix(src, source.HostsFilePrefix) &&
+			!strings.HasPrefix(src, source.ZoneFilePrefix) {
+			needsCluster = true
+		}
 	}
 
-	k8sClient, err := newK8sClient()
-	if err != nil {
-		lg.Fatal("Failed to create Kubernetes client:", zap.Error(err))
+	var k8sClient kubernetes.Interface
+	var fixtureEvents []fixtureEvent
+	soakResources := conf.SoakResources
+	simulated := fixturePath != "" || soakResources > 0
+	if soakResources > 0 {
+		k8sClient = newFixtureClient(soakServices(soakResources))
+		lg.Info("Soak testing with synthetic services, no cluster connection",
+			zap.Int("services", soakResources), zap.Float64("churn", conf.SoakChurn))
+	} else if fixturePath != "" {
+		objects, events, err := loadFixture(fixturePath)
+		if err != nil {
+			lg.Fatal("Failed to load fixture:", zap.Error(err))
+		}
+		k8sClient, fixtureEvents = newFixtureClient(objects), events
+		lg.Info("Running against fixture, no cluster connection", zap.String("fixture", fixturePath),
+			zap.Int("objects", len(objects)), zap.Int("events", len(events)))
+	} else if needsCluster {
+		if k8sClient, err = newK8sClient(); err != nil {
+			lg.Fatal("Failed to create Kubernetes client:", zap.Error(err))
+		}
+	}
+	if k8sClient != nil && !simulated && conf.CheckPermissions {
+		if sources = permittedSources(k8sClient, sources); len(sources) == 0 {
+			lg.Fatal("The service account may not list and watch the resources of any source")
+		}
+	}
+	if k8sClient != nil && planDue == nil {
+		recorder = newEventRecorder(k8sClient)
+		go recordSkipEvents()
+	}
+
+	if conf.NodeLocal {
+		if nodeAddresses, err = loadNodeAddresses(k8sClient); err != nil {
+			lg.Fatal("Failed to enable node-local mode:", zap.Error(err))
+		}
+		lg.Info("Node-local mode, only publishing addresses of this node",
+			zap.String("node", nodeName()), zap.Strings("addresses", nodeAddressList()),
+			zap.Bool("fallback", conf.NodeLocalFallback))
 	}
 
 	notifyMdns := make(chan resource.Resource)
@@ -219,44 +684,298 @@ func run(cmd *cobra.Command, args []string) {
 	defer close(stopper)
 	defer runtime.HandleCrash()
 
-	factory := informers.NewSharedInformerFactory(k8sClient, time.Minute*5)
+	var filter *source.Filter
+	if expr := conf.Filter; expr != "" {
+		if filter, err = source.NewFilter(lg, expr); err != nil {
+			lg.Fatal("Invalid configuration:", zap.Error(err))
+		}
+	}
+
+	// Every watched namespace gets its own factory, so its informers list
+	// and watch within the namespace and a Role there is enough.
+	factories := make(map[string]informers.SharedInformerFactory)
+	for _, namespace := range watchedNamespaces() {
+		factories[namespace] = informers.NewSharedInformerFactoryWithOptions(k8sClient, conf.ResyncPeriod,
+			informers.WithNamespace(namespace),
+			informers.WithTransform(source.StripObject))
+	}
 
 	for _, src := range sources {
 		switch src {
 		case "ingress":
-			ingressController := source.NewIngressWatcher(lg, factory, viper.GetString(config.Namespace), notifyMdns)
-			go ingressController.Run(stopper)
+			opts := source.IngressOptions{
+				FieldSelector:      conf.IngressFieldSelector,
+				Filter:             filter,
+				ControllerSelector: conf.IngressControllerSelector,
+				ControllerPods:     controllerPodInformer(k8sClient),
+				ControllerService:  controllerServiceInformer(k8sClient),
+				RequireReady:       conf.RequireReadyEndpoints,
+			}
+			for namespace, factory := range factories {
+				ingressController := source.NewIngressWatcher(lg, factory, namespace, notifyMdns, opts)
+				go ingressController.Run(stopper)
+			}
 		case "service":
-			serviceController := source.NewServicesWatcher(
-				lg,
-				factory,
-				viper.GetString(config.Namespace),
-				notifyMdns,
-				viper.GetBool(config.PublishInternalServices),
-			)
-			go serviceController.Run(stopper)
+			appProtocols, err := source.AppProtocolTypes(conf.DNSSDAppProtocol)
+			if err != nil {
+				lg.Fatal("Invalid configuration:", zap.Error(fmt.Errorf("--%s: %w", config.DNSSDAppProtocol, err)))
+			}
+			opts := source.ServiceOptions{
+				PublishInternal:      conf.PublishInternalServices,
+				RequireReady:         conf.RequireReadyEndpoints,
+				ResolveExternalNames: conf.ResolveExternalNames,
+				NodeAddresses:        nodeAddressList(),
+				NodeName:             nodeName(),
+				FieldSelector:        conf.ServiceFieldSelector,
+				Filter:               filter,
+				DNSSD:                conf.DNSSDPorts,
+				AppProtocolTypes:     appProtocols,
+			}
+			for namespace, factory := range factories {
+				serviceController, err := source.NewServicesWatcher(lg, factory, namespace, notifyMdns, opts)
+				if err != nil {
+					lg.Fatal("Failed to create service source:", zap.Error(err))
+				}
+				go serviceController.Run(stopper)
+			}
+		case "crd":
+			if simulated {
+				lg.Fatal("The crd source cannot be used with --test-fixture or soak testing")
+			}
+			startCRDSources(notifyMdns, stopper)
+		case "gateway":
+			if simulated {
+				lg.Fatal("The gateway source cannot be used with --test-fixture or soak testing")
+			}
+			startGatewaySource(k8sClient, notifyMdns, stopper)
+		default:
+			if path, ok := strings.CutPrefix(src, source.HostsFilePrefix); ok && path != "" {
+				hostsController := source.NewHostsFileWatcher(lg, path, conf.HostsFileWatch, notifyMdns)
+				go hostsController.Run(stopper)
+				continue
+			}
+			if path, ok := strings.CutPrefix(src, source.ZoneFilePrefix); ok && path != "" {
+				zoneController := source.NewZoneFileWatcher(lg, path, conf.ZoneFileWatch, notifyMdns)
+				go zoneController.Run(stopper)
+				continue
+			}
+			target, ok := strings.CutPrefix(src, source.PluginPrefix)
+			if !ok || target == "" {
+				lg.Fatal("Unknown source", zap.String("source", src))
+			}
+			pluginController := source.NewPluginWatcher(lg, target, notifyMdns)
+			go pluginController.Run(stopper)
 		}
 	}
 
+	if soakResources > 0 {
+		go runSoak(k8sClient, soakResources, conf.SoakChurn, conf.SoakReportInterval)
+	} else if fixturePath != "" {
+		go playFixture(k8sClient, fixtureEvents)
+	}
+	go source.MonitorWatches(lg, conf.StaleZoneAfter, stopper)
+	configureFinalizers(k8sClient, conf.GoodbyeFinalizer)
+	previous, orphaned := previousZone(k8sClient)
+	go warmCaches(stopper, previous, snapshot != nil)
+	if conf.AdvertiseSelf {
+		self, err := selfResource()
+		if err != nil {
+			lg.Fatal("Failed to advertise this host:", zap.Error(err))
+		}
+		go func() { notifyMdns <- self }()
+	}
+	if name := conf.AdvertiseAPIServer; name != "" {
+		if addresses := conf.APIServerAddresses; len(addresses) > 0 {
+			apiServer := resource.Resource{
+				SourceType: "apiserver",
+				SourceName: "kubernetes",
+				Created:    time.Now(),
+				Action:     resource.Added,
+				IPs:        addresses,
+				Names:      []string{name},
+			}
+			go func() { notifyMdns <- apiServer }()
+		} else {
+			apiServerController := source.NewAPIServerWatcher(lg, k8sClient, name, conf.ResyncPeriod, notifyMdns)
+			go apiServerController.Run(stopper)
+		}
+	}
+	if ref := conf.ZoneConfigMap; ref != "" {
+		namespace, name, err := parseNamespacedName(ref)
+		if err != nil {
+			lg.Fatal("Invalid configuration:", zap.Error(err))
+		}
+		go writeZoneConfigMap(k8sClient, namespace, name, orphaned, conf.ZoneConfigMapInterval, stopper)
+	}
+	sdReady()
+
+	// live holds the latest version of every published resource, so its
+	// records can be rebuilt when the configuration changes.
+	live := make(map[string]resource.Resource)
+	reloads := watchConfigReloads()
+	orphans := newOrphanCollector(conf.CollectOrphansAfter, conf.ResyncPeriod)
+	// flushDue is set while records changed by notifications wait for
+	// the rest of their batch, see notifyBatchDelay.
+	var flushDue <-chan time.Time
+
 	for {
 		select {
+		case fresh := <-reloads:
+			applyConfigChange(live, fresh)
+		case <-orphans.ticks:
+			orphans.collect(live)
+		case stale := <-source.StaleChanges():
+			applyStalePolicy(live, stale)
+		case res := <-zoneRequests:
+			res <- recordSources(live)
+		case req := <-restoreRequests:
+			req.result <- restoreSnapshot(req.records, req.merge)
+		case <-canaries.ticks:
+			canaries.check(live)
+		case result := <-canaries.results:
+			canaries.settle(live, result)
+		case req := <-drainRequests:
+			req.result <- applyDrain(live, req)
+		case <-drain.due:
+			finishDrain()
+		case <-prober.ticks:
+			prober.start(live)
+		case results := <-prober.results:
+			prober.settle(live, results)
+		case dups := <-duplicateReports:
+			recordDuplicateEvents(live, dups)
+		case result := <-ipam.results:
+			ipam.settle(live, result)
 		case advertiseResource := <-notifyMdns:
-			for _, record := range constructRecords(advertiseResource) {
-				if record == "" {
-					continue
-				}
-				switch advertiseResource.Action {
-				case resource.Added:
-					lg.Info("Publishing new DNS record:", zap.String("record", record))
-					publishRecord(record)
-				case resource.Deleted:
-					lg.Info("Removing DNS record:", zap.String("record", record))
-					unpublishRecord(record)
-				}
+			advertiseResource.Names = rewriteNames(advertiseResource.Names)
+			admitResource(live, advertiseResource)
+			if flushDue == nil {
+				flushDue = time.After(notifyBatchDelay)
+			}
+			continue
+		case <-flushDue:
+		case <-planDue:
+			if err := printPlan(live); err != nil {
+				lg.Fatal("Failed to print the plan:", zap.Error(err))
 			}
+			return
 		case <-stopper:
 			lg.Info("Stopping external-mdns")
 			return
 		}
+		flushDue = nil
+		flushRecords()
+	}
+}
+
+// admitResource checks a notified resource against the address and budget
+// policies and applies it. It runs on the main loop.
+func admitResource(live map[string]resource.Resource, advertiseResource resource.Resource) {
+	advertiseResource, ok := checkNames(advertiseResource)
+	if !ok {
+		// Withdraw what the object published before, if anything.
+		if _, published := live[liveKey(advertiseResource)]; !published {
+			return
+		}
+		advertiseResource.Action = resource.Deleted
+	}
+	advertiseResource.IPs = ipam.check(advertiseResource)
+	advertiseResource = checkPTRName(advertiseResource)
+	checkPriorityClass(advertiseResource)
+	budget.forget(advertiseResource)
+	canaries.admit(advertiseResource)
+	applyResource(live, advertiseResource)
+	publishing = append(publishing, advertiseResource)
+	finalizers.track(advertiseResource)
+	budget.enforce(live)
+}
+
+// checkNames drops the names of r that cannot be published, such as a name
+// with a space given by a plugin, a CRD field or a rewrite rule, whose
+// records would not parse. ok is false when r had names and none are left,
+// or its namespace, part of its qualified names, is not valid either.
+func checkNames(r resource.Resource) (resource.Resource, bool) {
+	if r.Namespace != "" {
+		if err := source.CheckName(r.Namespace); err != nil {
+			lg.Warn("Ignoring resource with an invalid namespace", zap.String("resource", ownerKey(r)), zap.Error(err))
+			return r, false
+		}
+	}
+	var names []string
+	for _, name := range r.Names {
+		if err := source.CheckName(name); err != nil {
+			lg.Warn("Ignoring invalid name", zap.String("resource", ownerKey(r)), zap.Error(err))
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == len(r.Names) {
+		return r, true
+	}
+	r.Names = names
+	return r, len(names) > 0
+}
+
+// applyResource publishes or withdraws the records of advertiseResource
+// and keeps live up to date. It runs on the main loop.
+func applyResource(live map[string]resource.Resource, advertiseResource resource.Resource) {
+	switch advertiseResource.Action {
+	case resource.Added:
+		// An object deleted and created again under the same name while
+		// a delete event was missed leaves the records of the old one
+		// behind; withdraw them first.
+		if old, ok := live[liveKey(advertiseResource)]; ok && old.Object.UID != "" &&
+			advertiseResource.Object.UID != "" && old.Object.UID != advertiseResource.Object.UID {
+			lg.Info("Object was replaced, withdrawing the records of the old one",
+				zap.String("resource", liveKey(advertiseResource)), zap.String("oldUID", old.Object.UID))
+			old.Action = resource.Deleted
+			applyResource(live, old)
+		}
+		live[liveKey(advertiseResource)] = advertiseResource
+	case resource.Deleted:
+		// Withdraw what was published, which the resource may no longer
+		// describe, such as an object only seen again once terminating.
+		if published, ok := live[liveKey(advertiseResource)]; ok {
+			published.Action = resource.Deleted
+			advertiseResource = published
+		}
+		delete(live, liveKey(advertiseResource))
+	}
+
+	// Claims are taken before and released after the records are
+	// built, so the resource still owns its short names while they
+	// are withdrawn. The same goes for the PTR records of shared
+	// addresses.
+	var (
+		transitions    []shortNameTransition
+		ptrTransitions []ptrTransition
+	)
+	if advertiseResource.Action == resource.Added {
+		transitions = shortNames.claim(advertiseResource)
+		ptrTransitions = reversePTRs.claim(advertiseResource)
+	}
+	records := constructRecords(advertiseResource)
+	if advertiseResource.Action == resource.Deleted {
+		transitions = shortNames.release(advertiseResource)
+		ptrTransitions = reversePTRs.release(advertiseResource)
+	}
+
+	for _, record := range records {
+		if record == "" {
+			continue
+		}
+		switch advertiseResource.Action {
+		case resource.Added:
+			lg.Info("Publishing new DNS record:", zap.String("record", record))
+			rankRecord(record, advertiseResource)
+			publishRecord(liveKey(advertiseResource), record)
+		case resource.Deleted:
+			lg.Info("Removing DNS record:", zap.String("record", record))
+			unpublishRecord(liveKey(advertiseResource), record)
+		}
 	}
+	applyShortNameTransitions(transitions)
+	applyPTRTransitions(ptrTransitions)
+	announceSSDP(advertiseResource)
+	announceWSD(advertiseResource)
 }
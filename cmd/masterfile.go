@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/miekg/dns"
+)
+
+// masterFileTTL is the TTL of the synthetic SOA and NS records of a master
+// file.
+const masterFileTTL = 120
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/zone/file", func(w http.ResponseWriter, r *http.Request) {
+		zone, err := masterFile(mdns.Records(), r.URL.Query().Get("origin"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(zone))
+	})
+}
+
+// masterFile renders records in master file presentation format, sorted by
+// name, type and data so dumps can be diffed. With an origin, only the
+// records in that zone are kept, preceded by a $ORIGIN and a synthetic SOA
+// and NS so tools such as named-checkzone accept the file. The SOA serial
+// is derived from the records, changing only when they do.
+func masterFile(records []string, origin string) (string, error) {
+	if origin != "" {
+		if _, ok := dns.IsDomainName(origin); !ok {
+			return "", fmt.Errorf("invalid origin %q", origin)
+		}
+		origin = dns.CanonicalName(origin)
+	}
+
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			continue
+		}
+		if origin != "" && !dns.IsSubDomain(origin, dns.CanonicalName(rr.Header().Name)) {
+			continue
+		}
+		rr.Header().Class &^= 0x8000
+		rrs = append(rrs, rr)
+	}
+	sort.Slice(rrs, func(i, j int) bool {
+		a, b := rrs[i].Header(), rrs[j].Header()
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return rrs[i].String() < rrs[j].String()
+	})
+
+	var zone strings.Builder
+	zone.WriteString("; Records published by external-mdns\n")
+	if origin != "" {
+		serial := fnv.New32a()
+		for _, rr := range rrs {
+			serial.Write([]byte(rr.String()))
+		}
+		fmt.Fprintf(&zone, "$ORIGIN %s\n", origin)
+		fmt.Fprintf(&zone, "%s\t%d\tIN\tSOA\tlocalhost. hostmaster.localhost. %d 3600 600 86400 %d\n",
+			origin, masterFileTTL, serial.Sum32(), masterFileTTL)
+		fmt.Fprintf(&zone, "%s\t%d\tIN\tNS\tlocalhost.\n", origin, masterFileTTL)
+	}
+	for _, rr := range rrs {
+		zone.WriteString(rr.String())
+		zone.WriteString("\n")
+	}
+	return zone.String(), nil
+}
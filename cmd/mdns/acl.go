@@ -0,0 +1,62 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// acl decides which clients the responder is willing to answer.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// permits reports whether a query from ip should be answered. The deny list
+// always wins; an empty allow list permits everything not denied.
+func (a acl) permits(ip net.IP) bool {
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSubnets converts a list of CIDR strings into networks. A bare address
+// is treated as a single-host network.
+func ParseSubnets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid subnet %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,79 @@
+package mdns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLogSize is the number of recent queries kept for inspection.
+const queryLogSize = 200
+
+// QueryLog describes a query received by the responder.
+type QueryLog struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Questions []string  `json:"questions"`
+	Answers   int       `json:"answers"`
+	Unicast   bool      `json:"unicast"`
+}
+
+// activity records recent queries and when names were last multicast.
+type activity struct {
+	mu        sync.Mutex
+	queries   []QueryLog // ring buffer of the last queryLogSize queries
+	next      int
+	announced map[string]time.Time
+}
+
+var recent = &activity{announced: make(map[string]time.Time)}
+
+func (a *activity) query(q QueryLog) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.queries) < queryLogSize {
+		a.queries = append(a.queries, q)
+		return
+	}
+	a.queries[a.next] = q
+	a.next = (a.next + 1) % queryLogSize
+}
+
+// multicast notes that rrs were multicast to the link.
+func (a *activity) multicast(rrs []dns.RR) {
+	now := clock().Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, rr := range rrs {
+		a.announced[strings.ToLower(rr.Header().Name)] = now
+	}
+}
+
+// RecentQueries returns the most recent queries, oldest first.
+func RecentQueries() []QueryLog {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	queries := make([]QueryLog, 0, len(recent.queries))
+	queries = append(queries, recent.queries[recent.next:]...)
+	return append(queries, recent.queries[:recent.next]...)
+}
+
+// LastMulticast returns when records of name were last multicast, either
+// announced or in answer to a query, or the zero time.
+func LastMulticast(name string) time.Time {
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+	return recent.announced[strings.ToLower(dns.Fqdn(name))]
+}
+
+func questionStrings(qs []dns.Question) []string {
+	s := make([]string, 0, len(qs))
+	for _, q := range qs {
+		s = append(s, strings.TrimSuffix(q.Name, ".")+" "+dns.TypeToString[q.Qtype])
+	}
+	return s
+}
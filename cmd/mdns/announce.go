@@ -0,0 +1,235 @@
+package mdns
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxPacketSize is the largest mDNS message we send (RFC 6762 section 17).
+const maxPacketSize = 9000
+
+// packetLimits bounds the size of the messages we send.
+type packetLimits struct {
+	size    int // bytes per message
+	answers int // answers per message, 0 for no limit
+}
+
+// limits returns the packet limits of cfg.
+func (cfg Config) limits() packetLimits {
+	l := packetLimits{size: maxPacketSize, answers: cfg.MaxAnswers}
+	if cfg.MaxPacketSize > 0 {
+		l.size = cfg.MaxPacketSize
+	}
+	return l
+}
+
+// announce multicasts every record in the zone as unsolicited responses
+// with the cache-flush bit set, so caches on the link pick up the current
+// state (RFC 6762 section 8.3). Nothing is sent in respond-only mode.
+func (z *zone) announce() {
+	z.mu.Lock()
+	respondOnly := z.cfg.RespondOnly || z.held.Load()
+	limits := z.cfg.limits()
+	conns := append([]*connector(nil), z.conns...)
+	z.mu.Unlock()
+	if respondOnly {
+		return
+	}
+
+	records := z.snapshot()
+	if len(records) == 0 {
+		return
+	}
+
+	answers := make([]dns.RR, 0, len(records))
+	for _, e := range records {
+		answers = append(answers, e.RR)
+	}
+	multicast(conns, limits, answers)
+}
+
+// AnnounceZone announces the whole zone twice, one second apart, as a
+// responder starting up does (RFC 6762 section 8.3), so caches on the link
+// learn every record at once instead of as each is first queried. Nothing
+// is sent in respond-only mode.
+func AnnounceZone() {
+	local.announce()
+	clock().Sleep(time.Second)
+	local.announce()
+}
+
+// SayGoodbye multicasts goodbyes (RFC 6762 section 10.1) for every record
+// in the zone and holds it, so caches on the link drop the whole zone and
+// nothing is answered until Release. The records stay in the zone, for
+// AnnounceZone to bring back. No goodbyes are sent in respond-only mode.
+func SayGoodbye() {
+	local.mu.Lock()
+	respondOnly := local.cfg.RespondOnly || local.held.Load()
+	limits := local.cfg.limits()
+	conns := append([]*connector(nil), local.conns...)
+	local.mu.Unlock()
+	local.held.Store(true)
+	if respondOnly {
+		return
+	}
+
+	records := local.snapshot()
+	answers := make([]dns.RR, 0, len(records))
+	for _, e := range records {
+		goodbye := dns.Copy(e.RR)
+		goodbye.Header().Ttl = 0
+		answers = append(answers, goodbye)
+	}
+	if len(answers) > 0 {
+		multicast(conns, limits, answers)
+	}
+}
+
+// Announce multicasts the given records with the cache-flush bit set, so
+// caches on the link replace what they hold for those names, for instance
+// after a TTL change. Nothing is sent in respond-only mode.
+func Announce(records []string) error {
+	answers := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return err
+		}
+		answers = append(answers, rr)
+	}
+
+	local.mu.Lock()
+	respondOnly := local.cfg.RespondOnly || local.held.Load()
+	limits := local.cfg.limits()
+	conns := append([]*connector(nil), local.conns...)
+	local.mu.Unlock()
+	if !respondOnly && len(answers) > 0 {
+		multicast(conns, limits, answers)
+	}
+	return nil
+}
+
+// rank orders names in announcements, see SetPriority.
+type rank struct {
+	class, priority int
+}
+
+var ranks = struct {
+	mu    sync.Mutex
+	names map[string]rank
+}{names: make(map[string]rank)}
+
+// SetPriority sets the priority class and priority of the resource name
+// belongs to. Announcements carry names of higher class, then of higher
+// priority, first, so they reach caches soonest.
+func SetPriority(name string, class, priority int) {
+	ranks.mu.Lock()
+	defer ranks.mu.Unlock()
+	ranks.names[strings.ToLower(dns.Fqdn(name))] = rank{class, priority}
+}
+
+// forgetPriority drops the rank of name once it has no records left.
+func forgetPriority(name string) {
+	ranks.mu.Lock()
+	defer ranks.mu.Unlock()
+	delete(ranks.names, strings.ToLower(name))
+}
+
+// sortByPriority orders answers by the rank of their names, highest first.
+func sortByPriority(answers []dns.RR) {
+	ranks.mu.Lock()
+	defer ranks.mu.Unlock()
+	if len(ranks.names) == 0 {
+		return
+	}
+	sort.SliceStable(answers, func(i, j int) bool {
+		a := ranks.names[strings.ToLower(answers[i].Header().Name)]
+		b := ranks.names[strings.ToLower(answers[j].Header().Name)]
+		if a.class != b.class {
+			return a.class > b.class
+		}
+		return a.priority > b.priority
+	})
+}
+
+// multicast sends answers as unsolicited responses with the cache-flush bit
+// set on unique records on every connector, highest priority names first.
+// When announcements are paced, they are queued instead, see
+// announcementQueue. Records of wildcard names are left out, see
+// Config.Wildcards.
+func multicast(conns []*connector, limits packetLimits, answers []dns.RR) {
+	if answers = withoutWildcards(answers); len(answers) == 0 {
+		return
+	}
+	sortByPriority(answers)
+	for _, rr := range answers {
+		if !isShared(rr) {
+			rr.Header().Class |= 0x8000
+		}
+	}
+	if pacer.enqueue(conns, limits, answers) {
+		return
+	}
+	recent.multicast(answers)
+	for _, c := range conns {
+		if !c.multicasts() {
+			continue
+		}
+		for _, msg := range limits.pack(newAnnouncement(), answers, nil) {
+			if err := c.writeMessage(msg, c.UDPAddr); err != nil {
+				log.Printf("Cannot announce on %s: %s", c.UDPAddr, err)
+				break
+			}
+		}
+	}
+}
+
+// pack spreads answers over as few copies of template as fit within the
+// limits, as RFC 6762 section 6 allows for multicast responses. Additional
+// records are added to the last message while they fit.
+func (l packetLimits) pack(template *dns.Msg, answers, extra []dns.RR) []*dns.Msg {
+	var msgs []*dns.Msg
+	msg := emptyCopy(template)
+	for _, rr := range answers {
+		msg.Answer = append(msg.Answer, rr)
+		full := l.answers > 0 && len(msg.Answer) > l.answers
+		if (full || msg.Len() > l.size) && len(msg.Answer) > 1 {
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+			msgs = append(msgs, msg)
+			msg = emptyCopy(template)
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	for _, rr := range extra {
+		msg.Extra = append(msg.Extra, rr)
+		if msg.Len() > l.size {
+			msg.Extra = msg.Extra[:len(msg.Extra)-1]
+			break
+		}
+	}
+	return append(msgs, msg)
+}
+
+// emptyCopy returns template's header and questions without any records.
+// Names are compressed (RFC 6762 section 18.14), so records sharing a name
+// or domain take a pointer rather than another copy of it and more of them
+// fit in a message.
+func emptyCopy(template *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.MsgHdr = template.MsgHdr
+	msg.Question = template.Question
+	msg.Compress = true
+	return msg
+}
+
+func newAnnouncement() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.MsgHdr.Response = true
+	msg.MsgHdr.Authoritative = true
+	return msg
+}
@@ -0,0 +1,305 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// startMemory starts the responder on a MemoryTransport driven by a
+// FakeClock, and returns the packets it sends along with the clock. The
+// zone and connectors are cleared when the test ends.
+func startMemory(t *testing.T, cfg Config) (<-chan Packet, *FakeClock) {
+	t.Helper()
+	clk := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	transport := NewMemoryTransport(&net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353})
+	cfg.Transports = []Transport{transport}
+	cfg.Clock = clk
+	cfg.AcceptOffLink = true
+	if err := Start(cfg); err != nil {
+		t.Fatal(err)
+	}
+	packets, cancel := transport.Subscribe(16)
+	t.Cleanup(func() {
+		cancel()
+		Clear()
+		Release()
+		local.mu.Lock()
+		for _, c := range local.conns {
+			c.Close()
+		}
+		local.conns = nil
+		local.mu.Unlock()
+		pacer.configure(Config{})
+	})
+	return packets, clk
+}
+
+// publish adds records to the zone, failing the test if one does not
+// parse.
+func publish(t *testing.T, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := Publish(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The zone has taken the records once it answers a snapshot.
+	local.snapshot()
+}
+
+// nextPacket returns the next message sent, failing the test if none is
+// sent within a second of real time.
+func nextPacket(t *testing.T, packets <-chan Packet) *dns.Msg {
+	t.Helper()
+	select {
+	case p := <-packets:
+		var msg dns.Msg
+		if err := msg.Unpack(p.Data); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	case <-time.After(time.Second):
+		t.Fatal("no packet sent")
+		return nil
+	}
+}
+
+// noPacket fails the test if a message is sent within a short while.
+func noPacket(t *testing.T, packets <-chan Packet) {
+	t.Helper()
+	select {
+	case p := <-packets:
+		var msg dns.Msg
+		msg.Unpack(p.Data)
+		t.Fatalf("unexpected packet sent: %v", msg.Answer)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// awaitWaiters waits for n sleepers on clk, so the clock is only advanced
+// once the code under test waits for it.
+func awaitWaiters(t *testing.T, clk *FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for clk.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters on the clock, want %d", clk.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// answerTTLs returns the TTL of each answer of msg by record name.
+func answerTTLs(msg *dns.Msg) map[string]uint32 {
+	ttls := make(map[string]uint32)
+	for _, rr := range msg.Answer {
+		ttls[rr.Header().Name] = rr.Header().Ttl
+	}
+	return ttls
+}
+
+func TestAnnounceZone(t *testing.T) {
+	packets, clk := startMemory(t, Config{})
+	publish(t, "a.local. 120 IN A 192.0.2.1", "b.local. 120 IN A 192.0.2.2")
+
+	done := make(chan struct{})
+	go func() {
+		AnnounceZone()
+		close(done)
+	}()
+	first := nextPacket(t, packets)
+	if len(first.Answer) != 2 {
+		t.Fatalf("first announcement has %d answers, want 2", len(first.Answer))
+	}
+	for _, rr := range first.Answer {
+		if rr.Header().Class&0x8000 == 0 {
+			t.Errorf("%s is announced without the cache-flush bit", rr.Header().Name)
+		}
+	}
+
+	awaitWaiters(t, clk, 1)
+	noPacket(t, packets)
+	clk.Advance(time.Second)
+	if second := nextPacket(t, packets); len(second.Answer) != 2 {
+		t.Fatalf("second announcement has %d answers, want 2", len(second.Answer))
+	}
+	<-done
+}
+
+func TestAnnounceZoneHeld(t *testing.T) {
+	packets, clk := startMemory(t, Config{})
+	publish(t, "a.local. 120 IN A 192.0.2.1")
+	Hold()
+
+	go AnnounceZone()
+	awaitWaiters(t, clk, 1)
+	clk.Advance(time.Second)
+	noPacket(t, packets)
+}
+
+func TestApplyGoodbyes(t *testing.T) {
+	packets, _ := startMemory(t, Config{})
+	publish(t, "a.local. 120 IN A 192.0.2.1", "b.local. 120 IN A 192.0.2.2")
+
+	if err := Apply([]string{"b.local. 60 IN A 192.0.2.2"}, []string{"a.local. 120 IN A 192.0.2.1", "b.local. 120 IN A 192.0.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	ttls := answerTTLs(nextPacket(t, packets))
+	if ttl, ok := ttls["a.local."]; !ok || ttl != 0 {
+		t.Errorf("a.local. is sent with TTL %d (sent: %v), want a goodbye", ttl, ok)
+	}
+	if ttl := ttls["b.local."]; ttl != 60 {
+		t.Errorf("b.local. is sent with TTL %d, want it announced again with 60 rather than a goodbye", ttl)
+	}
+}
+
+func TestGoodbyesWithheldWhileHeld(t *testing.T) {
+	packets, _ := startMemory(t, Config{})
+	publish(t, "a.local. 120 IN A 192.0.2.1", "b.local. 120 IN A 192.0.2.2")
+	Hold()
+
+	if err := Apply(nil, []string{"a.local. 120 IN A 192.0.2.1", "b.local. 120 IN A 192.0.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply([]string{"b.local. 120 IN A 192.0.2.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	AfterGoodbyes(func() { close(written) })
+	noPacket(t, packets)
+	select {
+	case <-written:
+		t.Fatal("goodbyes reported written while held")
+	default:
+	}
+
+	Release()
+	ttls := answerTTLs(nextPacket(t, packets))
+	if ttl, ok := ttls["a.local."]; !ok || ttl != 0 {
+		t.Errorf("a.local. is sent with TTL %d (sent: %v), want a goodbye", ttl, ok)
+	}
+	if _, ok := ttls["b.local."]; ok {
+		t.Error("b.local. is said goodbye to although it was added back")
+	}
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("goodbyes not reported written after release")
+	}
+}
+
+func TestPacedAnnouncements(t *testing.T) {
+	packets, clk := startMemory(t, Config{AnnounceRate: 1, AnnounceBurst: 1})
+	publish(t, "a.local. 120 IN A 192.0.2.1")
+
+	if err := Apply([]string{"b.local. 120 IN A 192.0.2.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ttls := answerTTLs(nextPacket(t, packets)); ttls["b.local."] != 120 {
+		t.Fatalf("first message announces %v, want b.local.", ttls)
+	}
+
+	// The queue waits for its next turn before the goodbye goes out.
+	awaitWaiters(t, clk, 1)
+	if err := Apply(nil, []string{"a.local. 120 IN A 192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	AfterGoodbyes(func() { close(written) })
+	noPacket(t, packets)
+
+	clk.Advance(time.Second)
+	if ttl, ok := answerTTLs(nextPacket(t, packets))["a.local."]; !ok || ttl != 0 {
+		t.Fatalf("a.local. is sent with TTL %d (sent: %v), want a goodbye", ttl, ok)
+	}
+	awaitWaiters(t, clk, 1)
+	clk.Advance(time.Second)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("goodbyes not reported written once the queue drained")
+	}
+}
+
+func TestPacedAnnouncementsCoalesceBatch(t *testing.T) {
+	// A queue already draining, so enqueue leaves the records queued.
+	q := &announcementQueue{
+		queued:   make(map[string]int),
+		limiter:  rate.NewLimiter(1, 1),
+		draining: true,
+	}
+	var answers []dns.RR
+	for _, r := range []string{
+		"a.local. 120 IN A 192.0.2.1",
+		"b.local. 120 IN A 192.0.2.2",
+		"a.local. 0 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, rr)
+	}
+	if !q.enqueue(nil, packetLimits{}, answers) {
+		t.Fatal("answers not queued")
+	}
+
+	if len(q.pending) != 2 {
+		t.Fatalf("queued %v, want a.local. once", q.pending)
+	}
+	for _, rr := range q.pending {
+		if rr.Header().Name == "a.local." && rr.Header().Ttl != 0 {
+			t.Errorf("a.local. is queued with TTL %d, want the later goodbye", rr.Header().Ttl)
+		}
+	}
+}
+
+func TestPacedAnnouncementsStopWhenHeld(t *testing.T) {
+	packets, clk := startMemory(t, Config{AnnounceRate: 1, AnnounceBurst: 1})
+	publish(t, "a.local. 120 IN A 192.0.2.1")
+
+	if err := Apply([]string{"b.local. 120 IN A 192.0.2.2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	nextPacket(t, packets)
+
+	// A goodbye and an announcement wait for their turn when the zone is
+	// held.
+	awaitWaiters(t, clk, 1)
+	if err := Apply([]string{"c.local. 120 IN A 192.0.2.3"}, []string{"a.local. 120 IN A 192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	AfterGoodbyes(func() { close(written) })
+	Hold()
+	clk.Advance(time.Second)
+	noPacket(t, packets)
+	select {
+	case <-written:
+		t.Fatal("goodbyes reported written while held")
+	default:
+	}
+
+	// The goodbye is queued again, for the next turn.
+	Release()
+	awaitWaiters(t, clk, 1)
+	clk.Advance(time.Second)
+	ttls := answerTTLs(nextPacket(t, packets))
+	if ttl, ok := ttls["a.local."]; !ok || ttl != 0 {
+		t.Errorf("a.local. is sent with TTL %d (sent: %v), want the withheld goodbye", ttl, ok)
+	}
+	if _, ok := ttls["c.local."]; ok {
+		t.Error("c.local. is announced from the queue of the held zone")
+	}
+	awaitWaiters(t, clk, 1)
+	clk.Advance(time.Second)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("goodbyes not reported written after release")
+	}
+}
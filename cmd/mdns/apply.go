@@ -0,0 +1,96 @@
+package mdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Apply removes and adds records in a single step, so no query is answered
+// from part of the change, and announces the change in as few packets as
+// fit: the added records, and goodbyes (RFC 6762 section 10.1) for the
+// removed records that are not added back, even with another TTL. Publish
+// and UnPublish announce nothing, leaving caches to learn of each record as
+// it is queried. Nothing is announced in respond-only mode, and while held
+// the goodbyes are withheld until Release. If any record does not parse,
+// the zone is left as it is.
+func Apply(added, removed []string) error {
+	addedEntries, err := parseEntries(added)
+	if err != nil {
+		return err
+	}
+	removedEntries, err := parseEntries(removed)
+	if err != nil {
+		return err
+	}
+	if len(addedEntries) == 0 && len(removedEntries) == 0 {
+		return nil
+	}
+	local.op <- operation{op: "apply", added: addedEntries, removed: removedEntries}
+
+	local.mu.Lock()
+	respondOnly := local.cfg.RespondOnly
+	held := local.held.Load()
+	if held && !respondOnly {
+		withhold(addedEntries, removedEntries)
+	}
+	limits := local.cfg.limits()
+	conns := append([]*connector(nil), local.conns...)
+	local.mu.Unlock()
+	if respondOnly || held {
+		return nil
+	}
+
+	// The zone holds the added records themselves, so copies are sent.
+	answers := make([]dns.RR, 0, len(addedEntries)+len(removedEntries))
+	kept := make(map[string]bool, len(addedEntries))
+	for _, e := range addedEntries {
+		answers = append(answers, dns.Copy(e.RR))
+		kept[canonicalRecord(e.RR)] = true
+	}
+	for _, e := range removedEntries {
+		if kept[canonicalRecord(e.RR)] {
+			continue
+		}
+		goodbye := dns.Copy(e.RR)
+		goodbye.Header().Ttl = 0
+		answers = append(answers, goodbye)
+	}
+	if len(answers) > 0 {
+		multicast(conns, limits, answers)
+	}
+	return nil
+}
+
+// withhold keeps the goodbyes for removed until the zone is released,
+// dropping those for the records added back. The caller must hold local.mu.
+func withhold(added, removed entries) {
+	kept := make(map[string]bool, len(added))
+	for _, e := range added {
+		key := canonicalRecord(e.RR)
+		delete(local.withheld, key)
+		kept[key] = true
+	}
+	for _, e := range removed {
+		key := canonicalRecord(e.RR)
+		if kept[key] {
+			continue
+		}
+		goodbye := dns.Copy(e.RR)
+		goodbye.Header().Ttl = 0
+		local.withheld[key] = goodbye
+	}
+}
+
+// parseEntries parses records into zone entries.
+func parseEntries(records []string) (entries, error) {
+	parsed := make(entries, 0, len(records))
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil {
+			parsed = append(parsed, &entry{rr})
+		}
+	}
+	return parsed, nil
+}
@@ -0,0 +1,93 @@
+package mdns
+
+import (
+	"log"
+	"net"
+	"slices"
+)
+
+// boundIP returns the address t is bound to, or nil for a wildcard
+// socket.
+func boundIP(t Transport) net.IP {
+	local, ok := t.LocalAddr().(*net.UDPAddr)
+	if !ok || local.IP.IsUnspecified() {
+		return nil
+	}
+	return local.IP
+}
+
+// sourceIPs returns the addresses packets sent over t come from: the
+// address it is bound to or, for a wildcard socket, the addresses of the
+// interface it is bound to, or of every local interface in the network
+// namespace ns when it is not bound to one.
+func sourceIPs(t Transport, ns string) []net.IP {
+	if ip := boundIP(t); ip != nil {
+		return []net.IP{ip}
+	}
+	var device string
+	if conn, ok := t.(*net.UDPConn); ok {
+		device = boundDevice(conn)
+	}
+	var ips []net.IP
+	err := inNetNS(ns, func() error {
+		addrs, err := net.InterfaceAddrs()
+		if device != "" {
+			var iface *net.Interface
+			if iface, err = net.InterfaceByName(device); err != nil {
+				return err
+			}
+			addrs, err = iface.Addrs()
+		}
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, n.IP)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cannot list the addresses of %s, not detecting bridged links for it: %s", t.LocalAddr(), err)
+	}
+	return ips
+}
+
+// noteOwnPacket reports whether a response received by c from from was
+// sent by another of our connectors, coming from one of its source
+// addresses. Our own packets are not looped back, so one can only arrive
+// over the network: the two connectors' interfaces are bridged to the same
+// link, such as sockets passed by systemd for each interface. c then stops
+// multicasting and leaves it to the other, so the link does not get every
+// announcement and answer twice.
+func (c *connector) noteOwnPacket(from *net.UDPAddr) bool {
+	if from.Port != c.UDPAddr.Port {
+		return false
+	}
+
+	c.zone.mu.Lock()
+	defer c.zone.mu.Unlock()
+	for _, o := range c.zone.conns {
+		// Only a connector of the same family shares the link's group.
+		if o == c || (o.UDPAddr.IP.To4() == nil) != (c.UDPAddr.IP.To4() == nil) {
+			continue
+		}
+		if !slices.ContainsFunc(o.sourceIPs, from.IP.Equal) {
+			continue
+		}
+		if c.bridgedTo.Load() == nil && o.bridgedTo.Load() == nil {
+			c.bridgedTo.Store(o)
+			log.Printf("Sockets %s and %s are on the same link, multicasting on %s only",
+				c.LocalAddr(), o.LocalAddr(), o.LocalAddr())
+		}
+		return true
+	}
+	return false
+}
+
+// multicasts reports whether c sends multicast announcements and answers,
+// rather than leaving them to a connector on the same link.
+func (c *connector) multicasts() bool {
+	return c.bridgedTo.Load() == nil
+}
@@ -0,0 +1,127 @@
+package mdns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the time source of the responder: when queries and
+// announcements happened, how long withdrawn names are answered
+// negatively, the delay of shared answers, the spacing of start-up
+// announcements and the pacing of announcements. Config.Clock replaces the
+// system clock, with a FakeClock in tests and simulations.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// AfterFunc calls f in its own goroutine once d has elapsed.
+	AfterFunc(d time.Duration, f func())
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+// clockBox wraps the clock in use, as an atomic.Value needs a single
+// concrete type.
+type clockBox struct{ Clock }
+
+var currentClock atomic.Value // of clockBox
+
+// useClock makes c, or the system clock if nil, the clock of the responder.
+func useClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	currentClock.Store(clockBox{c})
+}
+
+// clock returns the clock of the responder.
+func clock() Clock {
+	if box, ok := currentClock.Load().(clockBox); ok {
+		return box.Clock
+	}
+	return systemClock{}
+}
+
+// FakeClock is a Clock that only moves when told to, so tests can step
+// through announcement schedules, grace periods and delays
+// deterministically.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at   time.Time
+	fire func()
+}
+
+// NewFakeClock returns a FakeClock reading start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the time the clock was last advanced to.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	woken := make(chan struct{})
+	c.AfterFunc(d, func() { close(woken) })
+	<-woken
+}
+
+// AfterFunc calls f in its own goroutine once the clock is advanced by at
+// least d.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		go f()
+		return
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), fire: f})
+}
+
+// Advance moves the clock forward by d, waking the sleepers and calling
+// the functions due by then.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due, pending []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			due = append(due, w)
+		}
+	}
+	c.waiters = pending
+	c.mu.Unlock()
+
+	for _, w := range due {
+		go w.fire()
+	}
+}
+
+// Waiters returns the number of sleepers and functions waiting for the
+// clock, so a test can wait for the code under test to reach a Sleep
+// before advancing.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
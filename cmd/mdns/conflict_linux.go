@@ -0,0 +1,70 @@
+package mdns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// portOwners describes the processes holding UDP port, such as
+// "avahi-daemon (pid 812)", as far as /proc lets us see them. It reads the
+// sockets of the calling thread's network namespace. Processes outside our
+// PID namespace, as in a pod without hostPID, cannot be named.
+func portOwners(port int) []string {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/thread-self/net/udp", "/proc/thread-self/net/udp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if p, err := strconv.ParseUint(hexPort, 16, 16); !ok || err != nil || int(p) != port {
+				continue
+			}
+			if fields[9] != "0" {
+				inodes["socket:["+fields[9]+"]"] = true
+			}
+		}
+		f.Close()
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	var owners []string
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	seen := make(map[string]bool)
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !inodes[target] {
+			continue
+		}
+		pid := strings.Split(fd, "/")[2]
+		if pid == strconv.Itoa(os.Getpid()) || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		comm, _ := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+		owners = append(owners, fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), pid))
+	}
+	if len(owners) == 0 {
+		owners = append(owners, "a process outside our PID namespace")
+	}
+	return owners
+}
+
+// publisherAttr makes delegated publishers exit with us.
+func publisherAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
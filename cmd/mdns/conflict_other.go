@@ -0,0 +1,15 @@
+//go:build !linux
+
+package mdns
+
+import "syscall"
+
+// portOwners cannot tell which processes hold a port on this platform.
+func portOwners(port int) []string {
+	return nil
+}
+
+// publisherAttr returns no process attributes on this platform.
+func publisherAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,124 @@
+package mdns
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// What to do when another process holds the mDNS port exclusively, see
+// Config.PortConflict.
+const (
+	// PortConflictFail fails to start, explaining which process holds the
+	// port and how to free it.
+	PortConflictFail = "fail"
+	// PortConflictAvahi publishes address records through the avahi-daemon
+	// holding the port instead of answering queries ourselves.
+	PortConflictAvahi = "avahi"
+)
+
+// avahiPublish is the avahi command publishing a record for as long as it
+// runs.
+const avahiPublish = "avahi-publish"
+
+// delegated is the publisher records are handed to when the zone is served
+// by another responder, or nil.
+var delegated atomic.Pointer[avahiPublisher]
+
+// avahiPublisher publishes address records through avahi-daemon by running
+// avahi-publish for each of them. Other record types cannot be published
+// this way and are skipped.
+type avahiPublisher struct {
+	mu          sync.Mutex
+	procs       map[string]*exec.Cmd // by name and address
+	unsupported map[uint16]bool      // record types already logged as skipped
+}
+
+func newAvahiPublisher() *avahiPublisher {
+	return &avahiPublisher{
+		procs:       make(map[string]*exec.Cmd),
+		unsupported: make(map[uint16]bool),
+	}
+}
+
+// publisherKey returns the name and address of an address record, or false
+// for other records.
+func publisherKey(rr dns.RR) (name, address string, ok bool) {
+	switch v := rr.(type) {
+	case *dns.A:
+		address = v.A.String()
+	case *dns.AAAA:
+		address = v.AAAA.String()
+	default:
+		return "", "", false
+	}
+	return strings.TrimSuffix(strings.ToLower(rr.Header().Name), "."), address, true
+}
+
+// add starts publishing rr, unless it already is.
+func (p *avahiPublisher) add(rr dns.RR) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name, address, ok := publisherKey(rr)
+	if !ok {
+		if rrtype := rr.Header().Rrtype; !p.unsupported[rrtype] {
+			p.unsupported[rrtype] = true
+			log.Printf("Not publishing %s records through avahi-daemon, only A and AAAA records can be", dns.TypeToString[rrtype])
+		}
+		return
+	}
+	key := name + " " + address
+	if p.procs[key] != nil {
+		return
+	}
+
+	cmd := exec.Command(avahiPublish, "--address", "--no-reverse", name, address)
+	cmd.SysProcAttr = publisherAttr()
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to publish %s through avahi-daemon: %s", key, err)
+		return
+	}
+	p.procs[key] = cmd
+	go func() {
+		err := cmd.Wait()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.procs[key] == cmd {
+			delete(p.procs, key)
+			log.Printf("%s for %s exited: %v", avahiPublish, key, err)
+		}
+	}()
+}
+
+// remove stops publishing rr.
+func (p *avahiPublisher) remove(rr dns.RR) {
+	name, address, ok := publisherKey(rr)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop(name + " " + address)
+}
+
+// clear stops publishing every record.
+func (p *avahiPublisher) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.procs {
+		p.stop(key)
+	}
+}
+
+// stop kills the publisher of key. The caller must hold p.mu.
+func (p *avahiPublisher) stop(key string) {
+	if cmd := p.procs[key]; cmd != nil {
+		delete(p.procs, key)
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,21 @@
+package mdns
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// boundDevice returns the interface conn is bound to with SO_BINDTODEVICE,
+// such as a socket systemd passes for BindToDevice=, or "" if none.
+func boundDevice(conn *net.UDPConn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var device string
+	raw.Control(func(fd uintptr) {
+		device, _ = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	return device
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package mdns
+
+import "net"
+
+// boundDevice cannot tell which interface a socket is bound to on this
+// platform.
+func boundDevice(conn *net.UDPConn) string {
+	return ""
+}
@@ -0,0 +1,122 @@
+package mdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDuplicates bounds the duplicates remembered between reports.
+const maxDuplicates = 1000
+
+// Duplicate is an answer for a name we publish sent by another responder,
+// such as a second instance or a reflector repeating our answers.
+type Duplicate struct {
+	Name      string `json:"name"`
+	Responder string `json:"responder"`
+	Record    string `json:"record"`
+	// Conflicting is set when the record differs from all those we
+	// publish for the name, rather than repeating one of them.
+	Conflicting bool      `json:"conflicting"`
+	Count       int       `json:"count"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// watchingDuplicates turns on the inspection of other responders' answers.
+var watchingDuplicates atomic.Bool
+
+var duplicates = struct {
+	mu   sync.Mutex
+	seen map[string]*Duplicate // by responder and record
+}{seen: make(map[string]*Duplicate)}
+
+// WatchDuplicates starts noting answers from other responders for the names
+// we publish, to be collected with TakeDuplicates. Our own packets are not
+// looped back, so any answer received comes from another socket.
+func WatchDuplicates() {
+	watchingDuplicates.Store(true)
+}
+
+// TakeDuplicates returns the duplicates seen since the previous call, by
+// responder and name.
+func TakeDuplicates() []Duplicate {
+	duplicates.mu.Lock()
+	seen := duplicates.seen
+	duplicates.seen = make(map[string]*Duplicate)
+	duplicates.mu.Unlock()
+
+	list := make([]Duplicate, 0, len(seen))
+	for _, d := range seen {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Responder != list[j].Responder {
+			return list[i].Responder < list[j].Responder
+		}
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Record < list[j].Record
+	})
+	return list
+}
+
+// noteDuplicates records the answers in msg, a response received from
+// another responder at from, for names that are in our zone. Shared
+// records, such as the PTRs from a DNS-SD service type to its instances,
+// are left out, as other responders rightly publish them too.
+func (c *connector) noteDuplicates(msg *dns.Msg, from *net.UDPAddr) {
+	now := clock().Now()
+	ours := make(map[string]map[string]bool)
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		if _, ok := rr.(*dns.OPT); ok || isShared(rr) {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		published, ok := ours[name]
+		if !ok {
+			published = make(map[string]bool)
+			for _, e := range c.zone.query(dns.Question{Name: rr.Header().Name, Qtype: dns.TypeANY, Qclass: dns.ClassINET}) {
+				published[canonicalRecord(e.RR)] = true
+			}
+			ours[name] = published
+		}
+		if len(published) == 0 {
+			continue
+		}
+
+		record := canonicalRecord(rr)
+		key := from.IP.String() + " " + record
+		duplicates.mu.Lock()
+		d := duplicates.seen[key]
+		if d == nil && len(duplicates.seen) < maxDuplicates {
+			d = &Duplicate{
+				Name:        strings.TrimSuffix(name, "."),
+				Responder:   from.IP.String(),
+				Record:      record,
+				Conflicting: !published[record],
+			}
+			duplicates.seen[key] = d
+		}
+		if d != nil {
+			d.Count++
+			d.LastSeen = now
+		}
+		duplicates.mu.Unlock()
+	}
+}
+
+// canonicalRecord formats rr without its TTL and cache-flush bit, so the
+// same record sent by different responders compares equal.
+func canonicalRecord(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Class &^= 0x8000
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	fields := strings.Fields(rr.String())
+	return strings.Join(append(fields[:1], fields[2:]...), " ")
+}
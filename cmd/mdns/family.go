@@ -0,0 +1,36 @@
+package mdns
+
+import "github.com/miekg/dns"
+
+// otherFamily returns the address record type of the family c does not
+// answer on: AAAA on an IPv4 socket and A on an IPv6 one.
+func (c *connector) otherFamily() uint16 {
+	if c.UDPAddr.IP.To4() != nil {
+		return dns.TypeAAAA
+	}
+	return dns.TypeA
+}
+
+// filterFamily drops the address records of the other family from rrs,
+// unless a question asked for them by type. Clients on a single-stack
+// network cannot use them, and RFC 6762 section 6.2 leaves including them
+// to the responder, see Config.BothFamilies.
+func (c *connector) filterFamily(rrs []dns.RR, questions []dns.Question) []dns.RR {
+	if c.bothFamilies {
+		return rrs
+	}
+	other := c.otherFamily()
+	for _, q := range questions {
+		if q.Qtype == other {
+			return rrs
+		}
+	}
+
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != other {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
@@ -3,11 +3,18 @@ package mdns
 // Advertise network services via multicast DNS
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"reflect"
 
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
 	"github.com/miekg/dns"
 	"github.com/mitchellh/copystructure"
 )
@@ -25,13 +32,242 @@ func init() {
 		entries: make(map[string]entries),
 		op:      make(chan operation),
 		queries: make(chan *query, 16),
+		dump:    make(chan chan []*entry),
+
+		withheld: make(map[string]dns.RR),
 	}
 	go local.mainloop()
-	if err := local.listen(ipv4mcastaddr); err != nil {
-		log.Fatalf("Failed to listen %s: %s", ipv4mcastaddr, err)
+}
+
+// Config controls how the responder listens and whom it answers.
+type Config struct {
+	// AllowSubnets, when non-empty, restricts answers to clients within
+	// these subnets.
+	AllowSubnets []*net.IPNet
+	// DenySubnets lists client subnets that are never answered.
+	DenySubnets []*net.IPNet
+	// ReusePort sets SO_REUSEPORT so several responders can share port 5353
+	// where the operating system allows it.
+	ReusePort bool
+	// MulticastTTL is the IPv4 multicast TTL of outgoing packets.
+	MulticastTTL int
+	// HopLimit is the IPv6 multicast hop limit of outgoing packets.
+	HopLimit int
+	// Port overrides the mDNS port (5353). Intended for tests and sandboxes.
+	Port int
+	// IPv4Group and IPv6Group override the multicast groups.
+	IPv4Group net.IP
+	IPv6Group net.IP
+	// NetNS names the Linux network namespace the sockets are opened in:
+	// a name under /var/run/netns, an absolute path, or "host".
+	NetNS string
+	// WatchInterfaces rebinds the sockets and re-announces all records when
+	// network interfaces or addresses change.
+	WatchInterfaces bool
+	// RespondOnly answers queries but never sends unsolicited
+	// announcements.
+	RespondOnly bool
+	// MaxPacketSize is the largest message sent, up to 9000 bytes
+	// (RFC 6762 section 17). Zero means 9000.
+	MaxPacketSize int
+	// MaxAnswers limits the answers per message, zero for no limit.
+	// Responses over a limit are split across several messages.
+	MaxAnswers int
+	// AcceptOffLink handles packets from sources outside the subnets of
+	// the local interfaces, which RFC 6762 section 11 says to ignore, such
+	// as unicast queries routed from another network.
+	AcceptOffLink bool
+	// BothFamilies includes A and AAAA records in every response, as RFC
+	// 6762 section 6.2 permits. Otherwise responses on an IPv4 socket
+	// leave out AAAA records, and on an IPv6 socket A records, unless the
+	// query asked for them.
+	BothFamilies bool
+	// AnswerOrder orders the addresses of a name in answers: one of
+	// AnswerOrderStable, the default, AnswerOrderRotate,
+	// AnswerOrderIPv4First and AnswerOrderIPv6First.
+	AnswerOrder string
+	// Wildcards lists the fully qualified wildcard names, such as
+	// *.preview.local., whose records in the zone answer queries for any
+	// name below them, such as a.preview.local., renamed, unless a closer
+	// name is in the zone. Their records are not announced. Other wildcard
+	// names in the zone are answered for as they are. See CheckWildcard.
+	Wildcards []string
+	// AnnounceRate limits announcements to this many messages per second,
+	// queueing and coalescing the excess. Zero sends them at once.
+	AnnounceRate float64
+	// AnnounceBurst is how many announcement messages may be sent back to
+	// back when AnnounceRate is set.
+	AnnounceBurst int
+	// WithdrawnGrace is how long queries for a name whose last record was
+	// removed are answered with an NSEC record saying it no longer exists,
+	// so clients fail fast instead of retrying. Zero leaves them
+	// unanswered.
+	WithdrawnGrace time.Duration
+	// PortConflict decides what happens when another process holds the
+	// mDNS port exclusively: PortConflictFail, the default, or
+	// PortConflictAvahi.
+	PortConflict string
+	// MissingPrivileges decides what happens when the process lacks the
+	// capabilities to open the sockets: MissingPrivilegesFail, the
+	// default, or MissingPrivilegesAvahi.
+	MissingPrivileges string
+	// Sockets are already bound UDP sockets, such as those passed by
+	// systemd socket activation, used instead of opening our own. They
+	// only join the multicast group of their address family.
+	Sockets []*net.UDPConn
+	// Transports, when set, are answered on instead of sockets, each for
+	// the group of the address family of its local address. Tests and
+	// simulations pass MemoryTransports.
+	Transports []Transport
+	// Clock replaces the system clock when set, see Clock.
+	Clock Clock
+}
+
+// groups returns the IPv4 and IPv6 group addresses to listen on.
+func (cfg Config) groups() (*net.UDPAddr, *net.UDPAddr) {
+	v4, v6 := *ipv4mcastaddr, *ipv6mcastaddr
+	if cfg.Port != 0 {
+		v4.Port, v6.Port = cfg.Port, cfg.Port
 	}
-	if err := local.listen(ipv6mcastaddr); err != nil {
-		log.Printf("Failed to listen %s: %s", ipv6mcastaddr, err)
+	if cfg.IPv4Group != nil {
+		v4.IP = cfg.IPv4Group
+	}
+	if cfg.IPv6Group != nil {
+		v6.IP = cfg.IPv6Group
+	}
+	return &v4, &v6
+}
+
+// Start opens the multicast sockets and begins answering queries. Records
+// may be published before Start is called.
+func Start(cfg Config) error {
+	useClock(cfg.Clock)
+	withdrawn.mu.Lock()
+	withdrawn.grace = cfg.WithdrawnGrace
+	withdrawn.mu.Unlock()
+	pacer.configure(cfg)
+	setWildcards(cfg.Wildcards)
+	if cfg.AnswerOrder != "" {
+		ordering.mu.Lock()
+		ordering.order = cfg.AnswerOrder
+		ordering.mu.Unlock()
+	}
+
+	local.mu.Lock()
+	local.cfg = cfg
+	err := checkPrivileges(cfg)
+	if err == nil {
+		err = local.bind()
+	}
+	local.mu.Unlock()
+	var perr *PrivilegeError
+	if err != nil && (cfg.PortConflict == PortConflictAvahi && errors.Is(err, syscall.EADDRINUSE) ||
+		cfg.MissingPrivileges == MissingPrivilegesAvahi && errors.As(err, &perr)) {
+		log.Printf("Publishing address records through avahi-daemon: %s", err)
+		delegateTo(newAvahiPublisher())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.WatchInterfaces {
+		changes, err := watchInterfaces(cfg.NetNS)
+		if err != nil {
+			log.Printf("Not watching network interfaces: %s", err)
+		} else {
+			go local.rebindOnChange(changes)
+		}
+	}
+	return nil
+}
+
+// delegateTo hands the records of the zone, and those published from now
+// on, to p.
+func delegateTo(p *avahiPublisher) {
+	delegated.Store(p)
+	for _, e := range local.snapshot() {
+		p.add(e.RR)
+	}
+}
+
+// interfaceSettleTime is how long the network must stay quiet after a change
+// before the sockets are rebound, so a burst of netlink events (DHCP renew,
+// VLAN creation) results in a single rebind.
+const interfaceSettleTime = 2 * time.Second
+
+// bind opens a connector per multicast group. The caller must hold z.mu.
+func (z *zone) bind() error {
+	v4, v6 := z.cfg.groups()
+	if !z.cfg.AcceptOffLink {
+		z.links = localSubnets(z.cfg.NetNS)
+	}
+	if len(z.cfg.Transports) > 0 {
+		for _, t := range z.cfg.Transports {
+			z.attach(familyGroup(t, v4, v6), t, z.cfg)
+		}
+		return nil
+	}
+	if len(z.cfg.Sockets) > 0 {
+		return z.adopt(v4, v6)
+	}
+	if err := z.listen(v4, z.cfg); err != nil {
+		return fmt.Errorf("failed to listen %s: %w", v4, err)
+	}
+	if err := z.listen(v6, z.cfg); err != nil {
+		log.Printf("Failed to listen %s: %s", v6, err)
+	}
+	return nil
+}
+
+// rebind opens the connectors again and closes the previous ones once the
+// new ones are bound, so a failure leaves the zone answering on the
+// previous sockets rather than on none. Inherited sockets and transports
+// cannot be reopened and are kept as they are.
+func (z *zone) rebind() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if len(z.cfg.Sockets) > 0 || len(z.cfg.Transports) > 0 {
+		return nil
+	}
+
+	previous, links := z.conns, z.links
+	z.conns = nil
+	if err := z.bind(); err != nil {
+		for _, c := range z.conns {
+			c.Close()
+		}
+		z.conns, z.links = previous, links
+		return err
+	}
+	for _, c := range previous {
+		c.Close()
+	}
+	return nil
+}
+
+// rebindOnChange rebinds the sockets and re-announces the zone once the
+// network settles after each burst of interface changes.
+func (z *zone) rebindOnChange(changes <-chan struct{}) {
+	for range changes {
+		settle := time.NewTimer(interfaceSettleTime)
+	drain:
+		for {
+			select {
+			case <-changes:
+				settle.Reset(interfaceSettleTime)
+			case <-settle.C:
+				break drain
+			}
+		}
+
+		log.Printf("Network interfaces changed, rebinding multicast sockets")
+		if err := z.rebind(); err != nil {
+			log.Printf("Failed to rebind multicast sockets, keeping the previous ones: %s", err)
+			continue
+		}
+		z.announce()
 	}
 }
 
@@ -41,7 +277,7 @@ func Publish(r string) error {
 	if err != nil {
 		return err
 	}
-	local.op <- operation{"add", &entry{rr}}
+	local.op <- operation{op: "add", entry: &entry{rr}}
 	return nil
 }
 
@@ -51,13 +287,78 @@ func UnPublish(r string) error {
 	if err != nil {
 		return err
 	}
-	local.op <- operation{"del", &entry{rr}}
+	local.op <- operation{op: "del", entry: &entry{rr}}
 	return nil
 }
 
+// Hold stops answering queries and sending announcements until Release is
+// called, so a responder that has not yet learned the whole zone does not
+// answer from part of it. Records can still be published meanwhile.
+func Hold() {
+	local.held.Store(true)
+}
+
+// Held reports whether the zone is held, see Hold.
+func Held() bool {
+	return local.held.Load()
+}
+
+// Release resumes answering queries after Hold, and multicasts goodbyes for
+// the records removed meanwhile.
+func Release() {
+	local.mu.Lock()
+	local.held.Store(false)
+	goodbyes := make([]dns.RR, 0, len(local.withheld))
+	for _, rr := range local.withheld {
+		goodbyes = append(goodbyes, rr)
+	}
+	clear(local.withheld)
+	waiters := local.waiters
+	local.waiters = nil
+	respondOnly := local.cfg.RespondOnly
+	limits := local.cfg.limits()
+	conns := append([]*connector(nil), local.conns...)
+	local.mu.Unlock()
+
+	if len(goodbyes) > 0 && !respondOnly {
+		multicast(conns, limits, goodbyes)
+	}
+	for _, fn := range waiters {
+		pacer.afterDrained(fn)
+	}
+}
+
+// AfterGoodbyes calls fn once the goodbyes for the records removed so far
+// have been written: at once unless they are still queued for pacing, or
+// withheld until Release while the zone is held. No goodbyes are written
+// in respond-only mode, so fn is never called. fn must not block.
+func AfterGoodbyes(fn func()) {
+	local.mu.Lock()
+	if local.cfg.RespondOnly {
+		local.mu.Unlock()
+		return
+	}
+	if local.held.Load() {
+		local.waiters = append(local.waiters, fn)
+		local.mu.Unlock()
+		return
+	}
+	local.mu.Unlock()
+	pacer.afterDrained(fn)
+}
+
 // Clear removes all entries from advertisement
 func Clear() {
-	local.op <- operation{"clr", nil}
+	local.op <- operation{op: "clr"}
+}
+
+// Records returns every published record in presentation format.
+func Records() []string {
+	var records []string
+	for _, e := range local.snapshot() {
+		records = append(records, e.RR.String())
+	}
+	return records
 }
 
 type entry struct {
@@ -85,54 +386,132 @@ func (e entries) contains(entry *entry) int {
 }
 
 type operation struct {
-	op string // one of add, del, clr
+	op string // one of add, del, clr, apply
 	*entry
+	added, removed entries // for apply, see Apply
 }
 
 type zone struct {
 	entries map[string]entries
 	op      chan operation
-	queries chan *query // query existing entries in zone
+	queries chan *query        // query existing entries in zone
+	dump    chan chan []*entry // snapshot all entries in zone
+
+	mu    sync.Mutex // guards cfg, conns and links
+	cfg   Config
+	conns []*connector
+	links []*net.IPNet // subnets of the local interfaces, see localSubnets
+
+	// held stops queries being answered and the zone being announced
+	// while it is still being filled, see Hold.
+	held atomic.Bool
+
+	// withheld holds the goodbyes for the records removed while held, by
+	// canonicalRecord, sent on Release. waiters are called once they are,
+	// see AfterGoodbyes. Both are guarded by mu.
+	withheld map[string]dns.RR
+	waiters  []func()
 }
 
 func (z *zone) mainloop() {
 	for {
 		select {
 		case op := <-z.op:
-			entry := op.entry
 			switch op.op {
 			case "add":
-				if z.entries[entry.fqdn()].contains(entry) == -1 {
-					z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
-				}
+				z.add(op.entry)
 			case "del":
-				entries := z.entries[entry.fqdn()]
-				idx := z.entries[entry.fqdn()].contains(entry)
-				if idx != -1 {
-					numEntries := len(entries)
-					if numEntries == 1 {
-						delete(z.entries, entry.fqdn())
-					} else {
-						// Copy last element to index idx
-						entries[idx] = entries[numEntries-1]
-						// Erase last element (write nil value).
-						entries[numEntries-1] = nil
-						// Truncate slice
-						z.entries[entry.fqdn()] = entries[:numEntries-1]
-					}
+				z.remove(op.entry)
+			case "apply":
+				for _, entry := range op.removed {
+					z.remove(entry)
+				}
+				for _, entry := range op.added {
+					z.add(entry)
 				}
 			case "clr":
 				z.entries = make(map[string]entries)
+				if p := delegated.Load(); p != nil {
+					p.clear()
+				}
+				ranks.mu.Lock()
+				ranks.names = make(map[string]rank)
+				ranks.mu.Unlock()
+				sharing.mu.Lock()
+				sharing.names = make(map[string]bool)
+				sharing.mu.Unlock()
 			}
 		case q := <-z.queries:
-			for _, entry := range z.entries[q.Question.Name] {
+			matches := z.entries[q.Question.Name]
+			if len(matches) == 0 {
+				matches = z.wildcardMatches(q.Question.Name)
+			}
+			for _, entry := range matches {
 				if q.matches(entry) {
 					q.result <- entry
 				}
 			}
 			close(q.result)
+		case res := <-z.dump:
+			var all []*entry
+			for _, ee := range z.entries {
+				all = append(all, ee...)
+			}
+			res <- all
+		}
+	}
+}
+
+// add puts entry in the zone. It runs on the zone's main loop.
+func (z *zone) add(entry *entry) {
+	if z.entries[entry.fqdn()].contains(entry) == -1 {
+		z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
+		if p := delegated.Load(); p != nil {
+			p.add(entry.RR)
+		}
+	}
+	forgetWithdrawn(entry.fqdn())
+}
+
+// remove takes entry out of the zone. It runs on the zone's main loop.
+func (z *zone) remove(entry *entry) {
+	entries := z.entries[entry.fqdn()]
+	idx := z.entries[entry.fqdn()].contains(entry)
+	if idx == -1 {
+		return
+	}
+	if p := delegated.Load(); p != nil {
+		p.remove(entry.RR)
+	}
+	numEntries := len(entries)
+	if numEntries == 1 {
+		delete(z.entries, entry.fqdn())
+		forgetPriority(entry.fqdn())
+		noteWithdrawn(entry.fqdn())
+		forgetRotation(entry.fqdn())
+		forgetSharing(entry.fqdn())
+	} else {
+		// Copy last element to index idx
+		entries[idx] = entries[numEntries-1]
+		// Erase last element (write nil value).
+		entries[numEntries-1] = nil
+		// Truncate slice
+		z.entries[entry.fqdn()] = entries[:numEntries-1]
+	}
+}
+
+// snapshot returns copies of every entry in the zone.
+func (z *zone) snapshot() (entries []*entry) {
+	res := make(chan []*entry)
+	z.dump <- res
+	for _, e := range <-res {
+		dup, err := copystructure.Copy(e)
+		if err != nil {
+			return
 		}
+		entries = append(entries, dup.(*entry))
 	}
+	return
 }
 
 func (z *zone) query(q dns.Question) (entries []*entry) {
@@ -149,38 +528,76 @@ func (z *zone) query(q dns.Question) (entries []*entry) {
 	return
 }
 
+// matches reports whether entry answers the query. A CNAME answers
+// queries of every type for its name (RFC 1034 section 3.6.2).
 func (q *query) matches(entry *entry) bool {
-	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == entry.RR.Header().Rrtype
+	rrtype := entry.RR.Header().Rrtype
+	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == rrtype || rrtype == dns.TypeCNAME
 }
 
 type connector struct {
 	*net.UDPAddr
-	*net.UDPConn
+	Transport
 	*zone
+	acl    acl
+	limits packetLimits
+	// links are the subnets packets are accepted from, nil for any.
+	links        []*net.IPNet
+	bothFamilies bool
+	// sourceIPs are the addresses its packets come from, and bridgedTo
+	// the connector multicasting for both when they are on the same
+	// link, see noteOwnPacket.
+	sourceIPs []net.IP
+	bridgedTo atomic.Pointer[connector]
 }
 
-func (z *zone) listen(addr *net.UDPAddr) error {
-	conn, err := openSocket(addr)
+func (z *zone) listen(addr *net.UDPAddr, cfg Config) error {
+	conn, err := openSocket(addr, cfg)
 	if err != nil {
 		return err
 	}
-	c := &connector{
-		UDPAddr: addr,
-		UDPConn: conn,
-		zone:    z,
-	}
-	go c.mainloop()
+	z.attach(addr, conn, cfg)
+	return nil
+}
 
+// adopt joins the inherited sockets to the group of their address family
+// and answers on them. The caller must hold z.mu.
+func (z *zone) adopt(v4, v6 *net.UDPAddr) error {
+	for _, conn := range z.cfg.Sockets {
+		addr := familyGroup(conn, v4, v6)
+		if err := joinGroup(conn, addr, z.cfg); err != nil {
+			return fmt.Errorf("failed to join multicast group %s on inherited socket %s: %w", addr.IP, conn.LocalAddr(), err)
+		}
+		z.attach(addr, conn, z.cfg)
+	}
 	return nil
 }
 
-func openSocket(addr *net.UDPAddr) (*net.UDPConn, error) {
-	switch addr.IP.To4() {
-	case nil:
-		return net.ListenMulticastUDP("udp6", nil, addr)
-	default:
-		return net.ListenMulticastUDP("udp4", nil, addr)
+// familyGroup returns the group of v4 and v6 of the address family t is
+// bound to.
+func familyGroup(t Transport, v4, v6 *net.UDPAddr) *net.UDPAddr {
+	if local, ok := t.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() != nil {
+		return v4
 	}
+	return v6
+}
+
+// attach starts answering queries for addr received on t.
+func (z *zone) attach(addr *net.UDPAddr, t Transport, cfg Config) {
+	c := &connector{
+		UDPAddr:      addr,
+		Transport:    t,
+		zone:         z,
+		acl:          acl{allow: cfg.AllowSubnets, deny: cfg.DenySubnets},
+		limits:       cfg.limits(),
+		bothFamilies: cfg.BothFamilies,
+		sourceIPs:    sourceIPs(t, cfg.NetNS),
+	}
+	if !cfg.AcceptOffLink {
+		c.links = z.links
+	}
+	z.conns = append(z.conns, c)
+	go c.mainloop()
 }
 
 type pkt struct {
@@ -189,11 +606,27 @@ type pkt struct {
 }
 
 func (c *connector) readloop(in chan pkt) {
+	defer close(in)
 	for {
 		msg, addr, err := c.readMessage()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			// log dud packets
-			log.Printf("Could not read from %#v: %s", c.UDPConn, err)
+			log.Printf("Could not read from %s: %s", c.LocalAddr(), err)
+			continue
+		}
+		if !c.acceptSource(addr.IP, !msg.Response) || !c.acl.permits(addr.IP) {
+			continue
+		}
+		if msg.Response {
+			if c.noteOwnPacket(addr) {
+				continue
+			}
+			if watchingDuplicates.Load() && len(msg.Answer) > 0 {
+				c.noteDuplicates(msg, addr)
+			}
 			continue
 		}
 		if len(msg.Question) > 0 {
@@ -205,14 +638,16 @@ func (c *connector) readloop(in chan pkt) {
 func (c *connector) mainloop() {
 	in := make(chan pkt, 32)
 	go c.readloop(in)
-	for {
-		msg := <-in
+	for msg := range in {
+		if c.held.Load() {
+			continue
+		}
 		msg.MsgHdr.Response = true      // convert question to response
 		msg.MsgHdr.Authoritative = true // answer should be authoritative otherwise it may be discarded
 
 		// https://datatracker.ietf.org/doc/html/rfc6762#section-6.7
-		// if source port is not 5353 then it's "One-Shot Multicast DNS Query" and we should send unicast response
-		isLegacyUnicast := msg.UDPAddr.Port != 5353
+		// if source port is not the mDNS port then it's "One-Shot Multicast DNS Query" and we should send unicast response
+		isLegacyUnicast := msg.UDPAddr.Port != c.UDPAddr.Port
 
 		msg.Answer = make([]dns.RR, 0) // some queries already have an answer, we should not answer them
 		for _, result := range c.query(msg.Question) {
@@ -220,19 +655,43 @@ func (c *connector) mainloop() {
 				// https://datatracker.ietf.org/doc/html/rfc6762#section-6.7
 				// The resource record TTL given in a legacy unicast response SHOULD NOT be greater than ten seconds
 				result.RR.Header().Ttl = 10
-			} else {
+			} else if !isShared(result.RR) {
 				// Set Cache-Flush bit
 				result.RR.Header().Class = result.RR.Header().Class | 0x8000
 			}
 			msg.Answer = append(msg.Answer, result.RR)
 		}
-		msg.Extra = append(msg.Extra, c.findExtra(msg.Answer...)...)
+		msg.Answer = c.filterFamily(msg.Answer, msg.Question)
+		orderAddresses(msg.Answer)
+		extra := c.filterFamily(c.findExtra(msg.Answer...), nil)
+
+		// https://tools.ietf.org/html/rfc6762#section-5.4
+		// Check if unicast-response bit set
+		isQueryUnicast := msg.Question[0].Qclass&32768 > 0
+		recent.query(QueryLog{
+			Time:      clock().Now(),
+			Client:    msg.UDPAddr.String(),
+			Questions: questionStrings(msg.Question),
+			Answers:   len(msg.Answer),
+			Unicast:   isLegacyUnicast || isQueryUnicast,
+		})
+		countQuery(msg.UDPAddr, msg.Question, msg.Answer)
+
+		// Names withdrawn moments ago get a negative answer, see
+		// Config.WithdrawnGrace. It goes out without the cache-flush
+		// bit: the name may have moved to another responder meanwhile,
+		// whose fresh records it must not flush from caches.
+		if len(msg.Answer) == 0 {
+			for _, rr := range negativeAnswers(msg.Question) {
+				if isLegacyUnicast {
+					rr.Header().Ttl = min(rr.Header().Ttl, 10)
+				}
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
 
 		if len(msg.Answer) > 0 {
 			var addr *net.UDPAddr
-			// https://tools.ietf.org/html/rfc6762#section-5.4
-			// Check if unicast-response bit set
-			isQueryUnicast := msg.Question[0].Qclass&32768 > 0
 
 			if isLegacyUnicast || isQueryUnicast {
 				addr = msg.UDPAddr
@@ -242,6 +701,10 @@ func (c *connector) mainloop() {
 				// address MUST only accept responses to that query that originate
 				// from the local link, and silently discard any other response packets.
 				addr = c.UDPAddr
+				if !c.multicasts() {
+					continue
+				}
+				recent.multicast(msg.Answer)
 			}
 			msg.UDPAddr = addr
 
@@ -250,8 +713,32 @@ func (c *connector) mainloop() {
 				msg.Question = nil
 			}
 
-			if err := c.writeMessage(msg.Msg, addr); err != nil {
-				log.Println("Cannot send: ", err)
+			answers := msg.Answer
+			msg.Answer = nil
+			msgs := c.limits.pack(msg.Msg, answers, extra)
+			if isLegacyUnicast && len(msgs) > 1 {
+				// Legacy resolvers expect a single message and retry
+				// over TCP, which we do not offer, when truncated.
+				msgs[0].Truncated = true
+				msgs = msgs[:1]
+			}
+			send := func() {
+				for _, m := range msgs {
+					if err := c.writeMessage(m, addr); err != nil {
+						log.Println("Cannot send: ", err)
+						break
+					}
+				}
+			}
+
+			// https://datatracker.ietf.org/doc/html/rfc6762#section-6
+			// Other responders may answer for shared records too, so
+			// multicast responses holding any are delayed by 20-120ms.
+			// Responses with unique records only are sent at once.
+			if addr == c.UDPAddr && containsShared(answers) {
+				clock().AfterFunc(sharedResponseDelay(), send)
+			} else {
+				send()
 			}
 		}
 	}
@@ -301,8 +788,15 @@ func (c *connector) writeMessage(msg *dns.Msg, addr *net.UDPAddr) error {
 	if err != nil {
 		return err
 	}
-	_, err = c.WriteToUDP(buf, addr)
-	return err
+	if _, err = c.WriteToUDP(buf, addr); err != nil {
+		return err
+	}
+	destination := "unicast"
+	if addr == c.UDPAddr {
+		destination = "multicast"
+	}
+	metrics.SentBytes.WithLabelValues(destination).Add(float64(len(buf)))
+	return nil
 }
 
 // consume an mdns packet from the wire and decode it
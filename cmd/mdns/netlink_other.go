@@ -0,0 +1,10 @@
+//go:build !linux
+
+package mdns
+
+import "errors"
+
+// watchInterfaces is only supported on Linux.
+func watchInterfaces(ns string) (<-chan struct{}, error) {
+	return nil, errors.New("interface watching is only supported on Linux")
+}
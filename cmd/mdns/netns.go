@@ -0,0 +1,7 @@
+package mdns
+
+// InNetNS runs fn in the network namespace ns, as the mDNS sockets are
+// opened there, see Config.NetNS. An empty ns runs fn where it is.
+func InNetNS(ns string, fn func() error) error {
+	return inNetNS(ns, fn)
+}
@@ -0,0 +1,71 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsPath resolves a namespace name to the file that references it.
+// "host" refers to the namespace of PID 1, which is the node's namespace
+// when the pod shares the host PID namespace.
+func netnsPath(ns string) string {
+	switch {
+	case ns == "host":
+		return "/proc/1/ns/net"
+	case filepath.IsAbs(ns):
+		return ns
+	}
+	return filepath.Join("/var/run/netns", ns)
+}
+
+// inNetNS runs fn with its OS thread switched into the network namespace
+// ns. Sockets created by fn remain in that namespace. fn runs on a goroutine
+// of its own whose thread is never unlocked, so the runtime discards the
+// thread when it exits rather than letting other goroutines run in ns.
+func inNetNS(ns string, fn func() error) error {
+	if ns == "" {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		done <- switchedNetNS(ns, fn)
+	}()
+	return <-done
+}
+
+// switchedNetNS runs fn in the network namespace ns and switches back, on
+// the locked thread of inNetNS. The errors of fn and of switching back are
+// both returned.
+func switchedNetNS(ns string, fn func() error) error {
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return fmt.Errorf("failed to open current network namespace: %w", err)
+	}
+	defer orig.Close()
+
+	target, err := os.Open(netnsPath(ns))
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %q: %w", ns, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			err = privilegeFailure(Config{NetNS: ns}, err)
+		}
+		return fmt.Errorf("failed to enter network namespace %q: %w", ns, err)
+	}
+
+	fnErr := fn()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		return errors.Join(fnErr, fmt.Errorf("failed to restore network namespace: %w", err))
+	}
+	return fnErr
+}
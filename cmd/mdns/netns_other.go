@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mdns
+
+import "errors"
+
+// inNetNS runs fn. Network namespaces are only supported on Linux.
+func inNetNS(ns string, fn func() error) error {
+	if ns != "" {
+		return errors.New("network namespaces are only supported on Linux")
+	}
+	return fn()
+}
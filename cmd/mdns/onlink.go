@@ -0,0 +1,79 @@
+package mdns
+
+import (
+	"log"
+	"net"
+
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+)
+
+// localSubnets returns the subnets of the interfaces in the network
+// namespace ns, the link a packet must come from to be accepted.
+func localSubnets(ns string) []*net.IPNet {
+	var subnets []*net.IPNet
+	err := inNetNS(ns, func() error {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				subnets = append(subnets, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Cannot list interface addresses, accepting packets from any source: %s", err)
+		return nil
+	}
+	return subnets
+}
+
+// onLink reports whether ip is on the link c answers on: a link-local
+// address or one within the subnet of a local interface
+// (RFC 6762 section 11). Packets from elsewhere were routed, or spoofed.
+func (c *connector) onLink(ip net.IP) bool {
+	return withinLinks(c.links, ip)
+}
+
+// withinLinks reports whether ip is link-local or within one of links,
+// which are nil when any source is accepted.
+func withinLinks(links []*net.IPNet, ip net.IP) bool {
+	if links == nil || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range links {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceFilter returns whether responders of other discovery protocols may
+// answer a client at ip, under the allow and deny lists of cfg and, unless
+// cfg.AcceptOffLink, the on-link check of the mDNS connectors. The subnets
+// of the interfaces are those when it is called.
+func SourceFilter(cfg Config) func(ip net.IP) bool {
+	a := acl{allow: cfg.AllowSubnets, deny: cfg.DenySubnets}
+	var links []*net.IPNet
+	if !cfg.AcceptOffLink {
+		links = localSubnets(cfg.NetNS)
+	}
+	return func(ip net.IP) bool {
+		return withinLinks(links, ip) && a.permits(ip)
+	}
+}
+
+// acceptSource reports whether a packet from ip is handled, counting the
+// queries ignored because they came from off the link.
+func (c *connector) acceptSource(ip net.IP, query bool) bool {
+	if c.onLink(ip) {
+		return true
+	}
+	if query {
+		metrics.OffLinkQueries.Inc()
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package mdns
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Orders of the addresses of a name in answers, see Config.AnswerOrder.
+const (
+	AnswerOrderStable    = "stable"     // lowest address first
+	AnswerOrderRotate    = "rotate"     // a different address first in each answer
+	AnswerOrderIPv4First = "ipv4-first" // A before AAAA, lowest address first
+	AnswerOrderIPv6First = "ipv6-first" // AAAA before A, lowest address first
+)
+
+var ordering = struct {
+	mu    sync.Mutex
+	order string
+	turns map[string]int // answers sent for each name under rotate
+}{order: AnswerOrderStable, turns: make(map[string]int)}
+
+// forgetRotation drops the rotation of name, no longer published.
+func forgetRotation(name string) {
+	ordering.mu.Lock()
+	defer ordering.mu.Unlock()
+	delete(ordering.turns, name)
+}
+
+// orderAddresses reorders the A and AAAA records of each name in answers
+// according to the answer order, leaving other records in place. Simple
+// clients use the first address they are given.
+func orderAddresses(answers []dns.RR) {
+	var (
+		names  []string
+		byName = make(map[string][]dns.RR)
+		slots  []int
+	)
+	for i, rr := range answers {
+		if rr.Header().Rrtype != dns.TypeA && rr.Header().Rrtype != dns.TypeAAAA {
+			continue
+		}
+		name := rr.Header().Name
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], rr)
+		slots = append(slots, i)
+	}
+	if len(slots) < 2 {
+		return
+	}
+
+	ordering.mu.Lock()
+	defer ordering.mu.Unlock()
+
+	var ordered []dns.RR
+	for _, name := range names {
+		addresses := byName[name]
+		sort.SliceStable(addresses, func(i, j int) bool {
+			a, b := address(addresses[i]), address(addresses[j])
+			if len(a) != len(b) {
+				switch ordering.order {
+				case AnswerOrderIPv4First:
+					return len(a) < len(b)
+				case AnswerOrderIPv6First:
+					return len(a) > len(b)
+				}
+			}
+			return bytes.Compare(a, b) < 0
+		})
+		if ordering.order == AnswerOrderRotate && len(addresses) > 1 {
+			turn := ordering.turns[name] % len(addresses)
+			ordering.turns[name] = turn + 1
+			addresses = append(append([]dns.RR{}, addresses[turn:]...), addresses[:turn]...)
+		}
+		ordered = append(ordered, addresses...)
+	}
+	for i, slot := range slots {
+		answers[slot] = ordered[i]
+	}
+}
+
+// address returns the address of an A or AAAA record, in its 4 or 16 byte
+// form.
+func address(rr dns.RR) []byte {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.To4()
+	case *dns.AAAA:
+		return rr.AAAA.To16()
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package mdns
+
+import (
+	"log"
+	"sync"
+
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// announcementQueue spreads announcements out to Config.AnnounceRate
+// messages per second, in bursts of up to Config.AnnounceBurst, so
+// publishing many resources at once does not flood the link. Records
+// waiting for their turn are coalesced: a record queued again, or
+// withdrawn, before it is sent replaces the queued one, and the queue is
+// packed into as few messages as fit.
+type announcementQueue struct {
+	mu       sync.Mutex
+	limiter  *rate.Limiter // nil when announcements are not paced
+	pending  []dns.RR
+	queued   map[string]int // index in pending, by canonicalRecord
+	conns    []*connector
+	limits   packetLimits
+	draining bool
+	drained  []func() // called once the queue is empty, see afterDrained
+}
+
+var pacer = &announcementQueue{queued: make(map[string]int)}
+
+// configure paces announcements as cfg asks.
+func (q *announcementQueue) configure(cfg Config) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limiter = nil
+	if cfg.AnnounceRate > 0 {
+		q.limiter = rate.NewLimiter(rate.Limit(cfg.AnnounceRate), max(cfg.AnnounceBurst, 1))
+	}
+}
+
+// enqueue queues answers for announcement when announcements are paced,
+// and reports whether it did.
+func (q *announcementQueue) enqueue(conns []*connector, limits packetLimits, answers []dns.RR) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.limiter == nil {
+		return false
+	}
+
+	for _, rr := range answers {
+		key := canonicalRecord(rr)
+		if i, ok := q.queued[key]; ok {
+			q.pending[i] = rr
+			continue
+		}
+		q.queued[key] = len(q.pending)
+		q.pending = append(q.pending, rr)
+	}
+	sortByPriority(q.pending)
+	q.reindex()
+	q.conns, q.limits = conns, limits
+
+	if !q.draining {
+		q.draining = true
+		go q.drain(q.limiter)
+	}
+	return true
+}
+
+// afterDrained calls fn once every announcement queued so far has been
+// sent, at once if none is queued.
+func (q *announcementQueue) afterDrained(fn func()) {
+	q.mu.Lock()
+	if q.draining {
+		q.drained = append(q.drained, fn)
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+	fn()
+}
+
+// drain sends the queued announcements a message at a time as limiter
+// allows, until the queue is empty. Once the zone is held, or in
+// respond-only mode, nothing more is sent, see stop.
+func (q *announcementQueue) drain(limiter *rate.Limiter) {
+	for {
+		reservation := limiter.ReserveN(clock().Now(), 1)
+		clock().Sleep(reservation.DelayFrom(clock().Now()))
+
+		local.mu.Lock()
+		silent := local.cfg.RespondOnly || local.held.Load()
+		local.mu.Unlock()
+		if silent {
+			q.stop()
+			return
+		}
+
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.draining = false
+			drained := q.drained
+			q.drained = nil
+			q.mu.Unlock()
+			for _, fn := range drained {
+				fn()
+			}
+			return
+		}
+		msg := q.limits.pack(newAnnouncement(), q.pending, nil)[0]
+		q.pending = append([]dns.RR(nil), q.pending[len(msg.Answer):]...)
+		q.reindex()
+		conns := q.conns
+		q.mu.Unlock()
+
+		recent.multicast(msg.Answer)
+		for _, c := range conns {
+			if !c.multicasts() {
+				continue
+			}
+			if err := c.writeMessage(msg, c.UDPAddr); err != nil {
+				log.Printf("Cannot announce on %s: %s", c.UDPAddr, err)
+			}
+		}
+	}
+}
+
+// stop empties the queue of a zone that stopped announcing. Announcements
+// are dropped, as the zone is announced again when it is released. The
+// goodbyes are withheld until then, see withhold, and so are the functions
+// waiting for them. In respond-only mode everything is dropped, as nothing
+// is ever sent.
+func (q *announcementQueue) stop() {
+	q.mu.Lock()
+	pending, drained := q.pending, q.drained
+	q.pending, q.drained = nil, nil
+	q.reindex()
+	q.draining = false
+	q.mu.Unlock()
+
+	local.mu.Lock()
+	if local.cfg.RespondOnly {
+		local.mu.Unlock()
+		return
+	}
+	if !local.held.Load() {
+		// Released meanwhile: send the goodbyes after all.
+		conns, limits := append([]*connector(nil), local.conns...), local.cfg.limits()
+		local.mu.Unlock()
+		var goodbyes []dns.RR
+		for _, rr := range pending {
+			if rr.Header().Ttl == 0 {
+				goodbyes = append(goodbyes, rr)
+			}
+		}
+		if len(goodbyes) > 0 {
+			multicast(conns, limits, goodbyes)
+		}
+		for _, fn := range drained {
+			q.afterDrained(fn)
+		}
+		return
+	}
+	for _, rr := range pending {
+		if rr.Header().Ttl == 0 {
+			local.withheld[canonicalRecord(rr)] = rr
+		}
+	}
+	local.waiters = append(local.waiters, drained...)
+	local.mu.Unlock()
+}
+
+// reindex rebuilds the index of the queued records after the queue
+// changed. The caller must hold q.mu.
+func (q *announcementQueue) reindex() {
+	clear(q.queued)
+	for i, rr := range q.pending {
+		q.queued[canonicalRecord(rr)] = i
+	}
+	metrics.AnnouncementBacklog.Set(float64(len(q.pending)))
+}
@@ -0,0 +1,86 @@
+package mdns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What to do when the process lacks the privileges to open the sockets,
+// see Config.MissingPrivileges.
+const (
+	// MissingPrivilegesFail fails to start, listing the securityContext
+	// settings that grant the missing privileges.
+	MissingPrivilegesFail = "fail"
+	// MissingPrivilegesAvahi publishes address records through
+	// avahi-daemon instead of answering queries ourselves.
+	MissingPrivilegesAvahi = "avahi"
+)
+
+// Privilege is a Linux capability the configuration needs.
+type Privilege struct {
+	// Capability is named as in a securityContext, such as
+	// NET_BIND_SERVICE.
+	Capability string
+	// Reason is what the capability is needed for.
+	Reason string
+}
+
+// PrivilegeError reports that the sockets cannot be opened with the
+// privileges of the process.
+type PrivilegeError struct {
+	// Missing are the capabilities needed but not held.
+	Missing []Privilege
+	// NonRoot is set when the process does not run as root, so that
+	// capabilities added to its container are not effective.
+	NonRoot bool
+	// Seccomp is set when the capabilities are held but a seccomp filter
+	// is in force, which then likely rejected the call.
+	Seccomp bool
+	// Err is the error of the call that failed, nil when the privileges
+	// were found missing before trying.
+	Err error
+}
+
+func (e *PrivilegeError) Error() string {
+	var causes []string
+	for _, p := range e.Missing {
+		causes = append(causes, fmt.Sprintf("CAP_%s to %s", p.Capability, p.Reason))
+	}
+	msg := "insufficient privileges"
+	switch {
+	case len(causes) > 0:
+		msg += ", missing " + strings.Join(causes, " and ")
+	case e.Seccomp:
+		msg += ", the call is likely blocked by the seccomp profile"
+	}
+	if e.Err != nil {
+		msg = e.Err.Error() + " (" + msg + ")"
+	}
+	return msg
+}
+
+func (e *PrivilegeError) Unwrap() error {
+	return e.Err
+}
+
+// SecurityContext returns the container securityContext settings that
+// grant the missing privileges, as YAML.
+func (e *PrivilegeError) SecurityContext() string {
+	var b strings.Builder
+	b.WriteString("securityContext:\n")
+	if len(e.Missing) > 0 {
+		names := make([]string, len(e.Missing))
+		for i, p := range e.Missing {
+			names[i] = fmt.Sprintf("%q", p.Capability)
+		}
+		fmt.Fprintf(&b, "  capabilities:\n    add: [%s]\n", strings.Join(names, ", "))
+		if e.NonRoot {
+			// Added capabilities only reach the effective set of root.
+			b.WriteString("  runAsUser: 0\n  runAsNonRoot: false\n")
+		}
+	}
+	if e.Seccomp {
+		b.WriteString("  seccompProfile:\n    type: Unconfined\n")
+	}
+	return b.String()
+}
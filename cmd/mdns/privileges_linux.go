@@ -0,0 +1,114 @@
+package mdns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capability is a required Linux capability and its bit in the capability
+// sets of /proc/self/status.
+type capability struct {
+	Privilege
+	bit uint
+}
+
+// requiredCapabilities returns the capabilities cfg needs to open its
+// sockets. Inherited sockets and transports need none.
+func requiredCapabilities(cfg Config) []capability {
+	if len(cfg.Sockets) > 0 || len(cfg.Transports) > 0 {
+		return nil
+	}
+	var caps []capability
+	if start := unprivilegedPortStart(); cfg.Port != 0 && cfg.Port < start {
+		caps = append(caps, capability{Privilege{"NET_BIND_SERVICE", fmt.Sprintf("bind port %d, below net.ipv4.ip_unprivileged_port_start %d", cfg.Port, start)}, unix.CAP_NET_BIND_SERVICE})
+	}
+	if cfg.NetNS != "" {
+		caps = append(caps, capability{Privilege{"SYS_ADMIN", fmt.Sprintf("enter network namespace %q", cfg.NetNS)}, unix.CAP_SYS_ADMIN})
+	}
+	return caps
+}
+
+// unprivilegedPortStart returns the lowest port bound without
+// CAP_NET_BIND_SERVICE.
+func unprivilegedPortStart() int {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 1024
+	}
+	return start
+}
+
+// processStatus returns the effective capabilities of the process and
+// whether a seccomp filter is in force. Both are zero when
+// /proc/self/status cannot be read.
+func processStatus() (effective uint64, seccomp bool, ok bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, false, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		value = strings.TrimSpace(value)
+		switch key {
+		case "CapEff":
+			if effective, err = strconv.ParseUint(value, 16, 64); err == nil {
+				ok = true
+			}
+		case "Seccomp":
+			seccomp = value == "2"
+		}
+	}
+	return effective, seccomp, ok
+}
+
+// missingPrivileges returns the capabilities cfg needs that are not in the
+// effective set.
+func missingPrivileges(cfg Config, effective uint64) []Privilege {
+	var missing []Privilege
+	for _, c := range requiredCapabilities(cfg) {
+		if effective&(1<<c.bit) == 0 {
+			missing = append(missing, c.Privilege)
+		}
+	}
+	return missing
+}
+
+// privilegeFailure explains err, a permission error opening the sockets
+// for cfg, as the capabilities missing or else the seccomp filter.
+func privilegeFailure(cfg Config, err error) error {
+	effective, seccomp, ok := processStatus()
+	if !ok {
+		return err
+	}
+	perr := &PrivilegeError{Missing: missingPrivileges(cfg, effective), NonRoot: os.Geteuid() != 0, Err: err}
+	perr.Seccomp = len(perr.Missing) == 0 && seccomp
+	if len(perr.Missing) == 0 && !perr.Seccomp {
+		return err
+	}
+	return perr
+}
+
+// checkPrivileges returns a PrivilegeError when the process lacks a
+// capability cfg needs, before any socket fails for it.
+func checkPrivileges(cfg Config) error {
+	effective, _, ok := processStatus()
+	if !ok {
+		return nil
+	}
+	missing := missingPrivileges(cfg, effective)
+	if len(missing) == 0 {
+		return nil
+	}
+	return &PrivilegeError{Missing: missing, NonRoot: os.Geteuid() != 0}
+}
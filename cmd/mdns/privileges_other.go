@@ -0,0 +1,14 @@
+//go:build !linux
+
+package mdns
+
+// privilegeFailure returns err. Capabilities are only inspected on Linux.
+func privilegeFailure(cfg Config, err error) error {
+	return err
+}
+
+// checkPrivileges finds nothing missing. Capabilities are only inspected
+// on Linux.
+func checkPrivileges(cfg Config) error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Probe sends a multicast query for name's A record to group from a
+// separate, unbound socket in the responder's network namespace and waits
+// for the answer. As the query comes from an ephemeral port, the responder
+// answers it directly (legacy unicast), which is the only reply that can
+// be received on the same host. It returns the round trip time.
+func Probe(group *net.UDPAddr, name string, timeout time.Duration) (time.Duration, error) {
+	_, rtt, err := Lookup(group, name, dns.TypeA, timeout)
+	return rtt, err
+}
+
+// OpenQuerySocket opens an unbound socket of group's address family in the
+// responder's network namespace, to send legacy unicast queries from.
+func OpenQuerySocket(group *net.UDPAddr) (*net.UDPConn, error) {
+	local.mu.Lock()
+	ns := local.cfg.NetNS
+	local.mu.Unlock()
+
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	var conn *net.UDPConn
+	err := inNetNS(ns, func() (err error) {
+		conn, err = net.ListenUDP(network, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open probe socket: %w", err)
+	}
+	return conn, nil
+}
+
+// Lookup sends a legacy unicast query for name's records of type qtype to
+// group, as Probe does, and returns the answers of the first responder to
+// reply along with the round trip time. It works without a running
+// responder, so it can be used to check what the LAN resolves. When the
+// responder answers over a MemoryTransport, the query goes to it instead.
+func Lookup(group *net.UDPAddr, name string, qtype uint16, timeout time.Duration) ([]dns.RR, time.Duration, error) {
+	return lookup(group, name, qtype, timeout, nil)
+}
+
+// LookupRemote is Lookup taking only answers from other hosts: replies from
+// the addresses of the interfaces in the responder's network namespace,
+// such as those of the responder itself, which receives the query through
+// multicast loopback, are ignored.
+func LookupRemote(group *net.UDPAddr, name string, qtype uint16, timeout time.Duration) ([]dns.RR, time.Duration, error) {
+	local.mu.Lock()
+	ns := local.cfg.NetNS
+	local.mu.Unlock()
+
+	own := make(map[string]bool)
+	for _, n := range localSubnets(ns) {
+		own[n.IP.String()] = true
+	}
+	return lookup(group, name, qtype, timeout, func(from net.IP) bool { return !own[from.String()] })
+}
+
+// lookup sends the query of Lookup and returns the first answers from a
+// source accept allows, or from any when accept is nil.
+func lookup(group *net.UDPAddr, name string, qtype uint16, timeout time.Duration, accept func(net.IP) bool) ([]dns.RR, time.Duration, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	query.RecursionDesired = false
+	if t := memoryTransportFor(group); t != nil {
+		return t.lookup(query, qtype, timeout)
+	}
+
+	conn, err := OpenQuerySocket(group)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteToUDP(buf, group); err != nil {
+		return nil, 0, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	conn.SetReadDeadline(start.Add(timeout))
+	reply := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(reply)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, 0, fmt.Errorf("no answer within %s", timeout)
+			}
+			return nil, 0, err
+		}
+		if accept != nil && !accept(from.IP) {
+			continue
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(reply[:n]); err != nil || msg.Id != query.Id {
+			continue
+		}
+		if answers := answersTo(query, &msg, qtype); len(answers) > 0 {
+			return answers, time.Since(start), nil
+		}
+	}
+}
+
+// answersTo returns the answers in msg of type qtype for the name query
+// asked about.
+func answersTo(query, msg *dns.Msg, qtype uint16) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype == qtype && rr.Header().Name == query.Question[0].Name {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
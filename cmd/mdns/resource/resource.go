@@ -14,6 +14,8 @@
 
 package resource
 
+import "time"
+
 const (
 	Added   = "ADD"
 	Deleted = "DELETE"
@@ -23,9 +25,60 @@ const (
 // Resource represents a resource to advertise over mDNS
 type Resource struct {
 	SourceType       string
+	SourceName       string    // Name of the Kubernetes object
+	File             string    // The file the resource was read from, for file sources
+	Object           ObjectRef // The Kubernetes object, when built from one
+	Created          time.Time // Creation time of the Kubernetes object
+	Priority         int       // Higher priority wins short-name conflicts
+	PriorityClass    string    // Named class, ranks before Priority
+	TTL              int       // Overrides the record-ttl flag when positive
 	Action           string
 	IPs              []string
+	Ports            []int // TCP ports served on IPs, for reachability probes
 	Names            []string
 	Namespace        string
-	WithoutNamespace bool // For service annotation override, not global flag
+	WithoutNamespace bool     // For service annotation override, not global flag
+	HyphenatedNames  *bool    // Overrides the hyphenated-names flag when set
+	RecordStrategy   string   // Overrides the record-strategy flag when set
+	Records          []string // Further records published as they are, e.g. from a zone file; not addresses, which go in IPs to get PTRs
+	PTRName          string   // When set, the only name reverse lookups of the IPs return
+	RecordTypes      []string // When set, the only types of address records published: A, AAAA and PTR
+	Shared           *bool    // Overrides whether the records are shared or unique when set
+	DNSSD            []DNSSDService
+	SSDP             *SSDPDevice
+	WSD              *WSDDevice
+}
+
+// ObjectRef identifies the Kubernetes object a resource was built from,
+// beyond its namespace and name.
+type ObjectRef struct {
+	APIVersion      string
+	Kind            string
+	UID             string
+	ResourceVersion string
+	Terminating     bool // The object has a deletionTimestamp
+}
+
+// DNSSDService describes a DNS-SD instance advertised for a resource, on
+// Port of its first name.
+type DNSSDService struct {
+	Type string // Service type, such as _https._tcp
+	Port int
+	TXT  []string // key=value pairs
+}
+
+// SSDPDevice describes a UPnP device announced over SSDP for a resource.
+// {ip} in Location is replaced by each published IPv4 address.
+type SSDPDevice struct {
+	DeviceType string
+	Location   string
+	UUID       string
+}
+
+// WSDDevice describes a WS-Discovery target service for a resource. {ip}
+// in XAddrs is replaced by each published IPv4 address.
+type WSDDevice struct {
+	Types  []string
+	XAddrs string
+	UUID   string
 }
@@ -0,0 +1,80 @@
+package mdns
+
+import (
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Multicast responses with shared records are sent after a random delay in
+// this range (RFC 6762 section 6), so answers from the other responders
+// for the same record set do not all collide.
+const (
+	minSharedResponseDelay = 20 * time.Millisecond
+	maxSharedResponseDelay = 120 * time.Millisecond
+)
+
+var sharing = struct {
+	mu    sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// SetSharing overrides whether the records of name are shared or unique,
+// for deployments where several responders deliberately answer for the
+// same records. nil drops the override.
+func SetSharing(name string, shared *bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	sharing.mu.Lock()
+	defer sharing.mu.Unlock()
+	if shared == nil {
+		delete(sharing.names, name)
+	} else {
+		sharing.names[name] = *shared
+	}
+}
+
+// forgetSharing drops the override of name once it has no records left.
+func forgetSharing(name string) {
+	sharing.mu.Lock()
+	defer sharing.mu.Unlock()
+	delete(sharing.names, strings.ToLower(name))
+}
+
+// isShared reports whether rr belongs to a shared record set, one other
+// responders may hold records of too. Unless overridden with SetSharing,
+// those are the PTR records of DNS-SD service types and service
+// enumeration. Shared records never have the cache-flush bit set (RFC 6762
+// section 10.2). Reverse address PTRs, like every other record we publish,
+// are unique.
+func isShared(rr dns.RR) bool {
+	sharing.mu.Lock()
+	shared, ok := sharing.names[strings.ToLower(rr.Header().Name)]
+	sharing.mu.Unlock()
+	if ok {
+		return shared
+	}
+	if rr.Header().Rrtype != dns.TypePTR {
+		return false
+	}
+	name := dns.CanonicalName(rr.Header().Name)
+	return !dns.IsSubDomain("in-addr.arpa.", name) && !dns.IsSubDomain("ip6.arpa.", name)
+}
+
+// containsShared reports whether any of rrs is a shared record.
+func containsShared(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if isShared(rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedResponseDelay returns a random delay for a response with shared
+// records.
+func sharedResponseDelay() time.Duration {
+	return minSharedResponseDelay + rand.N(maxSharedResponseDelay-minSharedResponseDelay+1)
+}
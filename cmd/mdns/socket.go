@@ -0,0 +1,166 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// openSocket binds a wildcard UDP socket on the group's port, applies the
+// configured socket options and joins the multicast group.
+func openSocket(addr *net.UDPAddr, cfg Config) (*net.UDPConn, error) {
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	var pc net.PacketConn
+	err := inNetNS(cfg.NetNS, func() (err error) {
+		lc := net.ListenConfig{Control: socketControl(cfg)}
+		if pc, err = lc.ListenPacket(context.Background(), network, net.JoinHostPort("", strconv.Itoa(addr.Port))); err != nil {
+			return bindError(addr, cfg, err)
+		}
+		return nil
+	})
+	if err != nil {
+		if pc != nil {
+			pc.Close()
+		}
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+
+	if err := joinGroup(conn, addr, cfg); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to join multicast group %s: %w", addr.IP, err)
+	}
+	return conn, nil
+}
+
+// joinGroup subscribes conn to addr's multicast group on every multicast
+// interface, disables loopback of our own packets and applies the outgoing
+// TTL or hop limit when one is configured. Interfaces added later are
+// joined when the sockets are rebound, see WatchInterfaces.
+func joinGroup(conn *net.UDPConn, addr *net.UDPAddr, cfg Config) error {
+	group := &net.UDPAddr{IP: addr.IP}
+	ifaces, err := multicastInterfaces(cfg.NetNS)
+	if err != nil {
+		return err
+	}
+	if addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if err := joinEach(ifaces, group, p.JoinGroup); err != nil {
+			return err
+		}
+		if cfg.MulticastTTL > 0 {
+			if err := p.SetMulticastTTL(cfg.MulticastTTL); err != nil {
+				return fmt.Errorf("failed to set multicast TTL: %w", err)
+			}
+		}
+		return p.SetMulticastLoopback(false)
+	}
+	p := ipv6.NewPacketConn(conn)
+	if err := joinEach(ifaces, group, p.JoinGroup); err != nil {
+		return err
+	}
+	if cfg.HopLimit > 0 {
+		if err := p.SetMulticastHopLimit(cfg.HopLimit); err != nil {
+			return fmt.Errorf("failed to set multicast hop limit: %w", err)
+		}
+	}
+	return p.SetMulticastLoopback(false)
+}
+
+// joinEach joins group on each of ifaces, or on the system-assigned
+// interface if there are none. Interfaces that fail to join, such as one
+// without an address of the group's family, are logged and skipped; it
+// fails only if none of them joins.
+func joinEach(ifaces []net.Interface, group net.Addr, join func(*net.Interface, net.Addr) error) error {
+	if len(ifaces) == 0 {
+		return join(nil, group)
+	}
+	var firstErr error
+	joined := 0
+	for i := range ifaces {
+		if err := join(&ifaces[i], group); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("on %s: %w", ifaces[i].Name, err)
+			}
+			log.Printf("Failed to join multicast group %s on %s: %s", group, ifaces[i].Name, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		return firstErr
+	}
+	return nil
+}
+
+// multicastInterfaces returns the interfaces of network namespace netns
+// that are up and multicast capable, other than loopback.
+func multicastInterfaces(netns string) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	err := inNetNS(netns, func() error {
+		all, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, ifi := range all {
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, ifi)
+			}
+		}
+		return nil
+	})
+	return ifaces, err
+}
+
+// bindError annotates a bind failure with a hint about the likely cause.
+func bindError(addr *net.UDPAddr, cfg Config, err error) error {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		owners := portOwners(addr.Port)
+		if len(owners) == 0 {
+			hint := "another mDNS responder (avahi-daemon, systemd-resolved, mDNSResponder) is holding the port"
+			if !cfg.ReusePort {
+				hint += "; stop it or retry with --reuse-port"
+			} else {
+				hint += " without SO_REUSEPORT"
+			}
+			return fmt.Errorf("cannot bind %s: %w (%s)", addr, err, hint)
+		}
+		return fmt.Errorf("cannot bind %s: %w (port %d is held exclusively by %s; %s)",
+			addr, err, addr.Port, strings.Join(owners, ", "), remediation(owners[0], cfg.ReusePort))
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return fmt.Errorf("cannot bind %s: %w", addr, privilegeFailure(cfg, err))
+	}
+	return fmt.Errorf("cannot bind %s: %w", addr, err)
+}
+
+// remediation advises how to free the mDNS port from owner, as described
+// by portOwners.
+func remediation(owner string, reusePort bool) string {
+	switch {
+	case strings.HasPrefix(owner, "avahi-daemon"):
+		return "set disallow-other-stacks=no in avahi-daemon.conf and restart it, stop it, or publish through it with --port-conflict=avahi"
+	case strings.HasPrefix(owner, "systemd-resolve"):
+		return "set MulticastDNS=no in /etc/systemd/resolved.conf and restart systemd-resolved"
+	case strings.HasPrefix(owner, "mDNSResponder"):
+		if !reusePort {
+			return "retry with --reuse-port to share the port with mDNSResponder"
+		}
+		return "mDNSResponder does not share the port on this system"
+	case !reusePort:
+		return "stop it or retry with --reuse-port"
+	}
+	return "stop it, it does not share the port with SO_REUSEPORT"
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package mdns
+
+import (
+	"errors"
+	"syscall"
+)
+
+// socketControl returns a ListenConfig control function. Socket options are
+// not supported on this platform.
+func socketControl(cfg Config) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if cfg.ReusePort {
+			return errors.New("SO_REUSEPORT is not supported on this platform")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+package mdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxTrackedKeys bounds each table of query statistics, so a scan of
+// random names cannot grow them without limit. Names and clients first
+// seen once a table is full are only counted in the totals.
+const maxTrackedKeys = 10000
+
+// QueryCount is a name or client with the number of queries seen for it.
+type QueryCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// QueryReport summarises the queries received over a period.
+type QueryReport struct {
+	Since      time.Time    `json:"since"`
+	Queries    int          `json:"queries"`
+	TopNames   []QueryCount `json:"topNames"`
+	TopClients []QueryCount `json:"topClients"`
+	Unanswered []QueryCount `json:"unanswered"`
+}
+
+// queryStats counts questions by name and type, queries by client address,
+// and questions that got no answer.
+type queryStats struct {
+	since      time.Time
+	queries    int
+	names      map[string]int
+	clients    map[string]int
+	unanswered map[string]int
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		since:      clock().Now(),
+		names:      make(map[string]int),
+		clients:    make(map[string]int),
+		unanswered: make(map[string]int),
+	}
+}
+
+var stats = struct {
+	mu     sync.Mutex
+	total  *queryStats
+	window *queryStats
+}{total: newQueryStats(), window: newQueryStats()}
+
+// countQuery adds a query from client and the answers given to it to the
+// statistics.
+func countQuery(client *net.UDPAddr, questions []dns.Question, answers []dns.RR) {
+	answered := make(map[string]bool, len(answers))
+	for _, rr := range answers {
+		answered[strings.ToLower(rr.Header().Name)] = true
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	for _, s := range []*queryStats{stats.total, stats.window} {
+		s.queries++
+		increment(s.clients, client.IP.String())
+		for _, q := range questions {
+			key := strings.TrimSuffix(strings.ToLower(q.Name), ".") + " " + dns.TypeToString[q.Qtype]
+			increment(s.names, key)
+			if !answered[strings.ToLower(q.Name)] {
+				increment(s.unanswered, key)
+			}
+		}
+	}
+}
+
+func increment(counts map[string]int, key string) {
+	if _, ok := counts[key]; ok || len(counts) < maxTrackedKeys {
+		counts[key]++
+	}
+}
+
+// report returns the top entries of each table.
+func (s *queryStats) report(top int) QueryReport {
+	return QueryReport{
+		Since:      s.since,
+		Queries:    s.queries,
+		TopNames:   topCounts(s.names, top),
+		TopClients: topCounts(s.clients, top),
+		Unanswered: topCounts(s.unanswered, top),
+	}
+}
+
+func topCounts(counts map[string]int, top int) []QueryCount {
+	list := make([]QueryCount, 0, len(counts))
+	for k, n := range counts {
+		list = append(list, QueryCount{Key: k, Count: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
+
+// QueryStats reports the top names, clients and unanswered names since the
+// responder started.
+func QueryStats(top int) QueryReport {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.total.report(top)
+}
+
+// TakeQueryWindow reports the top names, clients and unanswered names since
+// the previous call and starts a new window.
+func TakeQueryWindow(top int) QueryReport {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	r := stats.window.report(top)
+	stats.window = newQueryStats()
+	return r
+}
@@ -0,0 +1,171 @@
+package mdns
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Transport carries the packets of one multicast group for a connector:
+// a UDP socket joined to the group, or a MemoryTransport.
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// Packet is a message exchanged over a MemoryTransport.
+type Packet struct {
+	Data []byte
+	Addr *net.UDPAddr // where a packet sent goes, where a packet received came from
+}
+
+// MemoryTransport is a Transport within the process, for tests and
+// simulations that exercise the responder without a network: queries are
+// handed to it with Inject, and what it sends is read with Subscribe.
+type MemoryTransport struct {
+	group *net.UDPAddr
+	in    chan Packet
+	done  chan struct{}
+	once  sync.Once
+
+	mu          sync.Mutex
+	subscribers map[chan Packet]bool
+}
+
+// NewMemoryTransport returns a MemoryTransport for the multicast group,
+// which is also its local address.
+func NewMemoryTransport(group *net.UDPAddr) *MemoryTransport {
+	return &MemoryTransport{
+		group:       group,
+		in:          make(chan Packet, 32),
+		done:        make(chan struct{}),
+		subscribers: make(map[chan Packet]bool),
+	}
+}
+
+// LocalAddr returns the multicast group of t.
+func (t *MemoryTransport) LocalAddr() net.Addr {
+	return t.group
+}
+
+// ReadFromUDP returns the next packet injected, blocking until there is
+// one or t is closed.
+func (t *MemoryTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-t.in:
+		return copy(b, p.Data), p.Addr, nil
+	case <-t.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteToUDP hands a copy of b to every subscriber with room for it.
+func (t *MemoryTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-t.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	p := Packet{Data: bytes.Clone(b), Addr: addr}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ch := range t.subscribers {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+// Close stops t. Reads and writes fail with net.ErrClosed from then on.
+func (t *MemoryTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// Inject hands data to the responder as a packet received from from.
+func (t *MemoryTransport) Inject(data []byte, from *net.UDPAddr) error {
+	select {
+	case t.in <- Packet{Data: bytes.Clone(data), Addr: from}:
+		return nil
+	case <-t.done:
+		return net.ErrClosed
+	}
+}
+
+// Subscribe returns the packets sent over t from now on, until cancel is
+// called. Packets are dropped while the channel, of the given buffer
+// size, is full.
+func (t *MemoryTransport) Subscribe(buffer int) (packets <-chan Packet, cancel func()) {
+	ch := make(chan Packet, buffer)
+	t.mu.Lock()
+	t.subscribers[ch] = true
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers, ch)
+	}
+}
+
+// memoryTransportFor returns the MemoryTransport the responder answers on
+// for the address family of group, if any.
+func memoryTransportFor(group *net.UDPAddr) *MemoryTransport {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	for _, c := range local.conns {
+		t, ok := c.Transport.(*MemoryTransport)
+		if ok && (t.group.IP.To4() == nil) == (group.IP.To4() == nil) {
+			return t
+		}
+	}
+	return nil
+}
+
+// lookup sends query to the responder over t as a legacy unicast query
+// from a link-local address, and returns the answers of type qtype for
+// the name asked along with the round trip time, as Lookup does.
+func (t *MemoryTransport) lookup(query *dns.Msg, qtype uint16, timeout time.Duration) ([]dns.RR, time.Duration, error) {
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	from := &net.UDPAddr{IP: net.IPv4(169, 254, 0, 1), Port: 49152}
+	if t.group.IP.To4() == nil {
+		from.IP = net.ParseIP("fe80::1")
+	}
+
+	sent, cancel := t.Subscribe(16)
+	defer cancel()
+	start := clock().Now()
+	if err := t.Inject(buf, from); err != nil {
+		return nil, 0, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	expired := make(chan struct{})
+	clock().AfterFunc(timeout, func() { close(expired) })
+	for {
+		select {
+		case p := <-sent:
+			if !p.Addr.IP.Equal(from.IP) || p.Addr.Port != from.Port {
+				continue
+			}
+			var msg dns.Msg
+			if err := msg.Unpack(p.Data); err != nil || msg.Id != query.Id {
+				continue
+			}
+			if answers := answersTo(query, &msg, qtype); len(answers) > 0 {
+				return answers, clock().Now().Sub(start), nil
+			}
+		case <-expired:
+			return nil, 0, fmt.Errorf("no answer within %s", timeout)
+		}
+	}
+}
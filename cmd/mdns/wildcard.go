@@ -0,0 +1,89 @@
+package mdns
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// wildcards holds the wildcard names whose records answer queries for the
+// names below them, see Config.Wildcards.
+var wildcards atomic.Pointer[map[string]bool]
+
+// setWildcards makes the records of the wildcard names in patterns answer
+// for the names below them.
+func setWildcards(patterns []string) {
+	configured := make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		configured[pattern] = true
+	}
+	wildcards.Store(&configured)
+}
+
+// isWildcard reports whether name is one of the configured wildcard names,
+// whose first label is an asterisk, such as *.preview.local.
+func isWildcard(name string) bool {
+	configured := wildcards.Load()
+	return configured != nil && (*configured)[name]
+}
+
+// CheckWildcard returns an error unless pattern, a fully qualified name, can
+// be configured as a wildcard name. Wildcards directly under a top-level
+// name such as local. would answer for every name on the link, and none
+// are allowed in the reverse zones under arpa.
+func CheckWildcard(pattern string) error {
+	parent, ok := strings.CutPrefix(pattern, "*.")
+	switch {
+	case !ok || parent == "" || strings.Contains(parent, "*"):
+		return fmt.Errorf("%q is not a wildcard name such as *.preview.local", pattern)
+	case dns.CountLabel(parent) < 2:
+		return fmt.Errorf("%q would answer for every name under %s", pattern, parent)
+	case dns.IsSubDomain("arpa.", parent):
+		return fmt.Errorf("%q is in a reverse zone", pattern)
+	}
+	return nil
+}
+
+// wildcardMatches returns the entries of the configured wildcard name that
+// answers for name, which has no entries of its own, renamed to name as RFC
+// 4592 section 3.3.1 synthesizes them. The wildcard is taken from the
+// closest existing ancestor of name only, so names in the zone shadow the
+// wildcards above them. It runs on the zone's main loop.
+func (z *zone) wildcardMatches(name string) []*entry {
+	if configured := wildcards.Load(); configured == nil || len(*configured) == 0 {
+		return nil
+	}
+	for ancestor := name; ; {
+		_, parent, ok := strings.Cut(ancestor, ".")
+		if !ok || parent == "" {
+			return nil
+		}
+		if matches := z.entries["*."+parent]; len(matches) > 0 && isWildcard("*."+parent) {
+			synthesized := make([]*entry, len(matches))
+			for i, e := range matches {
+				rr := dns.Copy(e.RR)
+				rr.Header().Name = name
+				synthesized[i] = &entry{rr}
+			}
+			return synthesized
+		}
+		if len(z.entries[parent]) > 0 {
+			return nil
+		}
+		ancestor = parent
+	}
+}
+
+// withoutWildcards drops the records of configured wildcard names from
+// answers. They only answer queries, so they are never announced.
+func withoutWildcards(answers []dns.RR) []dns.RR {
+	kept := answers[:0]
+	for _, rr := range answers {
+		if !isWildcard(rr.Header().Name) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,69 @@
+package mdns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// withdrawn remembers the names recently removed from the zone, so queries
+// for them can be answered negatively for Config.WithdrawnGrace instead of
+// being left to time out.
+var withdrawn = struct {
+	mu    sync.Mutex
+	grace time.Duration
+	names map[string]time.Time // when each name was withdrawn
+}{names: make(map[string]time.Time)}
+
+// noteWithdrawn records that the last record of name was removed.
+func noteWithdrawn(name string) {
+	withdrawn.mu.Lock()
+	defer withdrawn.mu.Unlock()
+	if withdrawn.grace <= 0 {
+		return
+	}
+	now := clock().Now()
+	for n, since := range withdrawn.names {
+		if now.Sub(since) >= withdrawn.grace {
+			delete(withdrawn.names, n)
+		}
+	}
+	withdrawn.names[name] = now
+}
+
+// forgetWithdrawn drops name, published again.
+func forgetWithdrawn(name string) {
+	withdrawn.mu.Lock()
+	defer withdrawn.mu.Unlock()
+	delete(withdrawn.names, name)
+}
+
+// negativeAnswers returns, for each question about a name withdrawn within
+// the grace period, an NSEC record asserting the name has no records
+// (RFC 6762 section 6.1), with a TTL of the time left in the grace period.
+func negativeAnswers(qs []dns.Question) []dns.RR {
+	withdrawn.mu.Lock()
+	defer withdrawn.mu.Unlock()
+
+	var answers []dns.RR
+	seen := make(map[string]bool)
+	for _, q := range qs {
+		since, ok := withdrawn.names[q.Name]
+		left := withdrawn.grace - clock().Now().Sub(since)
+		if !ok || left <= 0 || seen[q.Name] {
+			continue
+		}
+		seen[q.Name] = true
+		answers = append(answers, &dns.NSEC{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeNSEC,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(max(left/time.Second, 1)),
+			},
+			NextDomain: q.Name,
+		})
+	}
+	return answers
+}
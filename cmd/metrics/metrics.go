@@ -0,0 +1,216 @@
+// Package metrics defines the Prometheus metrics exported by external-mdns.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "external_mdns"
+
+var (
+	// ServicesAwaitingIP counts LoadBalancer services waiting for an
+	// address to be assigned.
+	ServicesAwaitingIP = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services_awaiting_ip",
+		Help:      "LoadBalancer services waiting for an address to be assigned.",
+	})
+
+	// WatchErrors counts failed watches against the API server.
+	WatchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_errors_total",
+		Help:      "Failed watches against the Kubernetes API server.",
+	}, []string{"resource"})
+
+	// WatchReconnects counts watches that recovered after failing.
+	WatchReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_reconnects_total",
+		Help:      "Watches that recovered after failing.",
+	}, []string{"resource"})
+
+	// ZoneStale is 1 while a watch has been failing for longer than
+	// --stale-zone-after.
+	ZoneStale = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zone_stale",
+		Help:      "Whether the published zone may be outdated because the API server is unreachable.",
+	})
+
+	// DuplicateResponders is the number of other responders seen answering
+	// for our names in the last --duplicate-check-interval.
+	DuplicateResponders = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "duplicate_responders",
+		Help:      "Other responders seen answering for published names in the last check interval.",
+	})
+
+	// DuplicateAnswers counts records for our names answered by other
+	// responders.
+	DuplicateAnswers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_answers_total",
+		Help:      "Records for published names answered by other responders.",
+	})
+
+	// ZoneMemory estimates the memory held by the published records.
+	ZoneMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zone_memory_bytes",
+		Help:      "Estimated memory held by the published records.",
+	})
+
+	// ZoneMemoryBudget is --zone-memory-budget in bytes, 0 when unlimited.
+	ZoneMemoryBudget = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zone_memory_budget_bytes",
+		Help:      "Memory budget of the published records, 0 when unlimited.",
+	})
+
+	// EvictedResources is the number of resources withdrawn to keep the
+	// zone within its memory budget.
+	EvictedResources = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "evicted_resources",
+		Help:      "Resources currently withdrawn to keep the zone within its memory budget.",
+	})
+
+	// ProbeUp is 1 while an address of a resource passes its reachability
+	// probes and 0 once it has failed --probe-failures in a row.
+	ProbeUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "probe_up",
+		Help:      "Whether a published address of a resource is reachable, see --probe.",
+	}, []string{"resource", "address"})
+
+	// ProbeFailures counts failed reachability probes of an address of a
+	// resource.
+	ProbeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "probe_failures_total",
+		Help:      "Failed reachability probes of a published address of a resource.",
+	}, []string{"resource", "address"})
+
+	// ProbeDuration is how long the last reachability probe of an address
+	// of a resource took.
+	ProbeDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "probe_duration_seconds",
+		Help:      "Duration of the last reachability probe of a published address of a resource.",
+	}, []string{"resource", "address"})
+
+	// CanaryObjects is the number of objects whose records are published
+	// as canaries, see --canary-window.
+	CanaryObjects = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "canary_objects",
+		Help:      "Objects whose records are published with the canary TTL until they pass a reachability probe.",
+	})
+
+	// Evictions counts resources evicted to keep the zone within its
+	// memory budget.
+	Evictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evictions_total",
+		Help:      "Resources evicted to keep the zone within its memory budget.",
+	})
+
+	// OffLinkQueries counts queries ignored because their source address
+	// is not on the link they were received on.
+	OffLinkQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "off_link_queries_total",
+		Help:      "Queries ignored because they came from outside the local subnets.",
+	})
+
+	// AnnouncementBacklog is the number of records waiting to be
+	// announced while announcements are paced.
+	AnnouncementBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "announcement_backlog",
+		Help:      "Records queued for announcement while announcements are paced.",
+	})
+
+	// SentBytes counts the bytes of the mDNS messages sent, by whether
+	// they were multicast or unicast.
+	SentBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sent_bytes_total",
+		Help:      "Bytes of mDNS messages sent, by multicast or unicast destination.",
+	}, []string{"destination"})
+
+	// UnregisteredAddresses counts addresses found missing from the IPAM
+	// system when their resource was published.
+	UnregisteredAddresses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unregistered_addresses_total",
+		Help:      "Addresses about to be published that are not registered in IPAM.",
+	})
+
+	// SelfResolvable is the fraction of the names sampled in the last
+	// --verify-interval that resolved over multicast.
+	SelfResolvable = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "self_resolvable",
+		Help:      "Fraction of the published names sampled in the last verification round that resolved over multicast.",
+	})
+
+	// VerificationFailures counts sampled names that did not resolve over
+	// multicast.
+	VerificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verification_failures_total",
+		Help:      "Published names that did not resolve when queried over multicast.",
+	})
+
+	// OrphansCollected counts resources withdrawn because the object they
+	// were built from was no longer in the cache of their source.
+	OrphansCollected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orphans_collected_total",
+		Help:      "Resources withdrawn because their object was missing from the source cache without a delete event.",
+	}, []string{"source"})
+
+	// HookFailures counts record hooks that failed or timed out.
+	HookFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hook_failures_total",
+		Help:      "Record hooks that failed or timed out.",
+	}, []string{"hook"})
+
+	// SourceObjects is the number of objects in the cache of each
+	// informer, refreshed every few seconds.
+	SourceObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_objects",
+		Help:      "Objects in the informer cache of a source.",
+	}, []string{"resource"})
+
+	// SourceLastEvent is when a source last handled an add, update or
+	// delete event.
+	SourceLastEvent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_last_event_timestamp_seconds",
+		Help:      "Unix time a source last handled an event, by event type.",
+	}, []string{"resource", "event"})
+
+	// SourceBacklog is the number of events received by an informer that
+	// its source has yet to handle.
+	SourceBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_backlog",
+		Help:      "Events received by the informer of a source and not yet handled.",
+	}, []string{"resource"})
+
+	// PublishLatency is the time from a Kubernetes event arriving to the
+	// records built from it being applied to the zone. With tracing
+	// enabled, observations carry the trace ID of the event as exemplar.
+	PublishLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_latency_seconds",
+		Help:      "Time from a Kubernetes event arriving to its records being applied to the zone, by source.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"source"})
+)
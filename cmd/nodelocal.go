@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodeAddresses holds the addresses of this node when running in
+// node-local mode, and is nil otherwise.
+var nodeAddresses map[string]bool
+
+// nodeName returns --node-name, falling back to the NODE_NAME environment
+// variable usually populated from the downward API.
+func nodeName() string {
+	if name := conf.NodeName; name != "" {
+		return name
+	}
+	return os.Getenv("NODE_NAME")
+}
+
+// loadNodeAddresses looks up the internal and external addresses of the
+// node this instance runs on.
+func loadNodeAddresses(client kubernetes.Interface) (map[string]bool, error) {
+	name := nodeName()
+	if name == "" {
+		return nil, fmt.Errorf("node-local mode needs --%s or the NODE_NAME environment variable", config.NodeName)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %w", name, err)
+	}
+
+	addresses := make(map[string]bool)
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP || addr.Type == corev1.NodeExternalIP {
+			addresses[addr.Address] = true
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("node %s reports no addresses", name)
+	}
+	return addresses, nil
+}
+
+// nodeLocalIPs returns the addresses of ips this instance publishes: in
+// node-local mode, those of this node. A resource with none on this node,
+// such as a LoadBalancer service or an Ingress whose controller pods run
+// elsewhere, is skipped, or published with all of its addresses under
+// --node-local-fallback, so clients are answered with an endpoint on the
+// node that responds when there is one and with any endpoint otherwise.
+func nodeLocalIPs(ips []string) []string {
+	if nodeAddresses == nil {
+		return ips
+	}
+	local := slices.DeleteFunc(slices.Clone(ips), func(ip string) bool { return !nodeAddresses[ip] })
+	if len(local) == 0 && conf.NodeLocalFallback {
+		return ips
+	}
+	return local
+}
+
+// nodeAddressList returns the node's addresses, or nil when not running in
+// node-local mode.
+func nodeAddressList() []string {
+	if nodeAddresses == nil {
+		return nil
+	}
+	list := make([]string, 0, len(nodeAddresses))
+	for addr := range nodeAddresses {
+		list = append(list, addr)
+	}
+	return list
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+)
+
+// orphanCollector withdraws resources whose object has gone missing from
+// the cache of their source without a delete event reaching the main loop,
+// such as after a missed watch event, so their records do not stay
+// published for as long as the process runs. Only the main loop uses it.
+type orphanCollector struct {
+	ticks  <-chan time.Time // nil when disabled
+	after  int
+	misses map[string]int // consecutive periods missing, by liveKey
+}
+
+// newOrphanCollector checks the live resources every resync period and
+// withdraws those missing for after periods in a row. It is disabled when
+// either is zero.
+func newOrphanCollector(after int, resync time.Duration) *orphanCollector {
+	c := &orphanCollector{after: after, misses: make(map[string]int)}
+	if after > 0 && resync > 0 {
+		c.ticks = time.NewTicker(resync).C
+	}
+	return c
+}
+
+// collect counts the live resources whose object is missing and withdraws
+// those missing for long enough. Resources of sources not backed by
+// informers, or whose informers have not synced, are left alone.
+func (c *orphanCollector) collect(live map[string]resource.Resource) {
+	for key := range c.misses {
+		if _, ok := live[key]; !ok {
+			delete(c.misses, key)
+		}
+	}
+	for key, r := range live {
+		observed, known := source.Observed(r)
+		if !known || observed {
+			delete(c.misses, key)
+			continue
+		}
+		c.misses[key]++
+		if c.misses[key] < c.after {
+			continue
+		}
+
+		lg.Warn("Object missing from the source cache without a delete event, withdrawing its records",
+			zap.String("resource", ownerKey(r)), zap.String("uid", r.Object.UID), zap.Int("periods", c.misses[key]))
+		metrics.OrphansCollected.WithLabelValues(r.SourceType).Inc()
+		delete(c.misses, key)
+		r.Action = resource.Deleted
+		applyResource(live, r)
+	}
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// permissionCheckTimeout bounds each access review sent at startup.
+const permissionCheckTimeout = 10 * time.Second
+
+// watchedResource is a resource a source lists and watches, in namespace or
+// in every namespace when it is empty.
+type watchedResource struct {
+	group, resource, namespace string
+}
+
+func (w watchedResource) String() string {
+	name := w.resource
+	if w.group != "" {
+		name += "." + w.group
+	}
+	if w.namespace == "" {
+		return name + " in all namespaces"
+	}
+	return name + " in namespace " + w.namespace
+}
+
+// sourceResources returns the resources src lists and watches, or nil for
+// sources not backed by the cluster. Gateway API route kinds are left out,
+// startGatewaySource skips the ones it may not watch by itself.
+func sourceResources(src string) []watchedResource {
+	var kinds []watchedResource
+	switch src {
+	case "service":
+		kinds = append(kinds, watchedResource{resource: "services"})
+		if conf.RequireReadyEndpoints {
+			kinds = append(kinds, watchedResource{group: "discovery.k8s.io", resource: "endpointslices"})
+		}
+	case "ingress":
+		kinds = append(kinds, watchedResource{group: "networking.k8s.io", resource: "ingresses"})
+		if conf.RequireReadyEndpoints {
+			kinds = append(kinds, watchedResource{group: "discovery.k8s.io", resource: "endpointslices"})
+		}
+	case "crd":
+		var crds []source.CRDConfig
+		if err := decodeSection(config.CRDSources, &crds); err == nil {
+			for _, crd := range crds {
+				kinds = append(kinds, watchedResource{group: crd.Group, resource: crd.Resource})
+			}
+		}
+	case "gateway":
+		kinds = append(kinds, watchedResource{group: source.GatewayGroup, resource: "gateways"})
+	}
+
+	var resources []watchedResource
+	for _, namespace := range watchedNamespaces() {
+		for _, kind := range kinds {
+			kind.namespace = namespace
+			resources = append(resources, kind)
+		}
+	}
+	// The ingress controller is watched wherever it runs, whatever the
+	// namespaces the ingresses are watched in.
+	if src == "ingress" {
+		if conf.IngressControllerSelector != "" {
+			resources = append(resources, watchedResource{resource: "pods"})
+		}
+		if namespace, _, err := cache.SplitMetaNamespaceKey(conf.IngressControllerService); err == nil && namespace != "" {
+			resources = append(resources, watchedResource{resource: "services", namespace: namespace})
+		}
+	}
+	return resources
+}
+
+// permittedSources returns sources without the ones whose resources the
+// service account may not list and watch, logging each source it disables.
+func permittedSources(client kubernetes.Interface, sources []string) []string {
+	var permitted []string
+	for _, src := range sources {
+		if denied, ok := forbiddenResource(client, sourceResources(src)); ok {
+			lg.Warn("Disabling source, the service account may not list and watch its resources",
+				zap.String("source", src), zap.Stringer("resource", denied))
+			continue
+		}
+		permitted = append(permitted, src)
+	}
+	return permitted
+}
+
+// forbiddenResource returns the first of resources the service account may
+// not list and watch, if any. Resources whose access review fails are
+// assumed to be allowed, so a cluster without the authorization API behaves
+// as before and failing watches are reported as usual.
+func forbiddenResource(client kubernetes.Interface, resources []watchedResource) (watchedResource, bool) {
+	for _, r := range resources {
+		for _, verb := range []string{"list", "watch"} {
+			allowed, err := mayAccess(client, r, verb)
+			if err != nil {
+				lg.Warn("Failed to check permissions, assuming they are granted",
+					zap.Stringer("resource", r), zap.String("verb", verb), zap.Error(err))
+				break
+			}
+			if !allowed {
+				return r, true
+			}
+		}
+	}
+	return watchedResource{}, false
+}
+
+// mayAccess asks the API server whether the service account may use verb on
+// r, with a SelfSubjectAccessReview.
+func mayAccess(client kubernetes.Interface, r watchedResource, verb string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), permissionCheckTimeout)
+	defer cancel()
+	review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: r.namespace,
+				Verb:      verb,
+				Group:     r.group,
+				Resource:  r.resource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
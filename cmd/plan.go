@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"sigs.k8s.io/yaml"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Preview the records svc would publish",
+	Long: `plan runs the sources with the given svc flags until they have synced,
+without answering queries, announcing anything or writing to the cluster. It
+then prints a multi-document YAML stream: every resource that would be
+published with its records, then every object skipped and why. Logs go to
+standard error.`,
+	Example: `  external-mdns plan --source=service --source=ingress > plan.yaml`,
+	Run:     runPlan,
+}
+
+// planDue is closed once the sources have synced while planning, see
+// warmCaches. It is nil otherwise.
+var planDue chan struct{}
+
+// planDisabled holds the settings turned off while planning, as they
+// answer on the network, write to the cluster or reach other systems.
+var planDisabled = map[string]interface{}{
+	config.ServeMDNS:         false,
+	config.AdminListen:       "",
+	config.AgentListen:       "",
+	config.ZoneConfigMap:     "",
+	config.GoodbyeFinalizer:  false,
+	config.HookPrePublish:    []string{},
+	config.HookPostUnpublish: []string{},
+	config.EventsNATSURL:     "",
+	config.EventsMQTTURL:     "",
+	config.SSDP:              false,
+	config.WSD:               false,
+	config.RestoreSnapshot:   "",
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	planCmd.Flags().AddFlagSet(svcCmd.Flags())
+}
+
+func runPlan(cmd *cobra.Command, args []string) {
+	if conf.Test && conf.TestFixture == "" {
+		fmt.Fprintf(os.Stderr, "plan needs a cluster or --%s\n", config.TestFixture)
+		os.Exit(1)
+	}
+	for key, value := range planDisabled {
+		viper.Set(key, value)
+	}
+	if err := loadSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration; %s\n", err)
+		os.Exit(1)
+	}
+	logDestination = os.Stderr
+	planDue = make(chan struct{})
+	run(cmd, args)
+}
+
+// planResource is a document of the plan for a resource to publish.
+type planResource struct {
+	Plan      string     `json:"plan"`
+	Source    string     `json:"source"`
+	Object    *zoneOwner `json:"object,omitempty"`
+	Names     []string   `json:"names"`
+	Addresses []string   `json:"addresses"`
+	Records   []string   `json:"records"`
+}
+
+// planSkip is a document of the plan for an object left out.
+type planSkip struct {
+	Plan    string `json:"plan"`
+	Source  string `json:"source"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+	Quiet   bool   `json:"quiet,omitempty"`
+}
+
+// printPlan writes the resources of live and the skipped objects to
+// standard output, one YAML document each, in order of their source.
+func printPlan(live map[string]resource.Resource) error {
+	var docs []interface{}
+
+	keys := make([]string, 0, len(live))
+	for key := range live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r := live[key]
+		records := constructRecords(r)
+		sort.Strings(records)
+		doc := planResource{Plan: "publish", Source: ownerKey(r), Names: r.Names, Addresses: selectIPs(r), Records: records}
+		if r.Object.Kind != "" {
+			doc.Object = &zoneOwner{
+				APIVersion:      r.Object.APIVersion,
+				Kind:            r.Object.Kind,
+				Namespace:       r.Namespace,
+				Name:            r.SourceName,
+				UID:             r.Object.UID,
+				ResourceVersion: r.Object.ResourceVersion,
+			}
+		}
+		docs = append(docs, doc)
+	}
+
+	skips := source.Skips()
+	sort.Slice(skips, func(i, j int) bool {
+		if skips[i].Kind != skips[j].Kind {
+			return skips[i].Kind < skips[j].Kind
+		}
+		if skips[i].Namespace != skips[j].Namespace {
+			return skips[i].Namespace < skips[j].Namespace
+		}
+		return skips[i].Name < skips[j].Name
+	})
+	for _, s := range skips {
+		docs = append(docs, planSkip{
+			Plan:    "skip",
+			Source:  ownerKey(resource.Resource{SourceType: strings.ToLower(s.Kind), Namespace: s.Namespace, SourceName: s.Name}),
+			Reason:  s.Reason,
+			Message: s.Message,
+			Quiet:   s.Quiet,
+		})
+	}
+
+	for i, doc := range docs {
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(out))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultPriorityClass is the class of resources without a priority-class
+// annotation, or with an unknown one.
+const defaultPriorityClass = "default"
+
+// defaultPriorityClasses are the classes available unless --priority-class
+// is given.
+var defaultPriorityClasses = []string{"infra=1000", "default=0", "preview=-1000"}
+
+// priorityClasses maps class names to their value, see classValue.
+var priorityClasses = map[string]int{defaultPriorityClass: 0}
+
+// configurePriorityClasses parses --priority-class.
+func configurePriorityClasses() error {
+	classes := make(map[string]int)
+	for _, class := range conf.PriorityClass {
+		name, value, ok := strings.Cut(class, "=")
+		name = strings.TrimSpace(name)
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || name == "" || err != nil {
+			return fmt.Errorf("--%s %q must be given as name=value", config.PriorityClass, class)
+		}
+		classes[name] = n
+	}
+	if _, ok := classes[defaultPriorityClass]; !ok {
+		classes[defaultPriorityClass] = 0
+	}
+	priorityClasses = classes
+	return nil
+}
+
+// classValue returns the value of r's priority class. Resources of a
+// higher class always outrank those of a lower one, whatever their
+// priority.
+func classValue(r resource.Resource) int {
+	if value, ok := priorityClasses[r.PriorityClass]; ok {
+		return value
+	}
+	return priorityClasses[defaultPriorityClass]
+}
+
+// comparePriority returns 1 if a outranks b, -1 if b outranks a, and 0 if
+// they rank the same: by class, then by priority.
+func comparePriority(a, b resource.Resource) int {
+	if c := cmp.Compare(classValue(a), classValue(b)); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Priority, b.Priority)
+}
+
+// checkPriorityClass warns about a priority class that is not configured.
+func checkPriorityClass(r resource.Resource) {
+	if r.PriorityClass == "" || r.Action != resource.Added {
+		return
+	}
+	if _, ok := priorityClasses[r.PriorityClass]; !ok {
+		lg.Warn("Unknown priority class, using the default", zap.String("resource", ownerKey(r)),
+			zap.String("class", r.PriorityClass))
+		recordEvent(r, corev1.EventTypeWarning, "UnknownPriorityClass",
+			"Priority class %q is not configured, using %q", r.PriorityClass, defaultPriorityClass)
+	}
+}
+
+// rankRecord tells the responder the rank of record's name, so higher
+// ranked names are announced first, along with whether r marks its records
+// shared or unique.
+func rankRecord(record string, r resource.Resource) {
+	if fields := strings.Fields(record); len(fields) > 0 {
+		mdns.SetPriority(fields[0], classValue(r), r.Priority)
+		mdns.SetSharing(fields[0], r.Shared)
+	}
+}
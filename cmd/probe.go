@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// How --probe checks that a published address is reachable.
+const (
+	probeTCP  = "tcp"  // connect to one of the ports of the resource
+	probeICMP = "icmp" // ping the address
+)
+
+// What --probe-action does with an unreachable address.
+const (
+	probeActionWithdraw = "withdraw" // withdraw its address and PTR records
+	probeActionDegrade  = "degrade"  // keep them, with a TXT record naming it
+)
+
+// degradedMarker starts the TXT record published at a name with
+// unreachable addresses under --probe-action=degrade.
+const degradedMarker = `"external-mdns=degraded"`
+
+// probeTimeout bounds each connection attempt or ping.
+const probeTimeout = 2 * time.Second
+
+// probeConcurrency is how many addresses are probed at once.
+const probeConcurrency = 16
+
+// reachabilityProber probes the published addresses of live resources every
+// --probe-interval and acts on those that failed --probe-failures probes
+// in a row, until they pass one again. Only the main loop uses it, apart
+// from the probes it starts.
+type reachabilityProber struct {
+	mode     string // empty when disabled
+	action   string
+	failures int
+	ticks    <-chan time.Time // nil when disabled
+	results  chan []probeResult
+	running  bool // the probes of a tick have not reported yet
+	states   map[probeKey]*probeState
+}
+
+// probeKey is a published address of a live resource, by liveKey.
+type probeKey struct {
+	owner   string
+	address string
+}
+
+// probeState counts the consecutive failures of an address.
+type probeState struct {
+	failures int
+	down     bool
+}
+
+// probeJob is an address to probe and the TCP ports of its resource.
+type probeJob struct {
+	key   probeKey
+	ports []int
+}
+
+// probeResult is the outcome of probing an address.
+type probeResult struct {
+	key  probeKey
+	err  error
+	took time.Duration
+}
+
+// prober is disabled until configureProber runs.
+var prober = &reachabilityProber{}
+
+// configureProber sets up reachability probes from --probe and the flags
+// tuning them.
+func configureProber() error {
+	mode := conf.Probe
+	switch mode {
+	case "":
+		return nil
+	case probeTCP:
+	case probeICMP:
+		if err := checkICMP(); err != nil {
+			return fmt.Errorf("--%s=%s: %w", config.Probe, probeICMP, err)
+		}
+	default:
+		return fmt.Errorf("unknown probe %q (tcp, icmp)", mode)
+	}
+	action := conf.ProbeAction
+	if action != probeActionWithdraw && action != probeActionDegrade {
+		return fmt.Errorf("unknown probe action %q (withdraw, degrade)", action)
+	}
+	failures := conf.ProbeFailures
+	if failures <= 0 {
+		return fmt.Errorf("--%s must be positive", config.ProbeFailures)
+	}
+	interval := conf.ProbeInterval
+	if interval <= 0 {
+		return fmt.Errorf("--%s must be positive", config.ProbeInterval)
+	}
+	prober = &reachabilityProber{
+		mode:     mode,
+		action:   action,
+		failures: failures,
+		ticks:    time.NewTicker(interval).C,
+		results:  make(chan []probeResult),
+		states:   make(map[probeKey]*probeState),
+	}
+	return nil
+}
+
+// down reports whether the address of the live resource by key is
+// considered unreachable.
+func (p *reachabilityProber) down(key, address string) bool {
+	s := p.states[probeKey{key, address}]
+	return s != nil && s.down
+}
+
+// reachableIPs returns the addresses of r its records are published with:
+// the addresses selectIPs chooses, less those withdrawn as unreachable.
+func (p *reachabilityProber) reachableIPs(r resource.Resource) []string {
+	ips := selectIPs(r)
+	if p.action != probeActionWithdraw {
+		return ips
+	}
+	key := liveKey(r)
+	return slices.DeleteFunc(ips, func(address string) bool { return p.down(key, address) })
+}
+
+// markers returns, under --probe-action=degrade, a TXT record for every
+// name of forward with unreachable addresses, listing them.
+func (p *reachabilityProber) markers(r resource.Resource, forward []forwardName) []string {
+	if p.action != probeActionDegrade {
+		return nil
+	}
+	key := liveKey(r)
+	var names []string
+	unreachable := make(map[string][]string)
+	for _, f := range forward {
+		if !p.down(key, f.address) || slices.Contains(unreachable[f.name], f.address) {
+			continue
+		}
+		if len(unreachable[f.name]) == 0 {
+			names = append(names, f.name)
+		}
+		unreachable[f.name] = append(unreachable[f.name], f.address)
+	}
+	records := make([]string, 0, len(names))
+	for _, name := range names {
+		records = append(records, fmt.Sprintf(`%s %d IN TXT %s "unreachable=%s"`,
+			name, recordTTL(r, name), degradedMarker, strings.Join(unreachable[name], ",")))
+	}
+	return records
+}
+
+// start probes the published addresses of live resources, unless the
+// probes of the previous tick are still running, and forgets the addresses
+// no longer published. Under --probe=tcp, resources without ports are not
+// probed.
+func (p *reachabilityProber) start(live map[string]resource.Resource) {
+	current := make(map[probeKey]bool)
+	var jobs []probeJob
+	for key, r := range live {
+		if p.mode == probeTCP && len(r.Ports) == 0 {
+			continue
+		}
+		for _, address := range selectIPs(r) {
+			k := probeKey{key, address}
+			current[k] = true
+			jobs = append(jobs, probeJob{k, r.Ports})
+		}
+	}
+
+	changed := false
+	for k, s := range p.states {
+		if current[k] {
+			continue
+		}
+		// A resource that lost its ports keeps its records, which were
+		// built without the address.
+		if _, ok := live[k.owner]; ok && s.down {
+			changed = true
+		}
+		delete(p.states, k)
+		metrics.ProbeUp.DeleteLabelValues(k.owner, k.address)
+		metrics.ProbeFailures.DeleteLabelValues(k.owner, k.address)
+		metrics.ProbeDuration.DeleteLabelValues(k.owner, k.address)
+	}
+	if changed {
+		republish(live)
+	}
+
+	if p.running || len(jobs) == 0 {
+		return
+	}
+	p.running = true
+	go p.run(jobs)
+}
+
+// run probes the addresses of jobs and reports to the main loop.
+func (p *reachabilityProber) run(jobs []probeJob) {
+	results := make([]probeResult, len(jobs))
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			began := time.Now()
+			var err error
+			if p.mode == probeICMP {
+				err = ping(job.key.address, probeTimeout)
+			} else {
+				err = dialAny(job.key.address, job.ports, probeTimeout)
+			}
+			results[i] = probeResult{job.key, err, time.Since(began)}
+		}()
+	}
+	wg.Wait()
+	p.results <- results
+}
+
+// settle counts the consecutive failures of each address and republishes
+// the records of the live resources when an address goes down or becomes
+// reachable again.
+func (p *reachabilityProber) settle(live map[string]resource.Resource, results []probeResult) {
+	p.running = false
+	changed := false
+	for _, result := range results {
+		if _, ok := live[result.key.owner]; !ok {
+			continue
+		}
+		labels := []string{result.key.owner, result.key.address}
+		metrics.ProbeDuration.WithLabelValues(labels...).Set(result.took.Seconds())
+		s := p.states[result.key]
+		if s == nil {
+			s = &probeState{}
+			p.states[result.key] = s
+		}
+
+		if result.err == nil {
+			s.failures = 0
+			if s.down {
+				s.down = false
+				changed = true
+				lg.Info("Address is reachable again", zap.String("resource", result.key.owner),
+					zap.String("address", result.key.address))
+			}
+		} else {
+			s.failures++
+			metrics.ProbeFailures.WithLabelValues(labels...).Inc()
+			if !s.down && s.failures >= p.failures {
+				s.down = true
+				changed = true
+				lg.Warn("Address is unreachable, "+p.actionDescription(), zap.String("resource", result.key.owner),
+					zap.String("address", result.key.address), zap.Int("failures", s.failures), zap.Error(result.err))
+			}
+		}
+		up := 1.0
+		if s.down {
+			up = 0
+		}
+		metrics.ProbeUp.WithLabelValues(labels...).Set(up)
+	}
+	if changed {
+		republish(live)
+	}
+}
+
+// actionDescription describes --probe-action for the logs.
+func (p *reachabilityProber) actionDescription() string {
+	if p.action == probeActionDegrade {
+		return "marking its names degraded"
+	}
+	return "withdrawing its records"
+}
+
+// dialAny returns nil once address accepts a TCP connection on one of
+// ports, or the error of the last attempt.
+func dialAny(address string, ports []int, timeout time.Duration) error {
+	var err error
+	for _, port := range ports {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(port)), timeout); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s accepts no connections on ports %v: %w", address, ports, err)
+	}
+	return nil
+}
+
+// pingSeq numbers the echo requests of ping.
+var pingSeq atomic.Uint32
+
+// ping sends an ICMP echo request to address and waits for the reply.
+func ping(address string, timeout time.Duration) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	v4 := ip.To4() != nil
+	conn, raw, err := listenICMP(v4)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request, reply, proto := icmp.Type(ipv4.ICMPTypeEcho), icmp.Type(ipv4.ICMPTypeEchoReply), 1
+	if !v4 {
+		request, reply, proto = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+	id, seq := os.Getpid()&0xffff, int(pingSeq.Add(1)&0xffff)
+	b, err := (&icmp.Message{Type: request, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("external-mdns")}}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return fmt.Errorf("ping %s: %w", address, err)
+	}
+
+	// Datagram sockets only see their own replies, with the ID set by the
+	// kernel; raw sockets see every ICMP message of the host.
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("%s does not answer pings: %w", address, err)
+		}
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || msg.Type != reply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || raw && echo.ID != id || !peerIP(peer).Equal(ip) {
+			continue
+		}
+		return nil
+	}
+}
+
+// listenICMP opens an unprivileged ICMP datagram socket, which
+// net.ipv4.ping_group_range must allow, or else a raw one, which needs
+// NET_RAW. raw reports which.
+func listenICMP(v4 bool) (conn *icmp.PacketConn, raw bool, err error) {
+	network, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if !v4 {
+		network, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	if conn, err = icmp.ListenPacket(network, address); err == nil {
+		return conn, false, nil
+	}
+	if conn, rawErr := icmp.ListenPacket(rawNetwork, address); rawErr == nil {
+		return conn, true, nil
+	}
+	return nil, false, fmt.Errorf("cannot open an ICMP socket; net.ipv4.ping_group_range must include the group of external-mdns, or it needs the NET_RAW capability: %w", err)
+}
+
+// checkICMP reports whether ping can open its socket.
+func checkICMP() error {
+	conn, _, err := listenICMP(true)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// peerIP returns the IP address of an ICMP peer.
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
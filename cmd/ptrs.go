@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+)
+
+// Policies for resources sharing an address, such as Services behind a
+// shared LoadBalancer IP or the hosts of an Ingress, each wanting PTR
+// records for it. Under first-wins and annotation, a higher priority class
+// wins before anything else.
+const (
+	ptrConflictAll        = "all"        // everyone publishes PTRs, as before sharing was tracked
+	ptrConflictFirstWins  = "first-wins" // the oldest resource publishes the PTRs
+	ptrConflictAnnotation = "annotation" // a resource with a ptr-name wins, then the oldest
+	ptrConflictSuppress   = "suppress"   // a shared address gets no PTR records
+)
+
+// reversePTRs is the registry used by the main loop.
+var reversePTRs *ptrRegistry
+
+// ptrTransition describes another resource gaining or losing the PTR records
+// of an address as a side effect of the resource being processed.
+type ptrTransition struct {
+	res     resource.Resource
+	address string
+	action  string // resource.Added or resource.Deleted
+	records []string
+}
+
+// ptrRegistry tracks which resources claim each address and decides which
+// one of them publishes its PTR records. Like shortNameRegistry, the winner
+// only depends on the current claimants. It is only used from the main loop
+// and is not safe for concurrent use.
+type ptrRegistry struct {
+	policy string
+	claims map[string]map[string]resource.Resource // address -> liveKey -> claimant
+}
+
+func newPTRRegistry(policy string) (*ptrRegistry, error) {
+	switch policy {
+	case ptrConflictAll, ptrConflictFirstWins, ptrConflictAnnotation, ptrConflictSuppress:
+	default:
+		return nil, fmt.Errorf("unknown PTR conflict policy %q", policy)
+	}
+	return &ptrRegistry{
+		policy: policy,
+		claims: make(map[string]map[string]resource.Resource),
+	}, nil
+}
+
+// owns reports whether r publishes the PTR records of address.
+func (p *ptrRegistry) owns(address string, r resource.Resource) bool {
+	if p.policy == ptrConflictAll {
+		return true
+	}
+	return p.winner(address) == liveKey(r)
+}
+
+// winner returns the key of the claimant that publishes the PTR records of
+// address, or an empty string if nobody does.
+func (p *ptrRegistry) winner(address string) string {
+	claims := p.claims[address]
+	if p.policy == ptrConflictSuppress && len(claims) > 1 {
+		return ""
+	}
+
+	var best string
+	for key := range claims {
+		if best == "" || p.better(claims[key], key, claims[best], best) {
+			best = key
+		}
+	}
+	return best
+}
+
+// better reports whether claimant a outranks claimant b.
+func (p *ptrRegistry) better(a resource.Resource, aKey string, b resource.Resource, bKey string) bool {
+	if ca, cb := classValue(a), classValue(b); ca != cb {
+		return ca > cb
+	}
+	if p.policy == ptrConflictAnnotation && (a.PTRName != "") != (b.PTRName != "") {
+		return a.PTRName != ""
+	}
+	if !a.Created.Equal(b.Created) {
+		return a.Created.Before(b.Created)
+	}
+	return aKey < bKey
+}
+
+// claim registers r for each of its addresses that has a reverse name,
+// unless its record-types annotation leaves out PTR records.
+func (p *ptrRegistry) claim(r resource.Resource) []ptrTransition {
+	if p.policy == ptrConflictAll {
+		return nil
+	}
+
+	var transitions []ptrTransition
+	for _, address := range selectIPs(r) {
+		if reverseIP, _ := reverseAddress(address); reverseIP == "" || !wantsPTR(r, recordTypeFor(net.ParseIP(address))) {
+			continue
+		}
+		transitions = append(transitions, p.update(address, r, true)...)
+		if len(p.claims[address]) > 1 && !p.owns(address, r) {
+			lg.Info("Address shared with other resources, not publishing its PTR records",
+				zap.String("address", address), zap.String("resource", ownerKey(r)), zap.String("owner", p.winner(address)))
+		}
+	}
+	return transitions
+}
+
+// release withdraws r's claim on each of its addresses.
+func (p *ptrRegistry) release(r resource.Resource) []ptrTransition {
+	if p.policy == ptrConflictAll {
+		return nil
+	}
+
+	var transitions []ptrTransition
+	for _, address := range selectIPs(r) {
+		if _, ok := p.claims[address][liveKey(r)]; ok {
+			transitions = append(transitions, p.update(address, r, false)...)
+		}
+	}
+	return transitions
+}
+
+// update adds or removes r's claim on address and returns the changes this
+// causes for other claimants. The records of a claimant losing the address
+// are built before the claims change, while it still publishes them.
+func (p *ptrRegistry) update(address string, r resource.Resource, claim bool) []ptrTransition {
+	key := liveKey(r)
+	before := p.winner(address)
+
+	previous := p.claims[address][before]
+	var previousRecords []string
+	if before != "" && before != key {
+		previousRecords = reverseRecords(previous, address)
+	}
+
+	if claim {
+		if p.claims[address] == nil {
+			p.claims[address] = make(map[string]resource.Resource)
+		}
+		p.claims[address][key] = r
+	} else {
+		delete(p.claims[address], key)
+		if len(p.claims[address]) == 0 {
+			delete(p.claims, address)
+		}
+	}
+
+	after := p.winner(address)
+	if before == after {
+		return nil
+	}
+
+	var transitions []ptrTransition
+	if before != "" && before != key {
+		transitions = append(transitions, ptrTransition{res: previous, address: address, action: resource.Deleted, records: previousRecords})
+	}
+	if after != "" && after != key {
+		next := p.claims[address][after]
+		transitions = append(transitions, ptrTransition{res: next, address: address, action: resource.Added,
+			records: reverseRecords(next, address)})
+	}
+	return transitions
+}
+
+// reverseRecords returns the PTR records r publishes for address, derived
+// from the names it publishes with that address.
+func reverseRecords(r resource.Resource, address string) []string {
+	var forward []forwardName
+	for _, f := range forwardNames(r) {
+		if f.address == address {
+			forward = append(forward, f)
+		}
+	}
+	return derivedPTRs(r, forward)
+}
+
+// applyPTRTransitions publishes or withdraws the PTR records of resources
+// affected by the claimants of an address changing.
+func applyPTRTransitions(transitions []ptrTransition) {
+	for _, t := range transitions {
+		for _, record := range t.records {
+			switch t.action {
+			case resource.Added:
+				lg.Info("Publishing PTR record for shared address:", zap.String("record", record), zap.String("resource", ownerKey(t.res)))
+				rankRecord(record, t.res)
+				publishRecord(liveKey(t.res), record)
+			case resource.Deleted:
+				lg.Info("Withdrawing PTR record for shared address:", zap.String("record", record), zap.String("resource", ownerKey(t.res)))
+				unpublishRecord(liveKey(t.res), record)
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// watchConfigReloads returns a channel receiving the configuration whenever
+// the configuration file or a file it includes changes, or SIGHUP is
+// received. It is read with its includes into a fresh viper instance and
+// validated first, and invalid files are logged and skipped. Without a
+// configuration file, SIGHUP sends nil. The global configuration is only
+// changed on the main loop, see applyConfigChange, as it is read
+// concurrently.
+func watchConfigReloads() <-chan *viper.Viper {
+	reloads := make(chan *viper.Viper, 1)
+	path := viper.ConfigFileUsed()
+
+	var watch *configWatch
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if path != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			lg.Warn("Failed to watch the configuration file, reload it with SIGHUP", zap.Error(err))
+		} else {
+			watch = &configWatch{watcher: watcher, path: filepath.Clean(path)}
+			watch.update(viper.GetViper())
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				if !watch.affects(event) {
+					continue
+				}
+			case err := <-errs:
+				lg.Warn("Failed to watch the configuration file", zap.Error(err))
+				continue
+			case <-hup:
+			}
+
+			fresh, err := readConfig(path)
+			if err != nil {
+				lg.Warn("Reloaded configuration is invalid, not applying it", zap.Error(err))
+				continue
+			}
+			if watch != nil {
+				watch.update(fresh)
+			}
+			// Only the latest configuration matters.
+			select {
+			case <-reloads:
+			default:
+			}
+			reloads <- fresh
+		}
+	}()
+	return reloads
+}
+
+// configWatch tells which changes in the watched directories affect the
+// configuration: those to the configuration file, to a file or directory
+// it includes, or to the targets of their symlinks. Directories are
+// watched rather than files, as a mounted ConfigMap is updated by swapping
+// the symlink its files resolve through.
+type configWatch struct {
+	watcher  *fsnotify.Watcher
+	path     string
+	includes []string          // include entries: files, globs and directories
+	files    []string          // the files read
+	resolved map[string]string // the files read, by their symlink targets
+}
+
+// update watches the directories of the configuration read into v, and
+// notes the files it was read from.
+func (w *configWatch) update(v *viper.Viper) {
+	base := filepath.Dir(w.path)
+	dirs := []string{base}
+	w.includes = nil
+	for _, include := range v.GetStringSlice(config.Include) {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(base, include)
+		}
+		include = filepath.Clean(include)
+		w.includes = append(w.includes, include)
+		if info, err := os.Stat(include); err == nil && info.IsDir() {
+			dirs = append(dirs, include)
+		} else {
+			dirs = append(dirs, filepath.Dir(include))
+		}
+	}
+	for _, dir := range dirs {
+		if err := w.watcher.Add(dir); err != nil {
+			lg.Warn("Failed to watch configuration directory, reload changes to it with SIGHUP", zap.String("directory", dir), zap.Error(err))
+		}
+	}
+
+	included, _ := includedConfigFiles(v)
+	w.files = append([]string{w.path}, included...)
+	w.resolved = w.targets()
+}
+
+// targets returns the symlink targets of the files read.
+func (w *configWatch) targets() map[string]string {
+	targets := make(map[string]string, len(w.files))
+	for _, file := range w.files {
+		targets[file], _ = filepath.EvalSymlinks(file)
+	}
+	return targets
+}
+
+// affects reports whether event changes the configuration.
+func (w *configWatch) affects(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Clean(event.Name)
+	if name == w.path {
+		return true
+	}
+	for _, include := range w.includes {
+		if filepath.Dir(name) == include {
+			return true
+		}
+		if matched, _ := filepath.Match(include, name); matched {
+			return true
+		}
+	}
+	if targets := w.targets(); !maps.Equal(targets, w.resolved) {
+		w.resolved = targets
+		return true
+	}
+	return false
+}
+
+// readConfig reads the configuration file at path and the files it
+// includes into a fresh viper instance and validates them. It returns nil
+// without a path.
+func readConfig(path string) (*viper.Viper, error) {
+	if path == "" {
+		return nil, nil
+	}
+	fresh := viper.New()
+	fresh.SetConfigFile(path)
+	if err := fresh.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := mergeIncludes(fresh); err != nil {
+		return nil, err
+	}
+	if err := checkSettings(fresh); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// adoptConfig replaces the settings read from the configuration file with
+// those of fresh. It runs on the main loop.
+func adoptConfig(fresh *viper.Viper) error {
+	data, err := json.Marshal(fresh.AllSettings())
+	if err != nil {
+		return err
+	}
+	// ReadConfig replaces what was read before, where merging would keep
+	// the settings since removed from the file.
+	viper.SetConfigType("json")
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
+// applyConfigChange switches to the reloaded configuration fresh, if any,
+// and brings the records of every live resource in line with it. Records it
+// changes, such as a new TTL or the names renamed by turning off
+// hyphenated-names, are swapped in the same pass of the main loop: goodbyes
+// for the old ones and announcements for the new ones go out together, so
+// caches on the link switch over at once.
+func applyConfigChange(live map[string]resource.Resource, fresh *viper.Viper) {
+	if fresh != nil {
+		if err := adoptConfig(fresh); err != nil {
+			lg.Warn("Failed to apply the reloaded configuration", zap.Error(err))
+			return
+		}
+		if err := loadSettings(); err != nil {
+			lg.Warn("Failed to apply the reloaded configuration", zap.Error(err))
+			return
+		}
+	}
+	next := configuredTTLs()
+	next.limit = ttls.limit
+	next.drain = ttls.drain
+	if next != ttls {
+		if err := validateTTLJitter(); err != nil {
+			lg.Warn("Ignoring reloaded TTL settings", zap.Error(err))
+		} else {
+			lg.Info("Record TTL changed", zap.Int("ttl", next.base), zap.Int("jitter", next.jitter))
+			ttls = next
+		}
+	}
+	if withdrawn, published := republish(live); withdrawn+published > 0 {
+		lg.Info("Configuration changed, republishing records", zap.Int("withdrawn", withdrawn), zap.Int("published", published))
+	}
+}
+
+// republishWithTTLs switches to the TTL settings next, republishing and
+// announcing the records whose TTL changes, restored ones included.
+func republishWithTTLs(live map[string]resource.Resource, next ttlSettings) {
+	prev := ttls
+	ttls = next
+	republish(live)
+	republishRestored(prev)
+}
+
+// republish withdraws the records live resources no longer have under the
+// current configuration and publishes those they gained, returning how
+// many of each.
+func republish(live map[string]resource.Resource) (withdrawn, published int) {
+	budget.invalidate()
+	old := publishedRecords(live)
+	current := liveRecords(live)
+
+	for key, records := range old {
+		for record := range records {
+			if !current[key][record] {
+				unpublishRecord(key, record)
+				withdrawn++
+			}
+		}
+	}
+	for key, records := range current {
+		for record := range records {
+			if !old[key][record] {
+				publishRecord(key, record)
+				published++
+			}
+		}
+	}
+	return withdrawn, published
+}
+
+// publishedRecords returns the records published on behalf of each live
+// resource, by liveKey.
+func publishedRecords(live map[string]resource.Resource) map[string]map[string]bool {
+	records := make(map[string]map[string]bool, len(live))
+	for record, owners := range recordOwners {
+		for key := range owners {
+			if _, ok := live[key]; !ok {
+				continue
+			}
+			if records[key] == nil {
+				records[key] = make(map[string]bool)
+			}
+			records[key][record] = true
+		}
+	}
+	return records
+}
+
+// liveKey identifies r in the live resources. Ingresses send a resource
+// per host, so the names are part of the key.
+func liveKey(r resource.Resource) string {
+	return ownerKey(r) + "/" + strings.Join(r.Names, ",")
+}
+
+// liveRecords returns the records published for each live resource, by
+// liveKey.
+func liveRecords(live map[string]resource.Resource) map[string]map[string]bool {
+	records := make(map[string]map[string]bool, len(live))
+	for key, r := range live {
+		records[key] = make(map[string]bool)
+		for _, record := range constructRecords(r) {
+			if record != "" {
+				records[key][record] = true
+			}
+		}
+	}
+	return records
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/miekg/dns"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// addResponderFlags registers the flags controlling the mDNS responder.
+func addResponderFlags(flags *pflag.FlagSet) {
+	flags.StringSlice(config.AllowSubnets, nil, "Only answer queries from these client subnets (CIDR)")
+	flags.StringSlice(config.DenySubnets, nil, "Never answer queries from these client subnets (CIDR)")
+	flags.Bool(config.ReusePort, false, "Set SO_REUSEPORT so other mDNS listeners can share port 5353")
+	flags.String(config.PortConflict, mdns.PortConflictFail, "When another process holds the mDNS port exclusively, fail or publish address records through avahi-daemon (fail, avahi)")
+	flags.String(config.MissingPrivileges, mdns.MissingPrivilegesFail, "When the process lacks the capabilities to open the mDNS sockets, fail or publish address records through avahi-daemon (fail, avahi)")
+	flags.Int(config.MulticastTTL, 1, "IPv4 multicast TTL for outgoing packets (1-255)")
+	flags.Int(config.MulticastHopLimit, 1, "IPv6 multicast hop limit for outgoing packets (1-255)")
+	flags.Int(config.MDNSPort, 5353, "UDP port to listen and answer on (for testing)")
+	flags.String(config.MDNSIPv4Group, "224.0.0.251", "IPv4 multicast group (for testing)")
+	flags.String(config.MDNSIPv6Group, "ff02::fb", "IPv6 multicast group (for testing)")
+	flags.Bool(config.MemoryTransport, false, "Answer over an in-process transport instead of the network; selftest, soak and --verify-interval query it (for testing)")
+	flags.String(config.NetNS, "", "Linux network namespace to answer in: a name, a path, or \"host\" (requires hostPID)")
+	flags.Bool(config.WatchInterfaces, true, "Rebind and re-announce when network interfaces or addresses change")
+	flags.Int(config.MaxPacketSize, 9000, "Largest mDNS message sent in bytes (512-9000); lower it on constrained Wi-Fi")
+	flags.Int(config.MaxAnswers, 0, "Maximum answers per mDNS message, responses are split over several (0 for no limit)")
+	flags.Float64(config.AnnounceRate, 0, "Announcement messages sent per second at most, the excess is queued and coalesced (0 for no limit)")
+	flags.Int(config.AnnounceBurst, 10, "Announcement messages that may be sent back to back under --announce-rate")
+	flags.Bool(config.RespondOnly, false, "Only answer queries, never send unsolicited announcements")
+	flags.Bool(config.AcceptOffLink, false, "Answer queries from sources outside the subnets of the local interfaces")
+	flags.Duration(config.QueryReportInterval, time.Hour, "How often to log a summary of the queries received (0 to disable)")
+	flags.StringSlice(config.Wildcards, nil, "Wildcard names such as *.preview.local whose records answer queries for any name below them, instead of only for the wildcard name itself")
+	flags.Bool(config.BothFamilies, false, "Include A and AAAA records in every response instead of only those of the socket's address family")
+	flags.String(config.AnswerOrder, mdns.AnswerOrderStable, "Order of the addresses of a name in answers (stable, rotate, ipv4-first, ipv6-first)")
+	flags.Duration(config.WithdrawnGrace, 0, "Answer queries for withdrawn names with NSEC for this long so clients fail fast (0 to stay silent)")
+	flags.Duration(config.DuplicateCheckInterval, 0, "Watch for other responders answering for our names and report them this often (0 to disable)")
+	flags.Duration(config.VerifyInterval, 0, "Query a sample of the published names over multicast this often to check they resolve (0 to disable)")
+	flags.Int(config.VerifySample, 5, "Names queried in each --verify-interval")
+}
+
+// startResponder starts answering mDNS queries, exiting on failure.
+func startResponder() {
+	responderConfig, err := newResponderConfig()
+	if err != nil {
+		lg.Fatal("Invalid responder configuration:", zap.Error(err))
+	}
+	if responderConfig.Sockets, err = activatedSockets(); err != nil {
+		lg.Fatal("Failed to use activated sockets:", zap.Error(err))
+	}
+	if len(responderConfig.Sockets) > 0 {
+		lg.Info("Using sockets passed by systemd", zap.Int("sockets", len(responderConfig.Sockets)))
+	}
+	if err := mdns.Start(responderConfig); err != nil {
+		var perr *mdns.PrivilegeError
+		if errors.As(err, &perr) {
+			fmt.Fprintf(os.Stderr, "Grant the missing privileges in the container spec, or publish through avahi-daemon with --%s=%s:\n\n%s\n",
+				config.MissingPrivileges, mdns.MissingPrivilegesAvahi, perr.SecurityContext())
+		}
+		lg.Fatal("Failed to start mDNS responder:", zap.Error(err))
+	}
+	if interval := conf.QueryReportInterval; interval > 0 {
+		go reportQueries(interval)
+	}
+	if interval := conf.DuplicateCheckInterval; interval > 0 {
+		go reportDuplicates(interval)
+	}
+	if interval := conf.VerifyInterval; interval > 0 {
+		if conf.VerifySample < 1 {
+			lg.Fatal("Invalid responder configuration:", zap.Error(fmt.Errorf("--%s must be at least 1", config.VerifySample)))
+		}
+		group := &net.UDPAddr{IP: responderConfig.IPv4Group, Port: responderConfig.Port}
+		go verifyRecords(group, interval, conf.VerifySample)
+	}
+}
+
+// newResponderConfig builds the mDNS responder configuration from flags.
+func newResponderConfig() (mdns.Config, error) {
+	var (
+		cfg mdns.Config
+		err error
+	)
+
+	if cfg.AllowSubnets, err = mdns.ParseSubnets(conf.AllowSubnets); err != nil {
+		return cfg, fmt.Errorf("--%s: %w", config.AllowSubnets, err)
+	}
+	if cfg.DenySubnets, err = mdns.ParseSubnets(conf.DenySubnets); err != nil {
+		return cfg, fmt.Errorf("--%s: %w", config.DenySubnets, err)
+	}
+
+	cfg.ReusePort = conf.ReusePort
+	switch cfg.PortConflict = conf.PortConflict; cfg.PortConflict {
+	case mdns.PortConflictFail, mdns.PortConflictAvahi:
+	default:
+		return cfg, fmt.Errorf("--%s: unknown policy %q", config.PortConflict, cfg.PortConflict)
+	}
+	switch cfg.MissingPrivileges = conf.MissingPrivileges; cfg.MissingPrivileges {
+	case mdns.MissingPrivilegesFail, mdns.MissingPrivilegesAvahi:
+	default:
+		return cfg, fmt.Errorf("--%s: unknown policy %q", config.MissingPrivileges, cfg.MissingPrivileges)
+	}
+
+	cfg.MulticastTTL = conf.MulticastTTL
+	if cfg.MulticastTTL < 1 || cfg.MulticastTTL > 255 {
+		return cfg, fmt.Errorf("--%s must be between 1 and 255", config.MulticastTTL)
+	}
+	cfg.HopLimit = conf.MulticastHopLimit
+	if cfg.HopLimit < 1 || cfg.HopLimit > 255 {
+		return cfg, fmt.Errorf("--%s must be between 1 and 255", config.MulticastHopLimit)
+	}
+
+	cfg.Port = conf.MDNSPort
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("--%s must be between 1 and 65535", config.MDNSPort)
+	}
+	if cfg.IPv4Group, err = multicastGroup(config.MDNSIPv4Group, conf.MDNSIPv4Group, true); err != nil {
+		return cfg, err
+	}
+	if cfg.IPv6Group, err = multicastGroup(config.MDNSIPv6Group, conf.MDNSIPv6Group, false); err != nil {
+		return cfg, err
+	}
+
+	if conf.MemoryTransport {
+		cfg.Transports = []mdns.Transport{
+			mdns.NewMemoryTransport(&net.UDPAddr{IP: cfg.IPv4Group, Port: cfg.Port}),
+			mdns.NewMemoryTransport(&net.UDPAddr{IP: cfg.IPv6Group, Port: cfg.Port}),
+		}
+	}
+
+	cfg.NetNS = conf.NetNS
+	cfg.WatchInterfaces = conf.WatchInterfaces
+	cfg.RespondOnly = conf.RespondOnly
+	cfg.AcceptOffLink = conf.AcceptOffLink
+	cfg.WithdrawnGrace = conf.WithdrawnGrace
+	cfg.BothFamilies = conf.BothFamilies
+	for _, pattern := range conf.Wildcards {
+		pattern = dns.Fqdn(strings.ToLower(pattern))
+		if err := mdns.CheckWildcard(pattern); err != nil {
+			return cfg, fmt.Errorf("--%s: %w", config.Wildcards, err)
+		}
+		cfg.Wildcards = append(cfg.Wildcards, pattern)
+	}
+
+	switch cfg.AnswerOrder = conf.AnswerOrder; cfg.AnswerOrder {
+	case mdns.AnswerOrderStable, mdns.AnswerOrderRotate, mdns.AnswerOrderIPv4First, mdns.AnswerOrderIPv6First:
+	default:
+		return cfg, fmt.Errorf("--%s: unknown answer order %q", config.AnswerOrder, cfg.AnswerOrder)
+	}
+
+	cfg.MaxPacketSize = conf.MaxPacketSize
+	if cfg.MaxPacketSize < 512 || cfg.MaxPacketSize > 9000 {
+		return cfg, fmt.Errorf("--%s must be between 512 and 9000", config.MaxPacketSize)
+	}
+	cfg.MaxAnswers = conf.MaxAnswers
+	if cfg.MaxAnswers < 0 {
+		return cfg, fmt.Errorf("--%s cannot be negative", config.MaxAnswers)
+	}
+	cfg.AnnounceRate = conf.AnnounceRate
+	cfg.AnnounceBurst = conf.AnnounceBurst
+	if cfg.AnnounceRate < 0 || cfg.AnnounceBurst < 1 {
+		return cfg, fmt.Errorf("--%s cannot be negative and --%s must be at least 1", config.AnnounceRate, config.AnnounceBurst)
+	}
+
+	return cfg, nil
+}
+
+// multicastGroup parses the multicast group address value of flag.
+func multicastGroup(flag, value string, v4 bool) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil || !ip.IsMulticast() || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("--%s: %q is not a valid multicast group", flag, value)
+	}
+	return ip, nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+)
+
+// forwardName is a fully qualified name a resource is published under and
+// one of its addresses. The address record and the PTR record pointing back
+// at the name are both derived from it, so the forward and reverse views of
+// a resource cannot drift apart. The records of a resource published as they
+// are, see resource.Resource.Records, get no derived PTRs, so sources must
+// not put address records there: the zone file source turns them into
+// addresses. Agents and restored snapshots publish copies of a zone whose
+// PTRs were already derived.
+type forwardName struct {
+	name    string
+	address string
+}
+
+// forwardNames returns every name r is published under, with each of its
+// addresses: the names of its strategy, then the short names r owns.
+// Addresses withdrawn as unreachable, see --probe, are left out.
+func forwardNames(r resource.Resource) []forwardName {
+	var forward []forwardName
+	strategy := strategyFor(r)
+	for _, address := range prober.reachableIPs(r) {
+		for _, name := range r.Names {
+			for _, qualified := range strategy.qualifiedNames(r, name) {
+				forward = append(forward, forwardName{qualified, address})
+			}
+		}
+	}
+
+	// Short names are only published by the resource that wins any conflict
+	// over them, see shortNameRegistry.
+	if strategy.shortNames(r) {
+		for _, name := range r.Names {
+			if shortNames.owns(name, r) {
+				forward = append(forward, shortForwardNames(r, name)...)
+			}
+		}
+	}
+	return forward
+}
+
+// shortForwardNames returns <name>.local with each address of r.
+func shortForwardNames(r resource.Resource, name string) []forwardName {
+	var forward []forwardName
+	for _, address := range prober.reachableIPs(r) {
+		forward = append(forward, forwardName{name + ".local.", address})
+	}
+	return forward
+}
+
+// addressRecords returns the A and AAAA records of forward that r's
+// record-types annotation lets it publish, each once.
+func addressRecords(r resource.Resource, forward []forwardName) []string {
+	var records []string
+	seen := make(map[string]bool)
+	for _, f := range forward {
+		ip := net.ParseIP(f.address)
+		recordType := recordTypeFor(ip)
+		if !wantsRecordType(r, recordType) {
+			continue
+		}
+		record := fmt.Sprintf("%s %d IN %s %s", f.name, recordTTL(r, f.name), recordType, ip)
+		if !seen[record] {
+			seen[record] = true
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// checkPTRName drops the ptr-name of r unless r is published under that
+// name itself, so an object cannot point the reverse lookups of its
+// addresses at a name another resource publishes.
+func checkPTRName(r resource.Resource) resource.Resource {
+	if r.PTRName == "" || r.Action != resource.Added {
+		return r
+	}
+	strategy := strategyFor(r)
+	for _, name := range r.Names {
+		names := strategy.qualifiedNames(r, name)
+		if strategy.shortNames(r) {
+			names = append(names, name+".local.")
+		}
+		if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, r.PTRName) }) {
+			return r
+		}
+	}
+	lg.Warn("Ignoring ptr-name, the resource is not published under that name",
+		zap.String("resource", ownerKey(r)), zap.String("ptrName", r.PTRName))
+	r.PTRName = ""
+	return r
+}
+
+// derivedPTRs returns the PTR records pointing back at the names of
+// forward, each once. The ptr-name annotation points the PTR records of
+// every name at that name instead. PTR records of an address shared with
+// other resources are only derived for the one chosen by --ptr-conflict.
+func derivedPTRs(r resource.Resource, forward []forwardName) []string {
+	var records []string
+	seen := make(map[string]bool)
+	for _, f := range forward {
+		reverseIP, _ := reverseAddress(f.address)
+		if reverseIP == "" || !wantsPTR(r, recordTypeFor(net.ParseIP(f.address))) || !reversePTRs.owns(f.address, r) {
+			continue
+		}
+		target := f.name
+		if r.PTRName != "" {
+			target = r.PTRName
+		}
+		record := fmt.Sprintf("%s %d IN PTR %s", reverseIP, recordTTL(r, reverseIP), target)
+		if !seen[record] {
+			seen[record] = true
+			records = append(records, record)
+		}
+	}
+	return records
+}
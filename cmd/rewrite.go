@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+)
+
+// rewriteRule replaces matches of a regular expression in generated names.
+type rewriteRule struct {
+	Match   string `mapstructure:"match"`
+	Replace string `mapstructure:"replace"`
+
+	re *regexp.Regexp
+}
+
+// rewriteRules are applied in order to every name before records are built.
+var rewriteRules []rewriteRule
+
+// loadRewriteRules reads and compiles the rewrite key of the configuration
+// file.
+func loadRewriteRules() ([]rewriteRule, error) {
+	var rules []rewriteRule
+	if err := decodeSection(config.Rewrite, &rules); err != nil {
+		return nil, fmt.Errorf("invalid rewrite rules: %w", err)
+	}
+	for i := range rules {
+		re, err := regexp.Compile(rules[i].Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %w", i, err)
+		}
+		rules[i].re = re
+	}
+	return rules, nil
+}
+
+// rewriteNames applies the rewrite rules to names, each rule to the result
+// of the previous one. Names rewritten to nothing are dropped, as are
+// duplicates.
+func rewriteNames(names []string) []string {
+	if len(rewriteRules) == 0 {
+		return names
+	}
+
+	seen := make(map[string]bool, len(names))
+	rewritten := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, rule := range rewriteRules {
+			name = rule.re.ReplaceAllString(name, rule.Replace)
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		rewritten = append(rewritten, name)
+	}
+	return rewritten
+}
@@ -24,6 +24,8 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"os"
+	"reflect"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -58,6 +60,13 @@ func initConfig() {
 	viper.SetEnvPrefix("EXTERNAL_MDNS")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
+	// The environment is only looked up for keys viper knows, which the
+	// file-only settings are not unless the file has them.
+	for name, t := range sectionFields() {
+		if t.Kind() == reflect.String {
+			viper.BindEnv(name)
+		}
+	}
 
 	if cfgFile != "" {
 		// Use config file from the flag.
@@ -77,4 +86,24 @@ func initConfig() {
 	} else {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+	// The file and its includes are read again and checked on their own
+	// before they take effect, as on reloads.
+	fresh, err := readConfig(viper.ConfigFileUsed())
+	if err == nil && fresh == nil {
+		err = checkSettings(viper.GetViper())
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration; %s", err)
+	}
+	for _, err := range checkEnvironment(os.Environ()) {
+		log.Printf("Ignoring %s", err)
+	}
+	if fresh != nil {
+		if err := adoptConfig(fresh); err != nil {
+			log.Fatalf("Failed to include configuration; %s", err)
+		}
+	}
+	if err := loadSettings(); err != nil {
+		log.Fatalf("Invalid configuration; %s", err)
+	}
 }
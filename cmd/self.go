@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+)
+
+// selfResource describes this instance for --advertise-self: its hostname
+// and --self-alias pointing at its own addresses and, with --admin-listen,
+// a DNS-SD _http._tcp instance for the admin API.
+func selfResource() (resource.Resource, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return resource.Resource{}, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	hostname = strings.ToLower(strings.Split(hostname, ".")[0])
+
+	names := []string{hostname}
+	if alias := conf.SelfAlias; alias != "" && alias != hostname {
+		names = append([]string{alias}, names...)
+	}
+
+	ips := conf.SelfAddresses
+	if len(ips) == 0 {
+		if ips, err = interfaceAddresses(); err != nil {
+			return resource.Resource{}, err
+		}
+	}
+
+	r := resource.Resource{
+		SourceType: "self",
+		SourceName: hostname,
+		Created:    time.Now(),
+		Action:     resource.Added,
+		IPs:        ips,
+		Names:      names,
+	}
+
+	if addr := conf.AdminListen; addr != "" {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return resource.Resource{}, fmt.Errorf("invalid --%s: %w", config.AdminListen, err)
+		}
+		instance := "external-mdns-" + hostname + "._http._tcp.local."
+		ttl := ttls.base
+		r.Records = []string{
+			fmt.Sprintf("_services._dns-sd._udp.local. %d IN PTR _http._tcp.local.", ttl),
+			fmt.Sprintf("_http._tcp.local. %d IN PTR %s", ttl, instance),
+			fmt.Sprintf("%s %d IN SRV 0 0 %s %s.local.", instance, ttl, port, names[0]),
+			fmt.Sprintf(`%s %d IN TXT "path=/" "metrics=/metrics"`, instance, ttl),
+		}
+	}
+	return r, nil
+}
+
+// interfaceAddresses returns the global unicast addresses of the host's
+// interfaces that are up.
+func interfaceAddresses() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	var ips []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no interface addresses found, set --%s", config.SelfAddresses)
+	}
+	return ips, nil
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// selftestAddress is the documentation address (RFC 5737) the probe record
+// points to.
+const selftestAddress = "192.0.2.1"
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check that mDNS queries are answered on this node",
+	Long: `selftest starts the mDNS responder with the given responder flags, publishes
+a uniquely named probe record and queries it over multicast from a second
+socket, reporting whether the answer arrived and how long it took. It exits
+with a non-zero status when a probe fails.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		bindSettings(cmd.Flags())
+	},
+	Run: runSelftest,
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+
+	selftestCmd.Flags().Bool(config.Debug, false, "Enable debug logging")
+	selftestCmd.Flags().Duration(config.SelftestTimeout, 3*time.Second, "How long to wait for each answer")
+	selftestCmd.Flags().String(config.SelftestIPv6Interface, "", "Also probe over IPv6 on this interface")
+	addResponderFlags(selftestCmd.Flags())
+}
+
+func runSelftest(cmd *cobra.Command, args []string) {
+	var err error
+	if lg, err = NewLogger(); err != nil {
+		log.Fatalf("Failed to create logger: %v", err)
+	}
+
+	responderConfig, err := newResponderConfig()
+	if err != nil {
+		lg.Fatal("Invalid responder configuration:", zap.Error(err))
+	}
+	if err := mdns.Start(responderConfig); err != nil {
+		fmt.Printf("FAIL  start responder: %v\n", err)
+		os.Exit(1)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := "external-mdns-selftest-" + hex.EncodeToString(suffix) + ".local."
+	if err := mdns.Publish(fmt.Sprintf("%s 10 IN A %s", name, selftestAddress)); err != nil {
+		lg.Fatal("Failed to publish probe record:", zap.Error(err))
+	}
+
+	groups := []*net.UDPAddr{{IP: responderConfig.IPv4Group, Port: responderConfig.Port}}
+	if iface := conf.SelftestIPv6Interface; iface != "" {
+		groups = append(groups, &net.UDPAddr{IP: responderConfig.IPv6Group, Port: responderConfig.Port, Zone: iface})
+	}
+
+	timeout := conf.SelftestTimeout
+	failed := false
+	for _, group := range groups {
+		rtt, err := mdns.Probe(group, name, timeout)
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %-24s %s: %v\n", group, name, err)
+			continue
+		}
+		fmt.Printf("PASS  %-24s %s answered in %s\n", group, name, rtt.Round(time.Microsecond))
+	}
+
+	mdns.UnPublish(fmt.Sprintf("%s 10 IN A %s", name, selftestAddress))
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,430 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// fileSettings is the schema of the sections of the configuration file that
+// have no flag of their own. Every other setting is typed by its flag.
+type fileSettings struct {
+	Include    []string           `mapstructure:"include"`
+	AgentToken string             `mapstructure:"agent-token"`
+	AdminToken string             `mapstructure:"admin-token"`
+	CRD        []source.CRDConfig `mapstructure:"crd"`
+	Rewrite    []rewriteRule      `mapstructure:"rewrite"`
+}
+
+// settings is the typed configuration of every command: a field for each
+// flag, which may also be set in the configuration file or the environment,
+// and the file-only sections. loadSettings decodes it from viper.
+type settings struct {
+	Debug                     bool          `mapstructure:"debug"`
+	KubeConfig                string        `mapstructure:"kubeconfig"`
+	Master                    string        `mapstructure:"master"`
+	Namespace                 []string      `mapstructure:"namespace"`
+	CheckPermissions          bool          `mapstructure:"check-permissions"`
+	PublishInternalServices   bool          `mapstructure:"publish-internal-services"`
+	RecordTTL                 int           `mapstructure:"record-ttl"`
+	Source                    []string      `mapstructure:"source"`
+	WithoutNamespace          bool          `mapstructure:"without-namespace"`
+	Test                      bool          `mapstructure:"test"`
+	ExposeIPv4                bool          `mapstructure:"expose-ipv4"`
+	ExposeIPv6                bool          `mapstructure:"expose-ipv6"`
+	DefaultNamespace          []string      `mapstructure:"default-namespace"`
+	AllowSubnets              []string      `mapstructure:"allow-subnets"`
+	DenySubnets               []string      `mapstructure:"deny-subnets"`
+	ReusePort                 bool          `mapstructure:"reuse-port"`
+	PortConflict              string        `mapstructure:"port-conflict"`
+	MissingPrivileges         string        `mapstructure:"missing-privileges"`
+	MulticastTTL              int           `mapstructure:"multicast-ttl"`
+	MulticastHopLimit         int           `mapstructure:"multicast-hop-limit"`
+	MDNSPort                  int           `mapstructure:"mdns-port"`
+	MDNSIPv4Group             string        `mapstructure:"mdns-ipv4-group"`
+	MDNSIPv6Group             string        `mapstructure:"mdns-ipv6-group"`
+	MemoryTransport           bool          `mapstructure:"memory-transport"`
+	NetNS                     string        `mapstructure:"netns"`
+	WatchInterfaces           bool          `mapstructure:"watch-interfaces"`
+	HyphenatedNames           bool          `mapstructure:"hyphenated-names"`
+	RecordStrategy            string        `mapstructure:"record-strategy"`
+	DNSSDPorts                bool          `mapstructure:"dns-sd-ports"`
+	DNSSDAppProtocol          []string      `mapstructure:"dns-sd-app-protocol"`
+	ShortNameConflict         string        `mapstructure:"short-name-conflict"`
+	PTRConflict               string        `mapstructure:"ptr-conflict"`
+	MaxIPsPerName             int           `mapstructure:"max-ips-per-name"`
+	IPSelection               string        `mapstructure:"ip-selection"`
+	RequireReadyEndpoints     bool          `mapstructure:"require-ready-endpoints"`
+	GoodbyeFinalizer          bool          `mapstructure:"goodbye-finalizer"`
+	RestoreSnapshot           string        `mapstructure:"restore-snapshot"`
+	ResolveExternalNames      bool          `mapstructure:"resolve-external-names"`
+	ServeMDNS                 bool          `mapstructure:"serve-mdns"`
+	AgentListen               string        `mapstructure:"agent-listen"`
+	AgentTokenFile            string        `mapstructure:"agent-token-file"`
+	AgentTLSCert              string        `mapstructure:"agent-tls-cert"`
+	AgentTLSKey               string        `mapstructure:"agent-tls-key"`
+	Controller                string        `mapstructure:"controller"`
+	ControllerCA              string        `mapstructure:"controller-ca"`
+	InsecureSkipVerify        bool          `mapstructure:"insecure-skip-verify"`
+	NodeLocal                 bool          `mapstructure:"node-local"`
+	NodeLocalFallback         bool          `mapstructure:"node-local-fallback"`
+	NodeName                  string        `mapstructure:"node-name"`
+	AdminListen               string        `mapstructure:"admin-listen"`
+	AdminTokenFile            string        `mapstructure:"admin-token-file"`
+	TracingEndpoint           string        `mapstructure:"tracing-endpoint"`
+	ResyncPeriod              time.Duration `mapstructure:"resync-period"`
+	CollectOrphansAfter       int           `mapstructure:"collect-orphans-after"`
+	StaleZoneAfter            time.Duration `mapstructure:"stale-zone-after"`
+	ServiceFieldSelector      string        `mapstructure:"service-field-selector"`
+	IngressFieldSelector      string        `mapstructure:"ingress-field-selector"`
+	IngressControllerSelector string        `mapstructure:"ingress-controller-selector"`
+	IngressControllerService  string        `mapstructure:"ingress-controller-service"`
+	KubeAPIQPS                float64       `mapstructure:"kube-api-qps"`
+	KubeAPIBurst              int           `mapstructure:"kube-api-burst"`
+	KubeContext               string        `mapstructure:"context"`
+	ImpersonateUser           string        `mapstructure:"as"`
+	ImpersonateGroups         []string      `mapstructure:"as-group"`
+	TestFixture               string        `mapstructure:"test-fixture"`
+	SelftestTimeout           time.Duration `mapstructure:"timeout"`
+	SelftestIPv6Interface     string        `mapstructure:"ipv6-interface"`
+	SoakResources             int           `mapstructure:"soak-resources"`
+	SoakChurn                 float64       `mapstructure:"soak-churn"`
+	SoakReportInterval        time.Duration `mapstructure:"soak-report-interval"`
+	BenchRecords              int           `mapstructure:"records"`
+	BenchRate                 int           `mapstructure:"rate"`
+	BenchDuration             time.Duration `mapstructure:"duration"`
+	TTLJitter                 int           `mapstructure:"ttl-jitter"`
+	RespondOnly               bool          `mapstructure:"respond-only"`
+	AcceptOffLink             bool          `mapstructure:"accept-off-link"`
+	MaxPacketSize             int           `mapstructure:"max-packet-size"`
+	MaxAnswers                int           `mapstructure:"max-answers"`
+	AnnounceRate              float64       `mapstructure:"announce-rate"`
+	AnnounceBurst             int           `mapstructure:"announce-burst"`
+	Filter                    string        `mapstructure:"filter"`
+	EventsNATSURL             string        `mapstructure:"events-nats-url"`
+	EventsNATSSubject         string        `mapstructure:"events-nats-subject"`
+	EventsMQTTURL             string        `mapstructure:"events-mqtt-url"`
+	EventsMQTTTopic           string        `mapstructure:"events-mqtt-topic"`
+	HookPrePublish            []string      `mapstructure:"hook-pre-publish"`
+	HookPostUnpublish         []string      `mapstructure:"hook-post-unpublish"`
+	HookTimeout               time.Duration `mapstructure:"hook-timeout"`
+	IPAMURL                   string        `mapstructure:"ipam-url"`
+	IPAMType                  string        `mapstructure:"ipam-type"`
+	IPAMToken                 string        `mapstructure:"ipam-token"`
+	IPAMPolicy                string        `mapstructure:"ipam-policy"`
+	IPAMCacheTTL              time.Duration `mapstructure:"ipam-cache-ttl"`
+	ZoneConfigMap             string        `mapstructure:"zone-configmap"`
+	ZoneConfigMapInterval     time.Duration `mapstructure:"zone-configmap-interval"`
+	HostsFileWatch            bool          `mapstructure:"hostsfile-watch"`
+	ZoneFileWatch             bool          `mapstructure:"zonefile-watch"`
+	KubeConfigSecret          string        `mapstructure:"kubeconfig-secret"`
+	KubeConfigSecretKey       string        `mapstructure:"kubeconfig-secret-key"`
+	AdvertiseSelf             bool          `mapstructure:"advertise-self"`
+	SelfAlias                 string        `mapstructure:"self-alias"`
+	SelfAddresses             []string      `mapstructure:"self-address"`
+	AdvertiseAPIServer        string        `mapstructure:"advertise-api-server"`
+	APIServerAddresses        []string      `mapstructure:"api-server-address"`
+	SSDP                      bool          `mapstructure:"ssdp"`
+	WSD                       bool          `mapstructure:"wsd"`
+	QueryReportInterval       time.Duration `mapstructure:"query-report-interval"`
+	StalePolicy               string        `mapstructure:"stale-policy"`
+	StaleTTL                  int           `mapstructure:"stale-ttl"`
+	CanaryWindow              time.Duration `mapstructure:"canary-window"`
+	CanaryTTL                 int           `mapstructure:"canary-ttl"`
+	Probe                     string        `mapstructure:"probe"`
+	ProbeInterval             time.Duration `mapstructure:"probe-interval"`
+	ProbeFailures             int           `mapstructure:"probe-failures"`
+	ProbeAction               string        `mapstructure:"probe-action"`
+	DuplicateCheckInterval    time.Duration `mapstructure:"duplicate-check-interval"`
+	VerifyInterval            time.Duration `mapstructure:"verify-interval"`
+	VerifySample              int           `mapstructure:"verify-sample"`
+	WithdrawnGrace            time.Duration `mapstructure:"withdrawn-grace"`
+	AnswerOrder               string        `mapstructure:"answer-order"`
+	Wildcards                 []string      `mapstructure:"answer-wildcards"`
+	BothFamilies              bool          `mapstructure:"answer-both-families"`
+	ZoneMemoryBudget          string        `mapstructure:"zone-memory-budget"`
+	PriorityClass             []string      `mapstructure:"priority-class"`
+	Config                    string        `mapstructure:"config"` // read through cfgFile
+
+	fileSettings `mapstructure:",squash"`
+}
+
+// conf holds the settings of the running command. It is replaced on the
+// main loop when the configuration is reloaded.
+var conf settings
+
+// loadSettings decodes the flags, the environment and the configuration
+// file into conf, failing on keys and values the schema does not accept.
+func loadSettings() error {
+	var s settings
+	if err := viper.Unmarshal(&s, strictDecoding); err != nil {
+		return err
+	}
+	conf = s
+	return nil
+}
+
+// bindSettings binds the flags of the running command, so its values win
+// over those of other commands sharing a flag, and loads them into conf.
+// --help, which cobra handles, is not a setting.
+func bindSettings(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name != "help" {
+			viper.BindPFlag(f.Name, f)
+		}
+	})
+	if err := loadSettings(); err != nil {
+		log.Fatalf("Invalid configuration; %s", err)
+	}
+}
+
+// strictDecoding makes UnmarshalKey fail on keys the target does not have.
+func strictDecoding(dc *mapstructure.DecoderConfig) {
+	dc.ErrorUnused = true
+}
+
+// decodeSection decodes a section of the configuration, rejecting keys the
+// schema does not know.
+func decodeSection(key string, target any) error {
+	return viper.UnmarshalKey(key, target, strictDecoding)
+}
+
+// sectionFields maps the keys of the file-only sections to the type of
+// their value.
+func sectionFields() map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	t := reflect.TypeOf(fileSettings{})
+	for i := range t.NumField() {
+		fields[t.Field(i).Tag.Get("mapstructure")] = t.Field(i).Type
+	}
+	return fields
+}
+
+// knownFlags returns the flags of every command, so a configuration file
+// shared by several commands may hold the settings of any of them.
+func knownFlags() map[string]*pflag.Flag {
+	flags := map[string]*pflag.Flag{}
+	var walk func(*cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		for _, set := range []*pflag.FlagSet{cmd.PersistentFlags(), cmd.Flags()} {
+			set.VisitAll(func(f *pflag.Flag) {
+				if _, ok := flags[f.Name]; !ok {
+					flags[f.Name] = f
+				}
+			})
+		}
+		for _, child := range cmd.Commands() {
+			walk(child)
+		}
+	}
+	walk(rootCmd)
+	return flags
+}
+
+// knownSettings returns the names of every flag and file-only section,
+// sorted.
+func knownSettings(flags map[string]*pflag.Flag, fields map[string]reflect.Type) []string {
+	known := make([]string, 0, len(flags)+len(fields))
+	for name := range flags {
+		known = append(known, name)
+	}
+	for name := range fields {
+		known = append(known, name)
+	}
+	sort.Strings(known)
+	return known
+}
+
+// checkSettings validates the configuration file read into v and its
+// included files against the schema, so that a misspelled or mistyped
+// setting fails instead of leaving the default in place.
+func checkSettings(v *viper.Viper) error {
+	flags := knownFlags()
+	fields := sectionFields()
+	known := knownSettings(flags, fields)
+
+	files := []string{}
+	if v.ConfigFileUsed() != "" {
+		included, err := includedConfigFiles(v)
+		if err != nil {
+			return err
+		}
+		files = append([]string{v.ConfigFileUsed()}, included...)
+	}
+	for _, file := range files {
+		settings := viper.New()
+		settings.SetConfigFile(file)
+		if err := settings.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config %s: %w", file, err)
+		}
+		keys := settings.AllSettings()
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var err error
+			if f, ok := flags[name]; ok {
+				err = checkFlagValue(f, keys[name])
+			} else if t, ok := fields[name]; ok {
+				err = checkSection(settings, name, t)
+			} else {
+				err = unknownSetting(name, known)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// serviceLinkVariable matches the environment variables Kubernetes adds for
+// the Services of the namespace, such as EXTERNAL_MDNS_SERVICE_HOST and
+// EXTERNAL_MDNS_PORT_8443_TCP for a Service named external-mdns.
+var serviceLinkVariable = regexp.MustCompile(`_SERVICE_HOST$|_SERVICE_PORT(_[A-Z0-9_]+)?$|_PORT$|_PORT_[0-9]+_(TCP|UDP|SCTP)(_PROTO|_PORT|_ADDR)?$`)
+
+// checkEnvironment returns an error for each EXTERNAL_MDNS_ variable of
+// environ that names no setting. Unlike unknown keys in the configuration
+// file, these are only warned about: the variables Kubernetes adds for a
+// Service named external-mdns, which --agent-listen needs, share the
+// prefix. Those are skipped.
+func checkEnvironment(environ []string) []error {
+	flags := knownFlags()
+	fields := sectionFields()
+	known := knownSettings(flags, fields)
+
+	var errs []error
+	for _, env := range environ {
+		variable, _, _ := strings.Cut(env, "=")
+		name, ok := strings.CutPrefix(variable, "EXTERNAL_MDNS_")
+		if !ok || name == "" {
+			continue
+		}
+		name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+		if _, ok := flags[name]; ok {
+			continue
+		}
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		if serviceLinkVariable.MatchString(variable) {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("environment variable %s: %w", variable, unknownSetting(name, known)))
+	}
+	return errs
+}
+
+// checkFlagValue reports a value the flag's type cannot hold.
+func checkFlagValue(f *pflag.Flag, value any) error {
+	var err error
+	switch f.Value.Type() {
+	case "bool":
+		_, err = cast.ToBoolE(value)
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64":
+		_, err = cast.ToInt64E(value)
+	case "float32", "float64":
+		_, err = cast.ToFloat64E(value)
+	case "duration":
+		_, err = cast.ToDurationE(value)
+	case "string":
+		_, err = cast.ToStringE(value)
+	case "stringSlice", "stringArray":
+		_, err = cast.ToStringSliceE(value)
+	case "stringToString":
+		_, err = cast.ToStringMapStringE(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %v for %s, not a valid %s", value, f.Name, f.Value.Type())
+	}
+	return nil
+}
+
+// checkSection decodes a file-only section into its schema type, pointing
+// out misspelled keys of its entries.
+func checkSection(settings *viper.Viper, name string, t reflect.Type) error {
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct {
+		var fields []string
+		for i := range t.Elem().NumField() {
+			if tag := t.Elem().Field(i).Tag.Get("mapstructure"); tag != "" {
+				fields = append(fields, tag)
+			}
+		}
+		entries, _ := settings.Get(name).([]any)
+		for i, entry := range entries {
+			keys, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			for key := range keys {
+				if !containsFold(fields, key) {
+					return fmt.Errorf("%s entry %d: %w", name, i, unknownSetting(key, fields))
+				}
+			}
+		}
+	}
+	target := reflect.New(t).Interface()
+	if err := settings.UnmarshalKey(name, target, strictDecoding); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}
+
+// containsFold reports whether names holds name, ignoring case as viper does.
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownSetting returns the error for a setting the schema does not know,
+// suggesting the closest known one when it looks like a typo.
+func unknownSetting(name string, known []string) error {
+	best, distance := "", len(name)/3+1
+	for _, candidate := range known {
+		if d := editDistance(name, candidate); d <= distance && (best == "" || d < distance) {
+			best, distance = candidate, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown setting %q, did you mean %q?", name, best)
+	}
+	return fmt.Errorf("unknown setting %q", name)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
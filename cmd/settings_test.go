@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/spf13/viper"
+)
+
+func TestCheckSettingsRejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string // empty when the file is valid
+	}{
+		{"record-ttl: 60\nadmin-token: secret\n", ""},
+		{"record-tll: 60\n", `unknown setting "record-tll", did you mean "record-ttl"?`},
+		{"port: tcp://10.0.0.1:8443\n", `unknown setting "port"`},
+		{"record-ttl: soon\n", "invalid value soon for record-ttl"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "external-mdns.yaml")
+		if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		err := checkSettings(v)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("checkSettings(%q) = %v, want nil", tt.config, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("checkSettings(%q) = %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestCheckEnvironmentWarnsOnly(t *testing.T) {
+	environ := []string{
+		"EXTERNAL_MDNS_RECORD_TTL=60",
+		"EXTERNAL_MDNS_ADMIN_TOKEN=secret",
+		"EXTERNAL_MDNS_=",
+		// Service links for a Service named external-mdns.
+		"EXTERNAL_MDNS_SERVICE_HOST=10.0.0.1",
+		"EXTERNAL_MDNS_SERVICE_PORT=8443",
+		"EXTERNAL_MDNS_SERVICE_PORT_AGENT=8443",
+		"EXTERNAL_MDNS_PORT=tcp://10.0.0.1:8443",
+		"EXTERNAL_MDNS_PORT_8443_TCP=tcp://10.0.0.1:8443",
+		"EXTERNAL_MDNS_PORT_8443_TCP_PROTO=tcp",
+		"EXTERNAL_MDNS_PORT_8443_TCP_PORT=8443",
+		"EXTERNAL_MDNS_PORT_8443_TCP_ADDR=10.0.0.1",
+		"EXTERNAL_MDNS_RECORD_TLL=60",
+		"HOME=/root",
+	}
+	errs := checkEnvironment(environ)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `EXTERNAL_MDNS_RECORD_TLL: unknown setting "record-tll", did you mean "record-ttl"?`) {
+		t.Errorf("checkEnvironment() = %v, want only EXTERNAL_MDNS_RECORD_TLL", errs)
+	}
+}
+
+func TestLoadSettings(t *testing.T) {
+	setFlags(t, map[string]any{
+		config.RecordTTL:    "60",
+		config.ResyncPeriod: "2m",
+		config.Namespace:    "media,shop",
+		config.AdminToken:   "secret",
+	})
+	if conf.RecordTTL != 60 || conf.ResyncPeriod != 2*time.Minute || !slices.Equal(conf.Namespace, []string{"media", "shop"}) || conf.AdminToken != "secret" {
+		t.Errorf("loadSettings() = %+v", conf)
+	}
+
+	for key, value := range map[string]any{"record-tll": 60, config.RecordTTL: "soon"} {
+		viper.Set(key, value)
+		if err := loadSettings(); err == nil {
+			t.Errorf("loadSettings() with %s=%v = nil, want an error", key, value)
+		}
+		viper.Set(key, nil)
+	}
+}
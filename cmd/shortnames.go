@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Policies for resources in different namespaces claiming the same bare
+// <name>.local. Under first-wins and priority, a higher priority class wins
+// before anything else.
+const (
+	shortNameFirstWins = "first-wins" // the oldest object publishes the name
+	shortNamePriority  = "priority"   // the highest priority annotation wins, then the oldest
+	shortNameRefuse    = "refuse"     // nobody publishes a contested name
+	shortNameAll       = "all"        // everyone publishes, as before conflicts were tracked
+)
+
+// shortNames is the registry used by the main loop.
+var shortNames *shortNameRegistry
+
+// shortNameTransition describes another resource gaining or losing a short
+// name as a side effect of the resource being processed.
+type shortNameTransition struct {
+	res    resource.Resource
+	name   string
+	action string // resource.Added or resource.Deleted
+}
+
+// shortNameRegistry tracks which resources claim each short name and
+// decides which one of them publishes it. The winner is a pure function of
+// the current claimants so the outcome does not depend on event order. It
+// is only used from the main loop and is not safe for concurrent use.
+type shortNameRegistry struct {
+	policy string
+	claims map[string]map[string]resource.Resource // name -> owner -> claimant
+}
+
+func newShortNameRegistry(policy string) (*shortNameRegistry, error) {
+	switch policy {
+	case shortNameFirstWins, shortNamePriority, shortNameRefuse, shortNameAll:
+	default:
+		return nil, fmt.Errorf("unknown short name conflict policy %q", policy)
+	}
+	return &shortNameRegistry{
+		policy: policy,
+		claims: make(map[string]map[string]resource.Resource),
+	}, nil
+}
+
+// ownerKey identifies the Kubernetes object r was built from, or the entry
+// of a file source, qualified by its file as several files may hold the same
+// name.
+func ownerKey(r resource.Resource) string {
+	if r.File != "" {
+		return r.SourceType + ":" + r.File + "/" + r.Namespace + "/" + r.SourceName
+	}
+	return r.SourceType + "/" + r.Namespace + "/" + r.SourceName
+}
+
+// owns reports whether r publishes the short name.
+func (s *shortNameRegistry) owns(name string, r resource.Resource) bool {
+	if s.policy == shortNameAll {
+		return true
+	}
+	return s.winner(name) == ownerKey(r)
+}
+
+// winner returns the owner key of the claimant that publishes name, or an
+// empty string if nobody does.
+func (s *shortNameRegistry) winner(name string) string {
+	claims := s.claims[name]
+	if s.policy == shortNameRefuse && len(claims) > 1 {
+		return ""
+	}
+
+	var best string
+	for owner := range claims {
+		if best == "" || s.better(claims[owner], owner, claims[best], best) {
+			best = owner
+		}
+	}
+	return best
+}
+
+// better reports whether claimant a outranks claimant b. A higher priority
+// class wins under every policy.
+func (s *shortNameRegistry) better(a resource.Resource, aKey string, b resource.Resource, bKey string) bool {
+	if ca, cb := classValue(a), classValue(b); ca != cb {
+		return ca > cb
+	}
+	if s.policy == shortNamePriority && a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.Created.Equal(b.Created) {
+		return a.Created.Before(b.Created)
+	}
+	return aKey < bKey
+}
+
+// claim registers r for each of its short names.
+func (s *shortNameRegistry) claim(r resource.Resource) []shortNameTransition {
+	if s.policy == shortNameAll || !wantsShortNames(r) || len(selectIPs(r)) == 0 {
+		return nil
+	}
+
+	var transitions []shortNameTransition
+	for _, name := range r.Names {
+		transitions = append(transitions, s.update(name, r, true)...)
+
+		if others := len(s.claims[name]) - 1; others > 0 && !s.owns(name, r) {
+			if winner := s.winner(name); winner != "" {
+				lg.Warn("Short name already published by another resource",
+					zap.String("name", name+".local"), zap.String("resource", ownerKey(r)), zap.String("owner", winner))
+				recordEvent(r, corev1.EventTypeWarning, "ShortNameConflict",
+					"%s.local is already published for %s", name, winner)
+			} else {
+				lg.Warn("Short name claimed by several resources, not publishing",
+					zap.String("name", name+".local"), zap.String("resource", ownerKey(r)))
+				recordEvent(r, corev1.EventTypeWarning, "ShortNameConflict",
+					"%s.local is claimed by %d other resources and will not be published", name, others)
+			}
+		}
+	}
+	return transitions
+}
+
+// release withdraws r's claim on each of its short names.
+func (s *shortNameRegistry) release(r resource.Resource) []shortNameTransition {
+	if s.policy == shortNameAll {
+		return nil
+	}
+
+	var transitions []shortNameTransition
+	for _, name := range r.Names {
+		transitions = append(transitions, s.update(name, r, false)...)
+	}
+	return transitions
+}
+
+// update adds or removes r's claim on name and returns the changes this
+// causes for other claimants.
+func (s *shortNameRegistry) update(name string, r resource.Resource, claim bool) []shortNameTransition {
+	key := ownerKey(r)
+	before := s.winner(name)
+	previous := s.claims[name][before]
+
+	if claim {
+		if s.claims[name] == nil {
+			s.claims[name] = make(map[string]resource.Resource)
+		}
+		s.claims[name][key] = r
+	} else {
+		delete(s.claims[name], key)
+		if len(s.claims[name]) == 0 {
+			delete(s.claims, name)
+		}
+	}
+
+	after := s.winner(name)
+	if before == after {
+		return nil
+	}
+
+	var transitions []shortNameTransition
+	if before != "" && before != key {
+		transitions = append(transitions, shortNameTransition{res: previous, name: name, action: resource.Deleted})
+	}
+	if after != "" && after != key {
+		transitions = append(transitions, shortNameTransition{res: s.claims[name][after], name: name, action: resource.Added})
+	}
+	return transitions
+}
+
+// applyShortNameTransitions publishes or withdraws the short name records
+// of resources affected by a conflict changing.
+func applyShortNameTransitions(transitions []shortNameTransition) {
+	for _, t := range transitions {
+		for _, record := range shortNameRecords(t.res, t.name) {
+			switch t.action {
+			case resource.Added:
+				lg.Info("Publishing short name after conflict resolved:", zap.String("record", record))
+				rankRecord(record, t.res)
+				publishRecord(liveKey(t.res), record)
+			case resource.Deleted:
+				lg.Info("Withdrawing short name lost to conflict:", zap.String("record", record))
+				unpublishRecord(liveKey(t.res), record)
+			}
+		}
+		if t.action == resource.Deleted {
+			recordEvent(t.res, corev1.EventTypeWarning, "ShortNameConflict",
+				"%s.local is no longer published for this object because another resource claimed it", t.name)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// explanation tells whether an object is published and, if not, why.
+type explanation struct {
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace"`
+	Name      string       `json:"name"`
+	Published bool         `json:"published"`
+	Records   []string     `json:"records,omitempty"`
+	Skip      *source.Skip `json:"skip,omitempty"`
+}
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/skipped", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, source.Skips())
+	})
+	adminMux.HandleFunc("GET /api/v1/explain/{kind}/{namespace}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		kind := objectKind(r.PathValue("kind"))
+		if kind == "" {
+			http.Error(w, "kind must be service or ingress", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, explain(kind, r.PathValue("namespace"), r.PathValue("name")))
+	})
+}
+
+// objectKind returns the kind named by s, as in kubectl (svc, services,
+// ing...), or an empty string.
+func objectKind(s string) string {
+	switch strings.ToLower(s) {
+	case "svc", "service", "services":
+		return "Service"
+	case "ing", "ingress", "ingresses":
+		return "Ingress"
+	}
+	return ""
+}
+
+// explain reports the published records of an object or why it is skipped.
+func explain(kind, namespace, name string) explanation {
+	e := explanation{Kind: kind, Namespace: namespace, Name: name}
+	owner := strings.ToLower(kind) + "/" + namespace + "/" + name
+	for _, zr := range describeZone() {
+		if zr.Source == owner {
+			e.Records = append(e.Records, zr.Record)
+		}
+	}
+	e.Published = len(e.Records) > 0
+	if skip, ok := source.SkipFor(kind, namespace, name); ok && !e.Published {
+		e.Skip = &skip
+	}
+	return e
+}
+
+// reportedSkips returns the skips worth showing outside the process,
+// leaving out quiet ones.
+func reportedSkips() []source.Skip {
+	skips := []source.Skip{}
+	for _, s := range source.Skips() {
+		if !s.Quiet {
+			skips = append(skips, s)
+		}
+	}
+	return skips
+}
+
+// recordSkipEvents emits an Event, with the skip reason as its reason, each
+// time an object is skipped or skipped for a new reason. Evictions are
+// warnings, as the object would otherwise be published. Quiet skips raise
+// no Event.
+func recordSkipEvents() {
+	for s := range source.SkipChanges() {
+		if s.Quiet {
+			continue
+		}
+		eventType := corev1.EventTypeNormal
+		if s.Reason == source.SkipEvicted {
+			eventType = corev1.EventTypeWarning
+		}
+		r := resource.Resource{SourceType: strings.ToLower(s.Kind), Namespace: s.Namespace, SourceName: s.Name}
+		recordEvent(r, eventType, s.Reason, "Not published: %s", s.Message)
+	}
+}
+
+// skipKind returns the kind under which skips of r are recorded, or an
+// empty string if r does not come from a Service or Ingress.
+func skipKind(r resource.Resource) string {
+	return objectReference(r).Kind
+}
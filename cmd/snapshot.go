@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// snapshotOwner owns the records restored from snapshots in recordOwners.
+const snapshotOwner = "snapshot"
+
+// maxSnapshotSize bounds the body of a restore request.
+const maxSnapshotSize = 64 << 20
+
+// zoneSnapshot is the zone as saved by GET /api/v1/zone/snapshot and loaded
+// by POST /api/v1/zone/restore and --restore-snapshot.
+type zoneSnapshot struct {
+	Taken   time.Time `json:"taken"`
+	Records []string  `json:"records"`
+}
+
+// restoreResult reports what a restore changed.
+type restoreResult struct {
+	Restored  int `json:"restored"`
+	Withdrawn int `json:"withdrawn"`
+}
+
+// restoreRequest asks the main loop to publish the records of a snapshot,
+// replacing those restored before unless merge is set.
+type restoreRequest struct {
+	records []string
+	merge   bool
+	result  chan restoreResult
+}
+
+// restoreRequests carries restore requests to the main loop.
+var restoreRequests = make(chan restoreRequest)
+
+// restored holds the records published from snapshots. It is only used
+// from the main loop.
+var restored = make(map[string]bool)
+
+func init() {
+	adminMux.HandleFunc("GET /api/v1/zone/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		records := mdns.Records()
+		sort.Strings(records)
+		w.Header().Set("Content-Disposition", `attachment; filename="external-mdns-zone.json"`)
+		writeJSON(w, zoneSnapshot{Taken: time.Now().UTC(), Records: records})
+	})
+	adminMux.HandleFunc("POST /api/v1/zone/restore", authorized(func(w http.ResponseWriter, r *http.Request) {
+		var snapshot zoneSnapshot
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSnapshotSize)).Decode(&snapshot); err != nil {
+			http.Error(w, fmt.Sprintf("invalid snapshot: %s", err), http.StatusBadRequest)
+			return
+		}
+		records, err := snapshotRecords(snapshot)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestRestore(w, records, r.URL.Query().Get("merge") == "true")
+	}))
+	adminMux.HandleFunc("DELETE /api/v1/zone/restore", authorized(func(w http.ResponseWriter, r *http.Request) {
+		requestRestore(w, nil, false)
+	}))
+}
+
+// requestRestore hands records to the main loop and writes the result.
+func requestRestore(w http.ResponseWriter, records []string, merge bool) {
+	req := restoreRequest{records: records, merge: merge, result: make(chan restoreResult, 1)}
+	select {
+	case restoreRequests <- req:
+		writeJSON(w, <-req.result)
+	case <-time.After(2 * time.Second):
+		// The main loop is not running, as in agent or test mode.
+		http.Error(w, "the zone cannot be restored in this mode", http.StatusServiceUnavailable)
+	}
+}
+
+// snapshotRecords checks the records of snapshot and writes them the way
+// constructRecords does, one space between fields, so a restored record and
+// the same record published by a resource share an entry in recordOwners.
+func snapshotRecords(snapshot zoneSnapshot) ([]string, error) {
+	records := make([]string, 0, len(snapshot.Records))
+	for _, record := range snapshot.Records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %q: %w", record, err)
+		}
+		if rr == nil {
+			continue
+		}
+		rr.Header().Class &^= 0x8000
+		records = append(records, strings.Join(strings.Fields(rr.String()), " "))
+	}
+	return records, nil
+}
+
+// readSnapshot loads the records of the snapshot file at path.
+func readSnapshot(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot zoneSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	return snapshotRecords(snapshot)
+}
+
+// restoreSnapshot publishes records on behalf of the snapshot owner and,
+// unless merge is set, withdraws the records restored before that are not
+// among them. It runs on the main loop.
+func restoreSnapshot(records []string, merge bool) restoreResult {
+	var result restoreResult
+	keep := make(map[string]bool, len(records))
+	for _, record := range records {
+		keep[record] = true
+	}
+	if !merge {
+		var withdrawn []string
+		for record := range restored {
+			if !keep[record] {
+				withdrawn = append(withdrawn, record)
+			}
+		}
+		withdrawRestored(withdrawn)
+		result.Withdrawn = len(withdrawn)
+	}
+	for _, record := range records {
+		if !restored[record] {
+			restored[record] = true
+			publishRecord(snapshotOwner, restoredRecord(record, ttls))
+			result.Restored++
+		}
+	}
+	if result.Restored > 0 || result.Withdrawn > 0 {
+		lg.Info("Restored zone snapshot", zap.Int("restored", result.Restored), zap.Int("withdrawn", result.Withdrawn))
+	}
+	return result
+}
+
+// withdrawRestored withdraws restored records. A record a resource still
+// publishes, even with another TTL, is announced again in the same pass,
+// so caches are not sent a goodbye for it. It runs on the main loop.
+func withdrawRestored(records []string) {
+	if len(records) == 0 {
+		return
+	}
+	published := make(map[string]string)
+	for record, owners := range recordOwners {
+		if _, ok := owners[snapshotOwner]; !ok || len(owners) > 1 {
+			published[recordIdentity(record)] = record
+		}
+	}
+	for _, record := range records {
+		delete(restored, record)
+		record = restoredRecord(record, ttls)
+		unpublishRecord(snapshotOwner, record)
+		if current, ok := published[recordIdentity(record)]; ok && current != record {
+			queueRecord(current, true)
+		}
+	}
+}
+
+// restoredRecord returns a record restored from a snapshot as published
+// under the TTL settings s. Its TTL is taken from the snapshot rather than
+// from recordTTL, so only the drain cap applies.
+func restoredRecord(record string, s ttlSettings) string {
+	if s.drain <= 0 {
+		return record
+	}
+	rr, err := dns.NewRR(record)
+	if err != nil || rr == nil || rr.Header().Ttl <= uint32(s.drain) {
+		return record
+	}
+	rr.Header().Ttl = uint32(s.drain)
+	return strings.Join(strings.Fields(rr.String()), " ")
+}
+
+// republishRestored publishes the restored records again with the TTLs of
+// the current settings, after switching from prev. It runs on the main
+// loop.
+func republishRestored(prev ttlSettings) {
+	for record := range restored {
+		old, current := restoredRecord(record, prev), restoredRecord(record, ttls)
+		if old != current {
+			unpublishRecord(snapshotOwner, old)
+			publishRecord(snapshotOwner, current)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	soakNamespace = "soak"
+	// soakProbes is the number of queries sent per report to measure
+	// answer latency.
+	soakProbes = 20
+)
+
+// soakServices returns n LoadBalancer services to start a soak run with.
+func soakServices(n int) []k8sruntime.Object {
+	objects := make([]k8sruntime.Object, 0, n)
+	for i := 0; i < n; i++ {
+		objects = append(objects, soakService(i, 0))
+	}
+	return objects
+}
+
+// soakService returns synthetic service i with an address from the
+// benchmarking range (RFC 2544). generation varies the address so updates
+// change the published records.
+func soakService(i, generation int) *corev1.Service {
+	n := (i + generation*7919) % (1 << 17)
+	ip := net.IPv4(198, 18+byte(n>>16), byte(n>>8), byte(n)).String()
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("soak-%d", i),
+			Namespace:         soakNamespace,
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+			Ingress: []corev1.LoadBalancerIngress{{IP: ip}},
+		}},
+	}
+}
+
+// runSoak randomly creates, updates and deletes the synthetic services at
+// churn operations per second, and logs answer latency and memory use
+// every interval.
+func runSoak(client kubernetes.Interface, n int, churn float64, interval time.Duration) {
+	ctx := context.Background()
+	services := client.CoreV1().Services(soakNamespace)
+	live := make([]bool, n)
+	generation := make([]int, n)
+	for i := range live {
+		live[i] = true
+	}
+
+	var opTicks <-chan time.Time
+	if churn > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / churn))
+		defer ticker.Stop()
+		opTicks = ticker.C
+	}
+	report := time.NewTicker(interval)
+	defer report.Stop()
+
+	var ops, errors int
+	for {
+		select {
+		case <-opTicks:
+			i := rand.Intn(n)
+			var err error
+			switch {
+			case !live[i]:
+				_, err = services.Create(ctx, soakService(i, generation[i]), metav1.CreateOptions{})
+				live[i] = true
+			case rand.Intn(2) == 0:
+				generation[i]++
+				_, err = services.Update(ctx, soakService(i, generation[i]), metav1.UpdateOptions{})
+			default:
+				err = services.Delete(ctx, fmt.Sprintf("soak-%d", i), metav1.DeleteOptions{})
+				live[i] = false
+			}
+			ops++
+			if err != nil {
+				errors++
+				lg.Debug("Soak operation failed", zap.Error(err))
+			}
+		case <-report.C:
+			latencies, failed := soakProbe(live)
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			lg.Info("Soak report",
+				zap.Int("operations", ops),
+				zap.Int("operation_errors", errors),
+				zap.Int("records", len(mdns.Records())),
+				zap.Duration("answer_p50", percentile(latencies, 0.5)),
+				zap.Duration("answer_p99", percentile(latencies, 0.99)),
+				zap.Int("probes_failed", failed),
+				zap.Uint64("heap_alloc_bytes", mem.HeapAlloc),
+				zap.Uint64("sys_bytes", mem.Sys),
+				zap.Uint32("gc_cycles", mem.NumGC),
+				zap.Int("goroutines", runtime.NumGoroutine()))
+		}
+	}
+}
+
+// soakProbe queries random live services and returns the sorted answer
+// latencies and the number of unanswered queries.
+func soakProbe(live []bool) (latencies []time.Duration, failed int) {
+	responderConfig, err := newResponderConfig()
+	if err != nil {
+		return nil, 0
+	}
+	group := &net.UDPAddr{IP: responderConfig.IPv4Group, Port: responderConfig.Port}
+	for p := 0; p < soakProbes; p++ {
+		i := rand.Intn(len(live))
+		if !live[i] {
+			continue
+		}
+		rtt, err := mdns.Probe(group, fmt.Sprintf("soak-%d.%s.local", i, soakNamespace), time.Second)
+		if err != nil {
+			failed++
+			continue
+		}
+		latencies = append(latencies, rtt)
+	}
+	sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+	return latencies, failed
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
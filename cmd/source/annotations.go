@@ -0,0 +1,197 @@
+package source
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/miekg/dns"
+)
+
+// Annotations recognised on Services and Ingresses.
+const (
+	annotationPrefix = "external-mdns.blakecovarrubias.com/"
+
+	HostnamesAnnotation        = annotationPrefix + "hostnames"
+	WithoutNamespaceAnnotation = annotationPrefix + "without-namespace"
+	HyphenatedNamesAnnotation  = annotationPrefix + "hyphenated-names"
+	PriorityAnnotation         = annotationPrefix + "priority"
+	PriorityClassAnnotation    = annotationPrefix + "priority-class"
+	PublishInternalAnnotation  = annotationPrefix + "publish-internal"
+	TTLAnnotation              = annotationPrefix + "ttl"
+	PTRNameAnnotation          = annotationPrefix + "ptr-name"
+	SharingAnnotation          = annotationPrefix + "sharing"
+	RecordTypesAnnotation      = annotationPrefix + "record-types"
+	RecordStrategyAnnotation   = annotationPrefix + "record-strategy"
+	DNSSDAnnotation            = annotationPrefix + "dns-sd"
+	SSDPLocationAnnotation     = annotationPrefix + "ssdp-location"
+	SSDPDeviceTypeAnnotation   = annotationPrefix + "ssdp-device-type"
+	SSDPUUIDAnnotation         = annotationPrefix + "ssdp-uuid"
+	WSDXAddrsAnnotation        = annotationPrefix + "wsd-xaddrs"
+	WSDTypesAnnotation         = annotationPrefix + "wsd-types"
+	WSDUUIDAnnotation          = annotationPrefix + "wsd-uuid"
+)
+
+// GoodbyeFinalizer holds published objects back from deletion until the
+// goodbyes for their records have been sent, with --goodbye-finalizer.
+const GoodbyeFinalizer = annotationPrefix + "goodbye"
+
+// boolAnnotation returns the boolean value of annotation key, or nil if the
+// annotation is absent or not a boolean.
+func boolAnnotation(annotations map[string]string, key string) *bool {
+	v, ok := annotations[key]
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return nil
+	}
+	return &b
+}
+
+// intAnnotation returns the integer value of annotation key, or 0 if the
+// annotation is absent or not an integer.
+func intAnnotation(annotations map[string]string, key string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(annotations[key]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ptrNameAnnotation returns the fully qualified name of the ptr-name
+// annotation, see ptrName.
+func ptrNameAnnotation(annotations map[string]string) string {
+	return ptrName(annotations[PTRNameAnnotation])
+}
+
+// sharingAnnotation returns the value of the sharing annotation, see
+// sharing.
+func sharingAnnotation(annotations map[string]string) *bool {
+	return sharing(annotations[SharingAnnotation])
+}
+
+// sharing returns true for "shared", false for "unique", and nil for
+// anything else, leaving the responder to decide.
+func sharing(value string) *bool {
+	var shared bool
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "shared":
+		shared = true
+	case "unique":
+	default:
+		return nil
+	}
+	return &shared
+}
+
+// recordTypesAnnotation returns the record types listed by the
+// record-types annotation, see recordTypes.
+func recordTypesAnnotation(annotations map[string]string) []string {
+	return recordTypes(annotations[RecordTypesAnnotation])
+}
+
+// recordStrategyAnnotation returns the record strategy named by the
+// record-strategy annotation, lower-cased, or an empty string for the
+// --record-strategy default.
+func recordStrategyAnnotation(annotations map[string]string) string {
+	return strings.ToLower(strings.TrimSpace(annotations[RecordStrategyAnnotation]))
+}
+
+// recordTypes returns the A, AAAA and PTR types in the comma-separated
+// value, or nil, publishing every type, if it lists none of them.
+func recordTypes(value string) []string {
+	var types []string
+	for _, t := range strings.Split(value, ",") {
+		switch t = strings.ToUpper(strings.TrimSpace(t)); t {
+		case "A", "AAAA", "PTR":
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// ptrName returns name fully qualified for a PTR record, or an empty string
+// if it is empty or not a valid name. Names not under .local are taken to
+// be short names.
+func ptrName(name string) string {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if name == "" {
+		return ""
+	}
+	if !strings.HasSuffix(name, ".local") {
+		name += ".local"
+	}
+	if CheckName(name) != nil {
+		return ""
+	}
+	return dns.Fqdn(name)
+}
+
+// CheckName reports why name cannot be published: it must be a valid
+// domain name, and records are built as text, so it must not hold spaces
+// or the characters that start a comment, a group or a quoted string in
+// zone file syntax.
+func CheckName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if strings.ContainsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`;()"\`, r)
+	}) {
+		return fmt.Errorf("name %q has characters not allowed in a host name", name)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("name %q is not a valid domain name", name)
+	}
+	return nil
+}
+
+// ssdpAnnotation returns the UPnP device described by the SSDP annotations,
+// or nil if there is no location annotation or the annotations are invalid.
+// Their values go into SSDP headers as they are, so none may hold control
+// characters, which would end the header, and the location must be an
+// http(s) URL.
+func ssdpAnnotation(annotations map[string]string) *resource.SSDPDevice {
+	location := annotations[SSDPLocationAnnotation]
+	if location == "" {
+		return nil
+	}
+	device := &resource.SSDPDevice{
+		DeviceType: annotations[SSDPDeviceTypeAnnotation],
+		Location:   location,
+		UUID:       annotations[SSDPUUIDAnnotation],
+	}
+	if device.DeviceType == "" {
+		device.DeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+	}
+	for _, value := range []string{device.DeviceType, device.Location, device.UUID} {
+		if strings.ContainsFunc(value, unicode.IsControl) {
+			return nil
+		}
+	}
+	// {ip} is replaced by an address before the location is sent.
+	u, err := url.Parse(strings.ReplaceAll(location, "{ip}", "192.0.2.1"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil
+	}
+	return device
+}
+
+// wsdAnnotation returns the WS-Discovery target described by the WSD
+// annotations, or nil if there is no address annotation.
+func wsdAnnotation(annotations map[string]string) *resource.WSDDevice {
+	xaddrs := annotations[WSDXAddrsAnnotation]
+	if xaddrs == "" {
+		return nil
+	}
+	return &resource.WSDDevice{
+		Types:  strings.Fields(annotations[WSDTypesAnnotation]),
+		XAddrs: xaddrs,
+		UUID:   annotations[WSDUUIDAnnotation],
+	}
+}
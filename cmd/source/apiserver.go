@@ -0,0 +1,100 @@
+package source
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// APIServerSource publishes a name for the Kubernetes API server, pointing
+// at the addresses in the EndpointSlices of the default/kubernetes
+// Service. Those are the addresses the API servers advertise, usually
+// reachable from the LAN, and follow them when they change.
+type APIServerSource struct {
+	lg         *zap.Logger
+	name       string
+	notifyChan chan<- resource.Resource
+	informer   cache.SharedIndexInformer
+	published  *resource.Resource
+}
+
+// NewAPIServerWatcher creates an APIServerSource publishing name.
+func NewAPIServerWatcher(lg *zap.Logger, client kubernetes.Interface, name string, resync time.Duration, notifyChan chan<- resource.Resource) *APIServerSource {
+	informer := discoveryinformers.NewFilteredEndpointSliceInformer(client, metav1.NamespaceDefault, resync, cache.Indexers{},
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = discoveryv1.LabelServiceName + "=kubernetes"
+		})
+	informer.SetTransform(StripObject)
+
+	a := &APIServerSource{
+		lg:         lg,
+		name:       name,
+		notifyChan: notifyChan,
+		informer:   informer,
+	}
+	track(lg, "apiserver-endpointslices", informer, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { a.update() },
+		UpdateFunc: func(interface{}, interface{}) { a.update() },
+		DeleteFunc: func(interface{}) { a.update() },
+	})
+	return a
+}
+
+// Run publishes the API server name until stopCh is closed.
+func (a *APIServerSource) Run(stopCh chan struct{}) error {
+	a.informer.Run(stopCh)
+	return nil
+}
+
+// update republishes the name when the API server addresses change. Event
+// handlers of an informer are called one at a time, so no lock is needed.
+func (a *APIServerSource) update() {
+	var ips []string
+	for _, obj := range a.informer.GetStore().List() {
+		slice := obj.(*discoveryv1.EndpointSlice)
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				if !slices.Contains(ips, addr) {
+					ips = append(ips, addr)
+				}
+			}
+		}
+	}
+	sort.Strings(ips)
+
+	if a.published != nil {
+		if slices.Equal(a.published.IPs, ips) {
+			return
+		}
+		withdrawn := *a.published
+		withdrawn.Action = resource.Deleted
+		a.notifyChan <- withdrawn
+		a.published = nil
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	r := resource.Resource{
+		SourceType: "apiserver",
+		SourceName: "kubernetes",
+		Created:    time.Now(),
+		Action:     resource.Added,
+		IPs:        ips,
+		Names:      []string{a.name},
+	}
+	a.lg.Info("Publishing API server address", zap.String("name", a.name), zap.Strings("addresses", ips))
+	a.notifyChan <- r
+	a.published = &r
+}
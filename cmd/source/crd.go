@@ -0,0 +1,207 @@
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// CRDConfig describes an arbitrary resource to publish. Hostnames and IPs
+// are JSONPath expressions evaluated against each object, for example
+// "{.spec.virtualhost.fqdn}" and "{.status.loadBalancer.ingress[*].ip}".
+type CRDConfig struct {
+	Group     string `mapstructure:"group"`
+	Version   string `mapstructure:"version"`
+	Resource  string `mapstructure:"resource"`
+	Hostnames string `mapstructure:"hostnames"`
+	IPs       string `mapstructure:"ips"`
+}
+
+// GroupVersionResource returns the resource the configuration refers to.
+func (c CRDConfig) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: c.Group, Version: c.Version, Resource: c.Resource}
+}
+
+// CRDSource handles adding, updating, or removing mDNS record advertisements
+// for objects of an arbitrary resource type.
+type CRDSource struct {
+	lg             *zap.Logger
+	gvr            schema.GroupVersionResource
+	hostnames      *jsonpath.JSONPath
+	ips            *jsonpath.JSONPath
+	notifyChan     chan<- resource.Resource
+	sharedInformer cache.SharedIndexInformer
+}
+
+// Run starts shared informers and waits for the shared informer cache to
+// synchronize.
+func (c *CRDSource) Run(stopCh chan struct{}) error {
+	c.sharedInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.sharedInformer.HasSynced) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+	}
+	return nil
+}
+
+func (c *CRDSource) onAdd(obj interface{}) {
+	advertiseResource, err := c.buildRecord(obj, resource.Added)
+	if err != nil {
+		c.lg.Info("Error adding object", zap.Error(err), zap.String("resource", c.gvr.String()))
+		return
+	}
+	if len(advertiseResource.IPs) == 0 || len(advertiseResource.Names) == 0 {
+		return
+	}
+	c.notifyChan <- advertiseResource
+}
+
+func (c *CRDSource) onDelete(obj interface{}) {
+	obj = deletedObject(obj)
+	if _, ok := obj.(*unstructured.Unstructured); !ok {
+		return
+	}
+	advertiseResource, err := c.buildRecord(obj, resource.Deleted)
+	if err != nil {
+		c.lg.Info("Error deleting object", zap.Error(err), zap.String("resource", c.gvr.String()))
+		return
+	}
+	c.notifyChan <- advertiseResource
+}
+
+func (c *CRDSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	oldResource, err1 := c.buildRecord(oldObj, resource.Deleted)
+	if err1 != nil {
+		c.lg.Info("Error parsing old object", zap.Error(err1), zap.String("resource", c.gvr.String()))
+	}
+	c.notifyChan <- oldResource
+
+	newResource, err2 := c.buildRecord(newObj, resource.Added)
+	if err2 != nil {
+		c.lg.Info("Error parsing new object", zap.Error(err2), zap.String("resource", c.gvr.String()))
+	}
+	c.notifyChan <- newResource
+}
+
+func (c *CRDSource) buildRecord(obj interface{}, action string) (resource.Resource, error) {
+	advertiseObj := resource.Resource{
+		SourceType: "crd",
+		Action:     action,
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return advertiseObj, nil
+	}
+
+	advertiseObj.SourceName = u.GetName()
+	advertiseObj.Object = objectRef(u, u.GetAPIVersion(), u.GetKind())
+	advertiseObj.Namespace = u.GetNamespace()
+	advertiseObj.Created = u.GetCreationTimestamp().Time
+	advertiseObj.Priority = intAnnotation(u.GetAnnotations(), PriorityAnnotation)
+	advertiseObj.PriorityClass = strings.TrimSpace(u.GetAnnotations()[PriorityClassAnnotation])
+	advertiseObj.TTL = intAnnotation(u.GetAnnotations(), TTLAnnotation)
+	advertiseObj.PTRName = ptrNameAnnotation(u.GetAnnotations())
+	advertiseObj.RecordTypes = recordTypesAnnotation(u.GetAnnotations())
+	advertiseObj.RecordStrategy = recordStrategyAnnotation(u.GetAnnotations())
+	advertiseObj.Shared = sharingAnnotation(u.GetAnnotations())
+	advertiseObj.HyphenatedNames = boolAnnotation(u.GetAnnotations(), HyphenatedNamesAnnotation)
+	if u.GetDeletionTimestamp() != nil {
+		return advertiseObj, nil
+	}
+
+	hostnames, err := evaluate(c.hostnames, u)
+	if err != nil {
+		return advertiseObj, fmt.Errorf("evaluating hostnames of %s: %w", u.GetName(), err)
+	}
+	for _, host := range hostnames {
+		// Only publish bare names and names within .local
+		host = strings.TrimSuffix(host, ".")
+		if name, ok := strings.CutSuffix(host, ".local"); ok {
+			advertiseObj.Names = append(advertiseObj.Names, name)
+		} else if host != "" && !strings.Contains(host, ".") {
+			advertiseObj.Names = append(advertiseObj.Names, host)
+		}
+	}
+
+	if advertiseObj.IPs, err = evaluate(c.ips, u); err != nil {
+		return advertiseObj, fmt.Errorf("evaluating IPs of %s: %w", u.GetName(), err)
+	}
+
+	return advertiseObj, nil
+}
+
+// evaluate returns the non-empty string values path selects in u.
+func evaluate(path *jsonpath.JSONPath, u *unstructured.Unstructured) ([]string, error) {
+	results, err := path.FindResults(u.Object)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, result := range results {
+		for _, v := range result {
+			if s := strings.TrimSpace(fmt.Sprint(v.Interface())); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values, nil
+}
+
+// parseJSONPath compiles expr, adding the surrounding braces if omitted.
+func parseJSONPath(name, expr string) (*jsonpath.JSONPath, error) {
+	if !strings.HasPrefix(expr, "{") {
+		expr = "{" + expr + "}"
+	}
+	path := jsonpath.New(name).AllowMissingKeys(true)
+	if err := path.Parse(expr); err != nil {
+		return nil, fmt.Errorf("invalid %s expression %q: %w", name, expr, err)
+	}
+	return path, nil
+}
+
+// NewCRDWatcher creates a CRDSource. namespace is the namespace factory is
+// limited to, or empty when it watches every namespace.
+func NewCRDWatcher(lg *zap.Logger, factory dynamicinformer.DynamicSharedInformerFactory, namespace string, cfg CRDConfig, notifyChan chan<- resource.Resource) (*CRDSource, error) {
+	if cfg.Version == "" || cfg.Resource == "" {
+		return nil, fmt.Errorf("crd source needs a version and resource")
+	}
+	hostnames, err := parseJSONPath("hostnames", cfg.Hostnames)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := parseJSONPath("ips", cfg.IPs)
+	if err != nil {
+		return nil, err
+	}
+
+	gvr := cfg.GroupVersionResource()
+	informer := factory.ForResource(gvr).Informer()
+	if err := informer.SetTransform(StripObject); err != nil {
+		return nil, err
+	}
+	registerOwners("crd", informer)
+	c := &CRDSource{
+		lg:             lg,
+		gvr:            gvr,
+		hostnames:      hostnames,
+		ips:            ips,
+		notifyChan:     notifyChan,
+		sharedInformer: informer,
+	}
+
+	track(lg, watchName(gvr.GroupResource().String(), namespace), informer, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.onAdd,
+		DeleteFunc: c.onDelete,
+		UpdateFunc: c.onUpdate,
+	})
+
+	return c, nil
+}
@@ -0,0 +1,134 @@
+package source
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dependencyGraph records which objects the records of other objects are
+// derived from, such as an Ingress from the Services behind it and those
+// from their EndpointSlices, so that a change anywhere along the chain
+// reconciles everything downstream of it rather than only the object the
+// event was for.
+type dependencyGraph struct {
+	mu          sync.Mutex
+	dependsOn   map[string][]string         // dependent -> dependencies
+	dependents  map[string]map[string]bool  // dependency -> dependents
+	reconcilers map[string]func(key string) // by kind and namespace of dependent
+}
+
+// dependencies is the graph shared by the sources.
+var dependencies = newDependencyGraph()
+
+func newDependencyGraph() *dependencyGraph {
+	return &dependencyGraph{
+		dependsOn:   make(map[string][]string),
+		dependents:  make(map[string]map[string]bool),
+		reconcilers: make(map[string]func(key string)),
+	}
+}
+
+// objectKey returns the key of an object in the graph. Objects that are
+// not Kubernetes objects, such as the set of pods matching a selector, use
+// the selector as name and no namespace.
+func objectKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// splitObjectKey returns the kind, namespace and name of an object key.
+func splitObjectKey(key string) (kind, namespace, name string) {
+	kind, rest, _ := strings.Cut(key, "/")
+	namespace, name, _ = strings.Cut(rest, "/")
+	return kind, namespace, name
+}
+
+// register sets the function reconciling the records of objects of kind
+// in namespace, or in every namespace when it is empty, when something they
+// depend on changes. It is called with the object key and without any lock
+// of the graph held.
+func (g *dependencyGraph) register(kind, namespace string, reconcile func(key string)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reconcilers[kind+"/"+namespace] = reconcile
+}
+
+// reconcilerFor returns the function reconciling the dependent key: the
+// one registered for its namespace, or else for every namespace. The
+// caller must hold g.mu.
+func (g *dependencyGraph) reconcilerFor(key string) func(key string) {
+	kind, namespace, _ := splitObjectKey(key)
+	if reconcile, ok := g.reconcilers[kind+"/"+namespace]; ok {
+		return reconcile
+	}
+	return g.reconcilers[kind+"/"]
+}
+
+// set replaces the dependencies of dependent.
+func (g *dependencyGraph) set(dependent string, dependsOn []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.unlink(dependent)
+	if len(dependsOn) == 0 {
+		return
+	}
+	g.dependsOn[dependent] = dependsOn
+	for _, dependency := range dependsOn {
+		if g.dependents[dependency] == nil {
+			g.dependents[dependency] = make(map[string]bool)
+		}
+		g.dependents[dependency][dependent] = true
+	}
+}
+
+// forget removes dependent and its dependencies from the graph.
+func (g *dependencyGraph) forget(dependent string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.unlink(dependent)
+}
+
+// unlink removes the edges from dependent. The caller must hold g.mu.
+func (g *dependencyGraph) unlink(dependent string) {
+	for _, dependency := range g.dependsOn[dependent] {
+		delete(g.dependents[dependency], dependent)
+		if len(g.dependents[dependency]) == 0 {
+			delete(g.dependents, dependency)
+		}
+	}
+	delete(g.dependsOn, dependent)
+}
+
+// changed reconciles everything depending on key, directly or through
+// other objects, each once and nearest first.
+func (g *dependencyGraph) changed(key string) {
+	g.mu.Lock()
+	var order []string
+	seen := map[string]bool{key: true}
+	queue := []string{key}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		var dependents []string
+		for dependent := range g.dependents[next] {
+			if !seen[dependent] {
+				seen[dependent] = true
+				dependents = append(dependents, dependent)
+			}
+		}
+		sort.Strings(dependents)
+		order = append(order, dependents...)
+		queue = append(queue, dependents...)
+	}
+	reconcilers := make([]func(string), len(order))
+	for i, dependent := range order {
+		reconcilers[i] = g.reconcilerFor(dependent)
+	}
+	g.mu.Unlock()
+
+	for i, dependent := range order {
+		if reconcilers[i] != nil {
+			reconcilers[i](dependent)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package source
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// wellKnownServiceTypes are the DNS-SD service types derived from the
+// ports of a Service.
+var wellKnownServiceTypes = map[int32]string{
+	21:   "_ftp._tcp",
+	22:   "_ssh._tcp",
+	80:   "_http._tcp",
+	443:  "_https._tcp",
+	445:  "_smb._tcp",
+	548:  "_afpovertcp._tcp",
+	554:  "_rtsp._tcp",
+	631:  "_ipp._tcp",
+	1883: "_mqtt._tcp",
+	3689: "_daap._tcp",
+	5900: "_rfb._tcp",
+}
+
+// defaultAppProtocolTypes are the service types of ports whose appProtocol
+// names a protocol, whatever their number, unless --dns-sd-app-protocol
+// maps it otherwise.
+var defaultAppProtocolTypes = map[string]string{
+	"http":                 "_http._tcp",
+	"https":                "_https._tcp",
+	"kubernetes.io/h2c":    "_http._tcp",
+	"kubernetes.io/ws":     "_http._tcp",
+	"kubernetes.io/wss":    "_https._tcp",
+	"ssh":                  "_ssh._tcp",
+	"ftp":                  "_ftp._tcp",
+	"smb":                  "_smb._tcp",
+	"rtsp":                 "_rtsp._tcp",
+	"ipp":                  "_ipp._tcp",
+	"mqtt":                 "_mqtt._tcp",
+	"vnc":                  "_rfb._tcp",
+	"rfb":                  "_rfb._tcp",
+	"grpc":                 "_grpc._tcp",
+	"postgresql":           "_postgresql._tcp",
+	"kubernetes.io/sftp":   "_sftp-ssh._tcp",
+	"airplay":              "_airplay._tcp",
+	"homekit":              "_hap._tcp",
+	"kubernetes.io/sip":    "_sip._udp",
+	"kubernetes.io/syslog": "_syslog._udp",
+}
+
+// AppProtocolTypes returns the default appProtocol to service type table
+// with mappings, given as appProtocol=type, added or replaced.
+func AppProtocolTypes(mappings []string) (map[string]string, error) {
+	types := make(map[string]string, len(defaultAppProtocolTypes)+len(mappings))
+	for protocol, serviceType := range defaultAppProtocolTypes {
+		types[protocol] = serviceType
+	}
+	for _, mapping := range mappings {
+		protocol, serviceType, ok := strings.Cut(mapping, "=")
+		protocol, serviceType = strings.ToLower(strings.TrimSpace(protocol)), strings.TrimSpace(serviceType)
+		if !ok || protocol == "" || !validServiceType(serviceType) {
+			return nil, fmt.Errorf("%q must be given as appProtocol=_service._tcp or _service._udp", mapping)
+		}
+		types[protocol] = serviceType
+	}
+	return types, nil
+}
+
+// schemeTXT is the TXT data of the instances of service types that define
+// any (RFC 6763 section 6).
+var schemeTXT = map[string][]string{
+	"_http._tcp":  {"path=/"},
+	"_https._tcp": {"path=/"},
+}
+
+// dnssdServices returns the DNS-SD instances to advertise for the ports of
+// service: by appProtocol, looked up in appProtocols, or else by port
+// number. The dns-sd annotation overrides enabled: "true" or "false", or a
+// comma-separated list of port=type mappings, such as "8443=_https._tcp",
+// which replaces both.
+func dnssdServices(service *corev1.Service, enabled bool, appProtocols map[string]string) []resource.DNSSDService {
+	types := map[int32]string{}
+	byAppProtocol := true
+	value, annotated := service.Annotations[DNSSDAnnotation]
+	if b := boolAnnotation(service.Annotations, DNSSDAnnotation); b != nil {
+		enabled = *b
+	} else if annotated {
+		enabled, byAppProtocol = true, false
+		for _, mapping := range strings.Split(value, ",") {
+			port, serviceType, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+			n, err := strconv.ParseInt(strings.TrimSpace(port), 10, 32)
+			if ok && err == nil && validServiceType(strings.TrimSpace(serviceType)) {
+				types[int32(n)] = strings.TrimSpace(serviceType)
+			}
+		}
+	} else {
+		types = wellKnownServiceTypes
+	}
+	if !enabled {
+		return nil
+	}
+
+	var services []resource.DNSSDService
+	for _, port := range service.Spec.Ports {
+		var (
+			serviceType string
+			ok          bool
+		)
+		if byAppProtocol && port.AppProtocol != nil {
+			serviceType, ok = appProtocols[strings.ToLower(*port.AppProtocol)]
+		}
+		if !ok {
+			serviceType, ok = types[port.Port]
+		}
+		if !ok || !strings.HasSuffix(serviceType, "._"+strings.ToLower(string(portProtocol(port)))) {
+			continue
+		}
+		number := port.Port
+		if service.Spec.Type == corev1.ServiceTypeNodePort {
+			number = port.NodePort
+		}
+		services = append(services, resource.DNSSDService{Type: serviceType, Port: int(number), TXT: schemeTXT[serviceType]})
+	}
+	return services
+}
+
+// portProtocol returns the protocol of port, TCP unless set.
+func portProtocol(port corev1.ServicePort) corev1.Protocol {
+	if port.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// validServiceType reports whether t is a DNS-SD service type, such as
+// _https._tcp (RFC 6763 section 7).
+func validServiceType(t string) bool {
+	service, proto, ok := strings.Cut(t, ".")
+	return ok && len(service) > 1 && len(service) <= 16 && service[0] == '_' && (proto == "_tcp" || proto == "_udp")
+}
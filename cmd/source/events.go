@@ -0,0 +1,84 @@
+package source
+
+import (
+	"sync/atomic"
+
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"k8s.io/client-go/tools/cache"
+)
+
+// sourceEvents counts the events of an informer as they arrive and once its
+// source has handled them. The difference is the backlog of events waiting
+// for the source, whose handler blocks while the main loop is busy.
+type sourceEvents struct {
+	name      string
+	received  atomic.Int64
+	processed atomic.Int64
+}
+
+// backlog returns how many events the source has yet to handle. Both
+// counters are updated from different goroutines, so it is briefly
+// negative when the source handles an event before it is counted.
+func (e *sourceEvents) backlog() float64 {
+	return float64(max(e.received.Load()-e.processed.Load(), 0))
+}
+
+func (e *sourceEvents) receive() {
+	e.received.Add(1)
+	metrics.SourceBacklog.WithLabelValues(e.name).Set(e.backlog())
+}
+
+func (e *sourceEvents) process(event string) {
+	e.processed.Add(1)
+	metrics.SourceLastEvent.WithLabelValues(e.name, event).SetToCurrentTime()
+	metrics.SourceBacklog.WithLabelValues(e.name).Set(e.backlog())
+}
+
+// observe adds handler to informer along with the handlers counting its
+// events and recording their origin, see receiveEvent. Each handler of an
+// informer has its own queue, so events are counted as they arrive even
+// while handler is blocked.
+func observe(name string, informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	events := &sourceEvents{name: name}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			events.receive()
+			receiveEvent(name, "add", obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			events.receive()
+			if !unchanged(oldObj, newObj) {
+				receiveEvent(name, "update", newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			events.receive()
+			receiveEvent(name, "delete", obj)
+		},
+	})
+	informer.AddEventHandler(observedHandler{handler: handler, events: events})
+}
+
+// observedHandler records when handler has processed each event.
+type observedHandler struct {
+	handler cache.ResourceEventHandler
+	events  *sourceEvents
+}
+
+func (h observedHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	h.handler.OnAdd(obj, isInInitialList)
+	h.events.process("add")
+	handledEvent(obj)
+}
+
+func (h observedHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.handler.OnUpdate(oldObj, newObj)
+	h.events.process("update")
+	handledEvent(newObj)
+}
+
+func (h observedHandler) OnDelete(obj interface{}) {
+	h.handler.OnDelete(obj)
+	h.events.process("delete")
+	handledEvent(obj)
+}
@@ -0,0 +1,272 @@
+package source
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// externalNameCheckInterval is how often cached targets are checked for
+	// expiry.
+	externalNameCheckInterval = 5 * time.Second
+	// Bounds applied to the TTL of resolved targets.
+	externalNameMinTTL = 30 * time.Second
+	externalNameMaxTTL = time.Hour
+	// externalNameRetry is how long a failed lookup waits before retrying.
+	externalNameRetry = 30 * time.Second
+)
+
+// externalNameAnswer is a cached resolution of an ExternalName target.
+type externalNameAnswer struct {
+	ips     []string
+	expires time.Time
+}
+
+// externalNameResolver resolves ExternalName targets through the unicast
+// DNS servers in resolv.conf and caches the answers for their TTL, for as
+// long as a service points at them.
+type externalNameResolver struct {
+	client  *dns.Client
+	servers []string
+
+	mu    sync.Mutex
+	cache map[string]externalNameAnswer
+	refs  map[string]int // services pointing at each target
+
+	// wake tells refreshExternalNames a target was looked up that is not
+	// resolved yet.
+	wake chan struct{}
+}
+
+func newExternalNameResolver() (*externalNameResolver, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolver configuration: %w", err)
+	}
+	var servers []string
+	for _, server := range conf.Servers {
+		servers = append(servers, net.JoinHostPort(server, conf.Port))
+	}
+	return &externalNameResolver{
+		client:  &dns.Client{Timeout: 5 * time.Second},
+		servers: servers,
+		cache:   make(map[string]externalNameAnswer),
+		refs:    make(map[string]int),
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// lookup returns the cached addresses of target. Stale answers are returned
+// until a refresh succeeds. A target not cached yet has none: it is cached
+// as expired and left for refreshExternalNames to resolve, as lookups run
+// in event handlers, which slow DNS servers must not hold up.
+func (r *externalNameResolver) lookup(target string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answer, ok := r.cache[target]
+	if !ok {
+		r.cache[target] = externalNameAnswer{}
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+	return answer.ips
+}
+
+// expired reports whether target's cached answer needs refreshing.
+func (r *externalNameResolver) expired(target string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answer, ok := r.cache[target]
+	return !ok || time.Now().After(answer.expires)
+}
+
+// refresh resolves target and updates the cache. On failure the previous
+// answer is kept and retried later.
+func (r *externalNameResolver) refresh(target string) ([]string, error) {
+	ips, ttl, err := r.resolve(target)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		answer := r.cache[target]
+		answer.expires = time.Now().Add(externalNameRetry)
+		r.cache[target] = answer
+		return answer.ips, err
+	}
+	r.cache[target] = externalNameAnswer{ips: ips, expires: time.Now().Add(ttl)}
+	return ips, nil
+}
+
+// retain counts a service pointing at target.
+func (r *externalNameResolver) retain(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs[target]++
+}
+
+// release uncounts a service pointing at target, and drops target from the
+// cache once no service does.
+func (r *externalNameResolver) release(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[target]--; r.refs[target] <= 0 {
+		delete(r.refs, target)
+		delete(r.cache, target)
+	}
+}
+
+// resolve queries the A and AAAA records of target, returning the addresses
+// and the smallest TTL seen along the way, including any CNAME chain.
+func (r *externalNameResolver) resolve(target string) ([]string, time.Duration, error) {
+	var (
+		ips     []string
+		ttl     = externalNameMaxTTL
+		lastErr error
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(target), qtype)
+
+		in, err := r.exchange(msg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range in.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, max(ttl, externalNameMinTTL), nil
+}
+
+// exchange sends msg to each configured server until one answers.
+func (r *externalNameResolver) exchange(msg *dns.Msg) (*dns.Msg, error) {
+	err := fmt.Errorf("no DNS servers configured")
+	for _, server := range r.servers {
+		var in *dns.Msg
+		if in, _, err = r.client.Exchange(msg, server); err == nil {
+			if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[in.Rcode])
+				continue
+			}
+			return in, nil
+		}
+	}
+	return nil, err
+}
+
+// externalNameIPs returns the addresses to publish for an ExternalName
+// service. Deleted reuses the addresses last published so exactly those
+// records are withdrawn. The caller must hold s.mu.
+func (s *ServiceSource) externalNameIPs(service *corev1.Service, action string) []string {
+	key := serviceKey(service.Namespace, service.Name)
+	if action == resource.Deleted {
+		return s.external[key].ips
+	}
+	ips := s.resolver.lookup(service.Spec.ExternalName)
+	if state, ok := s.external[key]; !ok || state.target != service.Spec.ExternalName {
+		s.resolver.retain(service.Spec.ExternalName)
+		if ok {
+			s.resolver.release(state.target)
+		}
+	}
+	s.external[key] = externalNameState{target: service.Spec.ExternalName, ips: ips}
+	return ips
+}
+
+// forgetExternalName stops tracking the ExternalName service by key, if it
+// was. The caller must hold s.mu.
+func (s *ServiceSource) forgetExternalName(key string) {
+	if state, ok := s.external[key]; ok {
+		delete(s.external, key)
+		s.resolver.release(state.target)
+	}
+}
+
+// externalNameState is what an ExternalName service was last published with.
+type externalNameState struct {
+	target string
+	ips    []string
+}
+
+// refreshExternalNames resolves new and expired ExternalName targets and
+// republishes services whose addresses changed. Targets are resolved and
+// the changes sent without holding s.mu, so events are not held up by slow
+// DNS servers.
+func (s *ServiceSource) refreshExternalNames(stopCh chan struct{}) {
+	ticker := time.NewTicker(externalNameCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-s.resolver.wake:
+		}
+
+		var expired []string
+		s.mu.Lock()
+		for _, state := range s.external {
+			if s.resolver.expired(state.target) && !slices.Contains(expired, state.target) {
+				expired = append(expired, state.target)
+			}
+		}
+		s.mu.Unlock()
+		for _, target := range expired {
+			if _, err := s.resolver.refresh(target); err != nil {
+				s.lg.Info("Error resolving ExternalName target", zap.Error(err), zap.String("target", target))
+			}
+		}
+
+		var changes []resource.Resource
+		s.mu.Lock()
+		for key, state := range s.external {
+			// Several services may share a target, so compare against the
+			// cache rather than only the answers refreshed here.
+			ips := s.resolver.lookup(state.target)
+			if slices.Equal(ips, state.ips) {
+				continue
+			}
+
+			item, exists, err := s.sharedInformer.GetStore().GetByKey(key)
+			if err != nil || !exists {
+				continue
+			}
+			service := item.(*corev1.Service)
+
+			s.lg.Info("ExternalName target addresses changed", zap.String("service", key), zap.Strings("ips", ips))
+			if old, err := s.buildRecord(service, resource.Deleted); err == nil && len(old.IPs) > 0 {
+				changes = append(changes, old)
+			}
+			if updated, err := s.buildRecord(service, resource.Added); err == nil && len(updated.IPs) > 0 {
+				changes = append(changes, updated)
+			}
+		}
+		s.mu.Unlock()
+		for _, r := range changes {
+			s.notifyChan <- r
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package source
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// followFile calls reload once, then again whenever the file at path may
+// have changed if watch is set, until stopCh is closed. The directory is
+// watched rather than the file, which catches files replaced by renaming,
+// as editors and ConfigMap volumes do.
+func followFile(lg *zap.Logger, path string, watch bool, stopCh chan struct{}, reload func()) {
+	var events chan fsnotify.Event
+	var errs chan error
+	if watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			lg.Warn("Unable to watch file, changes will not be picked up", zap.Error(err))
+		} else {
+			defer watcher.Close()
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	reload()
+	for {
+		select {
+		case <-events:
+			reload()
+		case err := <-errs:
+			lg.Warn("Error watching file", zap.Error(err))
+		case <-stopCh:
+			return
+		}
+	}
+}
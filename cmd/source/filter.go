@@ -0,0 +1,87 @@
+package source
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Filter decides with a CEL expression whether an object is published.
+// A nil Filter publishes everything.
+type Filter struct {
+	lg      *zap.Logger
+	expr    string
+	program cel.Program
+}
+
+// NewFilter compiles expr, which must evaluate to a bool. It may refer to
+// kind, name, namespace, labels, annotations, serviceType (the Service type) and
+// object, the whole object as a map.
+func NewFilter(lg *zap.Logger, expr string) (*Filter, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("kind", cel.StringType),
+		cel.Variable("name", cel.StringType),
+		cel.Variable("namespace", cel.StringType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("annotations", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("serviceType", cel.StringType),
+		cel.Variable("object", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("invalid filter %q: must evaluate to a bool, not %s", expr, ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	return &Filter{lg: lg, expr: expr, program: program}, nil
+}
+
+// Matches reports whether obj, of the given kind and Service type, passes
+// the filter. Objects the expression fails on are not published.
+func (f *Filter) Matches(kind, serviceType string, obj metav1.Object) bool {
+	if f == nil {
+		return true
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		f.lg.Warn("Cannot filter object", zap.Error(err), zap.String("name", obj.GetNamespace()+"/"+obj.GetName()))
+		return false
+	}
+	out, _, err := f.program.Eval(map[string]interface{}{
+		"kind":        kind,
+		"name":        obj.GetName(),
+		"namespace":   obj.GetNamespace(),
+		"labels":      nonNil(obj.GetLabels()),
+		"annotations": nonNil(obj.GetAnnotations()),
+		"serviceType": serviceType,
+		"object":      content,
+	})
+	if err != nil {
+		// Typically a missing label or annotation, which is an expected
+		// outcome of most policies.
+		f.lg.Debug("Filter failed, not publishing", zap.Error(err), zap.String("kind", kind),
+			zap.String("name", obj.GetNamespace()+"/"+obj.GetName()))
+		return false
+	}
+	matched, _ := out.Value().(bool)
+	return matched
+}
+
+func nonNil(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
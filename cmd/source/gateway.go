@@ -0,0 +1,266 @@
+package source
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// GatewayGroup is the API group of the Gateway API.
+const GatewayGroup = "gateway.networking.k8s.io"
+
+// GatewayRouteKinds are the route resources the gateway source publishes,
+// by the source type of their resources.
+var GatewayRouteKinds = map[string]string{
+	"httproute": "httproutes",
+	"grpcroute": "grpcroutes",
+	"tlsroute":  "tlsroutes",
+}
+
+// GatewaySource publishes the hostnames of Gateway API routes with the
+// addresses of the Gateways they are attached to. Routes are published
+// again whenever one of their Gateways changes address.
+type GatewaySource struct {
+	lg         *zap.Logger
+	notifyChan chan<- resource.Resource
+	gateways   cache.SharedIndexInformer
+	routes     map[string]cache.SharedIndexInformer // by source type
+
+	mu        sync.Mutex                   // serialises event handlers
+	published map[string]resource.Resource // by source type, namespace and name
+}
+
+// NewGatewayWatcher creates a GatewaySource watching gateways and the
+// routes in routes, given as source type to resource. namespace is the
+// namespace factory is limited to, or empty when it watches every namespace.
+func NewGatewayWatcher(lg *zap.Logger, factory dynamicinformer.DynamicSharedInformerFactory, namespace string, gateways schema.GroupVersionResource,
+	routes map[string]schema.GroupVersionResource, notifyChan chan<- resource.Resource) (*GatewaySource, error) {
+	s := &GatewaySource{
+		lg:         lg,
+		notifyChan: notifyChan,
+		routes:     make(map[string]cache.SharedIndexInformer),
+		published:  make(map[string]resource.Resource),
+	}
+
+	s.gateways = factory.ForResource(gateways).Informer()
+	if err := s.gateways.SetTransform(StripObject); err != nil {
+		return nil, err
+	}
+	track(lg, watchName(gateways.GroupResource().String(), namespace), s.gateways, cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.onGateway,
+		UpdateFunc: func(_, newObj interface{}) { s.onGateway(newObj) },
+		DeleteFunc: s.onGateway,
+	})
+
+	for sourceType, gvr := range routes {
+		informer := factory.ForResource(gvr).Informer()
+		if err := informer.SetTransform(StripObject); err != nil {
+			return nil, err
+		}
+		registerOwners(sourceType, informer)
+		track(lg, watchName(gvr.GroupResource().String(), namespace), informer, cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { s.onRoute(sourceType, obj) },
+			UpdateFunc: func(_, newObj interface{}) { s.onRoute(sourceType, newObj) },
+			DeleteFunc: func(obj interface{}) { s.onRouteDelete(sourceType, obj) },
+		})
+		s.routes[sourceType] = informer
+	}
+	return s, nil
+}
+
+// Run starts the informers and waits for their caches to synchronize.
+func (s *GatewaySource) Run(stopCh chan struct{}) error {
+	synced := []cache.InformerSynced{s.gateways.HasSynced}
+	go s.gateways.Run(stopCh)
+	for _, informer := range s.routes {
+		synced = append(synced, informer.HasSynced)
+		go informer.Run(stopCh)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+	}
+	return nil
+}
+
+func (s *GatewaySource) onRoute(sourceType string, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publish(sourceType, u)
+}
+
+func (s *GatewaySource) onRouteDelete(sourceType string, obj interface{}) {
+	obj = deletedObject(obj)
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.withdraw(sourceType + "/" + u.GetNamespace() + "/" + u.GetName())
+}
+
+// onGateway publishes again the routes attached to a Gateway that was
+// added, changed or deleted.
+func (s *GatewaySource) onGateway(obj interface{}) {
+	obj = deletedObject(obj)
+	gateway, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := gateway.GetNamespace() + "/" + gateway.GetName()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sourceType, informer := range s.routes {
+		for _, obj := range informer.GetStore().List() {
+			route, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			for _, parent := range parentGateways(route) {
+				if parent == key {
+					s.publish(sourceType, route)
+					break
+				}
+			}
+		}
+	}
+}
+
+// publish sends the resource of route, withdrawing the one previously
+// sent if it differs. The caller must hold s.mu.
+func (s *GatewaySource) publish(sourceType string, route *unstructured.Unstructured) {
+	r := s.buildRecord(sourceType, route)
+	key := sourceType + "/" + route.GetNamespace() + "/" + route.GetName()
+	if old, ok := s.published[key]; ok {
+		if reflect.DeepEqual(old, r) {
+			return
+		}
+		s.withdraw(key)
+	}
+	if len(r.Names) == 0 || len(r.IPs) == 0 {
+		return
+	}
+	s.published[key] = r
+	s.notifyChan <- r
+}
+
+// withdraw deletes the resource sent for key, if any. The caller must hold
+// s.mu.
+func (s *GatewaySource) withdraw(key string) {
+	old, ok := s.published[key]
+	if !ok {
+		return
+	}
+	delete(s.published, key)
+	old.Action = resource.Deleted
+	s.notifyChan <- old
+}
+
+func (s *GatewaySource) buildRecord(sourceType string, u *unstructured.Unstructured) resource.Resource {
+	advertiseObj := resource.Resource{
+		SourceType: sourceType,
+		SourceName: u.GetName(),
+		Object:     objectRef(u, u.GetAPIVersion(), u.GetKind()),
+		Namespace:  u.GetNamespace(),
+		Created:    u.GetCreationTimestamp().Time,
+		Action:     resource.Added,
+	}
+	advertiseObj.Priority = intAnnotation(u.GetAnnotations(), PriorityAnnotation)
+	advertiseObj.PriorityClass = strings.TrimSpace(u.GetAnnotations()[PriorityClassAnnotation])
+	advertiseObj.TTL = intAnnotation(u.GetAnnotations(), TTLAnnotation)
+	advertiseObj.PTRName = ptrNameAnnotation(u.GetAnnotations())
+	advertiseObj.RecordTypes = recordTypesAnnotation(u.GetAnnotations())
+	advertiseObj.RecordStrategy = recordStrategyAnnotation(u.GetAnnotations())
+	advertiseObj.Shared = sharingAnnotation(u.GetAnnotations())
+	advertiseObj.HyphenatedNames = boolAnnotation(u.GetAnnotations(), HyphenatedNamesAnnotation)
+	if u.GetDeletionTimestamp() != nil {
+		return advertiseObj
+	}
+
+	hostnames, _, _ := unstructured.NestedStringSlice(u.Object, "spec", "hostnames")
+	for _, host := range hostnames {
+		// Only publish bare names and names within .local
+		host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+		if name, ok := strings.CutSuffix(host, ".local"); ok {
+			advertiseObj.Names = append(advertiseObj.Names, name)
+		} else if host != "" && !strings.Contains(host, ".") {
+			advertiseObj.Names = append(advertiseObj.Names, host)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, key := range parentGateways(u) {
+		obj, exists, err := s.gateways.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		for _, address := range gatewayAddresses(obj.(*unstructured.Unstructured)) {
+			if !seen[address] {
+				seen[address] = true
+				advertiseObj.IPs = append(advertiseObj.IPs, address)
+			}
+		}
+	}
+	return advertiseObj
+}
+
+// parentGateways returns the namespace/name keys of the Gateways route is
+// attached to.
+func parentGateways(route *unstructured.Unstructured) []string {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	var keys []string
+	for _, p := range parents {
+		parent, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(parent, "group")
+		kind, _, _ := unstructured.NestedString(parent, "kind")
+		namespace, _, _ := unstructured.NestedString(parent, "namespace")
+		name, _, _ := unstructured.NestedString(parent, "name")
+		if (group != "" && group != GatewayGroup) || (kind != "" && kind != "Gateway") || name == "" {
+			continue
+		}
+		if namespace == "" {
+			namespace = route.GetNamespace()
+		}
+		keys = append(keys, namespace+"/"+name)
+	}
+	return keys
+}
+
+// gatewayAddresses returns the IP addresses in the status of gateway, or
+// none while it is being deleted.
+func gatewayAddresses(gateway *unstructured.Unstructured) []string {
+	if gateway.GetDeletionTimestamp() != nil {
+		return nil
+	}
+	addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+	var ips []string
+	for _, a := range addresses {
+		address, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		addressType, _, _ := unstructured.NestedString(address, "type")
+		value, _, _ := unstructured.NestedString(address, "value")
+		if (addressType == "" || addressType == "IPAddress") && value != "" {
+			ips = append(ips, value)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,226 @@
+package source
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/cache"
+)
+
+// started holds the informers started with runInformer, as those shared
+// between sources must only be run once.
+var started = struct {
+	mu        sync.Mutex
+	informers map[cache.SharedIndexInformer]bool
+}{informers: make(map[cache.SharedIndexInformer]bool)}
+
+// runInformer runs informer until stopCh is closed, unless another source
+// has already started it.
+func runInformer(informer cache.SharedIndexInformer, stopCh <-chan struct{}) {
+	started.mu.Lock()
+	if started.informers[informer] {
+		started.mu.Unlock()
+		return
+	}
+	started.informers[informer] = true
+	started.mu.Unlock()
+	informer.Run(stopCh)
+}
+
+// watchCheckInterval is how often failing watches are checked for recovery
+// and the zone for staleness.
+const watchCheckInterval = 10 * time.Second
+
+// watches tracks the health of every informer started by the sources, so a
+// lost connection to the API server is surfaced instead of silently serving
+// an outdated zone.
+var watches = &watchHealth{informers: make(map[string]*watchState)}
+
+// staleChanges carries the latest change of the zone's staleness.
+var staleChanges = make(chan bool, 1)
+
+// StaleChanges returns a channel that receives true when the zone becomes
+// stale, see MonitorWatches, and false when it is up to date again.
+func StaleChanges() <-chan bool {
+	return staleChanges
+}
+
+type watchHealth struct {
+	mu         sync.Mutex
+	informers  map[string]*watchState
+	staleAfter time.Duration
+	stale      bool
+}
+
+type watchState struct {
+	informer cache.SharedIndexInformer
+	// failingSince is when the watch first failed after last being
+	// healthy, and version the resource version it had last synced.
+	failingSince time.Time
+	version      string
+	// lastErr is the error the watch last failed with, reported while
+	// it has not synced.
+	lastErr error
+}
+
+// watchName returns the name of the watch of resource, qualified with the
+// namespace it is limited to, if any, as every namespace has its own.
+func watchName(resource, namespace string) string {
+	if namespace == "" {
+		return resource
+	}
+	return resource + "/" + namespace
+}
+
+// track registers informer under name, installs a watch error handler and
+// adds handler with the metrics of the events it handles. It must be called
+// before the informer is started.
+func track(lg *zap.Logger, name string, informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	watches.mu.Lock()
+	watches.informers[name] = &watchState{informer: informer}
+	watches.mu.Unlock()
+
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		metrics.WatchErrors.WithLabelValues(name).Inc()
+		watches.failed(name, err)
+		lg.Warn("Watch failed, retrying", zap.String("resource", name), zap.Error(err))
+	})
+	if err != nil {
+		lg.Warn("Failed to set watch error handler", zap.String("resource", name), zap.Error(err))
+	}
+	observe(name, informer, handler)
+}
+
+func (h *watchHealth) failed(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state := h.informers[name]
+	if state == nil {
+		return
+	}
+	state.lastErr = err
+	if !state.failingSince.IsZero() {
+		return
+	}
+	state.failingSince = time.Now()
+	state.version = state.informer.LastSyncResourceVersion()
+}
+
+// MonitorWatches periodically checks failing watches for recovery and warns
+// when the zone has been served without a working watch for longer than
+// staleAfter. It returns when stopCh is closed.
+func MonitorWatches(lg *zap.Logger, staleAfter time.Duration, stopCh <-chan struct{}) {
+	watches.mu.Lock()
+	watches.staleAfter = staleAfter
+	watches.mu.Unlock()
+
+	ticker := time.NewTicker(watchCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			watches.check(lg)
+		}
+	}
+}
+
+func (h *watchHealth) check(lg *zap.Logger) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var failing []string
+	for name, state := range h.informers {
+		metrics.SourceObjects.WithLabelValues(name).Set(float64(len(state.informer.GetStore().ListKeys())))
+		if state.failingSince.IsZero() {
+			continue
+		}
+		// A watch that has relisted has a new resource version.
+		if state.informer.LastSyncResourceVersion() != state.version {
+			lg.Info("Watch reconnected", zap.String("resource", name),
+				zap.Duration("after", time.Since(state.failingSince).Round(time.Second)))
+			metrics.WatchReconnects.WithLabelValues(name).Inc()
+			state.failingSince, state.lastErr = time.Time{}, nil
+			continue
+		}
+		if h.staleAfter > 0 && time.Since(state.failingSince) > h.staleAfter {
+			failing = append(failing, name)
+		}
+	}
+
+	stale := len(failing) > 0
+	if stale != h.stale {
+		select {
+		case <-staleChanges:
+		default:
+		}
+		staleChanges <- stale
+	}
+	if stale && !h.stale {
+		sort.Strings(failing)
+		lg.Warn("Zone may be stale, the API server has been unreachable", zap.Strings("resources", failing),
+			zap.Duration("threshold", h.staleAfter))
+	} else if !stale && h.stale {
+		lg.Info("Zone is up to date again")
+	}
+	h.stale = stale
+	if stale {
+		metrics.ZoneStale.Set(1)
+	} else {
+		metrics.ZoneStale.Set(0)
+	}
+}
+
+// Ready reports whether every informer has synced and none has been
+// disconnected for longer than the stale threshold, with the reason if not.
+func Ready() (bool, string) {
+	if unsynced := Unsynced(); len(unsynced) > 0 {
+		return false, strings.Join(unsynced, "; ")
+	}
+	watches.mu.Lock()
+	defer watches.mu.Unlock()
+	if watches.stale {
+		return false, "zone is stale, the API server is unreachable"
+	}
+	return true, ""
+}
+
+// Unsynced describes the informers that have not synced yet, with the error
+// their watch last failed with, such as a missing permission or resource.
+func Unsynced() []string {
+	watches.mu.Lock()
+	defer watches.mu.Unlock()
+
+	var unsynced []string
+	for name, state := range watches.informers {
+		if state.informer.HasSynced() {
+			continue
+		}
+		if state.lastErr != nil {
+			unsynced = append(unsynced, fmt.Sprintf("%s has not synced: %s", name, state.lastErr))
+		} else {
+			unsynced = append(unsynced, fmt.Sprintf("%s has not synced", name))
+		}
+	}
+	sort.Strings(unsynced)
+	return unsynced
+}
+
+// WaitForSync blocks until every informer has synced and reports whether
+// they did before stopCh was closed.
+func WaitForSync(stopCh <-chan struct{}) bool {
+	watches.mu.Lock()
+	var synced []cache.InformerSynced
+	for _, state := range watches.informers {
+		synced = append(synced, state.informer.HasSynced)
+	}
+	watches.mu.Unlock()
+	return cache.WaitForCacheSync(stopCh, synced...)
+}
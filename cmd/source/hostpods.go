@@ -0,0 +1,182 @@
+package source
+
+import (
+	"slices"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchNodePods starts watching the pods on node in node-local mode, so
+// services backed by host-network or hostPort pods running there are
+// published with the node's addresses.
+func (s *ServiceSource) watchNodePods(factory informers.SharedInformerFactory, node string) {
+	s.podInformer = factory.InformerFor(&corev1.Pod{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewFilteredPodInformer(client, s.namespace, resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+			withFieldSelector(fields.OneTermEqualSelector("spec.nodeName", node).String()))
+	})
+	s.podLister = corelisters.NewPodLister(s.podInformer.GetIndexer())
+	track(s.lg, watchName("pods", s.namespace), s.podInformer, cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.onNodePodChange,
+		UpdateFunc: func(_, newObj interface{}) { s.onNodePodChange(newObj) },
+		DeleteFunc: s.onNodePodChange,
+	})
+}
+
+// hostedFor returns the ports service is reachable on at the node's
+// addresses through the host-network or hostPort pods it selects on this
+// node, or nil if there are none. Added records the current ports; Deleted
+// reuses the ports the service was last published with so exactly those
+// records are withdrawn. The caller must hold s.mu.
+func (s *ServiceSource) hostedFor(service *corev1.Service, action string) []int {
+	key := serviceKey(service.Namespace, service.Name)
+	if action == resource.Deleted {
+		return s.hosted[key]
+	}
+	ports := s.hostPorts(service)
+	if ports == nil {
+		delete(s.hosted, key)
+	} else {
+		s.hosted[key] = ports
+	}
+	return ports
+}
+
+// hostPorts returns the TCP ports the running pods of service on this node
+// serve on the node's addresses: the target port of host-network pods, or
+// the hostPort a container maps it to.
+func (s *ServiceSource) hostPorts(service *corev1.Service) []int {
+	if len(service.Spec.Selector) == 0 {
+		return nil
+	}
+	pods, err := s.podLister.Pods(service.Namespace).List(labels.SelectorFromSet(service.Spec.Selector))
+	if err != nil {
+		s.lg.Info("Error listing node pods", zap.Error(err), zap.String("service", service.Name))
+		return nil
+	}
+	var ports []int
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for _, port := range service.Spec.Ports {
+			if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			if p := hostPort(pod, port.TargetPort, port.Port); p != 0 && !slices.Contains(ports, p) {
+				ports = append(ports, p)
+			}
+		}
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+// hostPort returns the port on the node that target, the target port of a
+// service port numbered servicePort, is served on by pod, or 0 if pod
+// serves it on its own address only.
+func hostPort(pod *corev1.Pod, target intstr.IntOrString, servicePort int32) int {
+	for _, c := range pod.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Protocol != "" && cp.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			matches := cp.ContainerPort == target.IntVal
+			switch {
+			case target.Type == intstr.String:
+				matches = cp.Name == target.StrVal
+			case target.IntVal == 0:
+				// An unset target port is the service port.
+				matches = cp.ContainerPort == servicePort
+			}
+			if !matches {
+				continue
+			}
+			if cp.HostPort != 0 {
+				return int(cp.HostPort)
+			}
+			if pod.Spec.HostNetwork {
+				return int(cp.ContainerPort)
+			}
+		}
+	}
+	// Host-network pods need not declare the ports they listen on.
+	if pod.Spec.HostNetwork && target.Type == intstr.Int {
+		if target.IntVal == 0 {
+			return int(servicePort)
+		}
+		return int(target.IntVal)
+	}
+	return 0
+}
+
+// onNodePodChange publishes or withdraws the services selecting a pod on
+// this node when the ports they are reachable on at the node change.
+func (s *ServiceSource) onNodePodChange(obj interface{}) {
+	pod, ok := deletedObject(obj).(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	services, err := s.sharedInformer.GetIndexer().ByIndex(cache.NamespaceIndex, pod.Namespace)
+	if err != nil {
+		return
+	}
+	for _, item := range services {
+		service, ok := item.(*corev1.Service)
+		if !ok || !hostable(service) || s.publishesInternal(service) {
+			continue
+		}
+		key := serviceKey(service.Namespace, service.Name)
+		if len(service.Spec.Selector) == 0 || !labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			// The pod may have been relabelled away from a service it
+			// was published through.
+			if s.hosted[key] == nil {
+				continue
+			}
+		}
+		if slices.Equal(s.hosted[key], s.hostPorts(service)) {
+			continue
+		}
+
+		wasHosted := s.hosted[key] != nil
+		if wasHosted {
+			if old, err := s.buildRecord(service, resource.Deleted); err == nil && len(old.IPs) > 0 {
+				s.notifyChan <- old
+			}
+		}
+		advertiseResource, err := s.buildRecord(service, resource.Added)
+		if err != nil {
+			s.lg.Info("Error building service resource", zap.Error(err), zap.String("service", key))
+			continue
+		}
+		if len(advertiseResource.IPs) > 0 {
+			s.lg.Info("Service has pods on this node's network, publishing",
+				zap.String("service", key), zap.Ints("ports", advertiseResource.Ports))
+			s.notifyChan <- advertiseResource
+		} else if wasHosted {
+			s.lg.Info("Service has no pods left on this node's network, withdrawing", zap.String("service", key))
+		}
+	}
+}
+
+// hostable reports whether service is published through the host-network
+// and hostPort pods behind it in node-local mode: ClusterIP services, which
+// are otherwise not reachable from outside the cluster.
+func hostable(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeClusterIP || service.Spec.Type == ""
+}
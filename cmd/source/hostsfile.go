@@ -0,0 +1,116 @@
+package source
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+)
+
+// HostsFilePrefix marks a --source value naming a hosts-format file, e.g.
+// hostsfile:/etc/hosts.
+const HostsFilePrefix = "hostsfile:"
+
+// HostsFileSource publishes the entries of a hosts-format file, one
+// resource per hostname. Names ending in .local are published without
+// that suffix, other names containing a dot are ignored.
+type HostsFileSource struct {
+	lg         *zap.Logger
+	path       string
+	watch      bool
+	notifyChan chan<- resource.Resource
+	hosts      map[string]resource.Resource
+}
+
+// NewHostsFileWatcher creates a HostsFileSource for path. With watch set
+// the file is re-read whenever it changes.
+func NewHostsFileWatcher(lg *zap.Logger, path string, watch bool, notifyChan chan<- resource.Resource) *HostsFileSource {
+	return &HostsFileSource{
+		lg:         lg.With(zap.String("hostsfile", path)),
+		path:       path,
+		watch:      watch,
+		notifyChan: notifyChan,
+		hosts:      make(map[string]resource.Resource),
+	}
+}
+
+// Run publishes the file and, when watching, follows its changes until
+// stopCh is closed.
+func (h *HostsFileSource) Run(stopCh chan struct{}) error {
+	followFile(h.lg, h.path, h.watch, stopCh, h.reload)
+	return nil
+}
+
+// reload reads the file and publishes what changed since the last read.
+func (h *HostsFileSource) reload() {
+	entries, err := readHostsFile(h.path)
+	if err != nil {
+		h.lg.Warn("Unable to read hosts file", zap.Error(err))
+		return
+	}
+
+	for name, r := range h.hosts {
+		if ips, ok := entries[name]; !ok || !slices.Equal(ips, r.IPs) {
+			delete(h.hosts, name)
+			r.Action = resource.Deleted
+			h.notifyChan <- r
+		}
+	}
+	for name, ips := range entries {
+		if _, ok := h.hosts[name]; ok {
+			continue
+		}
+		r := resource.Resource{
+			SourceType: "hostsfile",
+			SourceName: name,
+			File:       h.path,
+			Created:    time.Now(),
+			Action:     resource.Added,
+			IPs:        ips,
+			Names:      []string{name},
+		}
+		h.hosts[name] = r
+		h.notifyChan <- r
+	}
+}
+
+// readHostsFile returns the addresses of every publishable hostname in
+// path, in the order they appear.
+func readHostsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() {
+			continue
+		}
+		for _, host := range fields[1:] {
+			name := strings.ToLower(strings.TrimSuffix(host, "."))
+			if trimmed, ok := strings.CutSuffix(name, ".local"); ok {
+				name = trimmed
+			} else if strings.Contains(name, ".") {
+				continue
+			}
+			if name != "" && !slices.Contains(entries[name], ip.String()) {
+				entries[name] = append(entries[name], ip.String())
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -16,28 +16,101 @@ package source
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
 	"github.com/jpillora/go-tld"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	v1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
+	networkinginformers "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
+// IngressOptions configures an IngressSource.
+type IngressOptions struct {
+	// FieldSelector restricts the watch to matching ingresses.
+	FieldSelector string
+	// Filter decides which ingresses are published.
+	Filter *Filter
+	// ControllerSelector, when set, selects the ingress controller pods
+	// whose node IPs are published for ingresses without a load balancer
+	// address or hostname in their status.
+	ControllerSelector string
+	// ControllerPods watches the pods matching ControllerSelector. It is
+	// shared by the sources of every namespace.
+	ControllerPods cache.SharedIndexInformer
+	// ControllerService, when set, watches the Service of the ingress
+	// controller. Ingresses whose status still holds an address the
+	// Service had before are published with its current addresses. It is
+	// shared by the sources of every namespace.
+	ControllerService cache.SharedIndexInformer
+	// RequireReady withdraws ingresses none of whose backend Services has
+	// a ready endpoint.
+	RequireReady bool
+}
+
+// controllerServiceKey stands for the ingress controller Service in the
+// dependency graph.
+var controllerServiceKey = objectKey("IngressControllerService", "", "")
+
+// ingressKey returns the key of an Ingress in the dependency graph.
+func ingressKey(namespace, name string) string {
+	return objectKey("Ingress", namespace, name)
+}
+
 // IngressSource handles adding, updating, or removing mDNS record advertisements
 type IngressSource struct {
 	lg             *zap.Logger
 	namespace      string
 	notifyChan     chan<- resource.Resource
 	sharedInformer cache.SharedIndexInformer
+	filter         *Filter
+
+	// controllerInformer watches the pods selected by
+	// IngressOptions.ControllerSelector, if any.
+	controllerInformer cache.SharedIndexInformer
+
+	// serviceInformer watches IngressOptions.ControllerService, if any.
+	serviceInformer cache.SharedIndexInformer
+
+	// endpointInformer and endpointLister are set when ingresses without
+	// ready backends are withdrawn.
+	endpointInformer cache.SharedIndexInformer
+	endpointLister   discoverylisters.EndpointSliceLister
+
+	// controllerPodsKey stands for the controller pods in the dependency
+	// graph.
+	controllerPodsKey string
+
+	mu            sync.Mutex                     // serialises event handlers and guards the fields below
+	fallback      []string                       // node IPs of the running controller pods
+	controllerIPs []string                       // load balancer IPs of the controller Service
+	staleIPs      map[string]bool                // IPs the controller Service had before
+	published     map[string][]resource.Resource // by ingress key
 }
 
 // Run starts shared informers and waits for the shared informer cache to
 // synchronize.
 func (i *IngressSource) Run(stopCh chan struct{}) error {
+	if i.controllerInformer != nil {
+		go runInformer(i.controllerInformer, stopCh)
+	}
+	if i.serviceInformer != nil {
+		go runInformer(i.serviceInformer, stopCh)
+	}
+	if i.endpointInformer != nil {
+		go runInformer(i.endpointInformer, stopCh)
+	}
 	i.sharedInformer.Run(stopCh)
 	if !cache.WaitForCacheSync(stopCh, i.sharedInformer.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
@@ -46,51 +119,247 @@ func (i *IngressSource) Run(stopCh chan struct{}) error {
 }
 
 func (i *IngressSource) onAdd(obj interface{}) {
-	advertiseRecords, err := i.buildRecords(obj, resource.Added)
+	if ingress, ok := obj.(*v1.Ingress); ok {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.sync(ingressKey(ingress.Namespace, ingress.Name), ingress)
+	}
+}
 
-	if err != nil {
-		i.lg.Info("Error adding ingress", zap.Error(err), zap.Any("ingress", obj))
+func (i *IngressSource) onDelete(obj interface{}) {
+	obj = deletedObject(obj)
+	if ingress, ok := obj.(*v1.Ingress); ok {
+		ClearSkip("Ingress", ingress.Namespace, ingress.Name)
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.sync(ingressKey(ingress.Namespace, ingress.Name), nil)
+	}
+}
+
+func (i *IngressSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	if unchanged(oldObj, newObj) {
 		return
 	}
+	i.onAdd(newObj)
+}
+
+// reconcile publishes the ingress with key again after something it
+// depends on changed.
+func (i *IngressSource) reconcile(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, namespace, name := splitObjectKey(key)
+	obj, exists, err := i.sharedInformer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return
+	}
+	i.sync(key, obj.(*v1.Ingress))
+}
 
-	for _, record := range advertiseRecords {
+// sync publishes the records of ingress, withdrawing those previously
+// published for key that it no longer has, and records what they depend
+// on. A nil ingress withdraws everything published for key. The caller
+// must hold i.mu.
+func (i *IngressSource) sync(key string, ingress *v1.Ingress) {
+	var records []resource.Resource
+	if ingress != nil {
+		var err error
+		if records, err = i.buildRecords(ingress, resource.Added); err != nil {
+			i.lg.Info("Error building ingress resources", zap.Error(err), zap.String("ingress", key))
+		}
+		dependencies.set(key, i.dependsOn(ingress))
+	} else {
+		dependencies.forget(key)
+	}
+
+	published := i.published[key]
+	if reflect.DeepEqual(published, records) {
+		return
+	}
+	for _, record := range published {
+		record.Action = resource.Deleted
 		i.notifyChan <- record
 	}
+	for _, record := range records {
+		i.notifyChan <- record
+	}
+	if len(records) == 0 {
+		delete(i.published, key)
+	} else {
+		i.published[key] = records
+	}
 }
 
-func (i *IngressSource) onDelete(obj interface{}) {
-	advertiseRecords, err := i.buildRecords(obj, resource.Deleted)
+// dependsOn returns the keys of the objects the records of ingress are
+// derived from besides the Ingress itself. The caller must hold i.mu.
+func (i *IngressSource) dependsOn(ingress *v1.Ingress) []string {
+	var keys []string
+	if i.endpointLister != nil {
+		for _, name := range backendServices(ingress) {
+			keys = append(keys, objectKey("Service", ingress.Namespace, name))
+		}
+	}
+	if i.serviceInformer != nil && i.dependsOnController(ingress) {
+		keys = append(keys, controllerServiceKey)
+	}
+	if i.controllerInformer != nil && len(ingress.Status.LoadBalancer.Ingress) == 0 {
+		keys = append(keys, i.controllerPodsKey)
+	}
+	return keys
+}
 
-	if err != nil {
-		i.lg.Info("Error deleting ingress", zap.Error(err), zap.Any("ingress", obj))
+// onControllerChange republishes the ingresses relying on the node IPs of
+// the controller pods when the set of those IPs changes.
+func (i *IngressSource) onControllerChange(interface{}) {
+	i.mu.Lock()
+	fallback := controllerNodeIPs(i.controllerInformer.GetStore().List())
+	if reflect.DeepEqual(fallback, i.fallback) {
+		i.mu.Unlock()
 		return
 	}
+	i.lg.Info("Ingress controller node IPs changed", zap.Strings("ips", fallback))
+	i.fallback = fallback
+	i.mu.Unlock()
 
-	for _, record := range advertiseRecords {
-		i.notifyChan <- record
+	dependencies.changed(i.controllerPodsKey)
+}
+
+// onControllerServiceChange republishes the ingresses pointing at the
+// previous load balancer IPs of the controller Service when they change,
+// rather than waiting for the controller to update each Ingress status.
+func (i *IngressSource) onControllerServiceChange(interface{}) {
+	i.mu.Lock()
+	var ips []string
+	for _, obj := range i.serviceInformer.GetStore().List() {
+		if service, ok := obj.(*corev1.Service); ok {
+			for _, lb := range service.Status.LoadBalancer.Ingress {
+				if lb.IP != "" {
+					ips = append(ips, lb.IP)
+				}
+			}
+		}
 	}
+	sort.Strings(ips)
+	// Keep the last addresses while the Service has none, so ingresses are
+	// not withdrawn while it is being recreated.
+	if len(ips) == 0 || reflect.DeepEqual(ips, i.controllerIPs) {
+		i.mu.Unlock()
+		return
+	}
+	previous := i.controllerIPs
+	for _, ip := range previous {
+		i.staleIPs[ip] = true
+	}
+	for _, ip := range ips {
+		delete(i.staleIPs, ip)
+	}
+	i.controllerIPs = ips
+	if len(previous) == 0 {
+		// Ingresses pointing at the first addresses seen depend on the
+		// Service from now on.
+		for _, obj := range i.sharedInformer.GetStore().List() {
+			if ingress, ok := obj.(*v1.Ingress); ok && i.dependsOnController(ingress) {
+				dependencies.set(ingressKey(ingress.Namespace, ingress.Name), i.dependsOn(ingress))
+			}
+		}
+		i.mu.Unlock()
+		return
+	}
+	i.lg.Info("Ingress controller Service addresses changed", zap.Strings("old", previous), zap.Strings("new", ips))
+	i.mu.Unlock()
+
+	dependencies.changed(controllerServiceKey)
 }
 
-func (i *IngressSource) onUpdate(oldObj interface{}, newObj interface{}) {
-	oldResources, err1 := i.buildRecords(oldObj, resource.Updated)
-	if err1 != nil {
-		i.lg.Info("Error gathering old ingress resources", zap.Error(err1), zap.Any("ingress", oldObj))
+// onEndpointsChange reconciles whatever depends on the Service owning an
+// EndpointSlice, as its readiness may have changed.
+func (i *IngressSource) onEndpointsChange(obj interface{}) {
+	obj = deletedObject(obj)
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok || slice.Labels[discoveryv1.LabelServiceName] == "" {
+		return
 	}
+	dependencies.changed(objectKey("Service", slice.Namespace, slice.Labels[discoveryv1.LabelServiceName]))
+}
 
-	for _, record := range oldResources {
-		record.Action = resource.Deleted
-		i.notifyChan <- record
+// backendServices returns the names of the Services ingress routes to.
+func backendServices(ingress *v1.Ingress) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(backend *v1.IngressBackend) {
+		if backend != nil && backend.Service != nil && !seen[backend.Service.Name] {
+			seen[backend.Service.Name] = true
+			names = append(names, backend.Service.Name)
+		}
+	}
+	add(ingress.Spec.DefaultBackend)
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			add(&path.Backend)
+		}
 	}
+	return names
+}
 
-	newResources, err2 := i.buildRecords(newObj, resource.Updated)
-	if err2 != nil {
-		i.lg.Info("Error gathering new ingress resources", zap.Error(err2), zap.Any("ingress", newObj))
+// backendReady reports whether any Service ingress routes to has a ready
+// endpoint. Ingresses routing to no Service count as ready.
+func (i *IngressSource) backendReady(ingress *v1.Ingress) bool {
+	names := backendServices(ingress)
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if ready, err := hasReadyEndpoints(i.endpointLister, ingress.Namespace, name); err != nil {
+			i.lg.Info("Error listing endpoint slices", zap.Error(err), zap.String("service", name))
+		} else if ready {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, record := range newResources {
-		record.Action = resource.Added
-		i.notifyChan <- record
+// dependsOnController reports whether the status of ingress holds a current
+// or previous address of the controller Service. The caller must hold i.mu.
+func (i *IngressSource) dependsOnController(ingress *v1.Ingress) bool {
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if i.staleIPs[lb.IP] {
+			return true
+		}
+		for _, ip := range i.controllerIPs {
+			if lb.IP == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// controllerNodeIPs returns the sorted, distinct node IPs of the running
+// pods in pods.
+func controllerNodeIPs(pods []interface{}) []string {
+	seen := make(map[string]bool)
+	var ips []string
+	add := func(ip string) {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
 	}
+	for _, obj := range pods {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		add(pod.Status.HostIP)
+		for _, hostIP := range pod.Status.HostIPs {
+			add(hostIP.IP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
 }
 
 func (i *IngressSource) buildRecords(obj interface{}, action string) ([]resource.Resource, error) {
@@ -100,15 +369,43 @@ func (i *IngressSource) buildRecords(obj interface{}, action string) ([]resource
 	if !ok {
 		return records, nil
 	}
+	if ingress.DeletionTimestamp != nil {
+		noteSkip("Ingress", ingress, action, nil, SkipTerminating, "being deleted")
+		return records, nil
+	}
 
 	var ipFields []string
+	seen := make(map[string]bool)
 	for _, lb := range ingress.Status.LoadBalancer.Ingress {
-		if lb.IP != "" {
-			ipFields = append(ipFields, lb.IP)
+		ips := []string{lb.IP}
+		if i.staleIPs[lb.IP] {
+			// The controller Service has moved on from this address.
+			ips = i.controllerIPs
+		}
+		for _, ip := range ips {
+			if ip != "" && !seen[ip] {
+				seen[ip] = true
+				ipFields = append(ipFields, ip)
+			}
 		}
 	}
 
+	if len(ingress.Status.LoadBalancer.Ingress) == 0 {
+		// Ingress controllers on the host network, such as DaemonSets,
+		// often never set a status; publish the nodes they run on.
+		ipFields = append(ipFields, i.fallback...)
+	}
+
 	if len(ipFields) == 0 {
+		noteSkip("Ingress", ingress, action, nil, SkipNoAddress, "waiting for a load balancer address")
+		return records, nil
+	}
+	if i.endpointLister != nil && !i.backendReady(ingress) {
+		noteSkip("Ingress", ingress, action, nil, SkipNoReadyEndpoints, "no backend Service has ready endpoints (--require-ready-endpoints)")
+		return records, nil
+	}
+	if !i.filter.Matches("Ingress", "", ingress) {
+		noteSkip("Ingress", ingress, action, nil, SkipFiltered, "excluded by --filter")
 		return records, nil
 	}
 
@@ -134,33 +431,102 @@ func (i *IngressSource) buildRecords(obj interface{}, action string) ([]resource
 			hostname = parsedHost.Domain
 		}
 		advertiseObj := resource.Resource{
-			SourceType: "ingress",
-			Action:     action,
-			Names:      []string{hostname},
-			Namespace:  ingress.Namespace,
-			IPs:        ipFields,
+			SourceType:     "ingress",
+			SourceName:     ingress.Name,
+			Object:         objectRef(ingress, "networking.k8s.io/v1", "Ingress"),
+			Created:        ingress.CreationTimestamp.Time,
+			Priority:       intAnnotation(ingress.Annotations, PriorityAnnotation),
+			PriorityClass:  strings.TrimSpace(ingress.Annotations[PriorityClassAnnotation]),
+			TTL:            intAnnotation(ingress.Annotations, TTLAnnotation),
+			PTRName:        ptrNameAnnotation(ingress.Annotations),
+			RecordTypes:    recordTypesAnnotation(ingress.Annotations),
+			RecordStrategy: recordStrategyAnnotation(ingress.Annotations),
+			Shared:         sharingAnnotation(ingress.Annotations),
+			Action:         action,
+			Names:          []string{hostname},
+			Namespace:      ingress.Namespace,
+			IPs:            ipFields,
+			Ports:          ingressPorts(ingress),
+
+			HyphenatedNames: boolAnnotation(ingress.Annotations, HyphenatedNamesAnnotation),
 		}
 
 		records = append(records, advertiseObj)
 	}
+	if len(records) == 0 {
+		noteSkip("Ingress", ingress, action, nil, SkipNoLocalHost, "no rule host ends in .local")
+	} else {
+		noteSkip("Ingress", ingress, action, ipFields, "", "")
+	}
 	return records, nil
 }
 
-// NewIngressWatcher creates an IngressSource
-func NewIngressWatcher(lg *zap.Logger, factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource) IngressSource {
-	ingressInformer := factory.Networking().V1().Ingresses().Informer()
+// ingressPorts returns the ports an ingress controller serves ingress on:
+// 80, and 443 when it has TLS hosts.
+func ingressPorts(ingress *v1.Ingress) []int {
+	if len(ingress.Spec.TLS) > 0 {
+		return []int{80, 443}
+	}
+	return []int{80}
+}
+
+// NewIngressWatcher creates an IngressSource watching the ingresses in
+// namespace, or in every namespace when it is empty. factory must be
+// limited to the same namespace.
+func NewIngressWatcher(lg *zap.Logger, factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource, opts IngressOptions) *IngressSource {
+	ingressInformer := factory.InformerFor(&v1.Ingress{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return networkinginformers.NewFilteredIngressInformer(client, namespace, resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, withFieldSelector(opts.FieldSelector))
+	})
+	registerOwners("ingress", ingressInformer)
 	i := &IngressSource{
 		lg:             lg,
 		namespace:      namespace,
 		notifyChan:     notifyChan,
 		sharedInformer: ingressInformer,
+		filter:         opts.Filter,
+		staleIPs:       make(map[string]bool),
+		published:      make(map[string][]resource.Resource),
 	}
+	dependencies.register("Ingress", namespace, i.reconcile)
 
-	ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	if opts.ControllerPods != nil {
+		i.controllerPodsKey = objectKey("Pods", "", opts.ControllerSelector)
+		i.controllerInformer = opts.ControllerPods
+		track(lg, "pods", i.controllerInformer, cache.ResourceEventHandlerFuncs{
+			AddFunc:    i.onControllerChange,
+			UpdateFunc: func(_, newObj interface{}) { i.onControllerChange(newObj) },
+			DeleteFunc: i.onControllerChange,
+		})
+	}
+
+	track(lg, watchName("ingresses", namespace), ingressInformer, cache.ResourceEventHandlerFuncs{
 		AddFunc:    i.onAdd,
 		DeleteFunc: i.onDelete,
 		UpdateFunc: i.onUpdate,
 	})
 
-	return *i
+	if opts.RequireReady {
+		endpoints := factory.Discovery().V1().EndpointSlices()
+		i.endpointInformer = endpoints.Informer()
+		i.endpointLister = endpoints.Lister()
+		// The service source, when enabled, tracks the same informer under
+		// the same name.
+		track(lg, watchName("endpointslices", namespace), i.endpointInformer, cache.ResourceEventHandlerFuncs{
+			AddFunc:    i.onEndpointsChange,
+			UpdateFunc: func(_, newObj interface{}) { i.onEndpointsChange(newObj) },
+			DeleteFunc: i.onEndpointsChange,
+		})
+	}
+
+	if opts.ControllerService != nil {
+		i.serviceInformer = opts.ControllerService
+		track(lg, "ingress-controller-service", i.serviceInformer, cache.ResourceEventHandlerFuncs{
+			AddFunc:    i.onControllerServiceChange,
+			UpdateFunc: func(_, newObj interface{}) { i.onControllerServiceChange(newObj) },
+			DeleteFunc: i.onControllerServiceChange,
+		})
+	}
+
+	return i
 }
@@ -0,0 +1,105 @@
+package source
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// originExpiry is how long the origin of an event is kept for the records
+// it leads to, beyond which the event is assumed to have published nothing,
+// such as one for a filtered object.
+const originExpiry = 10 * time.Minute
+
+// tracer starts the spans of Kubernetes events. It does nothing unless a
+// tracer provider was installed, see configureTracing.
+var tracer = otel.Tracer("github.com/grumpylabs/external-mdns/cmd/source")
+
+// origin is the earliest Kubernetes event for an object whose records have
+// not been published since.
+type origin struct {
+	received time.Time
+	span     trace.Span
+}
+
+// origins holds the origin of the events awaiting publication, by object
+// UID.
+var origins = struct {
+	sync.Mutex
+	byUID map[string]origin
+	swept time.Time
+}{byUID: make(map[string]origin)}
+
+// receiveEvent records the origin of an event for obj as it arrives, and
+// starts its span. An object with an event still awaiting publication
+// keeps the origin of that one.
+func receiveEvent(name, event string, obj interface{}) {
+	object, err := meta.Accessor(deletedObject(obj))
+	if err != nil || object.GetUID() == "" {
+		return
+	}
+	uid := string(object.GetUID())
+	now := time.Now()
+
+	origins.Lock()
+	defer origins.Unlock()
+	if now.Sub(origins.swept) > originExpiry {
+		for uid, o := range origins.byUID {
+			if now.Sub(o.received) > originExpiry {
+				o.span.End()
+				delete(origins.byUID, uid)
+			}
+		}
+		origins.swept = now
+	}
+	if _, ok := origins.byUID[uid]; ok {
+		return
+	}
+	_, span := tracer.Start(context.Background(), "kubernetes "+event,
+		trace.WithTimestamp(now),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("k8s.watch", name),
+			attribute.String("k8s.namespace.name", object.GetNamespace()),
+			attribute.String("k8s.object.name", object.GetName()),
+			attribute.String("k8s.object.uid", uid),
+			attribute.String("k8s.object.resource_version", object.GetResourceVersion()),
+		))
+	origins.byUID[uid] = origin{received: now, span: span}
+}
+
+// handledEvent ends the span of the event for obj once its source has
+// handled it.
+func handledEvent(obj interface{}) {
+	object, err := meta.Accessor(deletedObject(obj))
+	if err != nil {
+		return
+	}
+	origins.Lock()
+	o, ok := origins.byUID[string(object.GetUID())]
+	origins.Unlock()
+	if ok {
+		o.span.End()
+	}
+}
+
+// TakeOrigin returns when the earliest event for the object with uid that
+// is not yet published arrived, along with the span context of that event,
+// and forgets it. ok is false when no event is awaiting publication. The
+// span is ended if its source is still handling the event.
+func TakeOrigin(uid string) (received time.Time, span trace.SpanContext, ok bool) {
+	origins.Lock()
+	defer origins.Unlock()
+	o, ok := origins.byUID[uid]
+	if !ok {
+		return time.Time{}, trace.SpanContext{}, false
+	}
+	delete(origins.byUID, uid)
+	o.span.End()
+	return o.received, o.span.SpanContext(), true
+}
@@ -0,0 +1,59 @@
+package source
+
+import (
+	"sync"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+)
+
+// owners holds the informers of each source type whose resources are
+// built from Kubernetes objects, so the main loop can check the objects
+// behind published records are still there, see Observed.
+var owners = struct {
+	sync.Mutex
+	informers map[string][]cache.SharedIndexInformer // by source type
+}{informers: make(map[string][]cache.SharedIndexInformer)}
+
+// registerOwners adds informer to those holding the objects resources of
+// sourceType are built from, such as one per custom resource for "crd".
+func registerOwners(sourceType string, informer cache.SharedIndexInformer) {
+	owners.Lock()
+	defer owners.Unlock()
+	owners.informers[sourceType] = append(owners.informers[sourceType], informer)
+}
+
+// Observed reports whether the object r was built from is in the cache of
+// its source, under the same UID. known is false for sources not backed by
+// informers, and while any of them has not synced.
+func Observed(r resource.Resource) (observed, known bool) {
+	owners.Lock()
+	informers := owners.informers[r.SourceType]
+	owners.Unlock()
+	if len(informers) == 0 {
+		return false, false
+	}
+
+	key := r.SourceName
+	if r.Namespace != "" {
+		key = r.Namespace + "/" + key
+	}
+	for _, informer := range informers {
+		if !informer.HasSynced() {
+			return false, false
+		}
+		obj, exists, err := informer.GetStore().GetByKey(key)
+		if err != nil {
+			return false, false
+		}
+		if !exists {
+			continue
+		}
+		accessor, err := meta.Accessor(obj)
+		if r.Object.UID == "" || err != nil || string(accessor.GetUID()) == r.Object.UID {
+			return true, true
+		}
+	}
+	return false, true
+}
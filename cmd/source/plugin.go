@@ -0,0 +1,236 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"go.uber.org/zap"
+)
+
+// PluginPrefix marks a --source value naming a plugin, e.g.
+// plugin:/usr/local/bin/my-source or plugin:http://localhost:8080/events.
+const PluginPrefix = "plugin:"
+
+const (
+	pluginMaxBackoff = 30 * time.Second
+	pluginMaxLine    = 1 << 20
+)
+
+// PluginEvent is one line of newline-delimited JSON emitted by a plugin.
+// "set" publishes an object, replacing what was published for it before,
+// and "delete" withdraws it.
+type PluginEvent struct {
+	Action           string   `json:"action"`
+	Object           string   `json:"object"`
+	Namespace        string   `json:"namespace"`
+	Names            []string `json:"names"`
+	IPs              []string `json:"ips"`
+	WithoutNamespace bool     `json:"withoutNamespace"`
+	Priority         int      `json:"priority"`
+	PriorityClass    string   `json:"priorityClass"`
+	PTRName          string   `json:"ptrName"`
+	Sharing          string   `json:"sharing"`
+	TTL              int      `json:"ttl"`
+}
+
+// PluginSource publishes objects streamed by an external program, either
+// the standard output of a long-running subprocess or the body of an HTTP
+// response. When the stream ends its objects are withdrawn and it is
+// restarted with backoff; the plugin is expected to emit its full state
+// again.
+type PluginSource struct {
+	lg         *zap.Logger
+	target     string
+	notifyChan chan<- resource.Resource
+	objects    map[string]resource.Resource
+}
+
+// NewPluginWatcher creates a PluginSource for target, a command path or an
+// http(s) URL.
+func NewPluginWatcher(lg *zap.Logger, target string, notifyChan chan<- resource.Resource) *PluginSource {
+	return &PluginSource{
+		lg:         lg.With(zap.String("plugin", target)),
+		target:     target,
+		notifyChan: notifyChan,
+		objects:    make(map[string]resource.Resource),
+	}
+}
+
+// Run follows the plugin until stopCh is closed.
+func (p *PluginSource) Run(stopCh chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := p.follow(ctx)
+		p.withdrawAll()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		p.lg.Warn("Plugin stream ended, restarting", zap.Error(err), zap.Duration("retry", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		backoff = min(backoff*2, pluginMaxBackoff)
+	}
+}
+
+// follow opens the plugin stream and applies its events until it ends.
+func (p *PluginSource) follow(ctx context.Context) error {
+	stream, err := p.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), pluginMaxLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event PluginEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			p.lg.Warn("Ignoring invalid plugin event", zap.Error(err), zap.String("line", line))
+			continue
+		}
+		if err := p.apply(event); err != nil {
+			p.lg.Warn("Ignoring invalid plugin event", zap.Error(err), zap.String("line", line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// open starts the subprocess or requests the URL.
+func (p *PluginSource) open(ctx context.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(p.target, "http://") || strings.HasPrefix(p.target, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/x-ndjson")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("plugin returned %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+
+	cmd := exec.CommandContext(ctx, p.target)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &pluginProcess{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// pluginProcess reaps the subprocess once its output is closed.
+type pluginProcess struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (p *pluginProcess) Close() error {
+	p.ReadCloser.Close()
+	p.cmd.Process.Kill()
+	return p.cmd.Wait()
+}
+
+// apply publishes or withdraws the object described by event.
+func (p *PluginSource) apply(event PluginEvent) error {
+	if event.Object == "" {
+		return fmt.Errorf("missing object")
+	}
+	if event.Namespace == "" {
+		event.Namespace = "default"
+	}
+	if event.Action == "set" {
+		names := event.Names
+		if len(names) == 0 {
+			names = []string{event.Object}
+		}
+		for _, name := range append(names, event.Namespace) {
+			if err := CheckName(name); err != nil {
+				return err
+			}
+		}
+	}
+	key := event.Namespace + "/" + event.Object
+
+	switch event.Action {
+	case "set":
+		p.withdraw(key)
+		r := resource.Resource{
+			SourceType:       "plugin",
+			SourceName:       event.Object,
+			Created:          time.Now(),
+			Priority:         event.Priority,
+			PriorityClass:    event.PriorityClass,
+			PTRName:          ptrName(event.PTRName),
+			Shared:           sharing(event.Sharing),
+			TTL:              event.TTL,
+			Action:           resource.Added,
+			IPs:              event.IPs,
+			Names:            event.Names,
+			Namespace:        event.Namespace,
+			WithoutNamespace: event.WithoutNamespace,
+		}
+		if len(r.Names) == 0 {
+			r.Names = []string{event.Object}
+		}
+		p.objects[key] = r
+		p.notifyChan <- r
+	case "delete":
+		p.withdraw(key)
+	default:
+		return fmt.Errorf("unknown action %q (set, delete)", event.Action)
+	}
+	return nil
+}
+
+func (p *PluginSource) withdraw(key string) {
+	r, ok := p.objects[key]
+	if !ok {
+		return
+	}
+	delete(p.objects, key)
+	r.Action = resource.Deleted
+	p.notifyChan <- r
+}
+
+func (p *PluginSource) withdrawAll() {
+	for key := range p.objects {
+		p.withdraw(key)
+	}
+}
@@ -17,15 +17,61 @@ package source
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
+const (
+	// Backoff between checks of a service awaiting a LoadBalancer address.
+	awaitIPBaseDelay = time.Second
+	awaitIPMaxDelay  = 5 * time.Minute
+)
+
+// ServiceOptions controls which services a ServiceSource publishes.
+type ServiceOptions struct {
+	// PublishInternal publishes the ClusterIP of ClusterIP services.
+	PublishInternal bool
+	// RequireReady only publishes services while they have at least one
+	// ready endpoint.
+	RequireReady bool
+	// ResolveExternalNames publishes ExternalName services with the
+	// addresses their target resolves to through unicast DNS.
+	ResolveExternalNames bool
+	// NodeAddresses, when set, publishes NodePort services with these
+	// addresses of the local node.
+	NodeAddresses []string
+	// NodeName, when set with NodeAddresses, also publishes ClusterIP
+	// services with the node's addresses while host-network or hostPort
+	// pods behind them run on this node.
+	NodeName string
+	// FieldSelector restricts the watch to matching services, e.g.
+	// spec.type=LoadBalancer.
+	FieldSelector string
+	// Filter decides which services are published.
+	Filter *Filter
+	// DNSSD advertises DNS-SD instances for the well-known ports of
+	// services, see dnssdServices.
+	DNSSD bool
+	// AppProtocolTypes maps port appProtocols to DNS-SD service types,
+	// see AppProtocolTypes.
+	AppProtocolTypes map[string]string
+}
+
 // ServiceSource handles adding, updating, or removing mDNS record advertisements
 type ServiceSource struct {
 	lg              *zap.Logger
@@ -33,11 +79,57 @@ type ServiceSource struct {
 	publishInternal bool
 	notifyChan      chan<- resource.Resource
 	sharedInformer  cache.SharedIndexInformer
+
+	// When requireReady is set, services are only published while they
+	// have at least one ready endpoint.
+	requireReady     bool
+	filter           *Filter
+	endpointInformer cache.SharedIndexInformer
+	endpointLister   discoverylisters.EndpointSliceLister
+
+	// resolver is set when ExternalName services are published.
+	resolver *externalNameResolver
+
+	// nodeAddresses are published for NodePort services in node-local mode,
+	// and for ClusterIP services with host-network or hostPort pods on the
+	// node when podInformer watches them.
+	nodeAddresses []string
+	podInformer   cache.SharedIndexInformer
+	podLister     corelisters.PodLister
+
+	// dnssd advertises DNS-SD instances for well-known ports, and those
+	// whose appProtocol is in appProtocols.
+	dnssd        bool
+	appProtocols map[string]string
+
+	// awaitingIP requeues LoadBalancer services until an address has
+	// been assigned, in case the status update is missed.
+	awaitingIP workqueue.TypedRateLimitingInterface[string]
+
+	mu       sync.Mutex                   // serialises event handlers
+	ready    map[string]bool              // readiness each service was last published with
+	external map[string]externalNameState // ExternalName services and their published addresses
+	hosted   map[string][]int             // node ports services with pods on this node were last published with
+	pending  map[string]bool              // LoadBalancer services awaiting an address
 }
 
 // Run starts shared informers and waits for the shared informer cache to
 // synchronize.
 func (s *ServiceSource) Run(stopCh chan struct{}) error {
+	if s.endpointInformer != nil {
+		go runInformer(s.endpointInformer, stopCh)
+	}
+	if s.podInformer != nil {
+		go runInformer(s.podInformer, stopCh)
+	}
+	if s.resolver != nil {
+		go s.refreshExternalNames(stopCh)
+	}
+	go s.processAwaitingIP()
+	go func() {
+		<-stopCh
+		s.awaitingIP.ShutDown()
+	}()
 	s.sharedInformer.Run(stopCh)
 	if !cache.WaitForCacheSync(stopCh, s.sharedInformer.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
@@ -46,6 +138,9 @@ func (s *ServiceSource) Run(stopCh chan struct{}) error {
 }
 
 func (s *ServiceSource) onAdd(obj interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	advertiseResource, err := s.buildRecord(obj, resource.Added)
 
 	if err != nil {
@@ -53,6 +148,7 @@ func (s *ServiceSource) onAdd(obj interface{}) {
 			s.lg.Info("updating", zap.String("name", name))
 		}
 	}
+	s.trackAwaitingIP(obj)
 
 	if len(advertiseResource.IPs) == 0 {
 		return
@@ -62,7 +158,23 @@ func (s *ServiceSource) onAdd(obj interface{}) {
 }
 
 func (s *ServiceSource) onDelete(obj interface{}) {
+	obj = deletedObject(obj)
+	if _, ok := obj.(*corev1.Service); !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	advertiseResource, err := s.buildRecord(obj, resource.Deleted)
+	if service, ok := obj.(*corev1.Service); ok {
+		ClearSkip("Service", service.Namespace, service.Name)
+		key := serviceKey(service.Namespace, service.Name)
+		delete(s.ready, key)
+		delete(s.hosted, key)
+		s.forgetExternalName(key)
+		s.setAwaitingIP(key, false)
+	}
 
 	if err != nil {
 		for _, name := range advertiseResource.Names {
@@ -73,6 +185,12 @@ func (s *ServiceSource) onDelete(obj interface{}) {
 }
 
 func (s *ServiceSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	if unchanged(oldObj, newObj) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	oldResource, err1 := s.buildRecord(oldObj, resource.Deleted)
 	if err1 != nil {
 		s.lg.Info("Error parsing old service resource", zap.Error(err1))
@@ -83,6 +201,7 @@ func (s *ServiceSource) onUpdate(oldObj interface{}, newObj interface{}) {
 	if err2 != nil {
 		s.lg.Info("Error parsing new service resource", zap.Error(err2))
 	}
+	s.trackAwaitingIP(newObj)
 	s.notifyChan <- newResource
 }
 
@@ -99,7 +218,7 @@ func (s *ServiceSource) buildRecord(obj interface{}, action string) (resource.Re
 		return advertiseObj, nil
 	}
 
-	if hostnames, ok := service.Annotations["external-mdns.blakecovarrubias.com/hostnames"]; ok {
+	if hostnames, ok := service.Annotations[HostnamesAnnotation]; ok {
 		names := strings.Split(hostnames, ",")
 		for i := range names {
 			names[i] = strings.TrimSpace(names[i])
@@ -108,41 +227,355 @@ func (s *ServiceSource) buildRecord(obj interface{}, action string) (resource.Re
 	} else {
 		advertiseObj.Names = []string{service.Name}
 	}
-	if withoutNS, ok := service.Annotations["external-mdns.blakecovarrubias.com/without-namespace"]; ok {
+	if withoutNS, ok := service.Annotations[WithoutNamespaceAnnotation]; ok {
 		advertiseObj.WithoutNamespace = strings.EqualFold(withoutNS, "true")
 	}
+	advertiseObj.HyphenatedNames = boolAnnotation(service.Annotations, HyphenatedNamesAnnotation)
 
 	advertiseObj.Namespace = service.Namespace
+	advertiseObj.SourceName = service.Name
+	advertiseObj.Object = objectRef(service, "v1", "Service")
+	advertiseObj.Created = service.CreationTimestamp.Time
+	advertiseObj.Priority = intAnnotation(service.Annotations, PriorityAnnotation)
+	advertiseObj.PriorityClass = strings.TrimSpace(service.Annotations[PriorityClassAnnotation])
+	advertiseObj.TTL = intAnnotation(service.Annotations, TTLAnnotation)
+	advertiseObj.PTRName = ptrNameAnnotation(service.Annotations)
+	advertiseObj.RecordTypes = recordTypesAnnotation(service.Annotations)
+	advertiseObj.RecordStrategy = recordStrategyAnnotation(service.Annotations)
+	advertiseObj.Shared = sharingAnnotation(service.Annotations)
+	advertiseObj.SSDP = ssdpAnnotation(service.Annotations)
+	advertiseObj.WSD = wsdAnnotation(service.Annotations)
+	advertiseObj.DNSSD = dnssdServices(service, s.dnssd, s.appProtocols)
+	advertiseObj.Ports = servicePorts(service)
 	advertiseObj.IPs = []string{}
+	if action == resource.Added && service.Spec.Type != corev1.ServiceTypeExternalName {
+		s.forgetExternalName(serviceKey(service.Namespace, service.Name))
+	}
+
+	// Withdraw services as soon as they are being deleted rather than once
+	// their finalizers are done, so clients stop resolving them meanwhile.
+	if service.DeletionTimestamp != nil {
+		noteSkip("Service", service, action, nil, SkipTerminating, "being deleted")
+		return advertiseObj, nil
+	}
+	if !s.filter.Matches("Service", string(service.Spec.Type), service) {
+		noteSkip("Service", service, action, nil, SkipFiltered, "excluded by --filter")
+		return advertiseObj, nil
+	}
 
-	if service.Spec.Type == "ClusterIP" && s.publishInternal {
+	var reason, message string
+	if service.Spec.Type == "ClusterIP" && s.publishesInternal(service) {
 		advertiseObj.IPs = append(advertiseObj.IPs, service.Spec.ClusterIP)
+	} else if hostable(service) && s.podLister != nil {
+		if ports := s.hostedFor(service, action); ports != nil {
+			advertiseObj.IPs = append(advertiseObj.IPs, s.nodeAddresses...)
+			advertiseObj.Ports = ports
+		}
+		reason, message = SkipServiceType, "no host-network or hostPort pods of the service run on this node"
 	} else if service.Spec.Type == "LoadBalancer" {
 		for _, lb := range service.Status.LoadBalancer.Ingress {
 			if lb.IP != "" {
 				advertiseObj.IPs = append(advertiseObj.IPs, lb.IP)
 			}
 		}
+		reason, message = SkipNoAddress, "waiting for a LoadBalancer address"
+	} else if service.Spec.Type == "NodePort" && len(s.nodeAddresses) > 0 {
+		advertiseObj.IPs = append(advertiseObj.IPs, s.nodeAddresses...)
+	} else if service.Spec.Type == "ExternalName" && s.resolver != nil {
+		// ExternalName services have no endpoints to gate on.
+		advertiseObj.IPs = append(advertiseObj.IPs, s.externalNameIPs(service, action)...)
+		noteSkip("Service", service, action, advertiseObj.IPs, SkipUnresolved,
+			fmt.Sprintf("%s does not resolve to any address", service.Spec.ExternalName))
+		return advertiseObj, nil
+	} else {
+		reason, message = SkipServiceType, serviceTypeSkipMessage(service.Spec.Type)
 	}
 
+	if s.requireReady && !s.readyFor(service, action) {
+		if len(advertiseObj.IPs) > 0 {
+			reason, message = SkipNoReadyEndpoints, "no ready endpoints (--require-ready-endpoints)"
+		}
+		advertiseObj.IPs = []string{}
+	}
+	noteSkip("Service", service, action, advertiseObj.IPs, reason, message)
+
 	return advertiseObj, nil
 }
 
-// NewServicesWatcher creates an ServiceSource
-func NewServicesWatcher(lg *zap.Logger, factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource, publishInternal bool) ServiceSource {
-	servicesInformer := factory.Core().V1().Services().Informer()
+// publishesInternal reports whether the ClusterIP of service is published.
+// The publish-internal annotation overrides --publish-internal-services for
+// a single service, in either direction.
+func (s *ServiceSource) publishesInternal(service *corev1.Service) bool {
+	if override := boolAnnotation(service.Annotations, PublishInternalAnnotation); override != nil {
+		return *override
+	}
+	return s.publishInternal
+}
+
+// servicePorts returns the TCP ports service serves on the addresses it is
+// published with: its node ports for a NodePort service, its ports
+// otherwise.
+func servicePorts(service *corev1.Service) []int {
+	var ports []int
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if service.Spec.Type == corev1.ServiceTypeNodePort {
+			if port.NodePort != 0 {
+				ports = append(ports, int(port.NodePort))
+			}
+			continue
+		}
+		ports = append(ports, int(port.Port))
+	}
+	return ports
+}
+
+// serviceTypeSkipMessage explains why services of type t are not published.
+func serviceTypeSkipMessage(t corev1.ServiceType) string {
+	switch t {
+	case corev1.ServiceTypeClusterIP, "":
+		return "ClusterIP services need --publish-internal-services or the publish-internal annotation"
+	case corev1.ServiceTypeNodePort:
+		return "NodePort services are only published in node-local mode"
+	case corev1.ServiceTypeExternalName:
+		return "ExternalName services need --resolve-external-names"
+	}
+	return fmt.Sprintf("services of type %s are not published", t)
+}
+
+// trackAwaitingIP queues LoadBalancer services that have no address yet and
+// forgets those that have one. The caller must hold s.mu.
+func (s *ServiceSource) trackAwaitingIP(obj interface{}) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	s.setAwaitingIP(serviceKey(service.Namespace, service.Name), awaitingIP(service))
+}
+
+// setAwaitingIP records whether the service key is awaiting an address.
+// The caller must hold s.mu.
+func (s *ServiceSource) setAwaitingIP(key string, awaiting bool) {
+	if awaiting == s.pending[key] {
+		return
+	}
+	if awaiting {
+		s.lg.Info("Service is awaiting a LoadBalancer address", zap.String("service", key))
+		s.pending[key] = true
+		s.awaitingIP.AddRateLimited(key)
+	} else {
+		delete(s.pending, key)
+		s.awaitingIP.Forget(key)
+	}
+	metrics.ServicesAwaitingIP.Set(float64(len(s.pending)))
+}
+
+// awaitingIP reports whether service is a LoadBalancer without an address.
+func awaitingIP(service *corev1.Service) bool {
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// processAwaitingIP checks queued services with backoff and publishes them
+// once an address has been assigned.
+func (s *ServiceSource) processAwaitingIP() {
+	for {
+		key, shutdown := s.awaitingIP.Get()
+		if shutdown {
+			return
+		}
+		s.checkAwaitingIP(key)
+		s.awaitingIP.Done(key)
+	}
+}
+
+func (s *ServiceSource) checkAwaitingIP(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.pending[key] {
+		return
+	}
+	item, exists, err := s.sharedInformer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		s.setAwaitingIP(key, false)
+		return
+	}
+	service := item.(*corev1.Service)
+	if awaitingIP(service) {
+		s.awaitingIP.AddRateLimited(key)
+		return
+	}
+
+	s.setAwaitingIP(key, false)
+	advertiseResource, err := s.buildRecord(service, resource.Added)
+	if err != nil || len(advertiseResource.IPs) == 0 {
+		return
+	}
+	s.lg.Info("LoadBalancer address assigned", zap.String("service", key), zap.Strings("ips", advertiseResource.IPs))
+	s.notifyChan <- advertiseResource
+}
+
+func serviceKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// readyFor reports whether service should be published for action. Added
+// records the current readiness; Deleted reuses the readiness the service
+// was last published with so exactly those records are withdrawn. The
+// caller must hold s.mu.
+func (s *ServiceSource) readyFor(service *corev1.Service, action string) bool {
+	key := serviceKey(service.Namespace, service.Name)
+	if action == resource.Deleted {
+		return s.ready[key]
+	}
+	ready := s.hasReadyEndpoints(service)
+	s.ready[key] = ready
+	return ready
+}
+
+// hasReadyEndpoints reports whether any EndpointSlice of service has a
+// ready endpoint. An endpoint without a ready condition counts as ready.
+func (s *ServiceSource) hasReadyEndpoints(service *corev1.Service) bool {
+	ready, err := hasReadyEndpoints(s.endpointLister, service.Namespace, service.Name)
+	if err != nil {
+		s.lg.Info("Error listing endpoint slices", zap.Error(err), zap.String("service", service.Name))
+	}
+	return ready
+}
+
+// hasReadyEndpoints reports whether any EndpointSlice of the Service name in
+// namespace has a ready endpoint.
+func hasReadyEndpoints(lister discoverylisters.EndpointSliceLister, namespace, name string) (bool, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: name})
+	slices, err := lister.EndpointSlices(namespace).List(selector)
+	if err != nil {
+		return false, err
+	}
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready == nil || *ep.Conditions.Ready {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// onEndpointsChange publishes or withdraws the owning service when its
+// readiness changes.
+func (s *ServiceSource) onEndpointsChange(obj interface{}) {
+	slice, ok := deletedObject(obj).(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := serviceKey(slice.Namespace, name)
+	item, exists, err := s.sharedInformer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	service := item.(*corev1.Service)
+
+	// Services not yet seen by onAdd are evaluated when they are.
+	wasReady, known := s.ready[key]
+	if !known || wasReady == s.hasReadyEndpoints(service) {
+		return
+	}
+
+	action := resource.Added
+	if wasReady {
+		action = resource.Deleted
+	}
+	advertiseResource, err := s.buildRecord(service, action)
+	if err != nil {
+		s.lg.Info("Error building service resource", zap.Error(err), zap.String("service", key))
+		return
+	}
+	if wasReady {
+		s.ready[key] = false
+		s.lg.Info("Service has no ready endpoints, withdrawing", zap.String("service", key))
+		RecordSkip(Skip{Kind: "Service", Namespace: service.Namespace, Name: service.Name,
+			Reason: SkipNoReadyEndpoints, Message: "no ready endpoints (--require-ready-endpoints)"})
+	} else {
+		s.lg.Info("Service has ready endpoints, publishing", zap.String("service", key))
+	}
+	if len(advertiseResource.IPs) > 0 {
+		s.notifyChan <- advertiseResource
+	}
+}
+
+// NewServicesWatcher creates an ServiceSource watching the services in
+// namespace, or in every namespace when it is empty. factory must be
+// limited to the same namespace.
+func NewServicesWatcher(lg *zap.Logger, factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource, opts ServiceOptions) (*ServiceSource, error) {
+	servicesInformer := factory.InformerFor(&corev1.Service{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return coreinformers.NewFilteredServiceInformer(client, namespace, resync,
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, withFieldSelector(opts.FieldSelector))
+	})
+	registerOwners("service", servicesInformer)
 	s := &ServiceSource{
 		lg:              lg,
 		namespace:       namespace,
-		publishInternal: publishInternal,
+		publishInternal: opts.PublishInternal,
 		notifyChan:      notifyChan,
 		sharedInformer:  servicesInformer,
+		requireReady:    opts.RequireReady,
+		filter:          opts.Filter,
+		nodeAddresses:   opts.NodeAddresses,
+		dnssd:           opts.DNSSD,
+		appProtocols:    opts.AppProtocolTypes,
+		ready:           make(map[string]bool),
+		external:        make(map[string]externalNameState),
+		hosted:          make(map[string][]int),
+		pending:         make(map[string]bool),
+		awaitingIP: workqueue.NewTypedRateLimitingQueue(
+			workqueue.NewTypedItemExponentialFailureRateLimiter[string](awaitIPBaseDelay, awaitIPMaxDelay),
+		),
+	}
+
+	if opts.ResolveExternalNames {
+		resolver, err := newExternalNameResolver()
+		if err != nil {
+			return nil, err
+		}
+		s.resolver = resolver
+	}
+
+	if opts.RequireReady {
+		endpoints := factory.Discovery().V1().EndpointSlices()
+		s.endpointInformer = endpoints.Informer()
+		s.endpointLister = endpoints.Lister()
+		track(lg, watchName("endpointslices", namespace), s.endpointInformer, cache.ResourceEventHandlerFuncs{
+			AddFunc:    s.onEndpointsChange,
+			UpdateFunc: func(_, newObj interface{}) { s.onEndpointsChange(newObj) },
+			DeleteFunc: s.onEndpointsChange,
+		})
+	}
+	if opts.NodeName != "" && len(opts.NodeAddresses) > 0 {
+		s.watchNodePods(factory, opts.NodeName)
 	}
-	servicesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	track(lg, watchName("services", namespace), servicesInformer, cache.ResourceEventHandlerFuncs{
 		AddFunc:    s.onAdd,
 		DeleteFunc: s.onDelete,
 		UpdateFunc: s.onUpdate,
 	})
 
-	return *s
+	return s, nil
 }
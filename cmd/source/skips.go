@@ -0,0 +1,139 @@
+package source
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reasons an object seen by a source is not published.
+const (
+	SkipFiltered         = "Filtered"
+	SkipNoAddress        = "NoLoadBalancerAddress"
+	SkipServiceType      = "UnpublishedServiceType"
+	SkipNoReadyEndpoints = "NoReadyEndpoints"
+	SkipUnresolved       = "ExternalNameUnresolved"
+	SkipNoLocalHost      = "NoLocalHost"
+	SkipEvicted          = "Evicted"
+	SkipUnregistered     = "UnregisteredAddress"
+	SkipTerminating      = "Terminating"
+)
+
+// Skip explains why an object is not published.
+type Skip struct {
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+	Since     time.Time `json:"since"`
+	// Quiet skips are expected, such as ClusterIP services while internal
+	// services are not published, and raise no Event.
+	Quiet bool `json:"quiet,omitempty"`
+}
+
+func (s Skip) key() string {
+	return s.Kind + "/" + s.Namespace + "/" + s.Name
+}
+
+var skips = struct {
+	mu      sync.Mutex
+	objects map[string]Skip
+}{objects: make(map[string]Skip)}
+
+// skipChanges carries new skips, or skips whose reason changed.
+var skipChanges = make(chan Skip, 256)
+
+// SkipChanges returns a channel that receives an object's skip when it is
+// first skipped or skipped for a different reason. Changes are dropped
+// while the channel is full.
+func SkipChanges() <-chan Skip {
+	return skipChanges
+}
+
+// RecordSkip records why an object is not published.
+func RecordSkip(s Skip) {
+	skips.mu.Lock()
+	old, ok := skips.objects[s.key()]
+	changed := !ok || old.Reason != s.Reason || old.Message != s.Message
+	if ok && old.Reason == s.Reason {
+		s.Since = old.Since
+	} else {
+		s.Since = time.Now()
+	}
+	skips.objects[s.key()] = s
+	skips.mu.Unlock()
+
+	if changed {
+		select {
+		case skipChanges <- s:
+		default:
+		}
+	}
+}
+
+// ClearSkip forgets the skip of an object that is published or deleted.
+func ClearSkip(kind, namespace, name string) {
+	skips.mu.Lock()
+	defer skips.mu.Unlock()
+	delete(skips.objects, Skip{Kind: kind, Namespace: namespace, Name: name}.key())
+}
+
+// Skips returns the objects currently not published, by kind, namespace
+// and name.
+func Skips() []Skip {
+	skips.mu.Lock()
+	list := make([]Skip, 0, len(skips.objects))
+	for _, s := range skips.objects {
+		list = append(list, s)
+	}
+	skips.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+	return list
+}
+
+// SkipFor returns the skip of an object, if it is not published.
+func SkipFor(kind, namespace, name string) (Skip, bool) {
+	skips.mu.Lock()
+	defer skips.mu.Unlock()
+	s, ok := skips.objects[Skip{Kind: kind, Namespace: namespace, Name: name}.key()]
+	return s, ok
+}
+
+// noteSkip records reason as the skip of obj when it is being added
+// without addresses to publish, and clears it when it has some.
+func noteSkip(kind string, obj metav1.Object, action string, ips []string, reason, message string) {
+	if action != resource.Added {
+		return
+	}
+	if len(ips) > 0 || reason == "" {
+		ClearSkip(kind, obj.GetNamespace(), obj.GetName())
+		return
+	}
+	RecordSkip(Skip{
+		Kind:      kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+		Reason:    reason,
+		Message:   message,
+		Quiet:     reason == SkipServiceType && !annotated(obj),
+	})
+}
+
+// annotated reports whether obj carries any of our annotations, a sign it
+// is meant to be published.
+func annotated(obj metav1.Object) bool {
+	for key := range obj.GetAnnotations() {
+		if strings.HasPrefix(key, annotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package source
+
+import (
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// lastAppliedAnnotation holds a full copy of the object written by
+// kubectl apply, which is never needed to build records.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// StripObject is an informer transform that drops managedFields and the
+// last-applied annotation before objects are stored, as they often make up
+// most of an object's size and are never used by the sources. Pods, whose
+// specs and statuses are large and many, only keep the fields the sources
+// read.
+func StripObject(obj interface{}) (interface{}, error) {
+	if _, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return obj, nil
+	}
+	if pod, ok := obj.(*corev1.Pod); ok {
+		obj = slimPod(pod)
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return obj, nil
+	}
+
+	accessor.SetManagedFields(nil)
+	if annotations := accessor.GetAnnotations(); annotations[lastAppliedAnnotation] != "" {
+		delete(annotations, lastAppliedAnnotation)
+		accessor.SetAnnotations(annotations)
+	}
+	return obj, nil
+}
+
+// slimPod returns pod with only its metadata, node, host network setting,
+// container ports, phase, conditions and addresses.
+func slimPod(pod *corev1.Pod) *corev1.Pod {
+	slim := &corev1.Pod{
+		TypeMeta:   pod.TypeMeta,
+		ObjectMeta: pod.ObjectMeta,
+		Spec: corev1.PodSpec{
+			NodeName:    pod.Spec.NodeName,
+			HostNetwork: pod.Spec.HostNetwork,
+		},
+		Status: corev1.PodStatus{
+			Phase:      pod.Status.Phase,
+			Conditions: pod.Status.Conditions,
+			HostIP:     pod.Status.HostIP,
+			HostIPs:    pod.Status.HostIPs,
+			PodIP:      pod.Status.PodIP,
+			PodIPs:     pod.Status.PodIPs,
+		},
+	}
+	for _, c := range pod.Spec.Containers {
+		slim.Spec.Containers = append(slim.Spec.Containers, corev1.Container{Name: c.Name, Ports: c.Ports})
+	}
+	return slim
+}
+
+// deletedObject returns the object of a delete event. Objects whose
+// deletion the informer only noticed when relisting, after missing the
+// watch event, come wrapped in a tombstone holding their last known state.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// objectRef returns the reference resources built from obj carry, for an
+// object of the given API version and kind.
+func objectRef(obj metav1.Object, apiVersion, kind string) resource.ObjectRef {
+	return resource.ObjectRef{
+		APIVersion:      apiVersion,
+		Kind:            kind,
+		UID:             string(obj.GetUID()),
+		ResourceVersion: obj.GetResourceVersion(),
+		Terminating:     obj.GetDeletionTimestamp() != nil,
+	}
+}
+
+// withFieldSelector returns a list option tweak restricting an informer to
+// objects matching selector.
+func withFieldSelector(selector string) func(*metav1.ListOptions) {
+	return func(options *metav1.ListOptions) {
+		options.FieldSelector = selector
+	}
+}
+
+// unchanged reports whether an update delivers the version of the object
+// that was already seen, as informers do for every object on each resync.
+func unchanged(oldObj, newObj interface{}) bool {
+	oldMeta, ok1 := oldObj.(metav1.Object)
+	newMeta, ok2 := newObj.(metav1.Object)
+	return ok1 && ok2 && oldMeta.GetResourceVersion() != "" &&
+		oldMeta.GetResourceVersion() == newMeta.GetResourceVersion()
+}
@@ -0,0 +1,124 @@
+package source
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// ZoneFilePrefix marks a --source value naming a BIND zone file, e.g.
+// zonefile:/etc/external-mdns/local.zone.
+const ZoneFilePrefix = "zonefile:"
+
+// ZoneFileSource publishes the A, AAAA, TXT, SRV and CNAME records of a
+// BIND zone file, one resource per owner name. Only names under .local are
+// published. Addresses go through the usual record construction, so they
+// get PTR records and take part in short name conflicts; the other types
+// are published as they are written.
+type ZoneFileSource struct {
+	lg         *zap.Logger
+	path       string
+	watch      bool
+	notifyChan chan<- resource.Resource
+	owners     map[string]resource.Resource
+}
+
+// NewZoneFileWatcher creates a ZoneFileSource for path. With watch set the
+// file is re-read whenever it changes.
+func NewZoneFileWatcher(lg *zap.Logger, path string, watch bool, notifyChan chan<- resource.Resource) *ZoneFileSource {
+	return &ZoneFileSource{
+		lg:         lg.With(zap.String("zonefile", path)),
+		path:       path,
+		watch:      watch,
+		notifyChan: notifyChan,
+		owners:     make(map[string]resource.Resource),
+	}
+}
+
+// Run publishes the zone and, when watching, follows its changes until
+// stopCh is closed.
+func (z *ZoneFileSource) Run(stopCh chan struct{}) error {
+	followFile(z.lg, z.path, z.watch, stopCh, z.reload)
+	return nil
+}
+
+// reload parses the zone and publishes what changed since the last read.
+// A zone that fails to parse is ignored, keeping the previous records.
+func (z *ZoneFileSource) reload() {
+	owners, err := z.read()
+	if err != nil {
+		z.lg.Warn("Unable to read zone file", zap.Error(err))
+		return
+	}
+
+	for name, r := range z.owners {
+		if next, ok := owners[name]; !ok || !slices.Equal(next.IPs, r.IPs) || !slices.Equal(next.Records, r.Records) {
+			delete(z.owners, name)
+			r.Action = resource.Deleted
+			z.notifyChan <- r
+		}
+	}
+	for name, r := range owners {
+		if _, ok := z.owners[name]; ok {
+			continue
+		}
+		z.owners[name] = r
+		z.notifyChan <- r
+	}
+}
+
+// read parses the zone file into a resource per owner name.
+func (z *ZoneFileSource) read() (map[string]resource.Resource, error) {
+	f, err := os.Open(z.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parser := dns.NewZoneParser(f, "", z.path)
+	parser.SetIncludeAllowed(true)
+
+	owners := make(map[string]resource.Resource)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+		name, local := strings.CutSuffix(owner, ".local.")
+		if !local {
+			z.lg.Debug("Skipping record outside .local", zap.String("record", rr.String()))
+			continue
+		}
+
+		r, seen := owners[name]
+		if !seen {
+			r = resource.Resource{
+				SourceType: "zonefile",
+				SourceName: name,
+				File:       z.path,
+				Created:    time.Now(),
+				Action:     resource.Added,
+				IPs:        []string{},
+			}
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			r.IPs = append(r.IPs, rr.A.String())
+			r.TTL = int(rr.Hdr.Ttl)
+		case *dns.AAAA:
+			r.IPs = append(r.IPs, rr.AAAA.String())
+			r.TTL = int(rr.Hdr.Ttl)
+		case *dns.TXT, *dns.SRV, *dns.CNAME:
+			r.Records = append(r.Records, rr.String())
+		default:
+			continue
+		}
+		if len(r.IPs) > 0 {
+			r.Names = []string{name}
+		}
+		owners[name] = r
+	}
+	return owners, parser.Err()
+}
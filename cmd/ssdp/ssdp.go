@@ -0,0 +1,359 @@
+// Package ssdp sends SSDP presence announcements (UPnP Device Architecture
+// 1.1, section 1.2) for devices hosted in the cluster and answers searches
+// for them (section 1.3), so clients that do not speak mDNS, such as many
+// smart TVs, can find them.
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// maxAge is how long receivers may cache an announcement.
+	maxAge = 1800
+	// interval is how often announcements are repeated, well within
+	// maxAge as the specification asks.
+	interval = 5 * time.Minute
+	// multicastTTL is the TTL the specification recommends for SSDP.
+	multicastTTL = 2
+	// maxMX caps the delay a search may ask for, as the specification
+	// recommends.
+	maxMX = 5
+	// maxPending bounds the searches waiting to be answered. Searches
+	// arriving beyond it are dropped rather than answered by ever more
+	// goroutines.
+	maxPending = 32
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// Device is a UPnP root device announced at Location, the URL of its
+// description document.
+type Device struct {
+	DeviceType string // e.g. urn:schemas-upnp-org:device:MediaServer:1
+	Location   string
+	UUID       string // defaults to one derived from the owner key
+}
+
+// Announcer announces devices until they are withdrawn and answers searches
+// for them.
+type Announcer struct {
+	mu      sync.Mutex
+	conn    *net.UDPConn
+	pconn   *ipv4.PacketConn
+	ifaces  []net.Interface
+	permits func(net.IP) bool
+	pending chan struct{}
+	devices map[string][]Device
+}
+
+// NewAnnouncer joins the SSDP group on the multicast interfaces of network
+// namespace netns, starts repeating announcements and answers searches from
+// the clients permits allows.
+func NewAnnouncer(netns string, permits func(net.IP) bool) (*Announcer, error) {
+	var conn *net.UDPConn
+	var ifaces []net.Interface
+	err := mdns.InNetNS(netns, func() (err error) {
+		if ifaces, err = multicastInterfaces(); err != nil {
+			return err
+		}
+		// The socket joins the group on the first interface, the others
+		// are joined below.
+		var first *net.Interface
+		if len(ifaces) > 0 {
+			first = &ifaces[0]
+		}
+		conn, err = net.ListenMulticastUDP("udp4", first, group)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", group, err)
+	}
+	pconn := ipv4.NewPacketConn(conn)
+	for i := 1; i < len(ifaces); i++ {
+		if err := pconn.JoinGroup(&ifaces[i], group); err != nil {
+			log.Printf("Failed to join SSDP group on %s: %s", ifaces[i].Name, err)
+		}
+	}
+	if err := pconn.SetMulticastTTL(multicastTTL); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set multicast TTL: %w", err)
+	}
+	// The destination tells multicast searches, which must give MX, from
+	// unicast ones.
+	if err := pconn.SetControlMessage(ipv4.FlagDst, true); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable control messages: %w", err)
+	}
+	a := &Announcer{
+		conn:    conn,
+		pconn:   pconn,
+		ifaces:  ifaces,
+		permits: permits,
+		pending: make(chan struct{}, maxPending),
+		devices: make(map[string][]Device),
+	}
+	go a.repeat()
+	go a.serve()
+	return a, nil
+}
+
+// multicastInterfaces returns the interfaces of the current network
+// namespace that are up, multicast capable and have an IPv4 address.
+func multicastInterfaces() ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil {
+				ifaces = append(ifaces, ifi)
+				break
+			}
+		}
+	}
+	return ifaces, nil
+}
+
+// Publish announces devices for owner, replacing any published before.
+func (a *Announcer) Publish(owner string, devices []Device) {
+	for i := range devices {
+		if devices[i].UUID == "" {
+			devices[i].UUID = ownerUUID(owner, devices[i].Location)
+		}
+	}
+
+	a.mu.Lock()
+	old := a.devices[owner]
+	a.devices[owner] = devices
+	a.mu.Unlock()
+
+	for _, d := range old {
+		a.send(d, "ssdp:byebye")
+	}
+	for _, d := range devices {
+		a.send(d, "ssdp:alive")
+	}
+}
+
+// Withdraw announces that the devices of owner are gone.
+func (a *Announcer) Withdraw(owner string) {
+	a.mu.Lock()
+	old := a.devices[owner]
+	delete(a.devices, owner)
+	a.mu.Unlock()
+
+	for _, d := range old {
+		a.send(d, "ssdp:byebye")
+	}
+}
+
+func (a *Announcer) repeat() {
+	for range time.Tick(interval) {
+		a.mu.Lock()
+		var devices []Device
+		for _, d := range a.devices {
+			devices = append(devices, d...)
+		}
+		a.mu.Unlock()
+
+		for _, d := range devices {
+			a.send(d, "ssdp:alive")
+		}
+	}
+}
+
+// targets returns the notification types of a root device with their
+// unique service names: for the root device, its UUID and its device type.
+func targets(d Device) [][2]string {
+	udn := "uuid:" + d.UUID
+	return [][2]string{
+		{"upnp:rootdevice", udn + "::upnp:rootdevice"},
+		{udn, udn},
+		{d.DeviceType, udn + "::" + d.DeviceType},
+	}
+}
+
+// send multicasts the three notifications of a root device on every
+// interface, see targets.
+func (a *Announcer) send(d Device, nts string) {
+	for _, t := range targets(d) {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"NT: " + t[0] + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + t[1] + "\r\n"
+		if nts == "ssdp:alive" {
+			msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", maxAge) +
+				"LOCATION: " + d.Location + "\r\n" +
+				"SERVER: Linux UPnP/1.1 external-mdns\r\n"
+		}
+		msg += "\r\n"
+		if err := a.multicast([]byte(msg)); err != nil {
+			log.Printf("Failed to send SSDP notification: %s", err)
+			return
+		}
+	}
+}
+
+// multicast sends msg to the group out of every interface, or out of the
+// default one if none was found.
+func (a *Announcer) multicast(msg []byte) error {
+	if len(a.ifaces) == 0 {
+		_, err := a.conn.WriteToUDP(msg, group)
+		return err
+	}
+	for _, ifi := range a.ifaces {
+		cm := &ipv4.ControlMessage{IfIndex: ifi.Index}
+		if _, err := a.pconn.WriteTo(msg, cm, group); err != nil {
+			return fmt.Errorf("on %s: %w", ifi.Name, err)
+		}
+	}
+	return nil
+}
+
+// search is an M-SEARCH request.
+type search struct {
+	target string        // ST
+	delay  time.Duration // MX, zero for unicast searches
+}
+
+// parseSearch parses an M-SEARCH request. Other messages, notably the
+// NOTIFY of other devices, are rejected.
+func parseSearch(b []byte, multicast bool) (*search, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+		return nil, fmt.Errorf("not a search")
+	}
+	s := &search{target: req.Header.Get("ST")}
+	if s.target == "" {
+		return nil, fmt.Errorf("no search target")
+	}
+	if !multicast {
+		return s, nil
+	}
+	// Multicast searches must give MX, the seconds replies are spread
+	// over.
+	mx, err := strconv.Atoi(req.Header.Get("MX"))
+	if err != nil || mx < 1 {
+		return nil, fmt.Errorf("invalid MX %q", req.Header.Get("MX"))
+	}
+	s.delay = time.Duration(min(mx, maxMX)) * time.Second
+	return s, nil
+}
+
+// serve answers searches until the socket is closed.
+func (a *Announcer) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, cm, from, err := a.pconn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || !a.permits(addr.IP) {
+			continue
+		}
+		multicast := cm == nil || cm.Dst == nil || cm.Dst.IsMulticast()
+		s, err := parseSearch(buf[:n], multicast)
+		if err != nil {
+			continue
+		}
+		select {
+		case a.pending <- struct{}{}:
+		default:
+			continue
+		}
+		go func() {
+			defer func() { <-a.pending }()
+			a.answer(s, addr)
+		}()
+	}
+}
+
+// answer replies to a single search after a random delay within its MX.
+func (a *Announcer) answer(s *search, from *net.UDPAddr) {
+	type match struct {
+		d      Device
+		target [2]string
+	}
+	var matches []match
+	a.mu.Lock()
+	for _, devices := range a.devices {
+		for _, d := range devices {
+			for _, t := range targets(d) {
+				if s.target == "ssdp:all" || strings.EqualFold(s.target, t[0]) {
+					matches = append(matches, match{d, t})
+				}
+			}
+		}
+	}
+	a.mu.Unlock()
+	if len(matches) == 0 {
+		return
+	}
+
+	if s.delay > 0 {
+		time.Sleep(time.Duration(mrand.Int63n(int64(s.delay))))
+	}
+	for _, m := range matches {
+		msg := "HTTP/1.1 200 OK\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", maxAge) +
+			"EXT:\r\n" +
+			"LOCATION: " + m.d.Location + "\r\n" +
+			"SERVER: Linux UPnP/1.1 external-mdns\r\n" +
+			"ST: " + m.target[0] + "\r\n" +
+			"USN: " + m.target[1] + "\r\n" +
+			"\r\n"
+		if _, err := a.conn.WriteToUDP([]byte(msg), from); err != nil {
+			log.Printf("Failed to answer SSDP search: %s", err)
+			return
+		}
+	}
+}
+
+// ownerUUID derives a stable UUID for a device from its owner and location
+// (RFC 4122 section 4.3, name-based with SHA-1).
+func ownerUUID(owner, location string) string {
+	return nameUUID(owner + " " + location)
+}
+
+// AddressUUID derives the UUID of the device at one address from the UUID
+// given for all of them, so each is announced as a device of its own.
+func AddressUUID(uuid, ip string) string {
+	return nameUUID(uuid + " " + ip)
+}
+
+// nameUUID returns the name-based UUID of name.
+func nameUUID(name string) string {
+	sum := sha1.Sum([]byte(name))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
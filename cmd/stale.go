@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+)
+
+// What to do while the API server has been unreachable for longer than
+// --stale-zone-after.
+const (
+	stalePolicyKeep     = "keep"      // answer from the last known zone
+	stalePolicyLowerTTL = "lower-ttl" // answer with TTLs capped at --stale-ttl
+	stalePolicyWithdraw = "withdraw"  // stop answering until reconnected
+)
+
+// validateStalePolicy checks --stale-policy.
+func validateStalePolicy() error {
+	switch p := conf.StalePolicy; p {
+	case stalePolicyKeep, stalePolicyWithdraw:
+	case stalePolicyLowerTTL:
+		if conf.StaleTTL <= 0 {
+			return fmt.Errorf("--%s must be positive", config.StaleTTL)
+		}
+	default:
+		return fmt.Errorf("unknown stale policy %q (keep, lower-ttl, withdraw)", p)
+	}
+	return nil
+}
+
+// applyStalePolicy reacts to the zone becoming stale, or up to date again,
+// according to --stale-policy. It runs on the main loop.
+func applyStalePolicy(live map[string]resource.Resource, stale bool) {
+	switch conf.StalePolicy {
+	case stalePolicyLowerTTL:
+		next := ttls
+		next.limit = 0
+		if stale {
+			next.limit = conf.StaleTTL
+			lg.Warn("Zone is stale, lowering record TTLs", zap.Int("ttl", next.limit))
+		} else {
+			lg.Info("Zone is up to date, restoring record TTLs")
+		}
+		republishWithTTLs(live, next)
+	case stalePolicyWithdraw:
+		if stale {
+			lg.Warn("Zone is stale, no longer answering queries")
+			mdns.Hold()
+			return
+		}
+		// Before the sources first synced, warmCaches starts answering.
+		// A drained zone stays silent.
+		if ready, _ := source.Ready(); ready && !drain.done {
+			lg.Info("Zone is up to date, answering queries again")
+			mdns.Release()
+			go mdns.AnnounceZone()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+)
+
+// Naming schemes for the records of a resource, chosen with
+// --record-strategy and the record-strategy annotation.
+const (
+	strategyDefault       = "default"        // <name>.<namespace>.local, <name>-<namespace>.local and short names
+	strategyWindowsCompat = "windows-compat" // <name>-<namespace>.local and short names, no subdomains
+	strategyDNSSDFull     = "dns-sd-full"    // as default, with DNS-SD instances for every name
+	strategyFlatNames     = "flat-names"     // <name>.local only
+)
+
+// recordStrategy decides the names a resource is published under. The
+// records for each name, and the PTRs pointing back at it, are built the
+// same way whatever the strategy, see constructRecords.
+type recordStrategy interface {
+	// qualifiedNames returns the fully qualified names name is published
+	// under within the namespace of r.
+	qualifiedNames(r resource.Resource, name string) []string
+	// shortNames reports whether the names of r are also published as
+	// <name>.local, for the resource winning any conflict over them.
+	shortNames(r resource.Resource) bool
+	// serviceTargets returns the names the DNS-SD instances of r point at,
+	// each getting one instance of every service.
+	serviceTargets(r resource.Resource) []string
+}
+
+var recordStrategies = map[string]recordStrategy{
+	strategyDefault:       defaultStrategy{},
+	strategyWindowsCompat: windowsCompatStrategy{},
+	strategyDNSSDFull:     dnssdFullStrategy{},
+	strategyFlatNames:     flatNamesStrategy{},
+}
+
+// validateRecordStrategy checks --record-strategy.
+func validateRecordStrategy() error {
+	if s := conf.RecordStrategy; recordStrategies[s] == nil {
+		return fmt.Errorf("unknown record strategy %q (%s)", s, strings.Join(recordStrategyNames(), ", "))
+	}
+	return nil
+}
+
+func recordStrategyNames() []string {
+	names := make([]string, 0, len(recordStrategies))
+	for name := range recordStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// strategyFor returns the strategy of r: its record-strategy annotation
+// when it names a known strategy, --record-strategy otherwise.
+func strategyFor(r resource.Resource) recordStrategy {
+	if s, ok := recordStrategies[r.RecordStrategy]; ok {
+		return s
+	}
+	if s, ok := recordStrategies[conf.RecordStrategy]; ok {
+		return s
+	}
+	return defaultStrategy{}
+}
+
+// defaultStrategy publishes <name>.<namespace>.local and, for clients such
+// as Windows that send subdomain queries to unicast DNS instead, also
+// <name>-<namespace>.local unless disabled globally or per resource. The
+// without-namespace annotation only adds short names, for backwards
+// compatibility.
+type defaultStrategy struct{}
+
+func (defaultStrategy) qualifiedNames(r resource.Resource, name string) []string {
+	// Resources without a namespace, such as hosts file entries, only
+	// have short names.
+	if r.Namespace == "" {
+		return nil
+	}
+	hyphenated := conf.HyphenatedNames
+	if r.HyphenatedNames != nil {
+		hyphenated = *r.HyphenatedNames
+	}
+	names := []string{name + "." + r.Namespace + ".local."}
+	if hyphenated {
+		names = append(names, name+"-"+r.Namespace+".local.")
+	}
+	return names
+}
+
+// shortNames reports whether r should be published without the namespace
+// if any of the following criteria is satisfied:
+// 1. The Service exists in one of the default namespaces
+// 2. Service names exposed with annotation and with additional without-namespace annotation set to true
+// 3. The -without-namespace flag is equal to true
+// 4. The record to be published is from an Ingress, or a custom resource, with a defined hostname
+func (defaultStrategy) shortNames(r resource.Resource) bool {
+	return r.Namespace == "" || isDefaultNamespace(r.Namespace) || r.WithoutNamespace || conf.WithoutNamespace || r.SourceType == "ingress" || r.SourceType == "crd" || source.GatewayRouteKinds[r.SourceType] != ""
+}
+
+func (defaultStrategy) serviceTargets(r resource.Resource) []string {
+	if len(r.Names) == 0 {
+		return nil
+	}
+	if r.Namespace == "" {
+		return []string{r.Names[0] + ".local."}
+	}
+	return []string{r.Names[0] + "." + r.Namespace + ".local."}
+}
+
+// windowsCompatStrategy only publishes names Windows resolves over mDNS,
+// without subdomains: <name>-<namespace>.local whatever --hyphenated-names
+// says, and short names as the default strategy does.
+type windowsCompatStrategy struct{ defaultStrategy }
+
+func (windowsCompatStrategy) qualifiedNames(r resource.Resource, name string) []string {
+	if r.Namespace == "" {
+		return nil
+	}
+	return []string{name + "-" + r.Namespace + ".local."}
+}
+
+func (windowsCompatStrategy) serviceTargets(r resource.Resource) []string {
+	if len(r.Names) == 0 {
+		return nil
+	}
+	if r.Namespace == "" {
+		return []string{r.Names[0] + ".local."}
+	}
+	return []string{r.Names[0] + "-" + r.Namespace + ".local."}
+}
+
+// dnssdFullStrategy names like the default strategy, but advertises the
+// DNS-SD services of a resource under each of its names instead of only
+// the first.
+type dnssdFullStrategy struct{ defaultStrategy }
+
+func (dnssdFullStrategy) serviceTargets(r resource.Resource) []string {
+	targets := make([]string, 0, len(r.Names))
+	for _, name := range r.Names {
+		if r.Namespace == "" {
+			targets = append(targets, name+".local.")
+		} else {
+			targets = append(targets, name+"."+r.Namespace+".local.")
+		}
+	}
+	return targets
+}
+
+// flatNamesStrategy publishes every resource as <name>.local alone, as if
+// all namespaces were one. Conflicts between namespaces are settled by
+// --short-name-conflict.
+type flatNamesStrategy struct{}
+
+func (flatNamesStrategy) qualifiedNames(resource.Resource, string) []string { return nil }
+
+func (flatNamesStrategy) shortNames(resource.Resource) bool { return true }
+
+func (flatNamesStrategy) serviceTargets(r resource.Resource) []string {
+	if len(r.Names) == 0 {
+		return nil
+	}
+	return []string{r.Names[0] + ".local."}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/spf13/viper"
+)
+
+// setFlags sets configuration values for the duration of the test.
+func setFlags(t *testing.T, values map[string]any) {
+	t.Helper()
+	// Cleanups run last first, so conf is reloaded once the values are
+	// restored.
+	t.Cleanup(func() {
+		if err := loadSettings(); err != nil {
+			t.Error(err)
+		}
+	})
+	for key, value := range values {
+		previous, wasSet := viper.Get(key), viper.IsSet(key)
+		viper.Set(key, value)
+		t.Cleanup(func() {
+			if wasSet {
+				viper.Set(key, previous)
+			} else {
+				viper.Set(key, nil)
+			}
+		})
+	}
+	if err := loadSettings(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordStrategies(t *testing.T) {
+	setFlags(t, map[string]any{
+		config.HyphenatedNames:  true,
+		config.DefaultNamespace: []string{"default"},
+	})
+	web := resource.Resource{SourceType: "service", Namespace: "media", Names: []string{"web", "www"}}
+	noHyphens := web
+	noHyphens.HyphenatedNames = new(bool)
+	inDefault := web
+	inDefault.Namespace = "default"
+	hosts := resource.Resource{SourceType: "hostsfile", Names: []string{"nas"}}
+
+	tests := []struct {
+		strategy  recordStrategy
+		r         resource.Resource
+		qualified []string // of the first name
+		short     bool
+		targets   []string
+	}{
+		{defaultStrategy{}, web, []string{"web.media.local.", "web-media.local."}, false, []string{"web.media.local."}},
+		{defaultStrategy{}, noHyphens, []string{"web.media.local."}, false, []string{"web.media.local."}},
+		{defaultStrategy{}, inDefault, []string{"web.default.local.", "web-default.local."}, true, []string{"web.default.local."}},
+		{defaultStrategy{}, hosts, nil, true, []string{"nas.local."}},
+		{windowsCompatStrategy{}, noHyphens, []string{"web-media.local."}, false, []string{"web-media.local."}},
+		{windowsCompatStrategy{}, hosts, nil, true, []string{"nas.local."}},
+		{dnssdFullStrategy{}, web, []string{"web.media.local.", "web-media.local."}, false, []string{"web.media.local.", "www.media.local."}},
+		{dnssdFullStrategy{}, hosts, nil, true, []string{"nas.local."}},
+		{flatNamesStrategy{}, web, nil, true, []string{"web.local."}},
+	}
+	for _, tt := range tests {
+		if got := tt.strategy.qualifiedNames(tt.r, tt.r.Names[0]); !slices.Equal(got, tt.qualified) {
+			t.Errorf("%T: qualifiedNames(%s/%s) = %v, want %v", tt.strategy, tt.r.Namespace, tt.r.Names[0], got, tt.qualified)
+		}
+		if got := tt.strategy.shortNames(tt.r); got != tt.short {
+			t.Errorf("%T: shortNames(%s/%s) = %v, want %v", tt.strategy, tt.r.Namespace, tt.r.Names[0], got, tt.short)
+		}
+		if got := tt.strategy.serviceTargets(tt.r); !slices.Equal(got, tt.targets) {
+			t.Errorf("%T: serviceTargets(%s/%s) = %v, want %v", tt.strategy, tt.r.Namespace, tt.r.Names[0], got, tt.targets)
+		}
+	}
+}
+
+func TestStrategyFor(t *testing.T) {
+	setFlags(t, map[string]any{config.RecordStrategy: strategyWindowsCompat})
+
+	tests := []struct {
+		annotation string
+		want       recordStrategy
+	}{
+		{"", windowsCompatStrategy{}},
+		{strategyFlatNames, flatNamesStrategy{}},
+		{strategyDefault, defaultStrategy{}},
+		{"no-such-strategy", windowsCompatStrategy{}},
+	}
+	for _, tt := range tests {
+		if got := strategyFor(resource.Resource{RecordStrategy: tt.annotation}); got != tt.want {
+			t.Errorf("strategyFor(%q) = %T, want %T", tt.annotation, got, tt.want)
+		}
+	}
+}
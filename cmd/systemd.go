@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation (sd_listen_fds(3)).
+const sdListenFDsStart = 3
+
+// activatedSockets returns the UDP sockets passed by systemd socket
+// activation, if any. The environment is cleared so the sockets are not
+// passed on to child processes.
+func activatedSockets() ([]*net.UDPConn, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var sockets []*net.UDPConn
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		pc, err := net.FilePacketConn(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation: descriptor %d: %w", fd, err)
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, fmt.Errorf("socket activation: descriptor %d is not a UDP socket", fd)
+		}
+		sockets = append(sockets, conn)
+	}
+	return sockets, nil
+}
+
+// sdNotify sends state to the systemd service manager (sd_notify(3)). It
+// does nothing when not run by systemd.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		lg.Warn("Failed to notify systemd", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		lg.Warn("Failed to notify systemd", zap.Error(err))
+	}
+}
+
+// sdReady tells systemd the service is ready and, when a watchdog is
+// configured with WatchdogSec=, keeps it fed.
+func sdReady() {
+	sdNotify("READY=1")
+
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// tracer starts the spans of publications, which continue the traces of
+// the Kubernetes events they were built from.
+var tracer = otel.Tracer("github.com/grumpylabs/external-mdns/cmd")
+
+// publishing holds the resources notified since records were last applied
+// to the zone, whose publication flushRecords observes.
+var publishing []resource.Resource
+
+// configureTracing installs a tracer provider exporting spans over
+// OTLP/HTTP to --tracing-endpoint, if set. The OTEL_TRACES_SAMPLER
+// environment variables choose which events are traced. It returns a
+// function flushing the spans not yet exported.
+func configureTracing() (func(), error) {
+	endpoint := conf.TracingEndpoint
+	if endpoint == "" {
+		return func() {}, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("--%s: %w", config.TracingEndpoint, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(sdkresource.NewSchemaless(attribute.String("service.name", "external-mdns"))),
+	)
+	otel.SetTracerProvider(provider)
+	lg.Info("Tracing Kubernetes events to their publication", zap.String("endpoint", endpoint))
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		provider.Shutdown(ctx)
+	}, nil
+}
+
+// observePublished records the publish latency of the resources notified
+// since the last flush, and ends their traces with a span covering it. It
+// runs on the main loop once their records are applied.
+func observePublished() {
+	now := time.Now()
+	for _, r := range publishing {
+		if r.Object.UID == "" {
+			continue
+		}
+		received, event, ok := source.TakeOrigin(r.Object.UID)
+		if !ok {
+			continue
+		}
+		latency := metrics.PublishLatency.WithLabelValues(r.SourceType)
+		if event.IsSampled() {
+			_, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), event), "publish",
+				trace.WithTimestamp(received),
+				trace.WithAttributes(
+					attribute.String("resource", liveKey(r)),
+					attribute.String("action", r.Action),
+					attribute.StringSlice("names", r.Names),
+				))
+			span.End(trace.WithTimestamp(now))
+			latency.(prometheus.ExemplarObserver).ObserveWithExemplar(now.Sub(received).Seconds(),
+				prometheus.Labels{"trace_id": event.TraceID().String()})
+			continue
+		}
+		latency.Observe(now.Sub(received).Seconds())
+	}
+	publishing = publishing[:0]
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/grumpylabs/external-mdns/cmd/config"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+)
+
+// ttlSettings are the TTL flags records are built with.
+type ttlSettings struct {
+	base   int
+	jitter int
+	// limit caps every TTL when positive, see applyStalePolicy.
+	limit int
+	// drain caps every TTL when positive, see startDrain.
+	drain int
+}
+
+// ttls holds the TTL settings in effect. It is only changed by the main
+// loop, see applyConfigChange, so records are always withdrawn with the TTL
+// they were published with.
+var ttls ttlSettings
+
+// configuredTTLs returns the TTL settings of the current configuration.
+func configuredTTLs() ttlSettings {
+	return ttlSettings{base: conf.RecordTTL, jitter: conf.TTLJitter}
+}
+
+// validateTTLJitter checks the --ttl-jitter percentage.
+func validateTTLJitter() error {
+	if jitter := conf.TTLJitter; jitter < 0 || jitter > 50 {
+		return fmt.Errorf("--%s must be between 0 and 50", config.TTLJitter)
+	}
+	return nil
+}
+
+// recordTTL returns the TTL for records of r owned by name: the TTL
+// annotation of r, or --record-ttl. With --ttl-jitter the latter is spread
+// up to that percentage either side, so client caches do not all expire at
+// once. Canaries are capped at --canary-ttl, and every record while the
+// zone is drained, restored ones too, see restoredRecord. The TTL is
+// derived from the name, so every record of an RRset shares it.
+func recordTTL(r resource.Resource, name string) int {
+	ttl := canaries.capTTL(r, baseRecordTTL(r, name))
+	if ttls.limit > 0 {
+		ttl = min(ttl, ttls.limit)
+	}
+	if ttls.drain > 0 {
+		ttl = min(ttl, ttls.drain)
+	}
+	return ttl
+}
+
+func baseRecordTTL(r resource.Resource, name string) int {
+	if r.TTL > 0 {
+		return r.TTL
+	}
+
+	ttl := ttls.base
+	spread := ttl * ttls.jitter / 100
+	if spread <= 0 {
+		return ttl
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return max(1, ttl-spread+int(h.Sum32()%uint32(2*spread+1)))
+}
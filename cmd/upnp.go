@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"net"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/ssdp"
+)
+
+// ssdpAnnouncer sends SSDP announcements for annotated services. It is nil
+// unless --ssdp is set.
+var ssdpAnnouncer *ssdp.Announcer
+
+// startSSDP starts SSDP announcements in the network namespace of the mDNS
+// responder, answering searches from the clients it answers.
+func startSSDP() (*ssdp.Announcer, error) {
+	cfg, err := newResponderConfig()
+	if err != nil {
+		return nil, err
+	}
+	return ssdp.NewAnnouncer(cfg.NetNS, mdns.SourceFilter(cfg))
+}
+
+// announceSSDP announces or withdraws the UPnP device of r, if it has one.
+func announceSSDP(r resource.Resource) {
+	if ssdpAnnouncer == nil || r.SSDP == nil {
+		return
+	}
+	if r.Action == resource.Deleted {
+		ssdpAnnouncer.Withdraw(ownerKey(r))
+		return
+	}
+
+	perAddress := strings.Contains(r.SSDP.Location, "{ip}")
+	var devices []ssdp.Device
+	for _, ip := range selectIPs(r) {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		d := ssdp.Device{
+			DeviceType: r.SSDP.DeviceType,
+			Location:   strings.ReplaceAll(r.SSDP.Location, "{ip}", ip),
+			UUID:       r.SSDP.UUID,
+		}
+		// A UUID identifies a single device, so each address announced
+		// gets one of its own.
+		if perAddress && d.UUID != "" {
+			d.UUID = ssdp.AddressUUID(d.UUID, ip)
+		}
+		devices = append(devices, d)
+		if !perAddress {
+			break
+		}
+	}
+	ssdpAnnouncer.Publish(ownerKey(r), devices)
+}
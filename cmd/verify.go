@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/metrics"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// verifyTimeout is how long each verification query waits for its answer.
+const verifyTimeout = 2 * time.Second
+
+// verified holds when each name was last resolved by a verification query.
+var verified = struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// lastVerified returns when name was last resolved by a verification query,
+// or the zero time.
+func lastVerified(name string) time.Time {
+	verified.mu.Lock()
+	defer verified.mu.Unlock()
+	return verified.last[strings.ToLower(dns.Fqdn(name))]
+}
+
+// verifyRecords queries a random sample of the published address records
+// over multicast every interval, catching a responder that believes it is
+// publishing while its packets never make it onto the wire, such as on the
+// wrong interface or behind a firewall. The queries come from an ephemeral
+// port, so they are answered directly, as Probe describes. Only answers
+// from other hosts count, as this host answers its own queries through
+// multicast loopback whether or not they reach the wire. Nothing is
+// verified while the zone is held.
+func verifyRecords(group *net.UDPAddr, interval time.Duration, sample int) {
+	for range time.Tick(interval) {
+		if mdns.Held() {
+			continue
+		}
+		names := sampleNames(mdns.Records(), sample)
+		if len(names) == 0 {
+			continue
+		}
+
+		resolved := 0
+		var failed []string
+		for name, qtype := range names {
+			if verifyName(group, name, qtype) {
+				resolved++
+				continue
+			}
+			failed = append(failed, name)
+		}
+		metrics.SelfResolvable.Set(float64(resolved) / float64(len(names)))
+		metrics.VerificationFailures.Add(float64(len(failed)))
+		if len(failed) > 0 {
+			lg.Warn("Published names did not resolve over multicast",
+				zap.Strings("names", failed), zap.Int("sampled", len(names)), zap.Stringer("group", group))
+		}
+	}
+}
+
+// verifyName queries name for records of qtype and reports whether they
+// were answered, recording when.
+func verifyName(group *net.UDPAddr, name string, qtype uint16) bool {
+	answers, _, err := mdns.LookupRemote(group, name, qtype, verifyTimeout)
+	if err != nil {
+		lg.Debug("Verification query failed", zap.String("name", name), zap.Error(err))
+		return false
+	}
+	for _, rr := range answers {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			verified.mu.Lock()
+			verified.last[strings.ToLower(name)] = time.Now()
+			verified.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// sampleNames picks up to n distinct names with address records from
+// records, with the type to query each for.
+func sampleNames(records []string, n int) map[string]uint16 {
+	candidates := make(map[string]uint16)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil || rr == nil {
+			continue
+		}
+		if rrtype := rr.Header().Rrtype; rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+			if _, ok := candidates[rr.Header().Name]; !ok || rrtype == dns.TypeA {
+				candidates[rr.Header().Name] = rrtype
+			}
+		}
+	}
+
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if len(names) > n {
+		names = names[:n]
+	}
+
+	// Forget names no longer published.
+	published := make(map[string]bool, len(candidates))
+	for name := range candidates {
+		published[strings.ToLower(name)] = true
+	}
+	verified.mu.Lock()
+	for name := range verified.last {
+		if !published[name] {
+			delete(verified.last, name)
+		}
+	}
+	verified.mu.Unlock()
+
+	sample := make(map[string]uint16, len(names))
+	for _, name := range names {
+		sample[name] = candidates[name]
+	}
+	return sample
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/source"
+	"go.uber.org/zap"
+)
+
+// warmupSettle is how long to wait after the sources have synced for the
+// main loop to publish the objects they listed.
+const warmupSettle = time.Second
+
+// warmupReportInterval is how often the sources that have not synced yet
+// are logged while warming up.
+const warmupReportInterval = 30 * time.Second
+
+// warmCaches starts answering queries and announces the whole zone once
+// every source has synced, so the LAN converges quickly after a restart
+// and is never answered from a partial zone. Goodbyes are sent first for
+// the records of the previous zone no longer published. The records of a
+// snapshot restored at startup are withdrawn first, except those the
+// sources publish again.
+func warmCaches(stopCh chan struct{}, previous []string, restoredAtStartup bool) {
+	synced := make(chan struct{})
+	go reportWarmup(synced)
+	ok := source.WaitForSync(stopCh)
+	close(synced)
+	if !ok {
+		return
+	}
+	select {
+	case <-time.After(warmupSettle):
+	case <-stopCh:
+		return
+	}
+	if planDue != nil {
+		close(planDue)
+		return
+	}
+	if restoredAtStartup {
+		select {
+		case restoreRequests <- restoreRequest{result: make(chan restoreResult, 1)}:
+		case <-stopCh:
+			return
+		}
+	}
+	lg.Info("Sources synced, answering queries and announcing the zone", zap.Int("records", len(mdns.Records())))
+	mdns.Release()
+	sayGoodbye(previous)
+	close(goodbyesSent)
+	mdns.AnnounceZone()
+}
+
+// reportWarmup logs the sources that have not synced, and why as far as
+// their watches tell, until synced is closed, so a source that never syncs,
+// such as one denied by RBAC or watching a CRD that is not installed, does
+// not leave the responder silent without a word.
+func reportWarmup(synced <-chan struct{}) {
+	ticker := time.NewTicker(warmupReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lg.Warn("Sources have not synced, not answering queries yet", zap.Strings("waiting", source.Unsynced()))
+		case <-synced:
+			return
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Package wsd answers WS-Discovery (version 2005/04, as used by Windows
+// network discovery) for devices hosted in the cluster: it multicasts Hello
+// and Bye messages and replies to Probe and Resolve requests on UDP port
+// 3702.
+package wsd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+)
+
+const (
+	nsSOAP       = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsDiscovery  = "http://schemas.xmlsoap.org/ws/2005/04/discovery"
+
+	toDiscovery = "urn:schemas-xmlsoap-org:ws:2005:04:discovery"
+	toAnonymous = "http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous"
+
+	// maxDelay bounds the random delay before answering a multicast probe
+	// (APP_MAX_DELAY), so replies from many devices do not collide.
+	maxDelay = 500 * time.Millisecond
+	// maxPending bounds the requests waiting to be answered. Requests
+	// arriving beyond it are dropped rather than answered by ever more
+	// goroutines.
+	maxPending = 32
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 3702}
+
+// Prefixes are the namespace prefixes that may be used in device types
+// without spelling out the namespace. Other types are given as
+// {namespace}LocalName.
+var Prefixes = map[string]string{
+	"wsdp": "http://schemas.xmlsoap.org/ws/2006/02/devprof",
+	"pub":  "http://schemas.microsoft.com/windows/pub/2005/07",
+	"wprt": "http://schemas.microsoft.com/windows/2006/08/wdp/print",
+	"wscn": "http://schemas.microsoft.com/windows/2006/08/wdp/scan",
+}
+
+// Device is a WS-Discovery target service.
+type Device struct {
+	Types  []string // e.g. wsdp:Device, wscn:ScanDeviceType
+	XAddrs string   // transport addresses, e.g. http://192.0.2.10:5357/
+	UUID   string   // defaults to one derived from the owner key
+}
+
+// qname is a device type resolved to its namespace.
+type qname struct{ space, local string }
+
+// Responder announces devices and answers probes for them.
+type Responder struct {
+	mu         sync.Mutex
+	conn       *net.UDPConn
+	permits    func(net.IP) bool
+	pending    chan struct{}
+	devices    map[string][]Device
+	instanceID int64
+	messageNo  int
+}
+
+// NewResponder listens on the WS-Discovery port and group in the network
+// namespace netns, as the mDNS sockets do, and answers the clients permits
+// accepts.
+func NewResponder(netns string, permits func(net.IP) bool) (*Responder, error) {
+	var conn *net.UDPConn
+	err := mdns.InNetNS(netns, func() (err error) {
+		conn, err = net.ListenMulticastUDP("udp4", nil, group)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", group, err)
+	}
+	r := &Responder{
+		conn:       conn,
+		permits:    permits,
+		pending:    make(chan struct{}, maxPending),
+		devices:    make(map[string][]Device),
+		instanceID: time.Now().Unix(),
+	}
+	go r.serve()
+	return r, nil
+}
+
+// Publish announces devices for owner, replacing any published before.
+// Types whose namespace is unknown are left out, see Prefixes.
+func (r *Responder) Publish(owner string, devices []Device) {
+	for i := range devices {
+		if devices[i].UUID == "" {
+			devices[i].UUID = ownerUUID(owner, devices[i].XAddrs)
+		}
+		devices[i].Types = knownTypes(owner, devices[i].Types)
+		if len(devices[i].Types) == 0 {
+			devices[i].Types = []string{"wsdp:Device"}
+		}
+	}
+
+	r.mu.Lock()
+	old := r.devices[owner]
+	r.devices[owner] = devices
+	r.mu.Unlock()
+
+	for _, d := range old {
+		r.multicast("Bye", d)
+	}
+	for _, d := range devices {
+		r.multicast("Hello", d)
+	}
+}
+
+// Withdraw sends Bye for the devices of owner.
+func (r *Responder) Withdraw(owner string) {
+	r.mu.Lock()
+	old := r.devices[owner]
+	delete(r.devices, owner)
+	r.mu.Unlock()
+
+	for _, d := range old {
+		r.multicast("Bye", d)
+	}
+}
+
+// multicast sends a Hello or Bye for d to the group.
+func (r *Responder) multicast(action string, d Device) {
+	body := "<wsd:" + action + ">" + deviceElements(d, action == "Hello") + "</wsd:" + action + ">"
+	msg := r.envelope(nsDiscovery+"/"+action, toDiscovery, "", d.Types, body)
+	if _, err := r.conn.WriteToUDP(msg, group); err != nil {
+		log.Printf("Failed to send WS-Discovery %s: %s", action, err)
+	}
+}
+
+// serve answers Probe and Resolve requests from permitted clients until the
+// socket is closed.
+func (r *Responder) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !r.permits(from.IP) {
+			continue
+		}
+		req, err := parseRequest(buf[:n])
+		if err != nil || req.messageID == "" {
+			continue
+		}
+		select {
+		case r.pending <- struct{}{}:
+		default:
+			continue
+		}
+		go func() {
+			defer func() { <-r.pending }()
+			r.answer(req, from)
+		}()
+	}
+}
+
+// answer replies to a single request after the random delay.
+func (r *Responder) answer(req *request, from *net.UDPAddr) {
+	var matches []Device
+	r.mu.Lock()
+	for _, devices := range r.devices {
+		for _, d := range devices {
+			if req.matches(d) {
+				matches = append(matches, d)
+			}
+		}
+	}
+	r.mu.Unlock()
+	if len(matches) == 0 {
+		return
+	}
+
+	time.Sleep(time.Duration(mrand.Int63n(int64(maxDelay))))
+	for _, d := range matches {
+		body := "<wsd:" + req.kind + "Matches><wsd:" + req.kind + "Match>" + deviceElements(d, true) +
+			"</wsd:" + req.kind + "Match></wsd:" + req.kind + "Matches>"
+		msg := r.envelope(nsDiscovery+"/"+req.kind+"Matches", toAnonymous, req.messageID, d.Types, body)
+		if _, err := r.conn.WriteToUDP(msg, from); err != nil {
+			log.Printf("Failed to answer WS-Discovery %s: %s", req.kind, err)
+		}
+	}
+}
+
+// envelope wraps body in a SOAP envelope with the addressing headers and
+// the namespace declarations of types.
+func (r *Responder) envelope(action, to, relatesTo string, types []string, body string) []byte {
+	r.mu.Lock()
+	r.messageNo++
+	messageNo := r.messageNo
+	r.mu.Unlock()
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	fmt.Fprintf(&b, `<soap:Envelope xmlns:soap="%s" xmlns:wsa="%s" xmlns:wsd="%s"`, nsSOAP, nsAddressing, nsDiscovery)
+	for prefix, space := range typeNamespaces(types) {
+		fmt.Fprintf(&b, ` xmlns:%s="%s"`, prefix, html.EscapeString(space))
+	}
+	b.WriteString(`><soap:Header>`)
+	fmt.Fprintf(&b, `<wsa:To>%s</wsa:To><wsa:Action>%s</wsa:Action><wsa:MessageID>urn:uuid:%s</wsa:MessageID>`,
+		to, action, randomUUID())
+	if relatesTo != "" {
+		fmt.Fprintf(&b, `<wsa:RelatesTo>%s</wsa:RelatesTo>`, html.EscapeString(relatesTo))
+	}
+	fmt.Fprintf(&b, `<wsd:AppSequence InstanceId="%d" MessageNumber="%d"/>`, r.instanceID, messageNo)
+	b.WriteString(`</soap:Header><soap:Body>`)
+	b.WriteString(body)
+	b.WriteString(`</soap:Body></soap:Envelope>`)
+	return b.Bytes()
+}
+
+// deviceElements renders the endpoint reference of d and, with details, its
+// types and addresses.
+func deviceElements(d Device, details bool) string {
+	s := "<wsa:EndpointReference><wsa:Address>urn:uuid:" + d.UUID + "</wsa:Address></wsa:EndpointReference>"
+	if details {
+		s += "<wsd:Types>" + strings.Join(typeNames(d.Types), " ") + "</wsd:Types>" +
+			"<wsd:XAddrs>" + html.EscapeString(d.XAddrs) + "</wsd:XAddrs>" +
+			"<wsd:MetadataVersion>1</wsd:MetadataVersion>"
+	}
+	return s
+}
+
+// resolveType turns a prefixed or {namespace}LocalName type into a qname.
+func resolveType(t string) qname {
+	if strings.HasPrefix(t, "{") {
+		if space, local, ok := strings.Cut(t[1:], "}"); ok {
+			return qname{space, local}
+		}
+	}
+	if prefix, local, ok := strings.Cut(t, ":"); ok {
+		return qname{Prefixes[prefix], local}
+	}
+	return qname{"", t}
+}
+
+// knownTypes returns the types whose namespace is known, logging the others
+// for the devices of owner.
+func knownTypes(owner string, types []string) []string {
+	known := types[:0:0]
+	for _, t := range types {
+		if resolveType(t).space == "" {
+			log.Printf("Leaving out WS-Discovery type %s of %s, its namespace is unknown", t, owner)
+			continue
+		}
+		known = append(known, t)
+	}
+	return known
+}
+
+// typeNamespaces returns the prefix declarations needed for types. Types
+// in {namespace}LocalName form get generated prefixes, see typeNames.
+func typeNamespaces(types []string) map[string]string {
+	namespaces := make(map[string]string)
+	for i, t := range types {
+		q := resolveType(t)
+		if strings.HasPrefix(t, "{") {
+			namespaces[fmt.Sprintf("t%d", i)] = q.space
+		} else if prefix, _, ok := strings.Cut(t, ":"); ok {
+			namespaces[prefix] = q.space
+		}
+	}
+	return namespaces
+}
+
+// typeNames returns types as prefixed names matching typeNamespaces.
+func typeNames(types []string) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		if strings.HasPrefix(t, "{") {
+			names[i] = fmt.Sprintf("t%d:%s", i, resolveType(t).local)
+		} else {
+			names[i] = t
+		}
+	}
+	return names
+}
+
+// request is a Probe or Resolve received from a client.
+type request struct {
+	kind      string // Probe or Resolve
+	messageID string
+	types     []qname
+	scoped    bool
+	address   string
+}
+
+// matches reports whether d answers the request. A probe matches when d
+// has all the requested types; probes for scopes never match, as devices
+// have none.
+func (req *request) matches(d Device) bool {
+	if req.kind == "Resolve" {
+		return req.address == "urn:uuid:"+d.UUID
+	}
+	if req.scoped {
+		return false
+	}
+	for _, want := range req.types {
+		found := false
+		for _, t := range d.Types {
+			have := resolveType(t)
+			if have.local == want.local && (want.space == "" || have.space == want.space) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRequest reads a Probe or Resolve. The prefixes of the requested
+// types are resolved with the namespace declarations in scope.
+func parseRequest(data []byte) (*request, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	req := &request{}
+	var path []string
+	scopes := []map[string]string{{}}
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			for k, v := range scopes[len(scopes)-1] {
+				scope[k] = v
+			}
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xmlns" {
+					scope[attr.Name.Local] = attr.Value
+				}
+			}
+			scopes = append(scopes, scope)
+			path = append(path, tok.Name.Local)
+			if tok.Name.Local == "Probe" || tok.Name.Local == "Resolve" {
+				req.kind = tok.Name.Local
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			scopes = scopes[:len(scopes)-1]
+		case xml.CharData:
+			if len(path) == 0 {
+				continue
+			}
+			text := strings.TrimSpace(string(tok))
+			switch path[len(path)-1] {
+			case "MessageID":
+				req.messageID = text
+			case "Address":
+				req.address = text
+			case "Types":
+				for _, t := range strings.Fields(text) {
+					q := qname{local: t}
+					if prefix, local, ok := strings.Cut(t, ":"); ok {
+						q = qname{scopes[len(scopes)-1][prefix], local}
+					}
+					req.types = append(req.types, q)
+				}
+			case "Scopes":
+				req.scoped = text != ""
+			}
+		}
+	}
+	if req.kind == "" {
+		return nil, fmt.Errorf("not a probe or resolve")
+	}
+	return req, nil
+}
+
+// ownerUUID derives a stable UUID for a device from its owner and address
+// (RFC 4122 section 4.3, name-based with SHA-1).
+func ownerUUID(owner, xaddrs string) string {
+	sum := sha1.Sum([]byte(owner + " " + xaddrs))
+	return formatUUID(sum[:16], 0x50)
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return formatUUID(b, 0x40)
+}
+
+func formatUUID(b []byte, version byte) string {
+	b[6] = b[6]&0x0f | version
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"net"
+	"strings"
+
+	"github.com/grumpylabs/external-mdns/cmd/mdns"
+	"github.com/grumpylabs/external-mdns/cmd/mdns/resource"
+	"github.com/grumpylabs/external-mdns/cmd/wsd"
+)
+
+// wsdResponder answers WS-Discovery for annotated services. It is nil
+// unless --wsd is set.
+var wsdResponder *wsd.Responder
+
+// startWSD starts answering WS-Discovery in the network namespace of the
+// mDNS responder, for the clients it answers.
+func startWSD() (*wsd.Responder, error) {
+	cfg, err := newResponderConfig()
+	if err != nil {
+		return nil, err
+	}
+	return wsd.NewResponder(cfg.NetNS, mdns.SourceFilter(cfg))
+}
+
+// announceWSD publishes or withdraws the WS-Discovery target of r, if it
+// has one.
+func announceWSD(r resource.Resource) {
+	if wsdResponder == nil || r.WSD == nil {
+		return
+	}
+	if r.Action == resource.Deleted {
+		wsdResponder.Withdraw(ownerKey(r))
+		return
+	}
+
+	var devices []wsd.Device
+	for _, ip := range selectIPs(r) {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		devices = append(devices, wsd.Device{
+			Types:  r.WSD.Types,
+			XAddrs: strings.ReplaceAll(r.WSD.XAddrs, "{ip}", ip),
+			UUID:   r.WSD.UUID,
+		})
+		if !strings.Contains(r.WSD.XAddrs, "{ip}") {
+			break
+		}
+	}
+	wsdResponder.Publish(ownerKey(r), devices)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxConfigMapData is the most data, keys included, the API server accepts
+// in a ConfigMap.
+const maxConfigMapData = 1 << 20
+
+// zoneTooLargeError reports a zone ConfigMap holding more than
+// maxConfigMapData bytes.
+type zoneTooLargeError struct {
+	size int
+}
+
+func (e *zoneTooLargeError) Error() string {
+	return fmt.Sprintf("the zone ConfigMap would hold %d bytes, over the %d bytes limit", e.size, maxConfigMapData)
+}
+
+// dataSize returns the bytes of ConfigMap data as the API server counts
+// them.
+func dataSize(data map[string]string) int {
+	var size int
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// zoneStatusEntry is a published record as written to the zone ConfigMap.
+// It leaves out the multicast time so the ConfigMap only changes with the
+// zone.
+type zoneStatusEntry struct {
+	Name   string `json:"name"`
+	Record string `json:"record"`
+	Source string `json:"source,omitempty"`
+}
+
+// parseNamespacedName splits a namespace/name reference.
+func parseNamespacedName(ref string) (string, string, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("%q must be given as namespace/name", ref)
+	}
+	return namespace, name, nil
+}
+
+// zoneConfigMapData renders the published zone as ConfigMap data: the
+// records in zone file form, as JSON with the resource each comes from, and
+// the objects skipped with the reason. The records are also kept under the
+// key of this instance, which previousZone reads after a restart.
+func zoneConfigMapData() map[string]string {
+	entries := []zoneStatusEntry{}
+	var zone strings.Builder
+	for _, zr := range describeZone() {
+		entries = append(entries, zoneStatusEntry{Name: zr.Name, Record: zr.Record, Source: zr.Source})
+		zone.WriteString(zr.Record)
+		zone.WriteString("\n")
+	}
+	encoded, _ := json.MarshalIndent(entries, "", "  ")
+	skipped, _ := json.MarshalIndent(reportedSkips(), "", "  ")
+	return map[string]string{
+		instanceName() + instanceZoneKey: zone.String(),
+		"zone":                           zone.String(),
+		"zone.json":                      string(encoded),
+		"skipped.json":                   string(skipped),
+	}
+}
+
+// writeZoneConfigMap keeps the ConfigMap namespace/name up to date with the
+// published zone, checking for changes every interval. The orphaned keys
+// of instances that are gone are dropped with the first write.
+func writeZoneConfigMap(client kubernetes.Interface, namespace, name string, orphaned []string, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var written map[string]string
+	for {
+		data := zoneConfigMapData()
+		if !equalData(written, data) {
+			err := applyZoneConfigMap(client, namespace, name, data, orphaned)
+			var tooLarge *zoneTooLargeError
+			switch {
+			case errors.As(err, &tooLarge):
+				// Retrying is pointless until the zone changes.
+				lg.Warn("Zone too large for the ConfigMap, not writing it", zap.String("configmap", namespace+"/"+name),
+					zap.Int("bytes", tooLarge.size), zap.Int("limit", maxConfigMapData))
+				written = data
+			case err != nil:
+				lg.Warn("Failed to write zone ConfigMap", zap.String("configmap", namespace+"/"+name), zap.Error(err))
+			default:
+				lg.Debug("Wrote zone ConfigMap", zap.String("configmap", namespace+"/"+name))
+				written, orphaned = data, nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// applyZoneConfigMap creates or updates the zone ConfigMap with data,
+// keeping the zones other instances wrote there and deleting the keys in
+// dropped.
+func applyZoneConfigMap(client kubernetes.Interface, namespace, name string, data map[string]string, dropped []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "external-mdns"},
+			},
+			Data: data,
+		}
+		if size := dataSize(data); size > maxConfigMapData {
+			return &zoneTooLargeError{size: size}
+		}
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string, len(data))
+	}
+	for _, key := range dropped {
+		delete(cm.Data, key)
+	}
+	maps.Copy(cm.Data, data)
+	if size := dataSize(cm.Data); size > maxConfigMapData {
+		return &zoneTooLargeError{size: size}
+	}
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+func equalData(a, b map[string]string) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}